@@ -0,0 +1,138 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+)
+
+// BatchStorage is implemented by storage backends that can save many new
+// sagas in a single write, which StartSagas uses instead of a SaveSaga per
+// saga
+type BatchStorage interface {
+	// SaveSagas saves sagas that have never been saved, as SaveSaga would.
+	// Either all of them are saved or, if it fails, none are.
+	SaveSagas(ctx context.Context, sagas []*Saga) error
+}
+
+// BatchPublisher is implemented by pubsubs that can publish many messages
+// at once, which StartSagas uses instead of a Publish per saga
+type BatchPublisher interface {
+	// PublishBatch publishes msgs on topic, in order. If it fails, any of
+	// them may have been published.
+	PublishBatch(ctx context.Context, topic string, msgs []Message) error
+}
+
+// StartSagas starts a saga from the registered definition for each entry
+// of data, as StartInstance would, and returns them in the same order. If
+// the storage implements BatchStorage the sagas are saved in one write, and
+// none are started if it fails. Otherwise, or with WithOutbox, they are
+// saved one at a time, and on failure the sagas started so far are returned
+// along with the error. The messages starting their first steps are
+// published at once if the pubsub implements BatchPublisher.
+func (o *Orchestrator) StartSagas(ctx context.Context, definitionName string, data []map[string]interface{}) ([]*Saga, error) {
+	o.definitionsMu.RLock()
+	def, exists := o.definitions[definitionName]
+	o.definitionsMu.RUnlock()
+	if !exists {
+		return nil, invalidSaga(fmt.Errorf("%w %s", ErrUnknownDefinition, definitionName))
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if err := o.checkHandlers(def.Name, def.Steps); err != nil {
+		return nil, invalidSaga(fmt.Errorf("invalid saga %s: %w", def.Name, err))
+	}
+
+	sagas := make([]*Saga, len(data))
+	for i, d := range data {
+		// Instances must not share the caller's maps
+		initial := make(map[string]interface{}, len(d))
+		for k, v := range d {
+			initial[k] = v
+		}
+		if err := def.Schema.Validate(initial); err != nil {
+			return nil, invalidSaga(fmt.Errorf("invalid data for saga %s: %w", def.Name, err))
+		}
+		if err := o.checkDataSize(initial); err != nil {
+			return nil, invalidSaga(fmt.Errorf("invalid data for saga %s: %w", def.Name, err))
+		}
+
+		sagas[i] = o.newSaga(ctx, def.Name, def.Steps, initial, o.instanceOptions(def))
+	}
+
+	batch, ok := o.storage.(BatchStorage)
+	if !ok || o.outbox != nil {
+		return o.startEach(ctx, sagas)
+	}
+	if err := batch.SaveSagas(ctx, sagas); err != nil {
+		return nil, storageFailure(fmt.Errorf("failed to save sagas: %w", err))
+	}
+	var first []Message
+	for _, saga := range sagas {
+		o.recordStarted(ctx, saga)
+		first = append(first, firstMessages(saga)...)
+	}
+	o.sendBatch(ctx, o.scheduleSteps(first...))
+
+	return sagas, nil
+}
+
+// startEach saves and starts new sagas one at a time, publishing the
+// messages starting their first steps once all of them are saved
+func (o *Orchestrator) startEach(ctx context.Context, sagas []*Saga) ([]*Saga, error) {
+	var scheduled []OutboxMessage
+	for i, saga := range sagas {
+		msgs := o.scheduleSteps(firstMessages(saga)...)
+		if err := o.saveSagaWith(ctx, saga, msgs); err != nil {
+			o.sendBatch(ctx, scheduled)
+			return sagas[:i], storageFailure(fmt.Errorf("failed to save saga: %w", err))
+		}
+		o.recordStarted(ctx, saga)
+		scheduled = append(scheduled, msgs...)
+	}
+	o.sendBatch(ctx, scheduled)
+
+	return sagas, nil
+}
+
+// sendBatch publishes messages whose writes have been saved, those on each
+// topic at once if the pubsub implements BatchPublisher
+func (o *Orchestrator) sendBatch(ctx context.Context, scheduled []OutboxMessage) {
+	publisher, ok := o.pubsub.(BatchPublisher)
+	if !ok || len(scheduled) == 0 {
+		o.send(ctx, scheduled)
+		return
+	}
+
+	// With WithShards the sagas' messages are on different topics
+	var topics []string
+	byTopic := make(map[string][]OutboxMessage)
+	for _, msg := range scheduled {
+		if _, exists := byTopic[msg.Topic]; !exists {
+			topics = append(topics, msg.Topic)
+		}
+		byTopic[msg.Topic] = append(byTopic[msg.Topic], msg)
+	}
+
+	var published []string
+	for _, topic := range topics {
+		batch := byTopic[topic]
+		msgs := make([]Message, len(batch))
+		for i, msg := range batch {
+			msgs[i] = msg.Message
+		}
+		if err := publisher.PublishBatch(ctx, topic, msgs); err != nil {
+			o.logger.Warn("Failed to publish messages", "topic", topic, "count", len(msgs), "error", err)
+			continue
+		}
+		for _, msg := range batch {
+			published = append(published, msg.ID)
+		}
+	}
+	if o.outbox == nil || len(published) == 0 {
+		return
+	}
+	if err := o.outbox.DeleteMessages(ctx, published); err != nil {
+		o.logger.Warn("Failed to delete published outbox messages", "error", err)
+	}
+}
@@ -0,0 +1,93 @@
+package saga
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Branch adds alternative sequences of steps after the most recently added
+// step, one of which is chosen by the value that step, or an earlier one,
+// wrote to data under key, e.g. "risk" choosing between "high" and "low".
+// Values are compared in their fmt.Sprint form, so 3 matches a branch "3".
+// The steps of the chosen branch run in order, each after the one before
+// it unless its spec sets DependsOn. The steps of the other branches are
+// marked skipped when their turn comes, without running their handlers, and
+// are never compensated; if no branch matches the value, all of them are.
+// The next step added waits for the branches to finish, so they can rejoin.
+// The value must not change while a branch runs, since each of its steps
+// checks it again. Every spec must have a Handler; step modifiers such as
+// NoCompensation are set through the spec's fields.
+func (b *Builder) Branch(key string, branches map[string][]StepSpec) *Builder {
+	if key == "" {
+		b.err = fmt.Errorf("branch key must not be empty")
+		return b
+	}
+	if len(branches) == 0 {
+		b.err = fmt.Errorf("branch on %s has no branches", key)
+		return b
+	}
+
+	after := b.join
+	if after == nil && len(b.steps) > 0 {
+		after = []string{b.steps[len(b.steps)-1].name}
+	}
+
+	// Map order is random, and declaration order decides which independent
+	// steps start first
+	values := make([]string, 0, len(branches))
+	for value := range branches {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	var join []string
+	for _, value := range values {
+		specs := branches[value]
+		if len(specs) == 0 {
+			b.err = fmt.Errorf("branch %s=%s has no steps", key, value)
+			return b
+		}
+
+		prev := after
+		for _, spec := range specs {
+			if spec.Handler == nil {
+				b.err = fmt.Errorf("step %s has no handler", spec.Name)
+				return b
+			}
+			deps := spec.DependsOn
+			if deps == nil {
+				deps = prev
+			}
+			b.steps = append(b.steps, builderStep{
+				name:              spec.Name,
+				handler:           branchHandler(spec.Handler, key, value),
+				dependsOn:         append([]string{}, deps...),
+				hasDeps:           true,
+				compensationOrder: spec.CompensationOrder,
+				noCompensation:    spec.NoCompensation,
+				compensateFailed:  spec.CompensateFailedStep,
+				resource:          spec.Resource,
+			})
+			prev = []string{spec.Name}
+		}
+		join = append(join, prev...)
+	}
+	b.join = join
+	return b
+}
+
+// branchHandler makes handler run only when data holds value under key, and
+// its own condition, if it has one, holds too
+func branchHandler(handler StepHandler, key, value string) StepHandler {
+	taken := func(data map[string]interface{}) bool {
+		v, exists := data[key]
+		return exists && fmt.Sprint(v) == value
+	}
+	condition := taken
+	if c, ok := handler.(conditionalStep); ok {
+		condition = func(data map[string]interface{}) bool {
+			return taken(data) && c.shouldExecute(data)
+		}
+	}
+	return conditionalHandler{StepHandler: handler, condition: condition}
+}
@@ -0,0 +1,109 @@
+package saga
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is the error a step fails with when its resource's circuit
+// breaker is open and the breaker has FailWhenOpen set
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// BreakerSettings configures a circuit breaker; see WithCircuitBreaker
+type BreakerSettings struct {
+	// FailureThreshold is how many executions in a row must fail to open
+	// the breaker. The default is 5.
+	FailureThreshold int
+	// OpenTimeout is how long the breaker stays open before it lets a
+	// single step through to probe the resource. The default is 30 seconds.
+	OpenTimeout time.Duration
+	// FailWhenOpen fails steps with ErrCircuitOpen while the breaker is
+	// open, which compensates their sagas. By default they are deferred
+	// instead: left pending, untouched, for recovery to deliver again once
+	// the step timeout has passed.
+	FailWhenOpen bool
+}
+
+// WithCircuitBreaker guards the steps that declare resource, e.g. with
+// Builder.Resource, with a circuit breaker. Once FailureThreshold
+// executions of such steps fail in a row the breaker opens, and steps
+// touching the resource are deferred or failed without running their
+// handler until OpenTimeout has passed. Then one step is let through: if it
+// succeeds the breaker closes, and if it fails the breaker stays open for
+// another OpenTimeout. Any error from the handler counts as a failure.
+// Compensations always run. Each orchestrator keeps its own breakers.
+// Negative settings panic.
+func WithCircuitBreaker(resource string, settings BreakerSettings) Option {
+	if resource == "" {
+		panic("saga: circuit breaker resource must not be empty")
+	}
+	if settings.FailureThreshold < 0 || settings.OpenTimeout < 0 {
+		panic("saga: circuit breaker settings must not be negative")
+	}
+	if settings.FailureThreshold == 0 {
+		settings.FailureThreshold = 5
+	}
+	if settings.OpenTimeout == 0 {
+		settings.OpenTimeout = 30 * time.Second
+	}
+	return func(o *Orchestrator) {
+		if o.breakers == nil {
+			o.breakers = make(map[string]*circuitBreaker)
+		}
+		o.breakers[resource] = &circuitBreaker{settings: settings}
+	}
+}
+
+// circuitBreaker tracks the outcome of the steps touching one resource
+type circuitBreaker struct {
+	settings BreakerSettings
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+	// When the breaker opened or last let a probe through
+	openedAt time.Time
+}
+
+// allow reports whether a step touching the resource may run. While open,
+// it lets one step through per OpenTimeout to probe the resource.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return true
+	}
+	if now.Sub(b.openedAt) < b.settings.OpenTimeout {
+		return false
+	}
+	b.openedAt = now
+	return true
+}
+
+// record counts the outcome of a step's execution
+func (b *circuitBreaker) record(err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		b.open = false
+		return
+	}
+
+	b.failures++
+	if b.open || b.failures >= b.settings.FailureThreshold {
+		b.open = true
+		b.openedAt = now
+	}
+}
+
+// breaker returns the circuit breaker guarding step, or nil if it has none
+func (o *Orchestrator) breaker(step *Step) *circuitBreaker {
+	if step.Resource == "" {
+		return nil
+	}
+	return o.breakers[step.Resource]
+}
@@ -3,19 +3,41 @@ package saga
 import (
 	"context"
 	"fmt"
+	"time"
 )
 
 // Builder allows defining handlers inline with steps
 type Builder struct {
-	name         string
-	steps        []builderStep
-	data         map[string]interface{}
-	orchestrator *Orchestrator
+	name          string
+	steps         []builderStep
+	data          map[string]interface{}
+	orchestrator  *Orchestrator
+	deadline      *time.Time
+	timeout       time.Duration
+	key           string
+	tags          map[string]string
+	failurePolicy FailurePolicy
+	timeoutPolicy TimeoutPolicy
+	// See Require and RequireType
+	schema DataSchema
+	// The last steps of each branch of a Branch, which the next step added
+	// waits for
+	join []string
+	err  error
 }
 
 type builderStep struct {
-	name    string
-	handler StepHandler
+	name              string
+	handler           StepHandler
+	dependsOn         []string
+	hasDeps           bool
+	compensationOrder int
+	noCompensation    bool
+	compensateFailed  bool
+	resource          string
+	// after, if set, replaces the step declared before this one as its
+	// default dependencies
+	after []string
 }
 
 // NewBuilder creates a builder that registers handlers automatically
@@ -33,35 +55,268 @@ func (b *Builder) Step(
 	execute func(ctx context.Context, data map[string]interface{}) error,
 	compensate func(ctx context.Context, data map[string]interface{}) error,
 ) *Builder {
-	handler := NewStepHandler(execute, compensate)
-	b.steps = append(b.steps, builderStep{
+	return b.AddStep(name, NewStepHandler(execute, compensate))
+}
+
+// AddStep adds a step run by handler, e.g. a struct with its dependencies
+// injected or a handler shared by several sagas. DependsOn and the other
+// step modifiers apply to it as to Step.
+func (b *Builder) AddStep(name string, handler StepHandler) *Builder {
+	if handler == nil {
+		b.err = fmt.Errorf("step %s has no handler", name)
+		return b
+	}
+	b.add(builderStep{
 		name:    name,
 		handler: handler,
 	})
 	return b
 }
 
+// add appends step, making it wait for the branches of a preceding Branch
+func (b *Builder) add(step builderStep) {
+	step.after, b.join = b.join, nil
+	b.steps = append(b.steps, step)
+}
+
+// StepIf adds a step that only runs when condition holds. The condition is
+// evaluated against the merged saga and step data when the step is about to
+// execute; if it is false the step is marked skipped and never compensated.
+func (b *Builder) StepIf(
+	name string,
+	condition func(data map[string]interface{}) bool,
+	execute func(ctx context.Context, data map[string]interface{}) error,
+	compensate func(ctx context.Context, data map[string]interface{}) error,
+) *Builder {
+	b.add(builderStep{
+		name: name,
+		handler: conditionalHandler{
+			StepHandler: NewStepHandler(execute, compensate),
+			condition:   condition,
+		},
+	})
+	return b
+}
+
+// DependsOn sets the steps the most recently added step waits for.
+// Steps without DependsOn run after the step declared before them;
+// calling DependsOn with no names makes the step start immediately.
+func (b *Builder) DependsOn(steps ...string) *Builder {
+	if len(b.steps) == 0 {
+		b.err = fmt.Errorf("DependsOn called before any step was added")
+		return b
+	}
+	last := &b.steps[len(b.steps)-1]
+	last.dependsOn = append([]string(nil), steps...)
+	last.hasDeps = true
+	return b
+}
+
+// CompensationOrder sets when the most recently added step is compensated,
+// for rollbacks that don't mirror execution order (e.g. cancel a shipment
+// before refunding the payment). Steps with an order are compensated first,
+// lowest order first; the rest follow in reverse dependency order.
+func (b *Builder) CompensationOrder(order int) *Builder {
+	if len(b.steps) == 0 {
+		b.err = fmt.Errorf("CompensationOrder called before any step was added")
+		return b
+	}
+	if order <= 0 {
+		b.err = fmt.Errorf("compensation order for step %s must be positive", b.steps[len(b.steps)-1].name)
+		return b
+	}
+	b.steps[len(b.steps)-1].compensationOrder = order
+	return b
+}
+
+// NoCompensation marks the most recently added step as having nothing to
+// undo, e.g. a read or a notification. Rollbacks skip it instead of calling
+// its compensation, and it stays completed rather than compensated, so its
+// status shows that nothing was rolled back.
+func (b *Builder) NoCompensation() *Builder {
+	if len(b.steps) == 0 {
+		b.err = fmt.Errorf("NoCompensation called before any step was added")
+		return b
+	}
+	b.steps[len(b.steps)-1].noCompensation = true
+	return b
+}
+
+// CompensateFailedStep makes a failure of the most recently added step run
+// its own compensation, before any other step is rolled back, so a handler
+// that made partial changes before returning an error (e.g. reserved two of
+// three items) can undo them. The compensation sees the data as the handler
+// left it, and must cope with the handler having changed nothing.
+func (b *Builder) CompensateFailedStep() *Builder {
+	if len(b.steps) == 0 {
+		b.err = fmt.Errorf("CompensateFailedStep called before any step was added")
+		return b
+	}
+	b.steps[len(b.steps)-1].compensateFailed = true
+	return b
+}
+
+// Resource declares the dependency the most recently added step calls, such
+// as "payments", so the circuit breaker set up for it with
+// WithCircuitBreaker guards the step
+func (b *Builder) Resource(name string) *Builder {
+	if len(b.steps) == 0 {
+		b.err = fmt.Errorf("Resource called before any step was added")
+		return b
+	}
+	b.steps[len(b.steps)-1].resource = name
+	return b
+}
+
 // WithData adds data to the saga context
 func (b *Builder) WithData(key string, value interface{}) *Builder {
 	b.data[key] = value
 	return b
 }
 
-// Execute registers all handlers and starts the saga
+// WithTag tags the saga with a business key, such as "order_id" and the
+// order's ID, so it can be found with Storage.FindSagasByTag without knowing
+// its ID. A saga can have several tags, with one value per key.
+func (b *Builder) WithTag(key, value string) *Builder {
+	if key == "" {
+		b.err = fmt.Errorf("tag key must not be empty")
+		return b
+	}
+	if b.tags == nil {
+		b.tags = make(map[string]string)
+	}
+	b.tags[key] = value
+	return b
+}
+
+// WithDeadline bounds the saga's total running time: once t has passed, no
+// further steps are started and the saga is failed and compensated
+func (b *Builder) WithDeadline(t time.Time) *Builder {
+	b.deadline = &t
+	b.timeout = 0
+	return b
+}
+
+// WithTimeout sets the saga's deadline d after it is started
+func (b *Builder) WithTimeout(d time.Duration) *Builder {
+	b.timeout = d
+	b.deadline = nil
+	return b
+}
+
+// WithIdempotencyKey starts the saga with an idempotency key: if a saga was
+// already started with key, Execute returns it instead of starting another.
+// See Orchestrator.StartSagaWithKey.
+func (b *Builder) WithIdempotencyKey(key string) *Builder {
+	b.key = key
+	return b
+}
+
+// WithFailurePolicy sets what happens to steps running in parallel when
+// one of them fails: with WaitAll, the default, they finish before the saga
+// is compensated, and with FailFast their handlers' contexts are canceled
+func (b *Builder) WithFailurePolicy(policy FailurePolicy) *Builder {
+	if !validFailurePolicy(policy) {
+		b.err = fmt.Errorf("unknown failure policy %q", policy)
+		return b
+	}
+	b.failurePolicy = policy
+	return b
+}
+
+// WithTimeoutPolicy sets what happens once the saga's deadline passes:
+// TimeoutCompensate, the default, rolls back its completed steps, while
+// TimeoutFailOnly just fails it
+func (b *Builder) WithTimeoutPolicy(policy TimeoutPolicy) *Builder {
+	if !validTimeoutPolicy(policy) {
+		b.err = fmt.Errorf("unknown timeout policy %q", policy)
+		return b
+	}
+	b.timeoutPolicy = policy
+	return b
+}
+
+// Execute starts the saga and registers all its handlers for this saga's
+// name. It returns an error if two steps share a name, since they would
+// share one handler. The handlers are only registered once the saga is
+// saved, so a saga that isn't started leaves the orchestrator unchanged;
+// its error matches ErrInvalidSaga if the saga or its data is invalid, and
+// ErrStorageFailure if storage failed.
 func (b *Builder) Execute(ctx context.Context) (*Saga, error) {
+	if b.err != nil {
+		return nil, invalidSaga(b.err)
+	}
 	if len(b.steps) == 0 {
-		return nil, fmt.Errorf("saga must have at least one step")
+		return nil, invalidSaga(fmt.Errorf("saga must have at least one step"))
 	}
 
-	// Auto-register all handlers
-	stepNames := make([]string, len(b.steps))
-	for i, step := range b.steps {
-		b.orchestrator.RegisterHandler(step.name, step.handler)
-		stepNames[i] = step.name
+	specs := b.specs()
+	if _, err := topologicalOrder(specs); err != nil {
+		return nil, invalidSaga(fmt.Errorf("invalid saga %s: %w", b.name, err))
+	}
+	if err := b.schema.Validate(b.data); err != nil {
+		return nil, invalidSaga(fmt.Errorf("invalid data for saga %s: %w", b.name, err))
+	}
+	for i := range specs {
+		specs[i].Handler = b.steps[i].handler
+	}
+
+	opts := sagaOptions{deadline: b.deadline, key: b.key, tags: copyMetadata(b.tags), failurePolicy: b.failurePolicy, timeoutPolicy: b.timeoutPolicy, registerHandlers: true}
+	if b.timeout > 0 {
+		deadline := b.orchestrator.now().Add(b.timeout)
+		opts.deadline = &deadline
 	}
 
 	// Start the saga
-	return b.orchestrator.StartSaga(ctx, b.name, stepNames, b.data)
+	return b.orchestrator.startSaga(ctx, b.name, specs, b.data, opts)
+}
+
+// Register registers the builder's steps as a definition under the saga's
+// name, so instances can be started with StartInstance without building
+// the saga again. Data set with WithData and the idempotency key are not
+// part of the definition; WithTimeout and the keys declared with Require
+// are, while WithDeadline can't be used since it is absolute.
+func (b *Builder) Register() error {
+	if b.err != nil {
+		return b.err
+	}
+	if b.deadline != nil {
+		return fmt.Errorf("saga %s: WithDeadline cannot be used in a definition, use WithTimeout", b.name)
+	}
+
+	specs := b.specs()
+	for i := range specs {
+		specs[i].Handler = b.steps[i].handler
+		// Dependencies are already resolved, so keep "no dependencies"
+		// from being chained to the previous step
+		if specs[i].DependsOn == nil {
+			specs[i].DependsOn = []string{}
+		}
+	}
+	return b.orchestrator.RegisterDefinition(SagaDefinition{Name: b.name, Steps: specs, Timeout: b.timeout, FailurePolicy: b.failurePolicy, TimeoutPolicy: b.timeoutPolicy, Schema: b.schema})
+}
+
+// specs resolves the declared steps into specs with explicit dependencies
+func (b *Builder) specs() []StepSpec {
+	specs := make([]StepSpec, len(b.steps))
+	for i, step := range b.steps {
+		specs[i] = StepSpec{
+			Name:                 step.name,
+			DependsOn:            step.dependsOn,
+			CompensationOrder:    step.compensationOrder,
+			NoCompensation:       step.noCompensation,
+			CompensateFailedStep: step.compensateFailed,
+			Resource:             step.resource,
+		}
+		switch {
+		case step.hasDeps:
+		case step.after != nil:
+			specs[i].DependsOn = step.after
+		case i > 0:
+			specs[i].DependsOn = []string{b.steps[i-1].name}
+		}
+	}
+	return specs
 }
 
 // Helper function to create a simple step handler
@@ -74,3 +329,18 @@ func NewStepHandler(
 		CompensateFn: compensate,
 	}
 }
+
+// conditionalStep is implemented by handlers that may skip their step
+type conditionalStep interface {
+	shouldExecute(data map[string]interface{}) bool
+}
+
+// conditionalHandler runs its step only when condition holds
+type conditionalHandler struct {
+	StepHandler
+	condition func(data map[string]interface{}) bool
+}
+
+func (h conditionalHandler) shouldExecute(data map[string]interface{}) bool {
+	return h.condition == nil || h.condition(data)
+}
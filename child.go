@@ -0,0 +1,188 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+type childSagasKey struct{}
+
+// childSagas collects the child sagas a step handler started, to be stored
+// on the step when the handler returns
+type childSagas struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (c *childSagas) add(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !containsString(c.ids, id) {
+		c.ids = append(c.ids, id)
+	}
+}
+
+// mergeInto appends the collected children missing from ids, which holds
+// the children of the step's earlier attempts
+func (c *childSagas) mergeInto(ids []string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range c.ids {
+		if !containsString(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// StartChildSaga starts an instance of a registered definition from within
+// a step handler and blocks until it finishes, so the step only succeeds
+// once its child has. It returns the child with an error if the child
+// failed, was rolled back or canceled, which fails the parent step as any
+// handler error would, or if ctx is done first.
+//
+// The child records the parent in ParentSagaID and ParentStepID, and the
+// parent step lists it in ChildSagaIDs. A step that runs again, e.g. after
+// recovery, waits for the child an earlier attempt started unless that
+// child failed, in which case a new one is started. The child's steps need
+// a free slot of their own, so don't run children under a concurrency limit
+// that parent steps alone can exhaust.
+func (o *Orchestrator) StartChildSaga(ctx context.Context, definitionName string, data map[string]interface{}) (*Saga, error) {
+	parent, ok := StepFromContext(ctx)
+	if !ok || parent.IsCompensating {
+		return nil, fmt.Errorf("child saga %s must be started from a step's Execute", definitionName)
+	}
+
+	o.definitionsMu.RLock()
+	def, exists := o.definitions[definitionName]
+	o.definitionsMu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("%w %s", ErrUnknownDefinition, definitionName)
+	}
+
+	initial := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		initial[k] = v
+	}
+
+	child, err := o.earlierChild(ctx, parent, definitionName)
+	if err != nil {
+		return nil, err
+	}
+	if child == nil {
+		opts := sagaOptions{
+			key:           childKey(parent.StepID, parent.Attempt, definitionName),
+			parentSagaID:  parent.SagaID,
+			parentStepID:  parent.StepID,
+			failurePolicy: def.FailurePolicy,
+			timeoutPolicy: def.TimeoutPolicy,
+		}
+		if def.Timeout > 0 {
+			deadline := o.now().Add(def.Timeout)
+			opts.deadline = &deadline
+		}
+		child, err = o.startSaga(ctx, def.Name, def.Steps, initial, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start child saga %s: %w", definitionName, err)
+		}
+	}
+	if children, ok := ctx.Value(childSagasKey{}).(*childSagas); ok {
+		children.add(child.ID)
+	}
+
+	status, err := o.WaitForCompletion(ctx, child.ID)
+	if err != nil {
+		return child, fmt.Errorf("failed waiting for child saga %s: %w", child.ID, err)
+	}
+	if child, err = o.storage.GetSaga(ctx, child.ID); err != nil {
+		return nil, fmt.Errorf("failed to get child saga: %w", err)
+	}
+	if status != StatusCompleted {
+		if child.Error != "" {
+			return child, fmt.Errorf("child saga %s %s: %s", child.ID, status, child.Error)
+		}
+		return child, fmt.Errorf("child saga %s %s", child.ID, status)
+	}
+	return child, nil
+}
+
+// childKey is the idempotency key of the child saga started by one attempt
+// of a step, so starting it again within the attempt returns the same child
+func childKey(stepID string, attempt int, definitionName string) string {
+	return fmt.Sprintf("child/%s/%d/%s", stepID, attempt, definitionName)
+}
+
+// earlierChild returns a child saga that an earlier attempt of the step
+// started and that hasn't failed, or nil if there is none
+func (o *Orchestrator) earlierChild(ctx context.Context, parent StepContext, definitionName string) (*Saga, error) {
+	for attempt := parent.Attempt - 1; attempt >= 1; attempt-- {
+		child, err := o.storage.GetSagaByKey(ctx, childKey(parent.StepID, attempt, definitionName))
+		if errors.Is(err, ErrSagaNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get child saga: %w", err)
+		}
+		switch child.Status {
+		case StatusPending, StatusPaused, StatusCompleted:
+			return child, nil
+		}
+	}
+	return nil, nil
+}
+
+// CompensateChildSagas rolls back the completed child sagas the current
+// step started, newest first, and waits for each rollback to finish. Call
+// it from a step's Compensate to undo its children along with the step;
+// children that failed have already compensated themselves and are left
+// alone.
+func (o *Orchestrator) CompensateChildSagas(ctx context.Context) error {
+	current, ok := StepFromContext(ctx)
+	if !ok {
+		return fmt.Errorf("CompensateChildSagas must be called from a step handler")
+	}
+
+	step, err := o.storage.GetStep(ctx, current.StepID)
+	if err != nil {
+		return fmt.Errorf("failed to get step: %w", err)
+	}
+
+	for i := len(step.ChildSagaIDs) - 1; i >= 0; i-- {
+		childID := step.ChildSagaIDs[i]
+		child, err := o.storage.GetSaga(ctx, childID)
+		if err != nil {
+			return fmt.Errorf("failed to get child saga: %w", err)
+		}
+		switch child.Status {
+		case StatusCompleted:
+			if err := o.Compensate(ctx, childID); err != nil {
+				return fmt.Errorf("failed to compensate child saga %s: %w", childID, err)
+			}
+		case StatusCompensating:
+			// Rolled back by an earlier attempt of this compensation that
+			// didn't finish
+		default:
+			continue
+		}
+
+		status, err := o.WaitForCompletion(ctx, childID)
+		if err != nil {
+			return fmt.Errorf("failed waiting for child saga %s: %w", childID, err)
+		}
+		if status != StatusRolledBack && status != StatusFailed {
+			return fmt.Errorf("child saga %s ended %s instead of rolled back", childID, status)
+		}
+	}
+	return nil
+}
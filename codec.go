@@ -0,0 +1,26 @@
+package saga
+
+import "encoding/json"
+
+// Codec encodes the Messages a pubsub backend sends as bytes, such as the
+// Kafka and NATS backends, which use JSONCodec unless given another one.
+// Swap it for Protobuf or MessagePack to interoperate with non-Go consumers
+// or to shrink payloads. Marshal receives a Message and Unmarshal a
+// *Message; a codec must round-trip every field, including Data.
+// MemoryPubSub hands over messages as they are and doesn't use a codec.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec encodes messages with encoding/json. Decoded Data holds JSON
+// types, as described for UnmarshalSaga.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,53 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// CompoundStep returns a handler that runs operations one after another as
+// a single, all-or-nothing step, with compensate as the one compensation
+// undoing all of them, e.g. the rows of a multi-row write. The orchestrator
+// treats it as one step: it is compensated once, not per operation.
+//
+// If an operation fails, the later ones don't run and compensate is called
+// right away to undo what the earlier ones did, before the error is
+// returned, so a failed or retried step leaves nothing behind. compensate
+// sees the data as the operations left it, and must cope with any of them
+// having run, including the one that failed. If it fails too, the step
+// fails permanently with both errors, since running the operations again
+// on top of partial work isn't safe. Don't mark the step with
+// CompensateFailedStep, which would undo it a second time.
+func CompoundStep(
+	compensate func(ctx context.Context, data map[string]interface{}) error,
+	operations ...func(ctx context.Context, data map[string]interface{}) error,
+) StepHandler {
+	return compoundHandler{operations: operations, compensate: compensate}
+}
+
+type compoundHandler struct {
+	operations []func(ctx context.Context, data map[string]interface{}) error
+	compensate func(ctx context.Context, data map[string]interface{}) error
+}
+
+func (h compoundHandler) Execute(ctx context.Context, data map[string]interface{}) error {
+	for i, operation := range h.operations {
+		err := operation(ctx, data)
+		if err == nil {
+			continue
+		}
+		if compErr := h.Compensate(ctx, data); compErr != nil {
+			return Permanent(errors.Join(err, fmt.Errorf("failed to undo operations 1-%d: %w", i+1, compErr)))
+		}
+		return err
+	}
+	return nil
+}
+
+func (h compoundHandler) Compensate(ctx context.Context, data map[string]interface{}) error {
+	if h.compensate == nil {
+		return nil
+	}
+	return h.compensate(ctx, data)
+}
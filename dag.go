@@ -0,0 +1,147 @@
+package saga
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StepSpec describes a step to add to a saga
+type StepSpec struct {
+	Name string
+	// DependsOn names the steps that must complete before this one runs
+	DependsOn []string
+	// Handler, if set, is registered for Name when the step is added
+	Handler StepHandler
+	// CompensationOrder, if positive, sets when the step is rolled back;
+	// see Builder.CompensationOrder
+	CompensationOrder int
+	// NoCompensation marks a step with nothing to undo; see
+	// Builder.NoCompensation
+	NoCompensation bool
+	// CompensateFailedStep makes the step's failure run its own
+	// compensation; see Builder.CompensateFailedStep
+	CompensateFailedStep bool
+	// Resource names the dependency the step calls; see Builder.Resource
+	Resource string
+}
+
+// linearSpecs builds specs where every step depends on the one before it
+func linearSpecs(names []string) []StepSpec {
+	specs := make([]StepSpec, len(names))
+	for i, name := range names {
+		specs[i] = StepSpec{Name: name}
+		if i > 0 {
+			specs[i].DependsOn = []string{names[i-1]}
+		}
+	}
+	return specs
+}
+
+// topologicalOrder returns spec indexes ordered so that every step comes
+// after the steps it depends on. Independent steps keep declaration order.
+// It returns an error for duplicate names, unknown dependencies and cycles.
+func topologicalOrder(specs []StepSpec) ([]int, error) {
+	index := make(map[string]int, len(specs))
+	for i, spec := range specs {
+		if _, exists := index[spec.Name]; exists {
+			return nil, fmt.Errorf("duplicate step name %q", spec.Name)
+		}
+		index[spec.Name] = i
+	}
+
+	remaining := make([]int, len(specs))
+	for i, spec := range specs {
+		for _, dep := range spec.DependsOn {
+			if _, exists := index[dep]; !exists {
+				return nil, fmt.Errorf("step %q depends on unknown step %q", spec.Name, dep)
+			}
+			if dep == spec.Name {
+				return nil, fmt.Errorf("step %q depends on itself", spec.Name)
+			}
+		}
+		remaining[i] = len(spec.DependsOn)
+	}
+
+	order := make([]int, 0, len(specs))
+	done := make([]bool, len(specs))
+	for len(order) < len(specs) {
+		next := -1
+		for i := range specs {
+			if !done[i] && remaining[i] == 0 {
+				next = i
+				break
+			}
+		}
+
+		if next == -1 {
+			var cycle []string
+			for i, spec := range specs {
+				if !done[i] {
+					cycle = append(cycle, spec.Name)
+				}
+			}
+			return nil, fmt.Errorf("dependency cycle between steps: %s", strings.Join(cycle, ", "))
+		}
+
+		done[next] = true
+		order = append(order, next)
+		for i, spec := range specs {
+			for _, dep := range spec.DependsOn {
+				if dep == specs[next].Name {
+					remaining[i]--
+				}
+			}
+		}
+	}
+
+	return order, nil
+}
+
+// stepSpecs returns the specs of a saga's steps
+func stepSpecs(steps []Step) []StepSpec {
+	specs := make([]StepSpec, len(steps))
+	for i, step := range steps {
+		specs[i] = StepSpec{Name: step.Name, DependsOn: step.DependsOn, CompensationOrder: step.CompensationOrder, NoCompensation: step.NoCompensation, CompensateFailedStep: step.CompensateFailedStep, Resource: step.Resource}
+	}
+	return specs
+}
+
+// dependenciesCompleted reports whether every dependency of step has
+// completed or was skipped
+func dependenciesCompleted(saga *Saga, step *Step) bool {
+	for _, dep := range step.DependsOn {
+		completed := false
+		for _, s := range saga.Steps {
+			if s.Name == dep {
+				completed = stepDone(s.Status)
+				break
+			}
+		}
+		if !completed {
+			return false
+		}
+	}
+	return true
+}
+
+// StepReady reports whether step can start: it is pending, its saga is
+// running, and every step it depends on has completed or was skipped.
+// Storage backends use it to implement ClaimNextPendingStep.
+func StepReady(saga *Saga, step *Step) bool {
+	return step.Status == StatusPending && saga.Status == StatusPending && dependenciesCompleted(saga, step)
+}
+
+// dependsOn reports whether step directly depends on the named step
+func dependsOn(step *Step, name string) bool {
+	for _, dep := range step.DependsOn {
+		if dep == name {
+			return true
+		}
+	}
+	return false
+}
+
+// stepDone reports whether a step finished without needing further work
+func stepDone(status Status) bool {
+	return status == StatusCompleted || status == StatusSkipped
+}
@@ -0,0 +1,88 @@
+package saga
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrDataTooLarge is returned when saga or step data exceeds the limit set
+// with WithMaxDataSize
+var ErrDataTooLarge = errors.New("data too large")
+
+// WithMaxDataSize limits saga and step data to n bytes, measured by encoding
+// it as JSON. Starting a saga with larger data returns ErrDataTooLarge, and
+// a step whose handler leaves larger data behind fails permanently instead
+// of storing it, which compensates its saga. This keeps oversized values out
+// of storage and of every message published for the saga. Writes made
+// through the storage directly, or by other orchestrators, are only checked
+// by a storage with a limit of its own, such as WithMemoryMaxDataSize. n
+// must be positive; there is no limit by default.
+func WithMaxDataSize(n int) Option {
+	if n <= 0 {
+		panic("saga: max data size must be positive")
+	}
+	return func(o *Orchestrator) {
+		o.maxDataSize = n
+	}
+}
+
+// WithMemoryMaxDataSize makes SaveSaga, UpdateStep and every other write
+// return an error wrapping ErrDataTooLarge, and store nothing, if the data
+// of the saga or of one of its steps is over n bytes, measured by encoding
+// it as JSON. n must be positive; there is no limit by default.
+func WithMemoryMaxDataSize(n int) MemoryStorageOption {
+	if n <= 0 {
+		panic("saga: max data size must be positive")
+	}
+	return func(m *MemoryStorage) {
+		m.maxDataSize = n
+	}
+}
+
+// CheckDataSize returns an error wrapping ErrDataTooLarge if the data of
+// saga, of one of its steps or of one of steps is over limit bytes,
+// measured by encoding it as JSON. A nil saga is skipped, and a limit of 0
+// or less disables the check. Storage backends use it to implement their
+// data size limit.
+func CheckDataSize(limit int, saga *Saga, steps ...*Step) error {
+	if limit <= 0 {
+		return nil
+	}
+	if saga != nil {
+		if err := checkSize(limit, saga.Data); err != nil {
+			return fmt.Errorf("saga %s: %w", saga.ID, err)
+		}
+		for i := range saga.Steps {
+			steps = append(steps, &saga.Steps[i])
+		}
+	}
+	for _, step := range steps {
+		if err := checkSize(limit, step.Data); err != nil {
+			return fmt.Errorf("step %s: %w", step.ID, err)
+		}
+	}
+	return nil
+}
+
+// checkDataSize returns an error wrapping ErrDataTooLarge if data is over
+// the orchestrator's limit
+func (o *Orchestrator) checkDataSize(data map[string]interface{}) error {
+	return checkSize(o.maxDataSize, data)
+}
+
+// checkSize returns an error wrapping ErrDataTooLarge if data is over limit
+// bytes, unless limit is 0
+func checkSize(limit int, data map[string]interface{}) error {
+	if limit <= 0 || len(data) == 0 {
+		return nil
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode data: %w", err)
+	}
+	if len(encoded) > limit {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrDataTooLarge, len(encoded), limit)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package saga
+
+import (
+	"context"
+	"time"
+)
+
+// Reasons a step is dead-lettered
+const (
+	// DeadLetterNoHandler means no handler is registered for the step's name
+	DeadLetterNoHandler = "no_handler"
+	// DeadLetterCompensationFailed means the step's compensation returned an
+	// error, so its effects may not have been undone
+	DeadLetterCompensationFailed = "compensation_failed"
+)
+
+// DeadLetter describes a step the orchestrator couldn't process
+type DeadLetter struct {
+	SagaID    string
+	StepID    string
+	StepName  string
+	Reason    string
+	Error     string
+	Timestamp time.Time
+}
+
+// DeadLetterHandler is called for every dead-lettered step, e.g. to alert
+// an operator or persist the step for manual repair
+type DeadLetterHandler func(ctx context.Context, letter DeadLetter)
+
+// WithDeadLetterHandler sets the handler called for steps that can't be
+// processed. Without one, dead letters are only logged.
+func WithDeadLetterHandler(handler DeadLetterHandler) Option {
+	return func(o *Orchestrator) {
+		o.deadLetters = handler
+	}
+}
+
+func (o *Orchestrator) deadLetter(ctx context.Context, step *Step, reason string, err error) {
+	letter := DeadLetter{
+		SagaID:    step.SagaID,
+		StepID:    step.ID,
+		StepName:  step.Name,
+		Reason:    reason,
+		Error:     err.Error(),
+		Timestamp: o.now(),
+	}
+
+	o.logger.Error("Dead-lettered step",
+		"saga_id", step.SagaID, "step_id", step.ID, "step", step.Name, "reason", reason, "error", letter.Error)
+	if o.deadLetters != nil {
+		o.deadLetters(ctx, letter)
+	}
+}
@@ -0,0 +1,132 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrUnknownDefinition is returned by StartInstance for a name that no
+// definition was registered under
+var ErrUnknownDefinition = errors.New("unknown saga definition")
+
+// SagaDefinition describes a saga type that can be started many times.
+// Registering it once with RegisterDefinition registers its handlers, and
+// StartInstance then launches instances by name.
+type SagaDefinition struct {
+	Name string
+	// Steps run in declaration order unless they set DependsOn: a spec with
+	// nil DependsOn runs after the spec before it, and an empty DependsOn
+	// starts immediately
+	Steps []StepSpec
+	// Timeout, if positive, sets each instance's deadline that long after
+	// it is started
+	Timeout time.Duration
+	// FailurePolicy and TimeoutPolicy apply to every instance; see
+	// Builder.WithFailurePolicy and Builder.WithTimeoutPolicy
+	FailurePolicy FailurePolicy
+	TimeoutPolicy TimeoutPolicy
+	// Schema, if set, lists the keys each instance's data must have; see
+	// Builder.RequireType
+	Schema DataSchema
+}
+
+// RegisterDefinition validates def and registers its handlers under the
+// saga's name. It returns an error if two steps share a name, a dependency
+// is unknown or cyclic, or a definition with the same name is already
+// registered.
+func (o *Orchestrator) RegisterDefinition(def SagaDefinition) error {
+	if def.Name == "" {
+		return fmt.Errorf("saga definition must have a name")
+	}
+	if len(def.Steps) == 0 {
+		return fmt.Errorf("saga %s must have at least one step", def.Name)
+	}
+
+	specs := chainSpecs(def.Steps, nil)
+	if _, err := topologicalOrder(specs); err != nil {
+		return fmt.Errorf("invalid saga %s: %w", def.Name, err)
+	}
+	if err := o.checkStepCount(len(specs)); err != nil {
+		return fmt.Errorf("invalid saga %s: %w", def.Name, err)
+	}
+	if !validFailurePolicy(def.FailurePolicy) {
+		return fmt.Errorf("saga %s has unknown failure policy %q", def.Name, def.FailurePolicy)
+	}
+	if !validTimeoutPolicy(def.TimeoutPolicy) {
+		return fmt.Errorf("saga %s has unknown timeout policy %q", def.Name, def.TimeoutPolicy)
+	}
+	var schema DataSchema
+	for key, typ := range def.Schema {
+		if !validDataType(typ) {
+			return fmt.Errorf("saga %s has unknown data type %q for key %s", def.Name, typ, key)
+		}
+		if schema == nil {
+			schema = make(DataSchema, len(def.Schema))
+		}
+		schema[key] = typ
+	}
+
+	o.definitionsMu.Lock()
+	defer o.definitionsMu.Unlock()
+	if _, exists := o.definitions[def.Name]; exists {
+		return fmt.Errorf("saga definition %s is already registered", def.Name)
+	}
+
+	for _, spec := range specs {
+		if spec.Handler != nil {
+			o.RegisterSagaHandler(def.Name, spec.Name, spec.Handler)
+		}
+	}
+	o.definitions[def.Name] = &SagaDefinition{Name: def.Name, Steps: specs, Timeout: def.Timeout, FailurePolicy: def.FailurePolicy, TimeoutPolicy: def.TimeoutPolicy, Schema: schema}
+	return nil
+}
+
+// StartInstance starts a new saga from the registered definition with data
+// as its initial state
+func (o *Orchestrator) StartInstance(ctx context.Context, definitionName string, data map[string]interface{}) (*Saga, error) {
+	o.definitionsMu.RLock()
+	def, exists := o.definitions[definitionName]
+	o.definitionsMu.RUnlock()
+	if !exists {
+		return nil, invalidSaga(fmt.Errorf("%w %s", ErrUnknownDefinition, definitionName))
+	}
+
+	// Instances must not share the caller's map
+	initial := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		initial[k] = v
+	}
+	if err := def.Schema.Validate(initial); err != nil {
+		return nil, invalidSaga(fmt.Errorf("invalid data for saga %s: %w", def.Name, err))
+	}
+	return o.startSaga(ctx, def.Name, def.Steps, initial, o.instanceOptions(def))
+}
+
+// instanceOptions returns the settings an instance of def starts with
+func (o *Orchestrator) instanceOptions(def *SagaDefinition) sagaOptions {
+	opts := sagaOptions{failurePolicy: def.FailurePolicy, timeoutPolicy: def.TimeoutPolicy}
+	if def.Timeout > 0 {
+		deadline := o.now().Add(def.Timeout)
+		opts.deadline = &deadline
+	}
+	return opts
+}
+
+// chainSpecs resolves specs with nil DependsOn to depend on the spec before
+// them; the first such spec depends on first
+func chainSpecs(specs []StepSpec, first []string) []StepSpec {
+	resolved := make([]StepSpec, len(specs))
+	for i, spec := range specs {
+		resolved[i] = spec
+		if spec.DependsOn == nil {
+			if i == 0 {
+				resolved[i].DependsOn = first
+			} else {
+				resolved[i].DependsOn = []string{specs[i-1].Name}
+			}
+		}
+	}
+	return resolved
+}
@@ -0,0 +1,76 @@
+package saga
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// SagaEvent records a single status transition of a saga or one of its
+// steps. StepID is empty for saga-level transitions, and FromStatus is empty
+// when the saga or step was just created.
+type SagaEvent struct {
+	SagaID     string    `json:"saga_id"`
+	StepID     string    `json:"step_id,omitempty"`
+	FromStatus Status    `json:"from_status,omitempty"`
+	ToStatus   Status    `json:"to_status"`
+	Timestamp  time.Time `json:"timestamp"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// EventStore is an append-only history of saga transitions. Unlike Storage,
+// which keeps only the current state, it is never updated in place.
+type EventStore interface {
+	Append(ctx context.Context, event SagaEvent) error
+	// List returns the saga's events in the order they were appended
+	List(ctx context.Context, sagaID string) ([]SagaEvent, error)
+}
+
+// WithEventStore makes the orchestrator append a SagaEvent to store on
+// every saga and step status change
+func WithEventStore(store EventStore) Option {
+	return func(o *Orchestrator) {
+		o.events = store
+	}
+}
+
+// recordEvent appends a transition to the configured event store, if any.
+// A failed append is logged but doesn't stop the saga.
+func (o *Orchestrator) recordEvent(ctx context.Context, event SagaEvent) {
+	if o.events == nil {
+		return
+	}
+
+	event.Timestamp = o.now()
+	if err := o.events.Append(ctx, event); err != nil {
+		o.logger.Error("Failed to record saga event",
+			"saga_id", event.SagaID, "step_id", event.StepID, "status", event.ToStatus, "error", err)
+	}
+}
+
+// MemoryEventStore implements EventStore in memory
+type MemoryEventStore struct {
+	mu     sync.RWMutex
+	events map[string][]SagaEvent
+}
+
+func NewMemoryEventStore() *MemoryEventStore {
+	return &MemoryEventStore{
+		events: make(map[string][]SagaEvent),
+	}
+}
+
+func (m *MemoryEventStore) Append(ctx context.Context, event SagaEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.events[event.SagaID] = append(m.events[event.SagaID], event)
+	return nil
+}
+
+func (m *MemoryEventStore) List(ctx context.Context, sagaID string) ([]SagaEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]SagaEvent(nil), m.events[sagaID]...), nil
+}
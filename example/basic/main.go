@@ -20,7 +20,9 @@ func main() {
 
 	// Start listener
 	ctx := context.Background()
-	orchestrator.StartListener(ctx)
+	if err := orchestrator.StartListener(ctx); err != nil {
+		log.Fatal(err)
+	}
 
 	// Create saga with inline handlers
 	sagaInstance, err := saga.NewBuilder("order_fulfillment", orchestrator).
@@ -74,7 +76,11 @@ func main() {
 	fmt.Printf("Started saga: %s\n", sagaInstance.ID)
 
 	// Wait for saga to complete
-	time.Sleep(2 * time.Second)
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if _, err := orchestrator.WaitForCompletion(waitCtx, sagaInstance.ID); err != nil {
+		log.Fatal(err)
+	}
 
 	// Check final status
 	finalSaga, _ := storage.GetSaga(ctx, sagaInstance.ID)
@@ -30,7 +30,9 @@ func main() {
 		},
 	))
 
-	orchestrator1.StartListener(context.Background())
+	if err := orchestrator1.StartListener(context.Background()); err != nil {
+		log.Fatal(err)
+	}
 
 	// Create recovery manager with short timeout for demo
 	recovery1 := saga.NewRecoveryManager(storage, pubsub)
@@ -120,7 +122,9 @@ func main() {
 		},
 	))
 
-	orchestrator2.StartListener(context.Background())
+	if err := orchestrator2.StartListener(context.Background()); err != nil {
+		log.Fatal(err)
+	}
 
 	// Recovery will trigger and instance 2 will pick up the work
 	fmt.Println("⏳ Waiting for recovery and completion...")
@@ -0,0 +1,76 @@
+package saga
+
+import (
+	"fmt"
+	"time"
+)
+
+// StepFailure describes a step's last failure in more detail than
+// Step.Error, for debugging failed sagas
+type StepFailure struct {
+	// Type is the Go type of the error the handler returned, such as
+	// "*net.OpError", or of the value it panicked with. Errors marked with
+	// Permanent or Retryable are described as the error they mark.
+	Type string `json:"type"`
+	// Chain holds the types of the errors Type wraps through Unwrap,
+	// outermost first
+	Chain []string `json:"chain,omitempty"`
+	// Retryable reports whether the error was classified as worth
+	// retrying, by Retryable or WithDefaultRetryable; the step still fails
+	// once WithMaxAttempts is used up
+	Retryable bool `json:"retryable"`
+	// Attempt is the attempt that failed, counting from 1
+	Attempt int `json:"attempt"`
+	// Stack is the handler's stack trace if it panicked
+	Stack    string    `json:"stack,omitempty"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// panicError is the error for a handler that panicked, keeping the stack
+// where it did
+type panicError struct {
+	value interface{}
+	stack []byte
+}
+
+func (e panicError) Error() string { return fmt.Sprintf("panic: %v", e.value) }
+
+// stepFailure describes the failure of step's current attempt with err
+func (o *Orchestrator) stepFailure(step *Step, err error) *StepFailure {
+	failure := &StepFailure{
+		Retryable: !IsPermanent(err) && (IsRetryable(err) || !o.plainErrorsPermanent),
+		Attempt:   step.Attempts,
+		FailedAt:  o.now(),
+	}
+
+	var chain []string
+	for err != nil {
+		switch e := err.(type) {
+		case permanentError, retryableError:
+		case panicError:
+			chain = append(chain, fmt.Sprintf("%T", e.value))
+			failure.Stack = string(e.stack)
+		default:
+			chain = append(chain, fmt.Sprintf("%T", err))
+		}
+		err = unwrapOne(err)
+	}
+	if len(chain) > 0 {
+		failure.Type, failure.Chain = chain[0], chain[1:]
+	}
+	return failure
+}
+
+// unwrapOne returns the error err wraps, or the first of them if it wraps
+// several, as errors.Join does
+func unwrapOne(err error) error {
+	switch e := err.(type) {
+	case interface{ Unwrap() error }:
+		return e.Unwrap()
+	case interface{ Unwrap() []error }:
+		if errs := e.Unwrap(); len(errs) > 0 {
+			return errs[0]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+type followUpsKey struct{}
+
+// followUps collects the compensations a compensation handler added, to be
+// stored with its step when the handler returns
+type followUps struct {
+	mu    sync.Mutex
+	specs []StepSpec
+}
+
+// AddCompensations, called from a step's compensation, adds follow-up
+// compensations to its saga's rollback, for cleanup that only turns out to
+// be needed while compensating, e.g. releasing stock that was reserved in
+// several warehouses. Each spec's Handler, if set, is registered for its
+// Name, and only its Compensate runs; the other fields of the spec are
+// ignored.
+//
+// The follow-ups are stored with the compensated step once the calling
+// compensation returns successfully, and dropped if it fails. They are
+// compensated next, in the order they were added, and can add follow-ups
+// of their own; only steps with a CompensationOrder still waiting to be
+// rolled back go before them. Like every compensation they see the
+// saga's data, which includes the keys the compensations before them
+// added or changed. A name already used by a step of the saga fails the
+// calling compensation.
+func AddCompensations(ctx context.Context, specs ...StepSpec) error {
+	f, ok := ctx.Value(followUpsKey{}).(*followUps)
+	if !ok {
+		return errors.New("AddCompensations called outside a compensation")
+	}
+	for _, spec := range specs {
+		if spec.Name == "" {
+			return errors.New("compensation must have a name")
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.specs = append(f.specs, specs...)
+	return nil
+}
+
+// compensationWrites returns the keys a compensation added or changed in
+// output, which it was given as input, for its saga's data
+func compensationWrites(input, output map[string]interface{}) map[string]interface{} {
+	writes := make(map[string]interface{})
+	for k, v := range output {
+		if before, exists := input[k]; exists && reflect.DeepEqual(before, v) {
+			continue
+		}
+		writes[k] = v
+	}
+	return writes
+}
+
+// followUpSteps registers the handlers of the follow-ups compensating step
+// added and returns them as completed steps of saga, the first compensated
+// first
+func (o *Orchestrator) followUpSteps(saga *Saga, step *Step, f *followUps) ([]Step, error) {
+	f.mu.Lock()
+	specs := append([]StepSpec(nil), f.specs...)
+	f.mu.Unlock()
+	if len(specs) == 0 {
+		return nil, nil
+	}
+
+	// Rollbacks go in reverse dependency order, so each follow-up depends on
+	// the one added after it, and the last on the step that added them
+	steps := make([]Step, len(specs))
+	for i := len(specs) - 1; i >= 0; i-- {
+		deps := []string{step.Name}
+		if i < len(specs)-1 {
+			deps = []string{specs[i+1].Name}
+		}
+		steps[i] = Step{
+			ID:          o.newID(),
+			SagaID:      saga.ID,
+			Name:        specs[i].Name,
+			Status:      StatusCompleted,
+			Data:        make(map[string]interface{}),
+			DependsOn:   deps,
+			CreatedAt:   o.now(),
+			UpdatedAt:   o.now(),
+			CompletedAt: o.timestamp(),
+		}
+	}
+	if _, err := topologicalOrder(append(stepSpecs(saga.Steps), stepSpecs(steps)...)); err != nil {
+		return nil, fmt.Errorf("invalid follow-up compensations: %w", err)
+	}
+	if err := o.checkStepCount(len(saga.Steps) + len(steps)); err != nil {
+		return nil, fmt.Errorf("invalid follow-up compensations: %w", err)
+	}
+
+	for _, spec := range specs {
+		if spec.Handler != nil {
+			o.RegisterSagaHandler(saga.Name, spec.Name, spec.Handler)
+		}
+	}
+	if err := o.checkHandlers(saga.Name, specs); err != nil {
+		return nil, fmt.Errorf("invalid follow-up compensations: %w", err)
+	}
+	return steps, nil
+}
+
+// saveCompensation stores a compensated step together with the data its
+// compensation wrote, its follow-ups and the message compensating the next
+// step, in one write, and returns that message
+func (o *Orchestrator) saveCompensation(ctx context.Context, step *Step, writes map[string]interface{}, added []Step) ([]OutboxMessage, error) {
+	for {
+		saga, err := o.storage.GetSaga(ctx, step.SagaID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get saga: %w", err)
+		}
+		if saga.Data == nil {
+			saga.Data = make(map[string]interface{})
+		}
+		for k, v := range writes {
+			saga.Data[k] = v
+		}
+		saga.Steps = append(saga.Steps, added...)
+		setStep(saga, step)
+
+		scheduled := o.compensationMessages(saga)
+		if o.outbox != nil {
+			err = o.outbox.CompleteStepWithMessages(ctx, step, saga, scheduled)
+		} else {
+			err = o.storage.CompleteStep(ctx, step, saga)
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			current, getErr := o.storage.GetStep(ctx, step.ID)
+			if getErr != nil {
+				return nil, fmt.Errorf("failed to get step: %w", getErr)
+			}
+			if current.Version == step.Version {
+				continue // Only the saga changed; merge again
+			}
+			o.logger.Warn("Step was changed while compensating, discarding result",
+				"saga_id", step.SagaID, "step_id", step.ID, "step", step.Name, "status", current.Status)
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to save compensation: %w", err)
+		}
+		return scheduled, nil
+	}
+}
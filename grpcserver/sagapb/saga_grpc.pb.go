@@ -0,0 +1,213 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.27.1
+// source: saga.proto
+
+package sagapb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	SagaService_StartSaga_FullMethodName = "/saga.v1.SagaService/StartSaga"
+	SagaService_GetSaga_FullMethodName   = "/saga.v1.SagaService/GetSaga"
+	SagaService_WatchSaga_FullMethodName = "/saga.v1.SagaService/WatchSaga"
+)
+
+// SagaServiceClient is the client API for SagaService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// SagaService starts and inspects sagas registered with an orchestrator
+type SagaServiceClient interface {
+	// StartSaga starts an instance of a registered saga definition
+	StartSaga(ctx context.Context, in *StartSagaRequest, opts ...grpc.CallOption) (*Saga, error)
+	// GetSaga returns a saga with its steps
+	GetSaga(ctx context.Context, in *GetSagaRequest, opts ...grpc.CallOption) (*Saga, error)
+	// WatchSaga sends the saga whenever its status changes, starting with its
+	// current state, and ends once the saga has finished
+	WatchSaga(ctx context.Context, in *WatchSagaRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Saga], error)
+}
+
+type sagaServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSagaServiceClient(cc grpc.ClientConnInterface) SagaServiceClient {
+	return &sagaServiceClient{cc}
+}
+
+func (c *sagaServiceClient) StartSaga(ctx context.Context, in *StartSagaRequest, opts ...grpc.CallOption) (*Saga, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Saga)
+	err := c.cc.Invoke(ctx, SagaService_StartSaga_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sagaServiceClient) GetSaga(ctx context.Context, in *GetSagaRequest, opts ...grpc.CallOption) (*Saga, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Saga)
+	err := c.cc.Invoke(ctx, SagaService_GetSaga_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sagaServiceClient) WatchSaga(ctx context.Context, in *WatchSagaRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Saga], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &SagaService_ServiceDesc.Streams[0], SagaService_WatchSaga_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchSagaRequest, Saga]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type SagaService_WatchSagaClient = grpc.ServerStreamingClient[Saga]
+
+// SagaServiceServer is the server API for SagaService service.
+// All implementations must embed UnimplementedSagaServiceServer
+// for forward compatibility.
+//
+// SagaService starts and inspects sagas registered with an orchestrator
+type SagaServiceServer interface {
+	// StartSaga starts an instance of a registered saga definition
+	StartSaga(context.Context, *StartSagaRequest) (*Saga, error)
+	// GetSaga returns a saga with its steps
+	GetSaga(context.Context, *GetSagaRequest) (*Saga, error)
+	// WatchSaga sends the saga whenever its status changes, starting with its
+	// current state, and ends once the saga has finished
+	WatchSaga(*WatchSagaRequest, grpc.ServerStreamingServer[Saga]) error
+	mustEmbedUnimplementedSagaServiceServer()
+}
+
+// UnimplementedSagaServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedSagaServiceServer struct{}
+
+func (UnimplementedSagaServiceServer) StartSaga(context.Context, *StartSagaRequest) (*Saga, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StartSaga not implemented")
+}
+func (UnimplementedSagaServiceServer) GetSaga(context.Context, *GetSagaRequest) (*Saga, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetSaga not implemented")
+}
+func (UnimplementedSagaServiceServer) WatchSaga(*WatchSagaRequest, grpc.ServerStreamingServer[Saga]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchSaga not implemented")
+}
+func (UnimplementedSagaServiceServer) mustEmbedUnimplementedSagaServiceServer() {}
+func (UnimplementedSagaServiceServer) testEmbeddedByValue()                     {}
+
+// UnsafeSagaServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SagaServiceServer will
+// result in compilation errors.
+type UnsafeSagaServiceServer interface {
+	mustEmbedUnimplementedSagaServiceServer()
+}
+
+func RegisterSagaServiceServer(s grpc.ServiceRegistrar, srv SagaServiceServer) {
+	// If the following call pancis, it indicates UnimplementedSagaServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&SagaService_ServiceDesc, srv)
+}
+
+func _SagaService_StartSaga_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StartSagaRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SagaServiceServer).StartSaga(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SagaService_StartSaga_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SagaServiceServer).StartSaga(ctx, req.(*StartSagaRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SagaService_GetSaga_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetSagaRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SagaServiceServer).GetSaga(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SagaService_GetSaga_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SagaServiceServer).GetSaga(ctx, req.(*GetSagaRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SagaService_WatchSaga_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchSagaRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SagaServiceServer).WatchSaga(m, &grpc.GenericServerStream[WatchSagaRequest, Saga]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type SagaService_WatchSagaServer = grpc.ServerStreamingServer[Saga]
+
+// SagaService_ServiceDesc is the grpc.ServiceDesc for SagaService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var SagaService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "saga.v1.SagaService",
+	HandlerType: (*SagaServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "StartSaga",
+			Handler:    _SagaService_StartSaga_Handler,
+		},
+		{
+			MethodName: "GetSaga",
+			Handler:    _SagaService_GetSaga_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchSaga",
+			Handler:       _SagaService_WatchSaga_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "saga.proto",
+}
@@ -0,0 +1,134 @@
+// Package grpcserver exposes an orchestrator as a gRPC service, so services
+// written in other languages can start and follow sagas. The service is
+// defined in sagapb/saga.proto.
+package grpcserver
+
+//go:generate protoc -I sagapb --go_out=sagapb --go_opt=paths=source_relative --go-grpc_out=sagapb --go-grpc_opt=paths=source_relative saga.proto
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	saga "github.com/andrewnguyen41/saga-go"
+	"github.com/andrewnguyen41/saga-go/grpcserver/sagapb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var _ sagapb.SagaServiceServer = (*Server)(nil)
+
+// Server implements sagapb.SagaServiceServer by delegating to an
+// orchestrator and its storage. Sagas are started from definitions
+// registered with RegisterDefinition, so the handlers stay in the Go
+// process while callers only pass the saga's name and initial data.
+type Server struct {
+	sagapb.UnimplementedSagaServiceServer
+
+	orchestrator *saga.Orchestrator
+	storage      saga.Storage
+}
+
+// NewServer creates a server; register it with
+// sagapb.RegisterSagaServiceServer
+func NewServer(orchestrator *saga.Orchestrator, storage saga.Storage) *Server {
+	return &Server{orchestrator: orchestrator, storage: storage}
+}
+
+func (s *Server) StartSaga(ctx context.Context, req *sagapb.StartSagaRequest) (*sagapb.Saga, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "saga name is required")
+	}
+
+	sg, err := s.orchestrator.StartInstance(ctx, req.GetName(), req.GetData().AsMap())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toProto(sg)
+}
+
+func (s *Server) GetSaga(ctx context.Context, req *sagapb.GetSagaRequest) (*sagapb.Saga, error) {
+	sg, err := s.storage.GetSaga(ctx, req.GetId())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toProto(sg)
+}
+
+// WatchSaga streams the saga on every status change until it finishes,
+// using the orchestrator's completion notifications rather than polling
+func (s *Server) WatchSaga(req *sagapb.WatchSagaRequest, stream sagapb.SagaService_WatchSagaServer) error {
+	err := s.orchestrator.WatchSaga(stream.Context(), req.GetId(), func(sg *saga.Saga) error {
+		msg, err := toProto(sg)
+		if err != nil {
+			return err
+		}
+		return stream.Send(msg)
+	})
+	if err != nil {
+		return toStatus(err)
+	}
+	return nil
+}
+
+// toStatus maps an orchestrator or storage error to a gRPC status
+func toStatus(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, saga.ErrSagaNotFound), errors.Is(err, saga.ErrUnknownDefinition):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func toProto(sg *saga.Saga) (*sagapb.Saga, error) {
+	data, err := toStruct(sg.Data)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "saga %s: %v", sg.ID, err)
+	}
+
+	msg := &sagapb.Saga{
+		Id:           sg.ID,
+		Name:         sg.Name,
+		Status:       string(sg.Status),
+		Data:         data,
+		Error:        sg.Error,
+		FailedStepId: sg.FailedStepID,
+		CreatedAt:    timestamppb.New(sg.CreatedAt),
+		UpdatedAt:    timestamppb.New(sg.UpdatedAt),
+	}
+	for _, step := range sg.Steps {
+		msg.Steps = append(msg.Steps, &sagapb.Step{
+			Id:       step.ID,
+			Name:     step.Name,
+			Status:   string(step.Status),
+			Error:    step.Error,
+			Attempts: int32(step.Attempts),
+		})
+	}
+	return msg, nil
+}
+
+// toStruct converts saga data through JSON, so values structpb can't
+// represent directly, such as structs, are sent as their JSON encoding
+func toStruct(data map[string]interface{}) (*structpb.Struct, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode data: %w", err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		return nil, fmt.Errorf("failed to decode data: %w", err)
+	}
+	return structpb.NewStruct(decoded)
+}
@@ -0,0 +1,130 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	saga "github.com/andrewnguyen41/saga-go"
+	"github.com/andrewnguyen41/saga-go/grpcserver/sagapb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func newTestClient(t *testing.T, orchestrator *saga.Orchestrator, storage saga.Storage) sagapb.SagaServiceClient {
+	t.Helper()
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	sagapb.RegisterSagaServiceServer(server, NewServer(orchestrator, storage))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return sagapb.NewSagaServiceClient(conn)
+}
+
+func TestStartAndWatchSaga(t *testing.T) {
+	storage := saga.NewMemoryStorage()
+	pubsub := saga.NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := saga.NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	release := make(chan struct{})
+	err := saga.NewBuilder("reserve", orchestrator).
+		Step("hold", func(ctx context.Context, data map[string]interface{}) error {
+			<-release
+			data["held"] = data["seats"]
+			return nil
+		}, nil).
+		Register()
+	if err != nil {
+		t.Fatalf("Failed to register definition: %v", err)
+	}
+
+	client := newTestClient(t, orchestrator, storage)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	data, _ := structpb.NewStruct(map[string]interface{}{"seats": 2})
+	started, err := client.StartSaga(ctx, &sagapb.StartSagaRequest{Name: "reserve", Data: data})
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if started.GetId() == "" || started.GetStatus() != string(saga.StatusPending) || len(started.GetSteps()) != 1 {
+		t.Fatalf("Unexpected started saga %+v", started)
+	}
+
+	stream, err := client.WatchSaga(ctx, &sagapb.WatchSagaRequest{Id: started.GetId()})
+	if err != nil {
+		t.Fatalf("Failed to watch saga: %v", err)
+	}
+	first, err := stream.Recv()
+	if err != nil || first.GetStatus() != string(saga.StatusPending) {
+		t.Fatalf("Expected the current status first, got %+v, %v", first, err)
+	}
+
+	close(release)
+	var last *sagapb.Saga
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Watch failed: %v", err)
+		}
+		last = msg
+	}
+	if last.GetStatus() != string(saga.StatusCompleted) || last.GetData().GetFields()["held"].GetNumberValue() != 2 {
+		t.Errorf("Expected the stream to end with the completed saga, got %+v", last)
+	}
+
+	fetched, err := client.GetSaga(ctx, &sagapb.GetSagaRequest{Id: started.GetId()})
+	if err != nil || fetched.GetStatus() != string(saga.StatusCompleted) {
+		t.Errorf("Expected GetSaga to return the completed saga, got %+v, %v", fetched, err)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	storage := saga.NewMemoryStorage()
+	pubsub := saga.NewMemoryPubSub()
+	defer pubsub.Close()
+
+	client := newTestClient(t, saga.NewOrchestrator(storage, pubsub), storage)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := client.StartSaga(ctx, &sagapb.StartSagaRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument without a name, got %v", err)
+	}
+	if _, err := client.StartSaga(ctx, &sagapb.StartSagaRequest{Name: "unknown"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound for an unknown definition, got %v", err)
+	}
+	if _, err := client.GetSaga(ctx, &sagapb.GetSagaRequest{Id: "missing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound for a missing saga, got %v", err)
+	}
+
+	stream, err := client.WatchSaga(ctx, &sagapb.WatchSagaRequest{Id: "missing"})
+	if err != nil {
+		t.Fatalf("Failed to watch saga: %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound when watching a missing saga, got %v", err)
+	}
+}
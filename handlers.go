@@ -0,0 +1,68 @@
+package saga
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrNoHandler is the error for a step no handler is registered for
+var ErrNoHandler = errors.New("no handler for step")
+
+// WithHandlerValidation makes starting a saga, or adding steps to one,
+// check that a handler is registered for each of its steps, and return an
+// error wrapping ErrNoHandler up front if one isn't, instead of the step
+// failing to run once its turn comes. Only enable it when every handler is
+// registered on each orchestrator that starts sagas.
+func WithHandlerValidation() Option {
+	return func(o *Orchestrator) {
+		o.validateHandlers = true
+	}
+}
+
+// HasHandler reports whether a step of the named saga type has a handler,
+// registered for that saga or for every saga type
+func (o *Orchestrator) HasHandler(sagaName, stepName string) bool {
+	_, exists := o.handler(sagaName, stepName)
+	return exists
+}
+
+// RegisteredHandlers returns the names of the steps of the named saga type
+// that have a handler, registered for that saga or for every saga type, in
+// alphabetical order. An empty sagaName lists only the handlers registered
+// for every saga type.
+func (o *Orchestrator) RegisteredHandlers(sagaName string) []string {
+	o.handlersMu.RLock()
+	defer o.handlersMu.RUnlock()
+
+	var names []string
+	for key := range o.handlers {
+		if key.saga != "" && key.saga != sagaName {
+			continue
+		}
+		if key.saga == "" && sagaName != "" {
+			// A step with both kinds of handler is listed once
+			if _, exists := o.handlers[handlerKey{saga: sagaName, step: key.step}]; exists {
+				continue
+			}
+		}
+		names = append(names, key.step)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkHandlers returns an error wrapping ErrNoHandler if the orchestrator
+// validates handlers and one of specs has none, registered or to be
+// registered from the spec
+func (o *Orchestrator) checkHandlers(sagaName string, specs []StepSpec) error {
+	if !o.validateHandlers {
+		return nil
+	}
+	for _, spec := range specs {
+		if spec.Handler == nil && !o.HasHandler(sagaName, spec.Name) {
+			return fmt.Errorf("%w: %s", ErrNoHandler, spec.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package saga
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultListLimit caps GET /sagas when no limit is given
+const defaultListLimit = 100
+
+// httpHandler serves the saga inspection and control API
+type httpHandler struct {
+	orchestrator *Orchestrator
+	storage      Storage
+}
+
+// NewHTTPHandler returns an http.Handler for inspecting and controlling
+// sagas, with JSON responses:
+//
+//	GET  /sagas              list sagas, newest first; filter with the name,
+//	                         status and limit query parameters (limit
+//	                         defaults to 100)
+//	GET  /sagas/{id}         get a saga with its steps
+//	POST /sagas/{id}/cancel  cancel a running saga, see CancelSaga
+//
+// Errors are returned as {"error": "..."}. Use http.StripPrefix to mount the
+// handler below a path. It performs no authentication, so protect it as
+// you would any admin endpoint.
+func NewHTTPHandler(orchestrator *Orchestrator, storage Storage) http.Handler {
+	h := &httpHandler{orchestrator: orchestrator, storage: storage}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sagas", h.listSagas)
+	mux.HandleFunc("/sagas/", h.saga)
+	return mux
+}
+
+func (h *httpHandler) listSagas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := SagaFilter{
+		Name:   query.Get("name"),
+		Status: Status(query.Get("status")),
+		Limit:  defaultListLimit,
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", limit))
+			return
+		}
+		filter.Limit = n
+	}
+
+	sagas, err := h.storage.ListSagas(r.Context(), filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if sagas == nil {
+		sagas = []Saga{}
+	}
+	writeJSON(w, http.StatusOK, sagas)
+}
+
+// saga serves /sagas/{id} and /sagas/{id}/cancel
+func (h *httpHandler) saga(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/sagas/"), "/")
+	if id == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch action {
+	case "":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		h.getSaga(w, r, id, http.StatusOK)
+	case "cancel":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		if err := h.orchestrator.CancelSaga(r.Context(), id); err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		// The rollback continues in the background
+		h.getSaga(w, r, id, http.StatusAccepted)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *httpHandler) getSaga(w http.ResponseWriter, r *http.Request, id string, status int) {
+	saga, err := h.storage.GetSaga(r.Context(), id)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, status, saga)
+}
+
+// errorStatus maps an orchestrator or storage error to an HTTP status
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrSagaNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrSagaNotRunning):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed, use %s", allowed))
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,34 @@
+package saga
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MarshalSaga encodes a saga, including its steps, as JSON for storage
+// backends that persist sagas as documents
+func MarshalSaga(saga *Saga) ([]byte, error) {
+	data, err := json.Marshal(saga)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode saga %s: %w", saga.ID, err)
+	}
+	return data, nil
+}
+
+// UnmarshalSaga decodes a saga encoded with MarshalSaga. Values in Data
+// come back as JSON types: numbers are float64, structs are
+// map[string]interface{} and slices are []interface{}, so handlers should
+// not rely on the concrete types they stored. Step data maps dropped by
+// omitempty are restored as empty maps, as the orchestrator creates them.
+func UnmarshalSaga(data []byte) (*Saga, error) {
+	var saga Saga
+	if err := json.Unmarshal(data, &saga); err != nil {
+		return nil, fmt.Errorf("failed to decode saga: %w", err)
+	}
+	for i := range saga.Steps {
+		if saga.Steps[i].Data == nil {
+			saga.Steps[i].Data = make(map[string]interface{})
+		}
+	}
+	return &saga, nil
+}
@@ -0,0 +1,289 @@
+// Package kafkapubsub provides a saga.PubSub backed by Kafka.
+package kafkapubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	saga "github.com/andrewnguyen41/saga-go"
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	_ saga.PubSub         = (*KafkaPubSub)(nil)
+	_ saga.BatchPublisher = (*KafkaPubSub)(nil)
+)
+
+// Kafka can't redeliver a single message of a partition, so a message whose
+// handler fails is retried in place this many times before it is committed
+// anyway and left to saga recovery
+const handlerAttempts = 3
+
+// A reader that fails to fetch backs off by fetchBackoff more after each
+// consecutive failure, up to maxFetchBackoff, instead of retrying at once
+const (
+	fetchBackoff    = 100 * time.Millisecond
+	maxFetchBackoff = 5 * time.Second
+)
+
+// reader is the part of *kafka.Reader a subscription uses
+type reader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// writer is the part of *kafka.Writer publishing uses
+type writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// KafkaPubSub implements saga.PubSub using Kafka. Messages are record values
+// encoded with the pubsub's codec (JSON by default) and keyed by SagaID, so all events of a saga land on the same
+// partition. Subscribers join a consumer group, so orchestrator instances
+// sharing a group ID split the work instead of each processing every message.
+type KafkaPubSub struct {
+	brokers []string
+	groupID string
+	writer  writer
+	codec   saga.Codec
+	logger  saga.Logger
+
+	// newReader opens the reader of a subscription to topic
+	newReader func(topic string) reader
+
+	mu      sync.Mutex
+	readers []reader
+	cancel  context.CancelFunc
+	ctx     context.Context
+	wg      sync.WaitGroup
+	closed  bool
+}
+
+// Option configures a KafkaPubSub
+type Option func(*KafkaPubSub)
+
+// WithCodec sets how messages are encoded; the default is saga.JSONCodec.
+// Every publisher and subscriber of a topic must use the same codec.
+func WithCodec(codec saga.Codec) Option {
+	return func(k *KafkaPubSub) {
+		k.codec = codec
+	}
+}
+
+// WithLogger sets the logger used for fetch, decode and commit failures and
+// for messages given up on. Nothing is logged by default.
+func WithLogger(logger saga.Logger) Option {
+	return func(k *KafkaPubSub) {
+		k.logger = logger
+	}
+}
+
+// NewKafkaPubSub creates a pubsub connected to the given brokers. groupID is
+// the consumer group used by Subscribe.
+func NewKafkaPubSub(brokers []string, groupID string, opts ...Option) *KafkaPubSub {
+	ctx, cancel := context.WithCancel(context.Background())
+	k := &KafkaPubSub{
+		brokers: brokers,
+		groupID: groupID,
+		writer: &kafka.Writer{
+			Addr:                   kafka.TCP(brokers...),
+			Balancer:               &kafka.Hash{},
+			RequiredAcks:           kafka.RequireAll,
+			AllowAutoTopicCreation: true,
+		},
+		codec:  saga.JSONCodec{},
+		logger: nopLogger{},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	k.newReader = func(topic string) reader {
+		return kafka.NewReader(kafka.ReaderConfig{
+			Brokers: k.brokers,
+			GroupID: k.groupID,
+			Topic:   topic,
+		})
+	}
+	for _, opt := range opts {
+		opt(k)
+	}
+	return k
+}
+
+func (k *KafkaPubSub) Publish(ctx context.Context, topic string, msg saga.Message) error {
+	k.mu.Lock()
+	closed := k.closed
+	k.mu.Unlock()
+	if closed {
+		return saga.ErrClosed
+	}
+
+	value, err := k.codec.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+
+	return k.writer.WriteMessages(ctx, kafka.Message{
+		Topic: topic,
+		Key:   []byte(msg.SagaID),
+		Value: value,
+	})
+}
+
+// PublishBatch writes msgs to topic together, in as few requests as the
+// writer's batch size allows rather than one per message
+func (k *KafkaPubSub) PublishBatch(ctx context.Context, topic string, msgs []saga.Message) error {
+	k.mu.Lock()
+	closed := k.closed
+	k.mu.Unlock()
+	if closed {
+		return saga.ErrClosed
+	}
+
+	records := make([]kafka.Message, len(msgs))
+	for i, msg := range msgs {
+		value, err := k.codec.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("failed to encode message: %w", err)
+		}
+		records[i] = kafka.Message{Topic: topic, Key: []byte(msg.SagaID), Value: value}
+	}
+
+	return k.writer.WriteMessages(ctx, records...)
+}
+
+// Subscribe consumes topic as part of the consumer group. Offsets are
+// committed after the handler returns, so a message whose handler never
+// finished (for example because the process crashed) is delivered again.
+// A handler error retries the message in place, a few times with a short
+// backoff, before it is committed.
+func (k *KafkaPubSub) Subscribe(ctx context.Context, topic string, handler func(saga.Message) error) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.closed {
+		return saga.ErrClosed
+	}
+
+	reader := k.newReader(topic)
+	k.readers = append(k.readers, reader)
+
+	k.wg.Add(1)
+	go k.consume(ctx, reader, handler)
+	return nil
+}
+
+func (k *KafkaPubSub) consume(ctx context.Context, reader reader, handler func(saga.Message) error) {
+	defer k.wg.Done()
+
+	// Stop on either the subscriber's context or Close
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-k.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	failures := 0
+	for {
+		record, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				return
+			}
+			failures++
+			k.logger.Error("Failed to fetch kafka message", "failures", failures, "error", err)
+
+			// Back off so a broker that keeps failing isn't hammered
+			backoff := time.Duration(failures) * fetchBackoff
+			if backoff > maxFetchBackoff {
+				backoff = maxFetchBackoff
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		failures = 0
+
+		var msg saga.Message
+		if err := k.codec.Unmarshal(record.Value, &msg); err != nil {
+			k.logger.Error("Dropping malformed kafka message",
+				"topic", record.Topic, "offset", record.Offset, "error", err)
+		} else {
+			k.handle(ctx, record, msg, handler)
+		}
+
+		if err := reader.CommitMessages(ctx, record); err != nil && ctx.Err() == nil {
+			k.logger.Error("Failed to commit kafka offset",
+				"topic", record.Topic, "offset", record.Offset, "error", err)
+		}
+	}
+}
+
+// handle runs handler on msg, retrying while it fails and attempts remain
+func (k *KafkaPubSub) handle(ctx context.Context, record kafka.Message, msg saga.Message, handler func(saga.Message) error) {
+	for attempt := 1; ; attempt++ {
+		err := handler(msg)
+		if err == nil {
+			return
+		}
+		if attempt == handlerAttempts {
+			k.logger.Error("Giving up on kafka message",
+				"topic", record.Topic, "offset", record.Offset, "saga_id", msg.SagaID,
+				"step_id", msg.StepID, "attempts", attempt, "error", err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+		}
+	}
+}
+
+// Close stops all consumers, waits for in-progress handlers, and flushes
+// pending writes.
+func (k *KafkaPubSub) Close() error {
+	k.mu.Lock()
+	if k.closed {
+		k.mu.Unlock()
+		return nil
+	}
+	k.closed = true
+	readers := k.readers
+	k.mu.Unlock()
+
+	k.cancel()
+	k.wg.Wait()
+
+	var errs []error
+	for _, reader := range readers {
+		if err := reader.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := k.writer.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// nopLogger discards everything; it keeps the pubsub silent by default
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...any) {}
+func (nopLogger) Info(msg string, args ...any)  {}
+func (nopLogger) Warn(msg string, args ...any)  {}
+func (nopLogger) Error(msg string, args ...any) {}
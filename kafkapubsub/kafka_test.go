@@ -0,0 +1,226 @@
+package kafkapubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	saga "github.com/andrewnguyen41/saga-go"
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeBroker stands in for Kafka: the writer appends records to it and the
+// reader hands them out in order, failing the first fetchErrors fetches
+type fakeBroker struct {
+	mu          sync.Mutex
+	records     chan kafka.Message
+	written     []kafka.Message
+	committed   []int64
+	fetchErrors int
+	fetches     []time.Time
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{records: make(chan kafka.Message, 10)}
+}
+
+func (b *fakeBroker) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, msg := range msgs {
+		msg.Offset = int64(len(b.written))
+		b.written = append(b.written, msg)
+		b.records <- msg
+	}
+	return nil
+}
+
+func (b *fakeBroker) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	b.mu.Lock()
+	b.fetches = append(b.fetches, time.Now())
+	if b.fetchErrors > 0 {
+		b.fetchErrors--
+		b.mu.Unlock()
+		return kafka.Message{}, errors.New("broker unavailable")
+	}
+	b.mu.Unlock()
+
+	select {
+	case record := <-b.records:
+		return record, nil
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+func (b *fakeBroker) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, msg := range msgs {
+		b.committed = append(b.committed, msg.Offset)
+	}
+	return nil
+}
+
+func (b *fakeBroker) Close() error { return nil }
+
+func (b *fakeBroker) committedOffsets() []int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]int64(nil), b.committed...)
+}
+
+func newTestPubSub(t *testing.T, broker *fakeBroker) *KafkaPubSub {
+	t.Helper()
+
+	k := NewKafkaPubSub([]string{"localhost:9092"}, "test-group")
+	k.writer = broker
+	k.newReader = func(topic string) reader { return broker }
+	t.Cleanup(func() { k.Close() })
+	return k
+}
+
+func TestKafkaRoundTrip(t *testing.T) {
+	broker := newFakeBroker()
+	k := newTestPubSub(t, broker)
+
+	received := make(chan saga.Message, 2)
+	if err := k.Subscribe(context.Background(), "saga_events", func(msg saga.Message) error {
+		received <- msg
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+
+	sent := saga.Message{
+		Type:   "step_execute",
+		SagaID: "saga-1",
+		StepID: "step-1",
+		Data:   map[string]interface{}{"amount": 42.0},
+	}
+	if err := k.Publish(context.Background(), "saga_events", sent); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	if err := k.PublishBatch(context.Background(), "saga_events", []saga.Message{{Type: "step_execute", SagaID: "saga-2", StepID: "step-2"}}); err != nil {
+		t.Fatalf("Failed to publish batch: %v", err)
+	}
+
+	for _, want := range []string{"saga-1", "saga-2"} {
+		select {
+		case msg := <-received:
+			if msg.SagaID != want {
+				t.Errorf("Expected a message of %s, got %+v", want, msg)
+			}
+			if want == "saga-1" && (msg.Type != sent.Type || msg.StepID != sent.StepID || msg.Data["amount"] != 42.0) {
+				t.Errorf("Expected the message to round-trip, got %+v", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the message of %s to be delivered", want)
+		}
+	}
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	for _, record := range broker.written {
+		if record.Topic != "saga_events" {
+			t.Errorf("Expected the record on saga_events, got %s", record.Topic)
+		}
+	}
+	if string(broker.written[0].Key) != "saga-1" || string(broker.written[1].Key) != "saga-2" {
+		t.Errorf("Expected records keyed by saga ID, got %q and %q", broker.written[0].Key, broker.written[1].Key)
+	}
+}
+
+func TestKafkaHandlerRetry(t *testing.T) {
+	broker := newFakeBroker()
+	k := newTestPubSub(t, broker)
+
+	var mu sync.Mutex
+	calls := map[string]int{}
+	done := make(chan struct{}, 2)
+	k.Subscribe(context.Background(), "saga_events", func(msg saga.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[msg.SagaID]++
+		// flaky succeeds on its second attempt, broken never does
+		if msg.SagaID == "flaky" && calls[msg.SagaID] == 2 {
+			done <- struct{}{}
+			return nil
+		}
+		if msg.SagaID == "broken" && calls[msg.SagaID] == handlerAttempts {
+			done <- struct{}{}
+		}
+		return errors.New("handler failed")
+	})
+
+	k.Publish(context.Background(), "saga_events", saga.Message{Type: "step_execute", SagaID: "flaky"})
+	k.Publish(context.Background(), "saga_events", saga.Message{Type: "step_execute", SagaID: "broken"})
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected both messages to be handled")
+		}
+	}
+
+	// Offsets are committed once a message is done with, after it succeeds
+	// or runs out of attempts
+	deadline := time.Now().Add(time.Second)
+	for len(broker.committedOffsets()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if committed := broker.committedOffsets(); len(committed) != 2 || committed[0] != 0 || committed[1] != 1 {
+		t.Errorf("Expected both offsets committed in order, got %v", committed)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls["flaky"] != 2 || calls["broken"] != handlerAttempts {
+		t.Errorf("Expected 2 attempts at flaky and %d at broken, got %v", handlerAttempts, calls)
+	}
+}
+
+func TestKafkaFetchBackoff(t *testing.T) {
+	broker := newFakeBroker()
+	broker.fetchErrors = 2
+	k := newTestPubSub(t, broker)
+
+	received := make(chan saga.Message, 1)
+	k.Subscribe(context.Background(), "saga_events", func(msg saga.Message) error {
+		received <- msg
+		return nil
+	})
+	k.Publish(context.Background(), "saga_events", saga.Message{Type: "step_execute", SagaID: "saga-1"})
+
+	select {
+	case <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the message to be delivered once the fetches recover")
+	}
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if len(broker.fetches) < 3 {
+		t.Fatalf("Expected a fetch after each failure, got %d fetches", len(broker.fetches))
+	}
+	for i, want := range []time.Duration{fetchBackoff, 2 * fetchBackoff} {
+		if gap := broker.fetches[i+1].Sub(broker.fetches[i]); gap < want {
+			t.Errorf("Expected at least %s before retry %d, got %s", want, i+1, gap)
+		}
+	}
+}
+
+func TestKafkaClosed(t *testing.T) {
+	k := newTestPubSub(t, newFakeBroker())
+	k.Close()
+
+	if err := k.Publish(context.Background(), "saga_events", saga.Message{}); !errors.Is(err, saga.ErrClosed) {
+		t.Errorf("Expected ErrClosed from Publish, got %v", err)
+	}
+	if err := k.Subscribe(context.Background(), "saga_events", func(saga.Message) error { return nil }); !errors.Is(err, saga.ErrClosed) {
+		t.Errorf("Expected ErrClosed from Subscribe, got %v", err)
+	}
+}
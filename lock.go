@@ -0,0 +1,59 @@
+package saga
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Locker is a lease-style lock shared between orchestrator instances, such
+// as a Redis key or a database row. A lock expires ttl after it was last
+// acquired, so an instance that dies doesn't hold it forever.
+type Locker interface {
+	// AcquireLock takes the named lock for owner, or extends it if owner
+	// already holds it, until ttl has passed. It reports false if another
+	// owner holds the lock.
+	AcquireLock(ctx context.Context, name, owner string, ttl time.Duration) (bool, error)
+	// Release gives up the lock if owner holds it
+	Release(ctx context.Context, name, owner string) error
+}
+
+// MemoryLocker implements Locker in memory, for tests and for instances
+// sharing one process
+type MemoryLocker struct {
+	mu    sync.Mutex
+	locks map[string]memoryLock
+}
+
+type memoryLock struct {
+	owner   string
+	expires time.Time
+}
+
+func NewMemoryLocker() *MemoryLocker {
+	return &MemoryLocker{
+		locks: make(map[string]memoryLock),
+	}
+}
+
+func (m *MemoryLocker) AcquireLock(ctx context.Context, name, owner string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if lock, held := m.locks[name]; held && lock.owner != owner && now.Before(lock.expires) {
+		return false, nil
+	}
+	m.locks[name] = memoryLock{owner: owner, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *MemoryLocker) Release(ctx context.Context, name, owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if lock, held := m.locks[name]; held && lock.owner == owner {
+		delete(m.locks, name)
+	}
+	return nil
+}
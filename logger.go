@@ -0,0 +1,19 @@
+package saga
+
+// Logger receives the orchestrator's and recovery manager's log events as a
+// message plus alternating key/value pairs. *slog.Logger satisfies it, and
+// adapters for zap, zerolog or a test spy only need these four methods.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// nopLogger discards everything; it keeps the library silent by default
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...any) {}
+func (nopLogger) Info(msg string, args ...any)  {}
+func (nopLogger) Warn(msg string, args ...any)  {}
+func (nopLogger) Error(msg string, args ...any) {}
@@ -0,0 +1,33 @@
+package saga
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTooManySteps is returned when a saga would have more steps than the
+// limit set with WithMaxSteps
+var ErrTooManySteps = errors.New("too many steps")
+
+// WithMaxSteps limits sagas to n steps. Registering a definition, starting
+// a saga or adding steps to one with AddSteps returns ErrTooManySteps if the
+// saga would have more, which guards against steps added in a runaway loop
+// and malformed definitions. n must be positive; there is no limit by
+// default.
+func WithMaxSteps(n int) Option {
+	if n <= 0 {
+		panic("saga: max steps must be positive")
+	}
+	return func(o *Orchestrator) {
+		o.maxSteps = n
+	}
+}
+
+// checkStepCount returns an error wrapping ErrTooManySteps if n steps are
+// over the orchestrator's limit
+func (o *Orchestrator) checkStepCount(n int) error {
+	if o.maxSteps > 0 && n > o.maxSteps {
+		return fmt.Errorf("%w: %d, limit is %d", ErrTooManySteps, n, o.maxSteps)
+	}
+	return nil
+}
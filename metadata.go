@@ -0,0 +1,62 @@
+package saga
+
+import "context"
+
+type metadataKey struct{}
+
+// ContextWithMetadata returns a copy of ctx carrying a metadata value, such
+// as a request or tenant ID. Metadata in the context passed to StartSaga,
+// Builder.Execute or StartInstance is stored with the saga and restored in
+// the context of every step handler, including compensations and steps
+// re-delivered by recovery.
+func ContextWithMetadata(ctx context.Context, key, value string) context.Context {
+	existing, _ := ctx.Value(metadataKey{}).(map[string]string)
+	md := make(map[string]string, len(existing)+1)
+	for k, v := range existing {
+		md[k] = v
+	}
+	md[key] = value
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// MetadataValue returns the metadata value for key carried by ctx
+func MetadataValue(ctx context.Context, key string) (string, bool) {
+	md, _ := ctx.Value(metadataKey{}).(map[string]string)
+	value, ok := md[key]
+	return value, ok
+}
+
+// MetadataFromContext returns a copy of the metadata carried by ctx, or nil
+// if it carries none
+func MetadataFromContext(ctx context.Context) map[string]string {
+	md, _ := ctx.Value(metadataKey{}).(map[string]string)
+	return copyMetadata(md)
+}
+
+// withSagaMetadata restores a saga's metadata into ctx for its handlers.
+// The saga's values take precedence over ones already in ctx.
+func withSagaMetadata(ctx context.Context, md map[string]string) context.Context {
+	if len(md) == 0 {
+		return ctx
+	}
+	existing, _ := ctx.Value(metadataKey{}).(map[string]string)
+	merged := make(map[string]string, len(existing)+len(md))
+	for k, v := range existing {
+		merged[k] = v
+	}
+	for k, v := range md {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, metadataKey{}, merged)
+}
+
+func copyMetadata(md map[string]string) map[string]string {
+	if md == nil {
+		return nil
+	}
+	c := make(map[string]string, len(md))
+	for k, v := range md {
+		c[k] = v
+	}
+	return c
+}
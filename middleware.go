@@ -0,0 +1,26 @@
+package saga
+
+// StepMiddleware wraps a step handler with behavior shared by every step,
+// such as auth checks, metrics, tracing or a circuit breaker. It returns a
+// handler whose Execute and Compensate call next's.
+type StepMiddleware func(next StepHandler) StepHandler
+
+// WithStepMiddleware wraps every step handler the orchestrator runs, both
+// for Execute and Compensate, in middleware. The first middleware is the
+// outermost; calling WithStepMiddleware again adds more inside the earlier
+// ones. The wrapped handler runs with the step's context, so middleware can
+// use StepFromContext to tell steps apart, and a panic in middleware fails
+// the step like one in the handler.
+func WithStepMiddleware(middleware ...StepMiddleware) Option {
+	return func(o *Orchestrator) {
+		o.middleware = append(o.middleware, middleware...)
+	}
+}
+
+// wrapHandler applies the orchestrator's middleware to handler
+func (o *Orchestrator) wrapHandler(handler StepHandler) StepHandler {
+	for i := len(o.middleware) - 1; i >= 0; i-- {
+		handler = o.middleware[i](handler)
+	}
+	return handler
+}
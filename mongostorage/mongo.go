@@ -0,0 +1,657 @@
+// Package mongostorage provides a saga.Storage backed by a MongoDB
+// collection.
+package mongostorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	saga "github.com/andrewnguyen41/saga-go"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+var _ saga.Storage = (*MongoStorage)(nil)
+
+// MongoStorage implements saga.Storage on a single MongoDB collection. Each
+// saga is one document keyed by its ID, with its steps embedded in order in
+// the steps array, so every write to a saga and its steps is atomic. Data
+// maps are stored as BSON documents. Versions are checked in the update
+// filters, so a stale write matches nothing and fails with
+// saga.ErrVersionConflict.
+//
+// Saving a saga uses an update pipeline, which needs MongoDB 4.2 or later.
+//
+// MongoStorage implements none of the optional storage interfaces: it is not
+// a saga.Outbox, so it can't back an orchestrator created WithOutbox, nor a
+// saga.WebhookStore or saga.BatchStorage, so StartSagas saves sagas one at a
+// time.
+type MongoStorage struct {
+	coll *mongo.Collection
+	// See WithMaxDataSize; zero means unlimited
+	maxDataSize int
+}
+
+// Option configures a MongoStorage
+type Option func(*MongoStorage)
+
+// WithMaxDataSize makes SaveSaga, UpdateStep and CompleteStep return an
+// error wrapping saga.ErrDataTooLarge, and store nothing, if the data of
+// the saga or of one of its steps is over n bytes, measured by encoding it
+// as JSON. n must be positive; there is no limit by default, beyond
+// MongoDB's own 16MB per document.
+func WithMaxDataSize(n int) Option {
+	if n <= 0 {
+		panic("mongostorage: max data size must be positive")
+	}
+	return func(s *MongoStorage) {
+		s.maxDataSize = n
+	}
+}
+
+// NewMongoStorage stores sagas in coll. Call EnsureIndexes once before use.
+func NewMongoStorage(coll *mongo.Collection, opts ...Option) *MongoStorage {
+	s := &MongoStorage{coll: coll}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// EnsureIndexes creates the indexes the storage queries on, including the
+// unique index that rejects duplicate idempotency keys. Creating indexes
+// that already exist is a no-op, so it's safe to call on every start.
+func (s *MongoStorage) EnsureIndexes(ctx context.Context) error {
+	_, err := s.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "deadline", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "updated_at", Value: 1}}},
+		{Keys: bson.D{{Key: "name", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "tags.$**", Value: 1}}},
+		{Keys: bson.D{{Key: "steps.id", Value: 1}}},
+		{Keys: bson.D{{Key: "steps.status", Value: 1}, {Key: "steps.updated_at", Value: 1}}},
+		{
+			Keys: bson.D{{Key: "idempotency_key", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"idempotency_key": bson.M{"$type": "string"}}),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create indexes: %w", err)
+	}
+	return nil
+}
+
+func (s *MongoStorage) SaveSaga(ctx context.Context, sg *saga.Saga) error {
+	if err := saga.CheckDataSize(s.maxDataSize, sg); err != nil {
+		return err
+	}
+	doc, steps := sagaDocs(sg, time.Now())
+
+	if sg.Version == 0 {
+		_, err := s.coll.InsertOne(ctx, storedSaga{Saga: doc, Steps: steps})
+		if mongo.IsDuplicateKeyError(err) {
+			return s.duplicateSaga(ctx, sg.ID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to save saga: %w", err)
+		}
+		sg.Version = doc.Version
+		return nil
+	}
+
+	// Existing steps only change through UpdateStep/UpdateStepStatus, so a
+	// stale snapshot can't undo a status change made concurrently
+	res, err := s.coll.UpdateOne(ctx, bson.M{"_id": sg.ID, "version": sg.Version}, replaceSaga(doc, "$steps", steps))
+	if mongo.IsDuplicateKeyError(err) {
+		return saga.ErrDuplicateIdempotencyKey
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save saga: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return saga.ErrVersionConflict
+	}
+	sg.Version = doc.Version
+	return nil
+}
+
+// sagaDocs returns the documents SaveSaga writes for sg, with the saga's
+// version already incremented
+func sagaDocs(sg *saga.Saga, now time.Time) (sagaDoc, []stepDoc) {
+	sg.UpdatedAt = now
+	if sg.CreatedAt.IsZero() {
+		sg.CreatedAt = now
+	}
+
+	steps := make([]stepDoc, len(sg.Steps))
+	for i, step := range sg.Steps {
+		if step.CreatedAt.IsZero() {
+			step.CreatedAt = now
+		}
+		step.UpdatedAt = now
+		step.Version = 1
+		steps[i] = stepDoc(step)
+	}
+	doc := sagaDoc(*sg)
+	doc.Version = sg.Version + 1
+	return doc, steps
+}
+
+// replaceSaga is an update pipeline replacing the saga's fields with doc and
+// its steps with existing, followed by the steps in added the document
+// doesn't have yet
+func replaceSaga(doc sagaDoc, existing interface{}, added []stepDoc) bson.A {
+	newSteps := bson.M{"$filter": bson.M{
+		"input": bson.M{"$literal": added},
+		"cond":  bson.M{"$not": bson.A{bson.M{"$in": bson.A{"$$this.id", "$steps.id"}}}},
+	}}
+	return bson.A{
+		bson.M{"$replaceWith": bson.M{"$mergeObjects": bson.A{
+			bson.M{"$literal": doc},
+			bson.M{"steps": bson.M{"$concatArrays": bson.A{existing, newSteps}}},
+		}}},
+	}
+}
+
+// duplicateSaga returns the error for a new saga that collided with an
+// existing document: a version conflict if the saga itself exists, and a
+// duplicate idempotency key otherwise
+func (s *MongoStorage) duplicateSaga(ctx context.Context, id string) error {
+	n, err := s.coll.CountDocuments(ctx, bson.M{"_id": id}, options.Count().SetLimit(1))
+	if err != nil {
+		return fmt.Errorf("failed to get saga: %w", err)
+	}
+	if n > 0 {
+		return saga.ErrVersionConflict
+	}
+	return saga.ErrDuplicateIdempotencyKey
+}
+
+func (s *MongoStorage) GetSaga(ctx context.Context, id string) (*saga.Saga, error) {
+	return s.findSaga(ctx, bson.M{"_id": id})
+}
+
+func (s *MongoStorage) GetSagaByKey(ctx context.Context, key string) (*saga.Saga, error) {
+	return s.findSaga(ctx, bson.M{"idempotency_key": key})
+}
+
+func (s *MongoStorage) findSaga(ctx context.Context, filter bson.M) (*saga.Saga, error) {
+	var doc storedSaga
+	err := s.coll.FindOne(ctx, filter).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, saga.ErrSagaNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get saga: %w", err)
+	}
+	return doc.toSaga(), nil
+}
+
+func (s *MongoStorage) ListSagas(ctx context.Context, filter saga.SagaFilter) ([]saga.Saga, error) {
+	query := bson.M{}
+	if filter.Name != "" {
+		query["name"] = filter.Name
+	}
+	if filter.Status != "" {
+		query["status"] = filter.Status
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: 1}})
+	if filter.Limit > 0 {
+		opts.SetLimit(int64(filter.Limit))
+	}
+	return s.findSagas(ctx, query, opts)
+}
+
+// FindSagasByTag queries the tags field, which EnsureIndexes covers with a
+// wildcard index. Tag keys must therefore be valid field names: not empty,
+// without dots and not starting with "$".
+func (s *MongoStorage) FindSagasByTag(ctx context.Context, key, value string) ([]saga.Saga, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: 1}})
+	return s.findSagas(ctx, bson.M{"tags." + key: value}, opts)
+}
+
+func (s *MongoStorage) UpdateStep(ctx context.Context, step *saga.Step) error {
+	if err := saga.CheckDataSize(s.maxDataSize, nil, step); err != nil {
+		return err
+	}
+	now := time.Now()
+	step.UpdatedAt = now
+	doc := stepDoc(*step)
+	doc.Version = step.Version + 1
+
+	res, err := s.coll.UpdateOne(ctx,
+		bson.M{"_id": step.SagaID, "steps": bson.M{"$elemMatch": bson.M{"id": step.ID, "version": step.Version}}},
+		bson.M{"$set": bson.M{"steps.$": doc, "updated_at": now}})
+	if err != nil {
+		return fmt.Errorf("failed to update step: %w", err)
+	}
+	if res.MatchedCount > 0 {
+		step.Version = doc.Version
+		return nil
+	}
+
+	// A step added after the saga was saved, e.g. a compensation
+	res, err = s.coll.UpdateOne(ctx,
+		bson.M{"_id": step.SagaID, "steps.id": bson.M{"$ne": step.ID}},
+		bson.M{"$push": bson.M{"steps": doc}, "$set": bson.M{"updated_at": now}})
+	if err != nil {
+		return fmt.Errorf("failed to add step: %w", err)
+	}
+	if res.MatchedCount > 0 {
+		step.Version = doc.Version
+		return nil
+	}
+
+	n, err := s.coll.CountDocuments(ctx, bson.M{"_id": step.SagaID}, options.Count().SetLimit(1))
+	if err != nil {
+		return fmt.Errorf("failed to get saga: %w", err)
+	}
+	if n == 0 {
+		return saga.ErrSagaNotFound
+	}
+	return saga.ErrVersionConflict
+}
+
+// CompleteStep writes the step and its saga in a single update of the
+// saga's document, which MongoDB applies atomically
+func (s *MongoStorage) CompleteStep(ctx context.Context, step *saga.Step, sg *saga.Saga) error {
+	if err := saga.CheckDataSize(s.maxDataSize, sg, step); err != nil {
+		return err
+	}
+	now := time.Now()
+	doc, steps := sagaDocs(sg, now)
+	step.UpdatedAt = now
+	updated := stepDoc(*step)
+	updated.Version = step.Version + 1
+
+	existing := bson.M{"$map": bson.M{
+		"input": "$steps",
+		"in": bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{"$$this.id", step.ID}},
+			bson.M{"$literal": updated},
+			"$$this",
+		}},
+	}}
+	filter := bson.M{
+		"_id":     sg.ID,
+		"version": sg.Version,
+		"steps":   bson.M{"$elemMatch": bson.M{"id": step.ID, "version": step.Version}},
+	}
+	res, err := s.coll.UpdateOne(ctx, filter, replaceSaga(doc, existing, steps))
+	if mongo.IsDuplicateKeyError(err) {
+		return saga.ErrDuplicateIdempotencyKey
+	}
+	if err != nil {
+		return fmt.Errorf("failed to complete step: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		n, err := s.coll.CountDocuments(ctx, bson.M{"_id": sg.ID}, options.Count().SetLimit(1))
+		if err != nil {
+			return fmt.Errorf("failed to get saga: %w", err)
+		}
+		if n == 0 {
+			return saga.ErrSagaNotFound
+		}
+		return saga.ErrVersionConflict
+	}
+	step.Version = updated.Version
+	sg.Version = doc.Version
+	return nil
+}
+
+func (s *MongoStorage) UpdateStepStatus(ctx context.Context, id string, from, to saga.Status) (bool, error) {
+	return s.updateStepIf(ctx, id, from, bson.M{"steps.$.status": to})
+}
+
+func (s *MongoStorage) ClaimStep(ctx context.Context, id, owner string, expiry time.Time) (bool, error) {
+	var claimExpiry *time.Time
+	if !expiry.IsZero() {
+		claimExpiry = &expiry
+	}
+	return s.updateStepIf(ctx, id, saga.StatusPending, bson.M{
+		"steps.$.status":       saga.StatusProcessing,
+		"steps.$.claimed_by":   owner,
+		"steps.$.claim_expiry": claimExpiry,
+	})
+}
+
+// ClaimNextPendingStep picks ready steps from the running sagas and claims
+// the longest waiting one with ClaimStep. If another worker claims it
+// first, it tries the next.
+func (s *MongoStorage) ClaimNextPendingStep(ctx context.Context, owner string, expiry time.Time) (*saga.Step, error) {
+	sagas, err := s.findSagas(ctx, bson.M{"status": saga.StatusPending, "steps.status": saga.StatusPending})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending steps: %w", err)
+	}
+
+	var ready []*saga.Step
+	for i := range sagas {
+		for j := range sagas[i].Steps {
+			if step := &sagas[i].Steps[j]; saga.StepReady(&sagas[i], step) {
+				ready = append(ready, step)
+			}
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool {
+		return ready[i].UpdatedAt.Before(ready[j].UpdatedAt)
+	})
+
+	for _, step := range ready {
+		claimed, err := s.ClaimStep(ctx, step.ID, owner, expiry)
+		if errors.Is(err, saga.ErrStepNotFound) {
+			// Deleted in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if claimed {
+			return s.GetStep(ctx, step.ID)
+		}
+	}
+	return nil, saga.ErrStepNotFound
+}
+
+// updateStepIf applies set to a step currently in the from status, bumping
+// its version, and reports whether it was
+func (s *MongoStorage) updateStepIf(ctx context.Context, id string, from saga.Status, set bson.M) (bool, error) {
+	now := time.Now()
+	set["steps.$.updated_at"] = now
+	set["updated_at"] = now
+
+	res, err := s.coll.UpdateOne(ctx,
+		bson.M{"steps": bson.M{"$elemMatch": bson.M{"id": id, "status": from}}},
+		bson.M{"$set": set, "$inc": bson.M{"steps.$.version": 1}})
+	if err != nil {
+		return false, fmt.Errorf("failed to update step status: %w", err)
+	}
+	if res.MatchedCount > 0 {
+		return true, nil
+	}
+
+	n, err := s.coll.CountDocuments(ctx, bson.M{"steps.id": id}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, fmt.Errorf("failed to get step: %w", err)
+	}
+	if n == 0 {
+		return false, saga.ErrStepNotFound
+	}
+	return false, nil
+}
+
+func (s *MongoStorage) GetStep(ctx context.Context, id string) (*saga.Step, error) {
+	var doc storedSaga
+	err := s.coll.FindOne(ctx, bson.M{"steps.id": id},
+		options.FindOne().SetProjection(bson.M{"steps": bson.M{"$elemMatch": bson.M{"id": id}}})).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) || (err == nil && len(doc.Steps) == 0) {
+		return nil, saga.ErrStepNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get step: %w", err)
+	}
+	step := doc.Steps[0].toStep()
+	return &step, nil
+}
+
+func (s *MongoStorage) GetStepsBySaga(ctx context.Context, sagaID string) ([]saga.Step, error) {
+	var doc storedSaga
+	err := s.coll.FindOne(ctx, bson.M{"_id": sagaID},
+		options.FindOne().SetProjection(bson.M{"steps": 1})).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get steps: %w", err)
+	}
+
+	var steps []saga.Step
+	for _, step := range doc.Steps {
+		steps = append(steps, step.toStep())
+	}
+	return steps, nil
+}
+
+func (s *MongoStorage) GetPendingSteps(ctx context.Context) ([]saga.Step, error) {
+	steps, err := s.findSteps(ctx, bson.M{"steps.status": saga.StatusPending}, func(step *stepDoc) bool {
+		return step.Status == saga.StatusPending
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending steps: %w", err)
+	}
+	return steps, nil
+}
+
+func (s *MongoStorage) GetStuckSteps(ctx context.Context, timeout time.Duration) ([]saga.Step, error) {
+	now := time.Now()
+	cutoff := now.Add(-timeout)
+
+	// Steps of finished or failed sagas are never going to run, and those
+	// of paused sagas wait for ResumeSaga. A processing step with a claim is
+	// only stuck once the claim has expired.
+	filter := bson.M{
+		"status": saga.StatusPending,
+		"steps": bson.M{"$elemMatch": bson.M{"$or": bson.A{
+			bson.M{"status": saga.StatusPending, "updated_at": bson.M{"$lt": cutoff}},
+			bson.M{"status": saga.StatusProcessing, "claim_expiry": bson.M{"$lt": now}},
+			bson.M{"status": saga.StatusProcessing, "claim_expiry": nil, "started_at": bson.M{"$lt": cutoff}},
+			bson.M{"status": saga.StatusProcessing, "claim_expiry": nil, "started_at": nil, "updated_at": bson.M{"$lt": cutoff}},
+		}}},
+	}
+	steps, err := s.findSteps(ctx, filter, func(step *stepDoc) bool {
+		switch step.Status {
+		case saga.StatusPending:
+			return step.UpdatedAt.Before(cutoff)
+		case saga.StatusProcessing:
+			if step.ClaimExpiry != nil {
+				return step.ClaimExpiry.Before(now)
+			}
+			startedAt := step.UpdatedAt
+			if step.StartedAt != nil {
+				startedAt = *step.StartedAt
+			}
+			return startedAt.Before(cutoff)
+		}
+		return false
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stuck steps: %w", err)
+	}
+	return steps, nil
+}
+
+func (s *MongoStorage) GetExpiredSagas(ctx context.Context, now time.Time) ([]saga.Saga, error) {
+	sagas, err := s.findSagas(ctx, bson.M{"status": saga.StatusPending, "deadline": bson.M{"$lt": now}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get expired sagas: %w", err)
+	}
+	return sagas, nil
+}
+
+func (s *MongoStorage) GetStuckCompensations(ctx context.Context, timeout time.Duration) ([]saga.Saga, error) {
+	sagas, err := s.findSagas(ctx, bson.M{
+		"status":     saga.StatusCompensating,
+		"updated_at": bson.M{"$lt": time.Now().Add(-timeout)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stuck compensations: %w", err)
+	}
+	return sagas, nil
+}
+
+func (s *MongoStorage) DeleteSaga(ctx context.Context, id string) error {
+	if _, err := s.coll.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+		return fmt.Errorf("failed to delete saga: %w", err)
+	}
+	return nil
+}
+
+func (s *MongoStorage) PurgeCompletedBefore(ctx context.Context, before time.Time) (int, error) {
+	res, err := s.coll.DeleteMany(ctx, bson.M{
+		"status": bson.M{"$in": bson.A{
+			saga.StatusCompleted, saga.StatusFailed, saga.StatusRolledBack, saga.StatusCanceled,
+		}},
+		"updated_at": bson.M{"$lt": before},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge sagas: %w", err)
+	}
+	return int(res.DeletedCount), nil
+}
+
+func (s *MongoStorage) findSagas(ctx context.Context, filter bson.M, opts ...options.Lister[options.FindOptions]) ([]saga.Saga, error) {
+	cursor, err := s.coll.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find sagas: %w", err)
+	}
+
+	var docs []storedSaga
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, fmt.Errorf("failed to read sagas: %w", err)
+	}
+	sagas := make([]saga.Saga, 0, len(docs))
+	for i := range docs {
+		sagas = append(sagas, *docs[i].toSaga())
+	}
+	return sagas, nil
+}
+
+// findSteps returns the steps that match keep in the sagas matching filter
+func (s *MongoStorage) findSteps(ctx context.Context, filter bson.M, keep func(*stepDoc) bool) ([]saga.Step, error) {
+	cursor, err := s.coll.Find(ctx, filter, options.Find().SetProjection(bson.M{"steps": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []storedSaga
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	var steps []saga.Step
+	for _, doc := range docs {
+		for i := range doc.Steps {
+			if keep(&doc.Steps[i]) {
+				steps = append(steps, doc.Steps[i].toStep())
+			}
+		}
+	}
+	return steps, nil
+}
+
+// sagaDoc is the BSON layout of a saga's own fields. It has the same fields
+// as saga.Saga so the two convert directly; steps are stored separately in
+// the document's steps array.
+type sagaDoc struct {
+	ID             string                 `bson:"_id"`
+	Name           string                 `bson:"name"`
+	Status         saga.Status            `bson:"status"`
+	Steps          []saga.Step            `bson:"-"`
+	Data           map[string]interface{} `bson:"data,omitempty"`
+	Error          string                 `bson:"error,omitempty"`
+	FailedStepID   string                 `bson:"failed_step_id,omitempty"`
+	FinalStatus    saga.Status            `bson:"final_status,omitempty"`
+	Metadata       map[string]string      `bson:"metadata,omitempty"`
+	Tags           map[string]string      `bson:"tags,omitempty"`
+	IdempotencyKey string                 `bson:"idempotency_key,omitempty"`
+	ParentSagaID   string                 `bson:"parent_saga_id,omitempty"`
+	ParentStepID   string                 `bson:"parent_step_id,omitempty"`
+	Deadline       *time.Time             `bson:"deadline,omitempty"`
+	FailurePolicy  saga.FailurePolicy     `bson:"failure_policy,omitempty"`
+	TimeoutPolicy  saga.TimeoutPolicy     `bson:"timeout_policy,omitempty"`
+	FinishedAt     *time.Time             `bson:"finished_at,omitempty"`
+	Version        int                    `bson:"version"`
+	CreatedAt      time.Time              `bson:"created_at"`
+	UpdatedAt      time.Time              `bson:"updated_at"`
+}
+
+// stepDoc is the BSON layout of an embedded step, with the same fields as
+// saga.Step
+type stepDoc struct {
+	ID                   string                 `bson:"id"`
+	SagaID               string                 `bson:"saga_id"`
+	Name                 string                 `bson:"name"`
+	Status               saga.Status            `bson:"status"`
+	Data                 map[string]interface{} `bson:"data,omitempty"`
+	Error                string                 `bson:"error,omitempty"`
+	Failure              *saga.StepFailure      `bson:"failure,omitempty"`
+	InputData            map[string]interface{} `bson:"input_data,omitempty"`
+	OutputData           map[string]interface{} `bson:"output_data,omitempty"`
+	DependsOn            []string               `bson:"depends_on,omitempty"`
+	CompensationOrder    int                    `bson:"compensation_order,omitempty"`
+	NoCompensation       bool                   `bson:"no_compensation,omitempty"`
+	CompensateFailedStep bool                   `bson:"compensate_failed_step,omitempty"`
+	Resource             string                 `bson:"resource,omitempty"`
+	CompensateID         string                 `bson:"compensate_id,omitempty"`
+	Attempts             int                    `bson:"attempts,omitempty"`
+	RecoveryAttempts     int                    `bson:"recovery_attempts,omitempty"`
+	LastRecoveredAt      *time.Time             `bson:"last_recovered_at,omitempty"`
+	ClaimedBy            string                 `bson:"claimed_by,omitempty"`
+	ClaimExpiry          *time.Time             `bson:"claim_expiry"`
+	ChildSagaIDs         []string               `bson:"child_saga_ids,omitempty"`
+	StartedAt            *time.Time             `bson:"started_at"`
+	CompletedAt          *time.Time             `bson:"completed_at,omitempty"`
+	Version              int                    `bson:"version"`
+	CreatedAt            time.Time              `bson:"created_at"`
+	UpdatedAt            time.Time              `bson:"updated_at"`
+}
+
+// storedSaga decodes a whole saga document
+type storedSaga struct {
+	Saga  sagaDoc   `bson:",inline"`
+	Steps []stepDoc `bson:"steps"`
+}
+
+func (d *storedSaga) toSaga() *saga.Saga {
+	sg := saga.Saga(d.Saga)
+	sg.Data = normalizeMap(sg.Data)
+	sg.Steps = make([]saga.Step, 0, len(d.Steps))
+	for _, step := range d.Steps {
+		sg.Steps = append(sg.Steps, step.toStep())
+	}
+	return &sg
+}
+
+func (d stepDoc) toStep() saga.Step {
+	step := saga.Step(d)
+	step.Data = normalizeMap(step.Data)
+	step.InputData = normalizeMap(step.InputData)
+	step.OutputData = normalizeMap(step.OutputData)
+	return step
+}
+
+// normalizeMap converts the BSON types the driver decodes nested values
+// into back to the plain Go types handlers expect
+func normalizeMap(m map[string]interface{}) map[string]interface{} {
+	for k, v := range m {
+		m[k] = normalize(v)
+	}
+	return m
+}
+
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.D:
+		m := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			m[e.Key] = normalize(e.Value)
+		}
+		return m
+	case bson.M:
+		return normalizeMap(map[string]interface{}(v))
+	case bson.A:
+		values := make([]interface{}, len(v))
+		for i, e := range v {
+			values[i] = normalize(e)
+		}
+		return values
+	case bson.DateTime:
+		return v.Time()
+	default:
+		return v
+	}
+}
@@ -0,0 +1,61 @@
+package mongostorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	saga "github.com/andrewnguyen41/saga-go"
+	"github.com/andrewnguyen41/saga-go/storagetest"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// newTestStorage returns storage on a fresh collection of the server at
+// MONGO_URI, skipping the test if it isn't set
+func newTestStorage(t *testing.T, opts ...Option) *MongoStorage {
+	t.Helper()
+
+	uri := os.Getenv("MONGO_URI")
+	if uri == "" {
+		t.Skip("MONGO_URI not set")
+	}
+	client, err := mongo.Connect(options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	coll := client.Database("saga_test").Collection(fmt.Sprintf("sagas_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		coll.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+
+	storage := NewMongoStorage(coll, opts...)
+	if err := storage.EnsureIndexes(context.Background()); err != nil {
+		t.Fatalf("Failed to create indexes: %v", err)
+	}
+	return storage
+}
+
+func TestMongoConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) saga.Storage { return newTestStorage(t) })
+}
+
+func TestMongoMaxDataSize(t *testing.T) {
+	storage := newTestStorage(t, WithMaxDataSize(16))
+
+	sg := &saga.Saga{
+		ID:     "saga-1",
+		Status: saga.StatusPending,
+		Data:   map[string]interface{}{"blob": "far more than sixteen bytes"},
+	}
+	if err := storage.SaveSaga(context.Background(), sg); !errors.Is(err, saga.ErrDataTooLarge) {
+		t.Fatalf("Expected ErrDataTooLarge, got %v", err)
+	}
+	if _, err := storage.GetSaga(context.Background(), "saga-1"); err == nil {
+		t.Error("Expected nothing to be stored")
+	}
+}
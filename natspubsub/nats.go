@@ -0,0 +1,219 @@
+// Package natspubsub provides a saga.PubSub backed by NATS JetStream.
+package natspubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	saga "github.com/andrewnguyen41/saga-go"
+	"github.com/nats-io/nats.go"
+)
+
+var _ saga.PubSub = (*NatsPubSub)(nil)
+
+// maxDeliver caps how often JetStream delivers a message whose handler
+// keeps failing, and nakDelay spaces out those redeliveries
+const (
+	maxDeliver = 5
+	nakDelay   = time.Second
+)
+
+// message is the part of *nats.Msg a handler acknowledges through
+type message interface {
+	Ack(opts ...nats.AckOpt) error
+	Nak(opts ...nats.AckOpt) error
+	NakWithDelay(delay time.Duration, opts ...nats.AckOpt) error
+	Term(opts ...nats.AckOpt) error
+}
+
+// NatsPubSub implements saga.PubSub using JetStream. Each topic is published
+// as a subject on the given stream, which must already exist and capture the
+// subjects in use. Subscribers share a durable queue consumer per topic, so
+// orchestrator instances split the work instead of each processing every
+// message.
+type NatsPubSub struct {
+	js     nats.JetStreamContext
+	stream string
+	codec  saga.Codec
+	logger saga.Logger
+
+	mu     sync.Mutex
+	subs   []*nats.Subscription
+	wg     sync.WaitGroup
+	done   chan struct{}
+	closed bool
+}
+
+// Option configures a NatsPubSub
+type Option func(*NatsPubSub)
+
+// WithCodec sets how messages are encoded; the default is saga.JSONCodec.
+// Every publisher and subscriber of a subject must use the same codec.
+func WithCodec(codec saga.Codec) Option {
+	return func(n *NatsPubSub) {
+		n.codec = codec
+	}
+}
+
+// WithLogger sets the logger used for malformed messages, handler panics and
+// ack failures. Nothing is logged by default.
+func WithLogger(logger saga.Logger) Option {
+	return func(n *NatsPubSub) {
+		n.logger = logger
+	}
+}
+
+// NewNatsPubSub creates a pubsub that publishes to and consumes from stream
+func NewNatsPubSub(js nats.JetStreamContext, stream string, opts ...Option) *NatsPubSub {
+	n := &NatsPubSub{
+		js:     js,
+		stream: stream,
+		codec:  saga.JSONCodec{},
+		logger: nopLogger{},
+		done:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	return n
+}
+
+func (n *NatsPubSub) Publish(ctx context.Context, topic string, msg saga.Message) error {
+	n.mu.Lock()
+	closed := n.closed
+	n.mu.Unlock()
+	if closed {
+		return saga.ErrClosed
+	}
+
+	data, err := n.codec.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+
+	if _, err := n.js.Publish(topic, data, nats.Context(ctx), nats.ExpectStream(n.stream)); err != nil {
+		return fmt.Errorf("failed to publish to %s: %w", topic, err)
+	}
+	return nil
+}
+
+// Subscribe consumes topic through a durable consumer on the stream. Each
+// message is acked once the handler succeeds; if the handler returns an
+// error or panics the message is nak'd so JetStream delivers it again, up
+// to five deliveries in total.
+func (n *NatsPubSub) Subscribe(ctx context.Context, topic string, handler func(saga.Message) error) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return saga.ErrClosed
+	}
+
+	durable := consumerName(n.stream, topic)
+	sub, err := n.js.QueueSubscribe(topic, durable, func(m *nats.Msg) {
+		n.handle(m, m.Subject, m.Data, handler)
+	},
+		nats.Durable(durable),
+		nats.BindStream(n.stream),
+		nats.ManualAck(),
+		nats.AckExplicit(),
+		nats.DeliverAll(),
+		nats.MaxDeliver(maxDeliver),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", topic, err)
+	}
+	n.subs = append(n.subs, sub)
+
+	// Stop consuming when the subscriber's context is done
+	go func() {
+		select {
+		case <-ctx.Done():
+			sub.Drain()
+		case <-n.done:
+		}
+	}()
+	return nil
+}
+
+// handle runs handler on the message received on subject with data, acking
+// it only once the handler has returned successfully
+func (n *NatsPubSub) handle(m message, subject string, data []byte, handler func(saga.Message) error) {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		m.Nak() // Let another subscriber take it
+		return
+	}
+	n.wg.Add(1)
+	n.mu.Unlock()
+	defer n.wg.Done()
+
+	var msg saga.Message
+	if err := n.codec.Unmarshal(data, &msg); err != nil {
+		// Redelivering a malformed message won't help
+		n.logger.Error("Dropping malformed nats message", "subject", subject, "error", err)
+		m.Term()
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			n.logger.Error("Handler panicked, requesting redelivery",
+				"subject", subject, "saga_id", msg.SagaID, "step_id", msg.StepID, "panic", r)
+			m.Nak()
+		}
+	}()
+
+	if err := handler(msg); err != nil {
+		m.NakWithDelay(nakDelay)
+		return
+	}
+
+	if err := m.Ack(); err != nil {
+		n.logger.Error("Failed to ack nats message",
+			"subject", subject, "saga_id", msg.SagaID, "step_id", msg.StepID, "error", err)
+	}
+}
+
+// Close drains all subscriptions and waits for in-progress handlers. The
+// JetStream connection itself is left open since it belongs to the caller.
+func (n *NatsPubSub) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	subs := n.subs
+	n.mu.Unlock()
+	close(n.done)
+
+	var errs []error
+	for _, sub := range subs {
+		if err := sub.Drain(); err != nil && !errors.Is(err, nats.ErrConnectionClosed) && !errors.Is(err, nats.ErrBadSubscription) {
+			errs = append(errs, err)
+		}
+	}
+	n.wg.Wait()
+	return errors.Join(errs...)
+}
+
+// consumerName derives a durable consumer name from the stream and topic.
+// Durable names may not contain '.', '*' or '>'.
+func consumerName(stream, topic string) string {
+	name := stream + "_" + topic
+	return strings.NewReplacer(".", "_", "*", "_", ">", "_").Replace(name)
+}
+
+// nopLogger discards everything; it keeps the pubsub silent by default
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...any) {}
+func (nopLogger) Info(msg string, args ...any)  {}
+func (nopLogger) Warn(msg string, args ...any)  {}
+func (nopLogger) Error(msg string, args ...any) {}
@@ -0,0 +1,137 @@
+package natspubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	saga "github.com/andrewnguyen41/saga-go"
+	"github.com/nats-io/nats.go"
+)
+
+// fakeMsg records how a message was acknowledged, in order
+type fakeMsg struct {
+	mu    sync.Mutex
+	acks  []string
+	delay time.Duration
+}
+
+func (m *fakeMsg) record(ack string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.acks = append(m.acks, ack)
+	return nil
+}
+
+func (m *fakeMsg) Ack(opts ...nats.AckOpt) error  { return m.record("ack") }
+func (m *fakeMsg) Nak(opts ...nats.AckOpt) error  { return m.record("nak") }
+func (m *fakeMsg) Term(opts ...nats.AckOpt) error { return m.record("term") }
+
+func (m *fakeMsg) NakWithDelay(delay time.Duration, opts ...nats.AckOpt) error {
+	m.mu.Lock()
+	m.delay = delay
+	m.mu.Unlock()
+	return m.record("nak")
+}
+
+func (m *fakeMsg) recorded() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.acks...)
+}
+
+func encode(t *testing.T, msg saga.Message) []byte {
+	t.Helper()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Failed to encode message: %v", err)
+	}
+	return data
+}
+
+func TestNatsAckAfterHandler(t *testing.T) {
+	n := NewNatsPubSub(nil, "SAGAS")
+	m := &fakeMsg{}
+
+	var received saga.Message
+	n.handle(m, "saga_events", encode(t, saga.Message{Type: "step_execute", SagaID: "saga-1", StepID: "step-1"}), func(msg saga.Message) error {
+		if acks := m.recorded(); len(acks) != 0 {
+			t.Errorf("Expected nothing acked while the handler runs, got %v", acks)
+		}
+		received = msg
+		return nil
+	})
+
+	if received.SagaID != "saga-1" || received.StepID != "step-1" {
+		t.Errorf("Expected the decoded message, got %+v", received)
+	}
+	if acks := m.recorded(); len(acks) != 1 || acks[0] != "ack" {
+		t.Errorf("Expected one ack once the handler returned, got %v", acks)
+	}
+}
+
+func TestNatsRedelivery(t *testing.T) {
+	n := NewNatsPubSub(nil, "SAGAS")
+	data := encode(t, saga.Message{Type: "step_execute", SagaID: "saga-1"})
+
+	// A failing handler gets the message again after nakDelay
+	failed := &fakeMsg{}
+	n.handle(failed, "saga_events", data, func(saga.Message) error {
+		return errors.New("storage unavailable")
+	})
+	if acks := failed.recorded(); len(acks) != 1 || acks[0] != "nak" || failed.delay != nakDelay {
+		t.Errorf("Expected a delayed nak for a failed handler, got %v after %s", acks, failed.delay)
+	}
+
+	// A panic is recovered and the message redelivered, not acked
+	panicked := &fakeMsg{}
+	n.handle(panicked, "saga_events", data, func(saga.Message) error {
+		panic("handler bug")
+	})
+	if acks := panicked.recorded(); len(acks) != 1 || acks[0] != "nak" {
+		t.Errorf("Expected a nak for a panicking handler, got %v", acks)
+	}
+
+	// A malformed message is terminated without reaching the handler
+	malformed := &fakeMsg{}
+	n.handle(malformed, "saga_events", []byte("{not json"), func(saga.Message) error {
+		t.Error("Expected the handler not to see a malformed message")
+		return nil
+	})
+	if acks := malformed.recorded(); len(acks) != 1 || acks[0] != "term" {
+		t.Errorf("Expected a malformed message to be terminated, got %v", acks)
+	}
+}
+
+func TestNatsClosed(t *testing.T) {
+	n := NewNatsPubSub(nil, "SAGAS")
+	if err := n.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	// Messages still arriving are left for another subscriber
+	m := &fakeMsg{}
+	n.handle(m, "saga_events", encode(t, saga.Message{SagaID: "saga-1"}), func(saga.Message) error {
+		t.Error("Expected a closed pubsub not to run the handler")
+		return nil
+	})
+	if acks := m.recorded(); len(acks) != 1 || acks[0] != "nak" {
+		t.Errorf("Expected a nak once closed, got %v", acks)
+	}
+
+	if err := n.Publish(context.Background(), "saga_events", saga.Message{}); !errors.Is(err, saga.ErrClosed) {
+		t.Errorf("Expected ErrClosed from Publish, got %v", err)
+	}
+}
+
+func TestConsumerName(t *testing.T) {
+	if name := consumerName("SAGAS", "saga_events.3"); name != "SAGAS_saga_events_3" {
+		t.Errorf("Expected dots replaced, got %s", name)
+	}
+	if name := consumerName("SAGAS", "saga.*.>"); name != "SAGAS_saga____" {
+		t.Errorf("Expected wildcards replaced, got %s", name)
+	}
+}
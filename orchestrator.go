@@ -2,7 +2,11 @@ package saga
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -10,72 +14,615 @@ import (
 
 // Orchestrator manages saga execution
 type Orchestrator struct {
-	storage  Storage
-	pubsub   PubSub
-	handlers map[string]StepHandler
+	storage Storage
+	pubsub  PubSub
+	logger  Logger
+	events  EventStore
+
+	deadLetters   DeadLetterHandler
+	messageErrors MessageErrorHandler
+	newID         func() string
+	now           func() time.Time
+
+	// Topic step messages are exchanged on, and the one finished sagas are
+	// announced on
+	topic           string
+	completionTopic string
+	// See WithShards
+	shards int
+
+	// See WithMaxAttempts and WithDefaultRetryable
+	maxAttempts          int
+	plainErrorsPermanent bool
+
+	scopedData bool
+
+	// See WithStepMiddleware
+	middleware []StepMiddleware
+
+	// See WithMaxDataSize; zero means unlimited
+	maxDataSize int
+	// See WithMaxSteps; zero means unlimited
+	maxSteps int
+
+	// Set with WithReservedKeyPrefix, on top of ReservedKeyPrefix
+	reservedPrefixes []string
+
+	// See WithHandlerValidation
+	validateHandlers bool
+
+	// See WithContextDeadlines
+	contextDeadlines bool
+
+	// Set with WithOutbox to schedule next steps through the storage
+	useOutbox bool
+	outbox    Outbox
+
+	// Deliveries of each step that found no handler, once limited
+	missingLimit    int
+	missingMu       sync.Mutex
+	missingHandlers map[string]int
+
+	// Handlers can be registered while steps run, e.g. by AddSteps
+	handlersMu sync.RWMutex
+	handlers   map[handlerKey]StepHandler
+
+	definitionsMu sync.RWMutex
+	definitions   map[string]*SagaDefinition
+
+	locksMu   sync.Mutex
+	sagaLocks map[string]*sagaLock
+
+	// Callers blocked in WaitForCompletion or WatchSaga, by saga ID
+	waitersMu sync.Mutex
+	waiters   map[string][]chan Status
+
+	// Listener state for graceful shutdown
+	listenerMu   sync.Mutex
+	listening    bool
+	shuttingDown bool
+	inFlight     sync.WaitGroup
+
+	// Steps currently being executed or compensated
+	inFlightSteps atomic.Int64
+
+	// Cancels the handlers of the steps executing on this orchestrator, by
+	// step ID; see FailFast
+	runningMu sync.Mutex
+	running   map[string]context.CancelCauseFunc
+
+	// Circuit breakers by resource; see WithCircuitBreaker
+	breakers map[string]*circuitBreaker
+
+	// Limits concurrently handled step messages; nil means unlimited
+	slots chan struct{}
+
+	// Recorded on the steps this orchestrator claims
+	instanceID string
+	claimTTL   time.Duration
+}
+
+// handlerKey identifies a handler by saga and step name. Handlers registered
+// for every saga type have an empty saga name.
+type handlerKey struct {
+	saga string
+	step string
+}
+
+// sagaLock serializes updates to a single saga
+type sagaLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// Option configures an Orchestrator
+type Option func(*Orchestrator)
+
+// WithLogger sets the logger used for step failures, finished sagas and
+// listener errors. Nothing is logged by default.
+func WithLogger(logger Logger) Option {
+	return func(o *Orchestrator) {
+		o.logger = logger
+	}
+}
+
+// WithMaxConcurrency caps how many step messages the listener executes or
+// compensates at once. Messages beyond the limit wait for a free slot
+// instead of running, so a burst of sagas can't overwhelm the services the
+// handlers call. n must be positive.
+func WithMaxConcurrency(n int) Option {
+	if n <= 0 {
+		panic("saga: max concurrency must be positive")
+	}
+	return func(o *Orchestrator) {
+		o.slots = make(chan struct{}, n)
+	}
+}
+
+// WithInstanceID sets the name this orchestrator records as ClaimedBy on the
+// steps it runs, e.g. the host or pod name. The default is a random UUID.
+func WithInstanceID(id string) Option {
+	return func(o *Orchestrator) {
+		o.instanceID = id
+	}
+}
+
+// WithClaimTTL sets how long a claim on a step lasts. A step still
+// processing once its claim has expired is considered abandoned by its
+// worker, and recovery resets it so another worker can claim it, however
+// recently it started. Without a TTL, recovery goes by its step timeout.
+// d must be positive.
+func WithClaimTTL(d time.Duration) Option {
+	if d <= 0 {
+		panic("saga: claim TTL must be positive")
+	}
+	return func(o *Orchestrator) {
+		o.claimTTL = d
+	}
+}
+
+// Message types published when a saga finishes
+const (
+	MessageSagaCompleted  = "saga_completed"
+	MessageSagaFailed     = "saga_failed"
+	MessageSagaRolledBack = "saga_rolled_back"
+	MessageSagaCanceled   = "saga_canceled"
+)
+
+// DefaultTopic is the topic orchestrators and recovery managers use unless
+// configured otherwise
+const DefaultTopic = "saga_events"
+
+// WithTopic sets the topic the orchestrator publishes its step messages to
+// and listens on, so several saga systems or environments can share a
+// broker. Every orchestrator and recovery manager of one system must use
+// the same topic; see WithRecoveryTopic. The default is DefaultTopic.
+func WithTopic(topic string) Option {
+	if topic == "" {
+		panic("saga: topic must not be empty")
+	}
+	return func(o *Orchestrator) {
+		o.topic = topic
+	}
 }
 
-func NewOrchestrator(storage Storage, pubsub PubSub) *Orchestrator {
-	return &Orchestrator{
-		storage:  storage,
-		pubsub:   pubsub,
-		handlers: make(map[string]StepHandler),
+// WithCompletionTopic sets the topic on which a message is published when a
+// saga finishes, with MessageSagaCompleted, MessageSagaFailed,
+// MessageSagaRolledBack or MessageSagaCanceled as its type, so other
+// services can react without polling. The default is the orchestrator's own
+// topic; see WithTopic.
+func WithCompletionTopic(topic string) Option {
+	return func(o *Orchestrator) {
+		o.completionTopic = topic
 	}
 }
 
-// RegisterHandler registers a step handler
+// WithIDGenerator sets the function that generates saga and step IDs, e.g.
+// to use ULIDs so IDs sort by creation time. IDs must be unique; the
+// default is a random UUID.
+func WithIDGenerator(generate func() string) Option {
+	return func(o *Orchestrator) {
+		o.newID = generate
+	}
+}
+
+// WithClock sets the function the orchestrator reads the current time
+// from, for timestamps, deadlines and claim expiries, e.g. a fake clock in
+// tests. Storage keeps its own timestamps; see WithMemoryClock. The default
+// is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(o *Orchestrator) {
+		o.now = now
+	}
+}
+
+// WithContextDeadlines makes a saga started with a context that has a
+// deadline, e.g. a request that must be done within 30 seconds, take that
+// deadline as its own, unless it already has an earlier one. Once it passes
+// the saga is failed and rolled back like with Builder.WithDeadline. By
+// default the context only bounds the start itself.
+func WithContextDeadlines() Option {
+	return func(o *Orchestrator) {
+		o.contextDeadlines = true
+	}
+}
+
+// WithMissingHandlerLimit fails a step, and compensates its saga, once it
+// has been delivered n times to this orchestrator without a registered
+// handler. By default such steps stay pending so another instance that has
+// the handler can pick them up, which leaves the saga stuck if none does.
+// n must be positive.
+func WithMissingHandlerLimit(n int) Option {
+	if n <= 0 {
+		panic("saga: missing handler limit must be positive")
+	}
+	return func(o *Orchestrator) {
+		o.missingLimit = n
+	}
+}
+
+// MessageErrorHandler is called when the listener fails to handle a
+// message, e.g. because storage was unreachable, before the message is
+// handed back to the pubsub for redelivery
+type MessageErrorHandler func(ctx context.Context, msg Message, err error)
+
+// WithMessageErrorHandler sets the handler called for messages the listener
+// fails to handle, e.g. to count them or alert an operator. Without one,
+// such failures are only logged.
+func WithMessageErrorHandler(handler MessageErrorHandler) Option {
+	return func(o *Orchestrator) {
+		o.messageErrors = handler
+	}
+}
+
+// NewOrchestrator creates an orchestrator that keeps sagas in storage and
+// exchanges step messages over pubsub. A nil pubsub runs it without a
+// broker; see RunWorker.
+func NewOrchestrator(storage Storage, pubsub PubSub, opts ...Option) *Orchestrator {
+	o := &Orchestrator{
+		storage:     storage,
+		pubsub:      pubsub,
+		handlers:    make(map[handlerKey]StepHandler),
+		logger:      nopLogger{},
+		newID:       func() string { return uuid.New().String() },
+		now:         time.Now,
+		maxAttempts: 1,
+		sagaLocks:   make(map[string]*sagaLock),
+		waiters:     make(map[string][]chan Status),
+		running:     make(map[string]context.CancelCauseFunc),
+
+		topic:           DefaultTopic,
+		shards:          1,
+		instanceID:      uuid.New().String(),
+		definitions:     make(map[string]*SagaDefinition),
+		missingHandlers: make(map[string]int),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.pubsub == nil {
+		o.pubsub = nopPubSub{}
+	}
+	if o.completionTopic == "" {
+		o.completionTopic = o.topic
+	}
+	if o.useOutbox {
+		outbox, ok := storage.(Outbox)
+		if !ok {
+			panic("saga: WithOutbox requires a storage that implements Outbox")
+		}
+		o.outbox = outbox
+	}
+	return o
+}
+
+// lockSaga acquires the update lock for a saga and returns its release func.
+// Every read-modify-write of a saga's state happens under this lock so that
+// concurrently executing steps don't lose each other's changes.
+func (o *Orchestrator) lockSaga(sagaID string) func() {
+	o.locksMu.Lock()
+	l, exists := o.sagaLocks[sagaID]
+	if !exists {
+		l = &sagaLock{}
+		o.sagaLocks[sagaID] = l
+	}
+	l.refs++
+	o.locksMu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+
+		o.locksMu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(o.sagaLocks, sagaID)
+		}
+		o.locksMu.Unlock()
+	}
+}
+
+// RegisterHandler registers a handler for steps with this name in every
+// saga type. Handlers registered for a specific saga with
+// RegisterSagaHandler take precedence.
 func (o *Orchestrator) RegisterHandler(stepName string, handler StepHandler) {
-	o.handlers[stepName] = handler
+	o.RegisterSagaHandler("", stepName, handler)
+}
+
+// RegisterSagaHandler registers a handler for a step of the named saga type,
+// so different saga types can have steps with the same name. Builder
+// registers its handlers this way.
+func (o *Orchestrator) RegisterSagaHandler(sagaName, stepName string, handler StepHandler) {
+	o.handlersMu.Lock()
+	defer o.handlersMu.Unlock()
+	o.handlers[handlerKey{saga: sagaName, step: stepName}] = handler
+}
+
+// handler returns the handler for a step of the named saga, falling back to
+// one registered for all sagas
+func (o *Orchestrator) handler(sagaName, stepName string) (StepHandler, bool) {
+	o.handlersMu.RLock()
+	defer o.handlersMu.RUnlock()
+	if handler, exists := o.handlers[handlerKey{saga: sagaName, step: stepName}]; exists {
+		return handler, true
+	}
+	handler, exists := o.handlers[handlerKey{step: stepName}]
+	return handler, exists
 }
 
-// StartSaga creates and starts a new saga
+// sagaOptions holds per-instance settings for starting a saga
+type sagaOptions struct {
+	deadline *time.Time
+	// key, if set, is the saga's idempotency key
+	key  string
+	tags map[string]string
+	// See FailurePolicy and TimeoutPolicy
+	failurePolicy FailurePolicy
+	timeoutPolicy TimeoutPolicy
+	// The step that started the saga, for child sagas
+	parentSagaID string
+	parentStepID string
+	// registerHandlers registers the specs' handlers under the saga's name
+	// once the saga is saved, or found by its key, for Builder.Execute
+	registerHandlers bool
+}
+
+// StartSaga creates and starts a new saga whose steps run in the given order
 func (o *Orchestrator) StartSaga(ctx context.Context, name string, steps []string, data map[string]interface{}) (*Saga, error) {
-	sagaID := uuid.New().String()
+	return o.startSaga(ctx, name, linearSpecs(steps), data, sagaOptions{})
+}
+
+// StartSagaWithKey starts a saga like StartSaga unless one was already
+// started with the same idempotency key, in which case that saga is
+// returned unchanged. Retrying a request with the same key therefore
+// doesn't create a duplicate saga.
+func (o *Orchestrator) StartSagaWithKey(ctx context.Context, key, name string, steps []string, data map[string]interface{}) (*Saga, error) {
+	if key == "" {
+		return nil, invalidSaga(fmt.Errorf("idempotency key must not be empty"))
+	}
+	return o.startSaga(ctx, name, linearSpecs(steps), data, sagaOptions{key: key})
+}
+
+func (o *Orchestrator) startSaga(ctx context.Context, name string, specs []StepSpec, data map[string]interface{}, opts sagaOptions) (*Saga, error) {
+	registerHandlers := func() {
+		if !opts.registerHandlers {
+			return
+		}
+		for _, spec := range specs {
+			o.RegisterSagaHandler(name, spec.Name, spec.Handler)
+		}
+	}
+
+	if opts.key != "" {
+		existing, err := o.storage.GetSagaByKey(ctx, opts.key)
+		if err == nil {
+			registerHandlers()
+			return existing, nil
+		}
+		if !errors.Is(err, ErrSagaNotFound) {
+			return nil, storageFailure(fmt.Errorf("failed to get saga by key: %w", err))
+		}
+	}
+
+	if err := o.checkDataSize(data); err != nil {
+		return nil, invalidSaga(fmt.Errorf("invalid data for saga %s: %w", name, err))
+	}
+	if err := o.checkStepCount(len(specs)); err != nil {
+		return nil, invalidSaga(fmt.Errorf("invalid saga %s: %w", name, err))
+	}
+	if err := o.checkHandlers(name, specs); err != nil {
+		return nil, invalidSaga(fmt.Errorf("invalid saga %s: %w", name, err))
+	}
+
+	saga := o.newSaga(ctx, name, specs, data, opts)
+	scheduled := o.scheduleSteps(firstMessages(saga)...)
+
+	if err := o.saveSagaWith(ctx, saga, scheduled); err != nil {
+		if errors.Is(err, ErrDuplicateIdempotencyKey) {
+			// Another start with the same key won the race
+			existing, getErr := o.storage.GetSagaByKey(ctx, opts.key)
+			if getErr != nil {
+				return nil, storageFailure(fmt.Errorf("failed to get saga by key: %w", getErr))
+			}
+			registerHandlers()
+			return existing, nil
+		}
+		return nil, storageFailure(fmt.Errorf("failed to save saga: %w", err))
+	}
+	// Before the first steps are published, which may run them at once
+	registerHandlers()
+	o.recordStarted(ctx, saga)
+	o.send(ctx, scheduled)
+
+	return saga, nil
+}
+
+// newSaga builds a pending saga with its steps
+func (o *Orchestrator) newSaga(ctx context.Context, name string, specs []StepSpec, data map[string]interface{}, opts sagaOptions) *Saga {
+	sagaID := o.newID()
+
+	if deadline, ok := ctx.Deadline(); ok && o.contextDeadlines {
+		if opts.deadline == nil || deadline.Before(*opts.deadline) {
+			opts.deadline = &deadline
+		}
+	}
 
 	saga := &Saga{
-		ID:        sagaID,
-		Name:      name,
-		Status:    StatusPending,
-		Data:      data,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:             sagaID,
+		Name:           name,
+		Status:         StatusPending,
+		Data:           data,
+		Metadata:       MetadataFromContext(ctx),
+		Tags:           opts.tags,
+		IdempotencyKey: opts.key,
+		ParentSagaID:   opts.parentSagaID,
+		ParentStepID:   opts.parentStepID,
+		Deadline:       opts.deadline,
+		FailurePolicy:  opts.failurePolicy,
+		TimeoutPolicy:  opts.timeoutPolicy,
+		CreatedAt:      o.now(),
+		UpdatedAt:      o.now(),
 	}
 
 	// Create steps
-	for _, stepName := range steps {
-		stepID := uuid.New().String()
+	for _, spec := range specs {
+		stepID := o.newID()
 		step := Step{
-			ID:        stepID,
-			SagaID:    sagaID,
-			Name:      stepName,
-			Status:    StatusPending,
-			Data:      make(map[string]interface{}),
-			CreatedAt: time.Now(),
-			UpdatedAt: time.Now(),
+			ID:                   stepID,
+			SagaID:               sagaID,
+			Name:                 spec.Name,
+			Status:               StatusPending,
+			Data:                 make(map[string]interface{}),
+			DependsOn:            spec.DependsOn,
+			CompensationOrder:    spec.CompensationOrder,
+			NoCompensation:       spec.NoCompensation,
+			CompensateFailedStep: spec.CompensateFailedStep,
+			Resource:             spec.Resource,
+			CreatedAt:            o.now(),
+			UpdatedAt:            o.now(),
 		}
 		saga.Steps = append(saga.Steps, step)
 	}
+	return saga
+}
 
-	if err := o.storage.SaveSaga(ctx, saga); err != nil {
-		return nil, fmt.Errorf("failed to save saga: %w", err)
+// firstMessages returns the messages starting a new saga: one executing
+// every step without dependencies
+func firstMessages(saga *Saga) []Message {
+	var first []Message
+	for _, step := range saga.Steps {
+		if len(step.DependsOn) > 0 {
+			continue
+		}
+		first = append(first, Message{
+			Type:     "step_execute",
+			SagaID:   saga.ID,
+			StepID:   step.ID,
+			Metadata: saga.Metadata,
+		})
+	}
+	return first
+}
+
+// recordStarted records the events of a saga that was just saved
+func (o *Orchestrator) recordStarted(ctx context.Context, saga *Saga) {
+	o.recordEvent(ctx, SagaEvent{SagaID: saga.ID, ToStatus: StatusPending})
+	for _, step := range saga.Steps {
+		o.recordEvent(ctx, SagaEvent{SagaID: saga.ID, StepID: step.ID, ToStatus: StatusPending})
+	}
+}
+
+// AddSteps appends steps to a running saga. The new steps take part in
+// scheduling and compensation like the saga's original steps. A spec with
+// nil DependsOn runs after the spec before it; the first one runs after the
+// saga's current position, which is the steps executing right now or, if
+// none are, the most recently declared step that has finished. Use an empty
+// DependsOn for a step that can start immediately. Adding steps to a saga
+// that has completed or is failing returns an error.
+func (o *Orchestrator) AddSteps(ctx context.Context, sagaID string, specs []StepSpec) error {
+	if len(specs) == 0 {
+		return nil
+	}
+
+	unlock := o.lockSaga(sagaID)
+	defer unlock()
+
+	saga, err := o.storage.GetSaga(ctx, sagaID)
+	if err != nil {
+		return fmt.Errorf("failed to get saga: %w", err)
+	}
+	if saga.Status != StatusPending {
+		return fmt.Errorf("cannot add steps to %s saga %s", saga.Status, sagaID)
+	}
+
+	resolved := chainSpecs(specs, currentPosition(saga))
+	if _, err := topologicalOrder(append(stepSpecs(saga.Steps), resolved...)); err != nil {
+		return fmt.Errorf("invalid steps for saga %s: %w", sagaID, err)
+	}
+	if err := o.checkStepCount(len(saga.Steps) + len(resolved)); err != nil {
+		return fmt.Errorf("invalid steps for saga %s: %w", sagaID, err)
 	}
 
-	// Start executing first step
-	if len(saga.Steps) > 0 {
-		msg := Message{
-			Type:   "step_execute",
-			SagaID: sagaID,
-			StepID: saga.Steps[0].ID,
-			Data:   data,
+	for _, spec := range resolved {
+		if spec.Handler != nil {
+			o.RegisterSagaHandler(saga.Name, spec.Name, spec.Handler)
 		}
-		o.pubsub.Publish(ctx, "saga_events", msg)
+	}
+	if err := o.checkHandlers(saga.Name, resolved); err != nil {
+		return fmt.Errorf("invalid steps for saga %s: %w", sagaID, err)
 	}
 
-	return saga, nil
+	first := len(saga.Steps)
+	for _, spec := range resolved {
+		saga.Steps = append(saga.Steps, Step{
+			ID:                   o.newID(),
+			SagaID:               sagaID,
+			Name:                 spec.Name,
+			Status:               StatusPending,
+			Data:                 make(map[string]interface{}),
+			DependsOn:            spec.DependsOn,
+			CompensationOrder:    spec.CompensationOrder,
+			NoCompensation:       spec.NoCompensation,
+			CompensateFailedStep: spec.CompensateFailedStep,
+			Resource:             spec.Resource,
+			CreatedAt:            o.now(),
+			UpdatedAt:            o.now(),
+		})
+	}
+
+	// Start the new steps whose dependencies have already finished
+	var runnable []Message
+	for i := first; i < len(saga.Steps); i++ {
+		step := &saga.Steps[i]
+		if !dependenciesCompleted(saga, step) {
+			continue
+		}
+		runnable = append(runnable, Message{
+			Type:     "step_execute",
+			SagaID:   sagaID,
+			StepID:   step.ID,
+			Metadata: saga.Metadata,
+		})
+	}
+	scheduled := o.scheduleSteps(runnable...)
+
+	if err := o.saveSagaWith(ctx, saga, scheduled); err != nil {
+		return fmt.Errorf("failed to save saga: %w", err)
+	}
+	for i := first; i < len(saga.Steps); i++ {
+		o.recordEvent(ctx, SagaEvent{SagaID: sagaID, StepID: saga.Steps[i].ID, ToStatus: StatusPending})
+	}
+	o.send(ctx, scheduled)
+
+	return nil
+}
+
+// currentPosition returns the names of the saga's executing steps, or the
+// most recently declared finished step if none are executing
+func currentPosition(saga *Saga) []string {
+	var names []string
+	for _, step := range saga.Steps {
+		if step.Status == StatusProcessing {
+			names = append(names, step.Name)
+		}
+	}
+	if len(names) > 0 {
+		return names
+	}
+
+	for i := len(saga.Steps) - 1; i >= 0; i-- {
+		if stepDone(saga.Steps[i].Status) {
+			return []string{saga.Steps[i].Name}
+		}
+	}
+	return []string{}
 }
 
 // ExecuteStep executes a specific step
 func (o *Orchestrator) ExecuteStep(ctx context.Context, stepID string) error {
+	o.inFlightSteps.Add(1)
+	defer o.inFlightSteps.Add(-1)
+
 	step, err := o.storage.GetStep(ctx, stepID)
 	if err != nil {
 		return fmt.Errorf("failed to get step: %w", err)
@@ -85,24 +632,99 @@ func (o *Orchestrator) ExecuteStep(ctx context.Context, stepID string) error {
 		return nil // Already processed or processing
 	}
 
-	handler, exists := o.handlers[step.Name]
+	saga, err := o.storage.GetSaga(ctx, step.SagaID)
+	if err != nil {
+		return fmt.Errorf("failed to get saga: %w", err)
+	}
+
+	if saga.Status != StatusPending || !dependenciesCompleted(saga, step) {
+		return nil // Not runnable yet, or the saga is no longer running
+	}
+
+	handler, exists := o.handler(saga.Name, step.Name)
 	if !exists {
-		return fmt.Errorf("no handler for step: %s", step.Name)
+		err := fmt.Errorf("%w: %s", ErrNoHandler, step.Name)
+		o.deadLetter(ctx, step, DeadLetterNoHandler, err)
+		if o.missingHandlerLimitReached(step.ID) {
+			if failErr := o.failUnhandledStep(ctx, stepID, err); failErr != nil {
+				return failErr
+			}
+		}
+		return err
 	}
 
-	// Mark step as processing
-	now := time.Now()
-	step.Status = StatusProcessing
-	step.StartedAt = &now
-	if err := o.storage.UpdateStep(ctx, step); err != nil {
+	// Don't start new work once the saga has run out of time
+	if o.deadlineExceeded(saga) {
+		return o.expireSaga(ctx, saga.ID)
+	}
+
+	// Spare a resource whose circuit breaker is open
+	breaker := o.breaker(step)
+	circuitOpen := breaker != nil && !breaker.allow(o.now())
+	if circuitOpen && !breaker.settings.FailWhenOpen {
+		o.logger.Warn("Circuit breaker open, deferring step",
+			"saga_id", step.SagaID, "step_id", step.ID, "step", step.Name, "resource", step.Resource)
+		return nil
+	}
+
+	// Claim the step; only the worker that moves it out of pending runs it
+	var claimExpiry time.Time
+	if o.claimTTL > 0 {
+		claimExpiry = o.now().Add(o.claimTTL)
+	}
+	claimed, err := o.storage.ClaimStep(ctx, stepID, o.instanceID, claimExpiry)
+	if err != nil {
 		return fmt.Errorf("failed to mark step as processing: %w", err)
 	}
+	if !claimed {
+		return nil // Another worker got here first
+	}
+	o.recordEvent(ctx, SagaEvent{SagaID: step.SagaID, StepID: stepID, FromStatus: StatusPending, ToStatus: StatusProcessing})
 
-	saga, err := o.storage.GetSaga(ctx, step.SagaID)
+	unlock := o.lockSaga(step.SagaID)
+	step, err = o.storage.GetStep(ctx, stepID)
 	if err != nil {
+		unlock()
+		return fmt.Errorf("failed to get step: %w", err)
+	}
+
+	saga, err = o.storage.GetSaga(ctx, step.SagaID)
+	if err != nil {
+		unlock()
 		return fmt.Errorf("failed to get saga: %w", err)
 	}
 
+	// The saga may have failed while the step was being claimed. Release the
+	// claim and resume the rollback, which waited for this step to finish.
+	if saga.Status != StatusPending {
+		defer unlock()
+		if _, err := o.storage.UpdateStepStatus(ctx, stepID, StatusProcessing, StatusPending); err != nil {
+			return fmt.Errorf("failed to release step: %w", err)
+		}
+		o.recordEvent(ctx, SagaEvent{SagaID: step.SagaID, StepID: stepID, FromStatus: StatusProcessing, ToStatus: StatusPending})
+		saga, err = o.storage.GetSaga(ctx, step.SagaID)
+		if err != nil {
+			return fmt.Errorf("failed to get saga: %w", err)
+		}
+		if saga.Status == StatusCompensating {
+			o.compensateNext(ctx, saga)
+		}
+		return nil
+	}
+
+	runCtx, stopTracking := o.trackStep(ctx, stepID)
+	defer stopTracking()
+
+	now := o.now()
+	step.StartedAt = &now
+	step.CompletedAt = nil
+	step.Attempts++
+	if err := o.storage.UpdateStep(ctx, step); err != nil {
+		unlock()
+		return fmt.Errorf("failed to mark step as processing: %w", err)
+	}
+	unlock()
+
 	// Merge saga data with step data
 	execData := make(map[string]interface{})
 	for k, v := range saga.Data {
@@ -112,131 +734,966 @@ func (o *Orchestrator) ExecuteStep(ctx context.Context, stepID string) error {
 		execData[k] = v
 	}
 
-	err = handler.Execute(ctx, execData)
-	if err != nil {
-		// Mark step as failed
-		step.Status = StatusFailed
-		step.Error = err.Error()
-		o.storage.UpdateStep(ctx, step)
+	// Conditional steps are skipped when their condition doesn't hold
+	if c, ok := handler.(conditionalStep); ok && !c.shouldExecute(execData) {
+		return o.skipStep(ctx, step)
+	}
+
+	input := copyData(execData)
+	promoted := &promotions{keys: make(map[string]bool)}
+	children := &childSagas{}
+	hctx := context.WithValue(handlerContext(runCtx, saga, step, false), promotionsKey{}, promoted)
+	hctx = context.WithValue(hctx, childSagasKey{}, children)
+	var stop bool
+	if circuitOpen {
+		err = Permanent(fmt.Errorf("resource %s: %w", step.Resource, ErrCircuitOpen))
+	} else {
+		err = o.callHandler(step, func() error { return o.wrapHandler(handler).Execute(hctx, execData) })
+		if errors.Is(err, ErrStopSaga) {
+			stop, err = true, nil
+		}
+		if err != nil && canceledByFailFast(runCtx) {
+			err = Permanent(err) // Its saga is already rolling back
+		} else if breaker != nil {
+			breaker.record(err, o.now())
+		}
+	}
 
-		// Start compensation
-		o.startCompensation(ctx, saga)
+	unlock = o.lockSaga(step.SagaID)
+	defer unlock()
+
+	// Recovery may have handed the step to another worker while this run
+	// was too slow; that worker's run is the one that counts
+	current, getErr := o.storage.GetStep(ctx, stepID)
+	if getErr != nil {
+		return fmt.Errorf("failed to get step: %w", getErr)
+	}
+	if current.Attempts != step.Attempts {
+		o.logger.Warn("Step was claimed again while running, discarding result",
+			"saga_id", step.SagaID, "step_id", step.ID, "step", step.Name, "claimed_by", current.ClaimedBy)
 		return nil
 	}
 
-	// Mark step as completed and save any data changes
+	step.InputData = input
+	step.ChildSagaIDs = children.mergeInto(step.ChildSagaIDs)
+	if err == nil {
+		if keyErr := o.checkReservedKeys(input, execData); keyErr != nil {
+			err = Permanent(fmt.Errorf("step %s data: %w", step.Name, keyErr))
+		} else if sizeErr := o.checkDataSize(execData); sizeErr != nil {
+			err = Permanent(fmt.Errorf("step %s data: %w", step.Name, sizeErr))
+		}
+	}
+	if err != nil {
+		if o.shouldRetry(step, err) {
+			return o.retryStep(ctx, step, err)
+		}
+		if step.CompensateFailedStep {
+			step.OutputData = deepCopyData(execData) // The partial work to undo
+		}
+		return o.failStep(ctx, step, err)
+	}
+	if stop {
+		if err := o.skipRemaining(ctx, step); err != nil {
+			return err
+		}
+	}
+
+	// Mark step as completed and update saga data with its results
 	step.Status = StatusCompleted
+	step.Error = "" // Left over from a failed attempt
+	step.Failure = nil
+	step.CompletedAt = o.timestamp()
 	step.Data = execData
+	step.OutputData = deepCopyData(execData)
+	saga, scheduled, err := o.completeStep(ctx, step, input, execData, promoted)
+	if err != nil || saga == nil {
+		return err
+	}
+	o.recordEvent(ctx, SagaEvent{SagaID: step.SagaID, StepID: step.ID, FromStatus: StatusProcessing, ToStatus: StatusCompleted})
+	o.send(ctx, scheduled)
+
+	// A sibling failed while this step was running; resume the rollback
+	if saga.Status == StatusCompensating {
+		o.compensateNext(ctx, saga)
+		return nil
+	}
+
+	o.completeOrExpire(ctx, saga)
+
+	return nil
+}
+
+// callHandler runs a step handler, turning a panic into a permanent error.
+// The step then fails, or its compensation is dead-lettered, like with any
+// other error, instead of the panic crashing the process and leaving the
+// step processing.
+func (o *Orchestrator) callHandler(step *Step, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			o.logger.Error("Step handler panicked",
+				"saga_id", step.SagaID, "step_id", step.ID, "step", step.Name, "panic", r, "stack", string(stack))
+			err = Permanent(panicError{value: r, stack: stack})
+		}
+	}()
+	return fn()
+}
+
+// completeStep stores a completed step and merges its results into its
+// saga's data in one write, and returns the saved saga. The saga is reloaded
+// first so data written by other steps in the meantime is kept, and again
+// whenever another instance saved it in between, since each conflict means
+// that instance made progress. If the step itself was changed, e.g. reset
+// by recovery, its result is discarded and nil is returned.
+// It also returns the messages starting the steps that follow, for the
+// caller to send; with WithOutbox they are written in the same write.
+func (o *Orchestrator) completeStep(ctx context.Context, step *Step, input, output map[string]interface{}, promoted *promotions) (*Saga, []OutboxMessage, error) {
+	for {
+		saga, err := o.storage.GetSaga(ctx, step.SagaID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get saga: %w", err)
+		}
+
+		o.mergeStepData(saga, step, input, output, promoted)
+
+		// The saga was read before the step is written
+		setStep(saga, step)
+
+		scheduled := o.scheduleSteps(o.nextStepMessages(saga, step)...)
+		if o.outbox != nil {
+			err = o.outbox.CompleteStepWithMessages(ctx, step, saga, scheduled)
+		} else {
+			err = o.storage.CompleteStep(ctx, step, saga)
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			current, getErr := o.storage.GetStep(ctx, step.ID)
+			if getErr != nil {
+				return nil, nil, fmt.Errorf("failed to get step: %w", getErr)
+			}
+			if current.Version == step.Version {
+				continue
+			}
+			o.logger.Warn("Step was changed while completing, discarding result",
+				"saga_id", step.SagaID, "step_id", step.ID, "step", step.Name, "status", current.Status)
+			return nil, nil, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to complete step: %w", err)
+		}
+
+		setStep(saga, step)
+		return saga, scheduled, nil
+	}
+}
+
+// missingHandlerLimitReached counts a delivery of the step without a handler
+// and reports whether it has reached WithMissingHandlerLimit
+func (o *Orchestrator) missingHandlerLimitReached(stepID string) bool {
+	if o.missingLimit <= 0 {
+		return false
+	}
+
+	o.missingMu.Lock()
+	defer o.missingMu.Unlock()
+
+	o.missingHandlers[stepID]++
+	if o.missingHandlers[stepID] < o.missingLimit {
+		return false
+	}
+	delete(o.missingHandlers, stepID)
+	return true
+}
+
+// failUnhandledStep fails a pending step that has no handler, unless another
+// worker claimed it or its saga stopped running in the meantime
+func (o *Orchestrator) failUnhandledStep(ctx context.Context, stepID string, stepErr error) error {
+	claimed, err := o.storage.UpdateStepStatus(ctx, stepID, StatusPending, StatusProcessing)
+	if err != nil {
+		return fmt.Errorf("failed to mark step as processing: %w", err)
+	}
+	if !claimed {
+		return nil
+	}
+
+	step, err := o.storage.GetStep(ctx, stepID)
+	if err != nil {
+		return fmt.Errorf("failed to get step: %w", err)
+	}
+	o.recordEvent(ctx, SagaEvent{SagaID: step.SagaID, StepID: stepID, FromStatus: StatusPending, ToStatus: StatusProcessing})
+
+	unlock := o.lockSaga(step.SagaID)
+	defer unlock()
+	return o.failStep(ctx, step, stepErr)
+}
+
+// failStep marks a processing step failed and starts compensating its saga.
+// The caller must hold the saga's lock.
+func (o *Orchestrator) failStep(ctx context.Context, step *Step, stepErr error) error {
+	step.Status = StatusFailed
+	step.Error = stepErr.Error()
+	step.Failure = o.stepFailure(step, stepErr)
+	step.CompletedAt = o.timestamp()
 	o.storage.UpdateStep(ctx, step)
+	o.recordEvent(ctx, SagaEvent{SagaID: step.SagaID, StepID: step.ID, FromStatus: StatusProcessing, ToStatus: StatusFailed, Error: step.Error})
 
-	// Update saga data with step results
-	for k, v := range execData {
-		saga.Data[k] = v
+	// Start compensation
+	saga, err := o.storage.GetSaga(ctx, step.SagaID)
+	if err != nil {
+		return fmt.Errorf("failed to get saga: %w", err)
 	}
-	o.storage.SaveSaga(ctx, saga)
+	o.logger.Warn("Step failed, compensating saga",
+		"saga_id", step.SagaID, "step_id", step.ID, "step", step.Name, "error", step.Error)
 
-	// Continue to next step or complete saga
-	o.continueOrComplete(ctx, saga)
+	// A saga that timed out with TimeoutFailOnly stays as it is
+	if isTerminal(saga.Status) {
+		return nil
+	}
 
+	// Keep the first failure if a sibling already failed the saga
+	if saga.Status == StatusPending || saga.Status == StatusPaused {
+		saga.Error = fmt.Sprintf("step %s failed: %s", step.Name, step.Error)
+		saga.FailedStepID = step.ID
+	}
+	o.startCompensation(ctx, saga)
 	return nil
 }
 
+// skipStep marks a claimed step skipped and moves on without running it
+func (o *Orchestrator) skipStep(ctx context.Context, step *Step) error {
+	unlock := o.lockSaga(step.SagaID)
+	defer unlock()
+
+	saga, err := o.storage.GetSaga(ctx, step.SagaID)
+	if err != nil {
+		return fmt.Errorf("failed to get saga: %w", err)
+	}
+
+	step.Status = StatusSkipped
+	step.CompletedAt = o.timestamp()
+	setStep(saga, step)
+	scheduled := o.scheduleSteps(o.nextStepMessages(saga, step)...)
+	if err := o.updateStepWith(ctx, step, scheduled); err != nil {
+		return fmt.Errorf("failed to mark step as skipped: %w", err)
+	}
+	setStep(saga, step)
+	o.recordEvent(ctx, SagaEvent{SagaID: step.SagaID, StepID: step.ID, FromStatus: StatusProcessing, ToStatus: StatusSkipped})
+	o.send(ctx, scheduled)
+
+	if saga.Status == StatusCompensating {
+		o.compensateNext(ctx, saga)
+		return nil
+	}
+
+	o.completeOrExpire(ctx, saga)
+	return nil
+}
+
+// setStep replaces the saga's copy of step, e.g. after the step was written
+// without the saga being read again
+func setStep(saga *Saga, step *Step) {
+	for i := range saga.Steps {
+		if saga.Steps[i].ID == step.ID {
+			saga.Steps[i] = *copyStep(step)
+		}
+	}
+}
+
 // CompensateStep compensates a specific step
 func (o *Orchestrator) CompensateStep(ctx context.Context, stepID string) error {
+	o.inFlightSteps.Add(1)
+	defer o.inFlightSteps.Add(-1)
+
 	step, err := o.storage.GetStep(ctx, stepID)
 	if err != nil {
 		return fmt.Errorf("failed to get step: %w", err)
 	}
 
-	if step.Status != StatusCompleted {
+	if !compensable(step) {
 		return nil // Nothing to compensate
 	}
+	from := step.Status
+
+	saga, err := o.storage.GetSaga(ctx, step.SagaID)
+	if err != nil {
+		return fmt.Errorf("failed to get saga: %w", err)
+	}
 
-	handler, exists := o.handlers[step.Name]
+	handler, exists := o.handler(saga.Name, step.Name)
 	if !exists {
-		return fmt.Errorf("no handler for step: %s", step.Name)
+		err := fmt.Errorf("%w: %s", ErrNoHandler, step.Name)
+		o.deadLetter(ctx, step, DeadLetterNoHandler, err)
+		return err
 	}
 
-	saga, err := o.storage.GetSaga(ctx, step.SagaID)
+	// Claim the compensation so a redelivered message doesn't run it twice
+	claimed, err := o.storage.UpdateStepStatus(ctx, stepID, from, StatusCompensating)
 	if err != nil {
-		return fmt.Errorf("failed to get saga: %w", err)
+		return fmt.Errorf("failed to mark step as compensating: %w", err)
+	}
+	if !claimed {
+		return nil
 	}
+	o.recordEvent(ctx, SagaEvent{SagaID: step.SagaID, StepID: stepID, FromStatus: from, ToStatus: StatusCompensating})
 
-	// Merge saga data with step data
-	execData := make(map[string]interface{})
-	for k, v := range saga.Data {
-		execData[k] = v
+	// The compensation sees the data its step produced on top of the saga's
+	// current data, so keys later steps changed, such as a charge ID, read
+	// as the step left them
+	output := step.OutputData
+	if output == nil {
+		output = step.Data // Completed before OutputData was recorded
 	}
-	for k, v := range step.Data {
+	execData := copyData(saga.Data)
+	if execData == nil {
+		execData = make(map[string]interface{})
+	}
+	for k, v := range deepCopyData(output) {
 		execData[k] = v
 	}
 
-	err = handler.Compensate(ctx, execData)
+	input := deepCopyData(execData)
+	added := &followUps{}
+	hctx := context.WithValue(handlerContext(ctx, saga, step, true), followUpsKey{}, added)
+	compErr := o.callHandler(step, func() error {
+		return o.wrapHandler(handler).Compensate(hctx, execData)
+	})
+
+	unlock := o.lockSaga(step.SagaID)
+	defer unlock()
+
+	// Reload the step, which the claim above has written since it was read
+	step, err = o.storage.GetStep(ctx, stepID)
 	if err != nil {
-		step.Error = err.Error()
+		return fmt.Errorf("failed to get step: %w", err)
 	}
 
+	// What a successful compensation wrote is kept for the compensations
+	// after it
+	var writes map[string]interface{}
+	var steps []Step
+	if compErr == nil {
+		writes = compensationWrites(input, execData)
+		if keyErr := o.checkReservedKeys(input, execData); keyErr != nil {
+			compErr = fmt.Errorf("compensation of step %s data: %w", step.Name, keyErr)
+		} else if sizeErr := o.checkDataSize(execData); sizeErr != nil {
+			compErr = fmt.Errorf("compensation of step %s data: %w", step.Name, sizeErr)
+		} else if saga, err = o.storage.GetSaga(ctx, step.SagaID); err != nil {
+			return fmt.Errorf("failed to get saga: %w", err)
+		} else {
+			steps, compErr = o.followUpSteps(saga, step, added)
+		}
+	}
+	if compErr != nil {
+		writes, steps = nil, nil
+		step.Error = compErr.Error()
+		o.deadLetter(ctx, step, DeadLetterCompensationFailed, compErr)
+	}
+
+	// The next compensation is recorded with this one, so a crash in
+	// between can't stall the rollback
 	step.Status = StatusCompensated
-	o.storage.UpdateStep(ctx, step)
+	var scheduled []OutboxMessage
+	if len(writes) > 0 || len(steps) > 0 {
+		if scheduled, err = o.saveCompensation(ctx, step, writes, steps); err != nil {
+			return err
+		}
+	} else {
+		saga, err = o.storage.GetSaga(ctx, step.SagaID)
+		if err != nil {
+			return fmt.Errorf("failed to get saga: %w", err)
+		}
+		setStep(saga, step)
+		scheduled = o.compensationMessages(saga)
+		if err := o.updateStepWith(ctx, step, scheduled); err != nil {
+			return fmt.Errorf("failed to mark step as compensated: %w", err)
+		}
+	}
+	o.recordEvent(ctx, SagaEvent{SagaID: step.SagaID, StepID: step.ID, FromStatus: StatusCompensating, ToStatus: StatusCompensated, Error: step.Error})
+	if len(scheduled) > 0 {
+		o.send(ctx, scheduled)
+		return nil
+	}
+
+	saga, err = o.storage.GetSaga(ctx, step.SagaID)
+	if err != nil {
+		return fmt.Errorf("failed to get saga: %w", err)
+	}
+	o.compensateNext(ctx, saga)
 
 	return nil
 }
 
-// StartListener starts listening for saga events
+// errListenerStopped asks the pubsub to deliver a message again, to another
+// instance or once recovery republishes it
+var errListenerStopped = errors.New("orchestrator is not accepting messages")
+
+// StartListener starts listening for saga events, on every shard if the
+// orchestrator has several; see WithShards. It returns an error if the
+// pubsub can't subscribe to the orchestrator's topic, e.g. because the
+// broker is unreachable, in which case no messages will be handled and the
+// caller should retry or give up. Messages that fail with an error, such as
+// a storage failure, are reported to the MessageErrorHandler and handed back
+// to the pubsub so it can deliver them again.
 func (o *Orchestrator) StartListener(ctx context.Context) error {
-	return o.pubsub.Subscribe(ctx, "saga_events", func(msg Message) {
-		switch msg.Type {
-		case "step_execute":
-			o.ExecuteStep(ctx, msg.StepID)
-		case "step_compensate":
-			o.CompensateStep(ctx, msg.StepID)
+	shards := make([]int, o.shards)
+	for i := range shards {
+		shards[i] = i
+	}
+	return o.StartShardListener(ctx, shards...)
+}
+
+// listen subscribes to step messages on topic
+func (o *Orchestrator) listen(ctx context.Context, topic string) error {
+	err := o.pubsub.Subscribe(ctx, topic, func(msg Message) error {
+		if msg.Type == "step_execute" || msg.Type == "step_recover" || msg.Type == "step_compensate" {
+			if !o.acquireSlot(ctx) {
+				return errListenerStopped
+			}
+			defer o.releaseSlot()
+		}
+
+		if !o.beginMessage() {
+			return errListenerStopped
 		}
+		defer o.inFlight.Done()
+
+		return o.handleMessage(ctx, msg)
 	})
+	if err != nil {
+		o.logger.Error("Failed to subscribe to saga events", "topic", topic, "error", err)
+		return fmt.Errorf("failed to subscribe to %s: %w", topic, err)
+	}
+	return nil
 }
 
-func (o *Orchestrator) continueOrComplete(ctx context.Context, saga *Saga) {
-	// Find current step index
-	currentIndex := -1
-	for i, step := range saga.Steps {
-		if step.Status == StatusCompleted {
-			currentIndex = i
-		} else {
-			break
+// handleMessage does the work a saga message asks for, reporting failures
+// to the MessageErrorHandler
+func (o *Orchestrator) handleMessage(ctx context.Context, msg Message) error {
+	var err error
+	switch msg.Type {
+	case "step_execute", "step_recover":
+		err = o.ExecuteStep(ctx, msg.StepID)
+	case "step_compensate":
+		err = o.CompensateStep(ctx, msg.StepID)
+	case "saga_timeout":
+		err = o.expireSaga(ctx, msg.SagaID)
+	case "saga_compensate":
+		err = o.resumeCompensation(ctx, msg.SagaID)
+	}
+	if err != nil {
+		o.logger.Warn("Failed to handle saga message",
+			"type", msg.Type, "saga_id", msg.SagaID, "step_id", msg.StepID, "error", err)
+		if o.messageErrors != nil {
+			o.messageErrors(ctx, msg, err)
 		}
 	}
+	return err
+}
 
-	// Check if there's a next step
-	if currentIndex+1 < len(saga.Steps) {
-		nextStep := saga.Steps[currentIndex+1]
-		msg := Message{
-			Type:   "step_execute",
-			SagaID: saga.ID,
-			StepID: nextStep.ID,
-			Data:   saga.Data,
-		}
-		o.pubsub.Publish(ctx, "saga_events", msg)
-	} else {
+// Stats is a point-in-time view of an orchestrator's activity
+type Stats struct {
+	// InFlightSteps is the number of steps being executed or compensated
+	InFlightSteps int
+	// HandlersRegistered is the number of registered step handlers
+	HandlersRegistered int
+	// Running reports whether the listener is consuming messages, or a
+	// worker polling storage, i.e. it was started and Shutdown hasn't been
+	// called
+	Running bool
+}
+
+// Stats reports the orchestrator's current activity, e.g. for readiness
+// probes or to tell when a draining instance has gone idle
+func (o *Orchestrator) Stats() Stats {
+	o.handlersMu.RLock()
+	handlers := len(o.handlers)
+	o.handlersMu.RUnlock()
+
+	o.listenerMu.Lock()
+	running := o.listening && !o.shuttingDown
+	o.listenerMu.Unlock()
+
+	return Stats{
+		InFlightSteps:      int(o.inFlightSteps.Load()),
+		HandlersRegistered: handlers,
+		Running:            running,
+	}
+}
+
+// Shutdown stops the listener from accepting new step messages and waits for
+// the steps it is already executing or compensating to finish. It returns the
+// context's error if they don't finish before ctx is done. Messages arriving
+// after Shutdown are dropped and left for the RecoveryManager to re-deliver.
+func (o *Orchestrator) Shutdown(ctx context.Context) error {
+	o.listenerMu.Lock()
+	o.shuttingDown = true
+	o.listenerMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		o.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// acquireSlot waits for room under the concurrency limit. It returns false
+// if ctx is done first.
+func (o *Orchestrator) acquireSlot(ctx context.Context) bool {
+	if o.slots == nil {
+		return true
+	}
+	select {
+	case o.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (o *Orchestrator) releaseSlot() {
+	if o.slots != nil {
+		<-o.slots
+	}
+}
+
+// beginMessage registers an in-flight message unless shutting down
+func (o *Orchestrator) beginMessage() bool {
+	o.listenerMu.Lock()
+	defer o.listenerMu.Unlock()
+
+	if o.shuttingDown {
+		return false
+	}
+	o.inFlight.Add(1)
+	return true
+}
+
+// completeOrExpire finishes a running saga that has no steps left, or
+// times it out if it has run out of time. The steps a finished step
+// unblocked are started by its caller; see nextStepMessages.
+func (o *Orchestrator) completeOrExpire(ctx context.Context, saga *Saga) {
+	// ResumeSaga schedules whatever became runnable while the saga was
+	// paused, and a saga failed by TimeoutFailOnly stays failed
+	if saga.Status != StatusPending {
+		return
+	}
+
+	if done, total := saga.Progress(); done == total {
 		// All steps completed, mark saga as completed
-		saga.Status = StatusCompleted
-		o.storage.SaveSaga(ctx, saga)
+		o.finishSaga(ctx, saga, StatusCompleted)
+		return
+	}
+
+	if o.deadlineExceeded(saga) {
+		o.timeOut(ctx, saga)
+	}
+}
+
+// nextStepMessages returns the messages starting the steps of a running
+// saga that became runnable when completed finished
+func (o *Orchestrator) nextStepMessages(saga *Saga, completed *Step) []Message {
+	if saga.Status != StatusPending || o.deadlineExceeded(saga) {
+		return nil
+	}
+
+	var msgs []Message
+	for i := range saga.Steps {
+		step := &saga.Steps[i]
+		if step.Status != StatusPending || !dependsOn(step, completed.Name) || !dependenciesCompleted(saga, step) {
+			continue
+		}
+		msgs = append(msgs, Message{
+			Type:     "step_execute",
+			SagaID:   saga.ID,
+			StepID:   step.ID,
+			Metadata: saga.Metadata,
+		})
+	}
+	return msgs
+}
+
+// errDeadlineExceeded is the saga error recorded when a saga times out
+const errDeadlineExceeded = "saga deadline exceeded"
+
+// TimeoutPolicy decides what happens to a saga that runs past its deadline
+type TimeoutPolicy string
+
+const (
+	// TimeoutCompensate fails the saga and rolls back its completed steps.
+	// This is the default.
+	TimeoutCompensate TimeoutPolicy = "compensate"
+	// TimeoutFailOnly fails the saga right away and leaves its completed
+	// steps as they are, e.g. for manual handling when compensations are
+	// expensive or risky. Steps still running finish but start nothing
+	// further, and a step failing afterwards doesn't start a rollback.
+	TimeoutFailOnly TimeoutPolicy = "fail_only"
+)
+
+// validTimeoutPolicy reports whether p is a known policy; empty means
+// TimeoutCompensate
+func validTimeoutPolicy(p TimeoutPolicy) bool {
+	return p == "" || p == TimeoutCompensate || p == TimeoutFailOnly
+}
+
+// timeOut fails a running saga that is past its deadline according to its
+// TimeoutPolicy. The caller must hold the saga's lock.
+func (o *Orchestrator) timeOut(ctx context.Context, saga *Saga) {
+	saga.Error = errDeadlineExceeded
+	if saga.TimeoutPolicy == TimeoutFailOnly {
+		o.logger.Warn("Saga timed out, failing without compensation", "saga_id", saga.ID)
+		o.finishSaga(ctx, saga, StatusFailed)
+		return
+	}
+	o.startCompensation(ctx, saga)
+}
+
+// timestamp returns the current time for a field recording when something
+// happened, such as Step.CompletedAt
+func (o *Orchestrator) timestamp() *time.Time {
+	now := o.now()
+	return &now
+}
+
+// deadlineExceeded reports whether the saga has a deadline that has passed
+func (o *Orchestrator) deadlineExceeded(saga *Saga) bool {
+	return saga.Deadline != nil && o.now().After(*saga.Deadline)
+}
+
+// expireSaga fails a running saga that is past its deadline and, unless its
+// TimeoutPolicy is TimeoutFailOnly, rolls back its completed steps. Sagas
+// that already finished or are being compensated are left alone, so a saga
+// is never compensated twice.
+func (o *Orchestrator) expireSaga(ctx context.Context, sagaID string) error {
+	unlock := o.lockSaga(sagaID)
+	defer unlock()
+
+	saga, err := o.storage.GetSaga(ctx, sagaID)
+	if err != nil {
+		return fmt.Errorf("failed to get saga: %w", err)
+	}
+
+	if saga.Status != StatusPending || !o.deadlineExceeded(saga) {
+		return nil
+	}
+
+	o.timeOut(ctx, saga)
+	return nil
+}
+
+// Compensate rolls back a completed saga, for example one found to be
+// fraudulent after it finished. Its completed steps are compensated in
+// reverse dependency order, as after a failure, and the saga ends up
+// rolled back. Sagas that haven't completed are refused.
+func (o *Orchestrator) Compensate(ctx context.Context, sagaID string) error {
+	unlock := o.lockSaga(sagaID)
+	defer unlock()
+
+	saga, err := o.storage.GetSaga(ctx, sagaID)
+	if err != nil {
+		return fmt.Errorf("failed to get saga: %w", err)
+	}
+	if saga.Status != StatusCompleted {
+		return fmt.Errorf("cannot compensate %s saga %s", saga.Status, sagaID)
+	}
+
+	saga.FinalStatus = StatusRolledBack
+	o.startCompensation(ctx, saga)
+	return nil
+}
+
+// ErrSagaNotRunning is returned when canceling a saga that has already
+// finished or is being compensated
+var ErrSagaNotRunning = errors.New("saga is not running")
+
+// errCanceled is the saga error recorded when a saga is canceled
+const errCanceled = "saga canceled"
+
+// CancelSaga stops a running or paused saga and rolls back its completed
+// steps; once the rollback is done the saga is canceled. Steps already
+// executing finish first and are then compensated too, unless the saga
+// fails fast; see FailFast. Sagas that have
+// finished or are being compensated are refused with ErrSagaNotRunning.
+func (o *Orchestrator) CancelSaga(ctx context.Context, sagaID string) error {
+	unlock := o.lockSaga(sagaID)
+	defer unlock()
+
+	saga, err := o.storage.GetSaga(ctx, sagaID)
+	if err != nil {
+		return fmt.Errorf("failed to get saga: %w", err)
+	}
+	if saga.Status != StatusPending && saga.Status != StatusPaused {
+		return fmt.Errorf("cannot cancel %s saga %s: %w", saga.Status, sagaID, ErrSagaNotRunning)
 	}
+
+	saga.Error = errCanceled
+	saga.FinalStatus = StatusCanceled
+	o.startCompensation(ctx, saga)
+	return nil
 }
 
+// PauseSaga stops a running saga from starting further steps, e.g. while
+// a downstream service is in maintenance, without failing it. Steps already
+// executing finish, but the steps after them wait until ResumeSaga. A step
+// that fails while the saga is paused still starts its rollback. Paused
+// sagas are not timed out until resumed, and recovery leaves their steps
+// alone.
+func (o *Orchestrator) PauseSaga(ctx context.Context, sagaID string) error {
+	unlock := o.lockSaga(sagaID)
+	defer unlock()
+
+	saga, err := o.storage.GetSaga(ctx, sagaID)
+	if err != nil {
+		return fmt.Errorf("failed to get saga: %w", err)
+	}
+	if saga.Status != StatusPending {
+		return fmt.Errorf("cannot pause %s saga %s", saga.Status, sagaID)
+	}
+
+	saga.Status = StatusPaused
+	if err := o.storage.SaveSaga(ctx, saga); err != nil {
+		return fmt.Errorf("failed to save saga: %w", err)
+	}
+	o.recordEvent(ctx, SagaEvent{SagaID: sagaID, FromStatus: StatusPending, ToStatus: StatusPaused})
+	o.notifyWaiters(sagaID, StatusPaused)
+	o.logger.Info("Saga paused", "saga_id", sagaID)
+	return nil
+}
+
+// ResumeSaga continues a paused saga, starting the steps that became
+// runnable while it was paused
+func (o *Orchestrator) ResumeSaga(ctx context.Context, sagaID string) error {
+	unlock := o.lockSaga(sagaID)
+	defer unlock()
+
+	saga, err := o.storage.GetSaga(ctx, sagaID)
+	if err != nil {
+		return fmt.Errorf("failed to get saga: %w", err)
+	}
+	if saga.Status != StatusPaused {
+		return fmt.Errorf("cannot resume %s saga %s", saga.Status, sagaID)
+	}
+
+	saga.Status = StatusPending
+	scheduled := o.scheduleSteps(runnableStepMessages(saga)...)
+	if err := o.saveSagaWith(ctx, saga, scheduled); err != nil {
+		return fmt.Errorf("failed to save saga: %w", err)
+	}
+	o.recordEvent(ctx, SagaEvent{SagaID: sagaID, FromStatus: StatusPaused, ToStatus: StatusPending})
+	o.notifyWaiters(sagaID, StatusPending)
+	o.logger.Info("Saga resumed", "saga_id", sagaID)
+	o.send(ctx, scheduled)
+
+	// The last steps may have finished while the saga was paused
+	if done, total := saga.Progress(); done == total {
+		o.finishSaga(ctx, saga, StatusCompleted)
+	}
+	return nil
+}
+
+// runnableStepMessages returns the messages starting every pending step of
+// the saga whose dependencies are done
+func runnableStepMessages(saga *Saga) []Message {
+	var msgs []Message
+	for i := range saga.Steps {
+		step := &saga.Steps[i]
+		if step.Status != StatusPending || !dependenciesCompleted(saga, step) {
+			continue
+		}
+		msgs = append(msgs, Message{
+			Type:     "step_execute",
+			SagaID:   saga.ID,
+			StepID:   step.ID,
+			Metadata: saga.Metadata,
+		})
+	}
+	return msgs
+}
+
+// resumeCompensation continues a rollback that stalled, e.g. because a
+// step_compensate message was lost
+func (o *Orchestrator) resumeCompensation(ctx context.Context, sagaID string) error {
+	unlock := o.lockSaga(sagaID)
+	defer unlock()
+
+	saga, err := o.storage.GetSaga(ctx, sagaID)
+	if err != nil {
+		return fmt.Errorf("failed to get saga: %w", err)
+	}
+	o.compensateNext(ctx, saga)
+	return nil
+}
+
+// startCompensation moves the saga to compensating and starts rolling back
+// its completed steps. Once the rollback is done the saga moves to its
+// FinalStatus, or failed if that isn't set.
 func (o *Orchestrator) startCompensation(ctx context.Context, saga *Saga) {
-	saga.Status = StatusFailed
-	o.storage.SaveSaga(ctx, saga)
+	if saga.Status != StatusCompensating {
+		from := saga.Status
+		saga.Status = StatusCompensating
+		scheduled := o.compensationMessages(saga)
+		if err := o.saveSagaWith(ctx, saga, scheduled); err != nil {
+			o.logger.Error("Failed to start compensation", "saga_id", saga.ID, "error", err)
+			return
+		}
+		o.recordEvent(ctx, SagaEvent{SagaID: saga.ID, FromStatus: from, ToStatus: StatusCompensating, Error: saga.Error})
+		o.notifyWaiters(saga.ID, StatusCompensating)
+		o.cancelRunningSteps(saga)
+		if len(scheduled) > 0 {
+			o.send(ctx, scheduled)
+			return
+		}
+	}
 
-	// Compensate completed steps in reverse order
-	for i := len(saga.Steps) - 1; i >= 0; i-- {
-		step := saga.Steps[i]
-		if step.Status == StatusCompleted {
-			msg := Message{
-				Type:   "step_compensate",
-				SagaID: saga.ID,
-				StepID: step.ID,
-				Data:   saga.Data,
-			}
-			o.pubsub.Publish(ctx, "saga_events", msg)
+	o.compensateNext(ctx, saga)
+}
+
+// compensateNext publishes the compensation of the next completed step in
+// reverse topological order, so a step is only rolled back after every step
+// depending on it. Steps are compensated one at a time, and not before the
+// steps still processing have finished.
+func (o *Orchestrator) compensateNext(ctx context.Context, saga *Saga) {
+	next, ready := nextCompensation(saga)
+	if !ready {
+		return
+	}
+
+	if next != nil {
+		msg := compensationMessage(saga, next)
+		if err := o.pubsub.Publish(ctx, o.stepTopic(saga.ID), msg); err != nil {
+			o.logger.Warn("Failed to publish message",
+				"type", msg.Type, "saga_id", msg.SagaID, "step_id", msg.StepID, "error", err)
 		}
+		return
+	}
+
+	// Nothing left to roll back
+	final := StatusFailed
+	if saga.FinalStatus != "" {
+		final = saga.FinalStatus
+	}
+	o.finishSaga(ctx, saga, final)
+}
+
+// compensationMessages prepares the message compensating the step the
+// saga rolls back next, if it can move on, to be written along with the
+// change that lets it
+func (o *Orchestrator) compensationMessages(saga *Saga) []OutboxMessage {
+	next, ready := nextCompensation(saga)
+	if !ready || next == nil {
+		return nil
+	}
+	return o.scheduleSteps(compensationMessage(saga, next))
+}
+
+// compensationMessage returns the message compensating step
+func compensationMessage(saga *Saga, step *Step) Message {
+	return Message{
+		Type:     "step_compensate",
+		SagaID:   saga.ID,
+		StepID:   step.ID,
+		Metadata: saga.Metadata,
+	}
+}
+
+// nextCompensation returns the step a compensating saga rolls back next, or
+// nil if there is none left. It reports false if the rollback can't move on
+// yet because a step is still processing or compensating, or if the saga
+// isn't compensating.
+func nextCompensation(saga *Saga) (*Step, bool) {
+	if saga.Status != StatusCompensating {
+		return nil, false
+	}
+
+	for _, step := range saga.Steps {
+		if step.Status == StatusProcessing || step.Status == StatusCompensating {
+			return nil, false
+		}
+	}
+
+	order, err := topologicalOrder(stepSpecs(saga.Steps))
+	if err != nil {
+		return nil, false
+	}
+
+	// Failed steps cleaning up their own partial work go first, then steps
+	// with a compensation order, lowest first; the rest are rolled back in
+	// reverse dependency order. Steps with nothing to undo stay completed.
+	var next *Step
+	for i := len(order) - 1; i >= 0; i-- {
+		step := &saga.Steps[order[i]]
+		if !compensable(step) {
+			continue
+		}
+		if next == nil || compensatesBefore(step, next) {
+			next = step
+		}
+	}
+	return next, true
+}
+
+// compensable reports whether a rollback still has to compensate step: a
+// completed step with something to undo, or a failed one with
+// CompensateFailedStep
+func compensable(step *Step) bool {
+	if step.NoCompensation {
+		return false
+	}
+	return step.Status == StatusCompleted || (step.Status == StatusFailed && step.CompensateFailedStep)
+}
+
+// compensatesBefore reports whether a should be rolled back ahead of b:
+// because a failed and b didn't, or because of their explicit compensation
+// order
+func compensatesBefore(a, b *Step) bool {
+	if (a.Status == StatusFailed) != (b.Status == StatusFailed) {
+		return a.Status == StatusFailed
+	}
+	if a.CompensationOrder <= 0 {
+		return false
+	}
+	return b.CompensationOrder <= 0 || a.CompensationOrder < b.CompensationOrder
+}
+
+// finishSaga moves the saga to a terminal status and wakes up anyone waiting
+// on it
+func (o *Orchestrator) finishSaga(ctx context.Context, saga *Saga, status Status) {
+	from := saga.Status
+	saga.Status = status
+	saga.FinishedAt = o.timestamp()
+	scheduled := o.schedule(o.completionTopic, Message{
+		Type:     completionMessageType(status),
+		SagaID:   saga.ID,
+		Data:     saga.Data,
+		Metadata: saga.Metadata,
+	})
+	saveErr := o.saveSagaWith(ctx, saga, scheduled)
+	o.recordEvent(ctx, SagaEvent{SagaID: saga.ID, FromStatus: from, ToStatus: status, Error: saga.Error})
+	o.logger.Info("Saga finished", "saga_id", saga.ID, "status", status)
+	o.notifyWaiters(saga.ID, status)
+
+	if saveErr != nil {
+		o.logger.Warn("Failed to save finished saga", "saga_id", saga.ID, "status", status, "error", saveErr)
+		return
+	}
+	o.send(ctx, scheduled)
+}
+
+// completionMessageType returns the message type announcing a finished saga
+func completionMessageType(status Status) string {
+	switch status {
+	case StatusCompleted:
+		return MessageSagaCompleted
+	case StatusRolledBack:
+		return MessageSagaRolledBack
+	case StatusCanceled:
+		return MessageSagaCanceled
+	default:
+		return MessageSagaFailed
 	}
 }
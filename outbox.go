@@ -0,0 +1,246 @@
+package saga
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// OutboxMessage is a message waiting in an outbox to be published on Topic
+type OutboxMessage struct {
+	ID        string
+	Topic     string
+	Message   Message
+	CreatedAt time.Time
+}
+
+// Outbox is implemented by storage backends that can record messages in
+// the same transaction as a write, so a saga or step is never changed
+// without the messages that follow from the change, such as those starting
+// the next steps, or the other way round. An OutboxRelay publishes the
+// recorded messages.
+type Outbox interface {
+	// SaveSagaWithMessages does what SaveSaga does and adds msgs to the
+	// outbox in the same transaction; if it fails, nothing is written
+	SaveSagaWithMessages(ctx context.Context, saga *Saga, msgs []OutboxMessage) error
+	// UpdateStepWithMessages does the same for UpdateStep
+	UpdateStepWithMessages(ctx context.Context, step *Step, msgs []OutboxMessage) error
+	// CompleteStepWithMessages does the same for CompleteStep
+	CompleteStepWithMessages(ctx context.Context, step *Step, saga *Saga, msgs []OutboxMessage) error
+	// PendingMessages returns up to limit messages still in the outbox,
+	// oldest first
+	PendingMessages(ctx context.Context, limit int) ([]OutboxMessage, error)
+	// DeleteMessages removes published messages from the outbox. Deleting
+	// a message that isn't there is not an error.
+	DeleteMessages(ctx context.Context, ids []string) error
+}
+
+// WithOutbox makes the orchestrator record the messages that follow from a
+// write, such as those starting a saga's first steps, the steps a completed
+// step unblocks, a retry, the next compensation of a rollback or a saga's
+// completion, in its storage's Outbox in the same transaction, instead of
+// publishing them separately. The orchestrator still publishes the messages
+// right away, and an OutboxRelay publishes those it couldn't, e.g. because
+// the broker was down or the orchestrator crashed in between. The storage
+// must implement Outbox.
+func WithOutbox() Option {
+	return func(o *Orchestrator) {
+		o.useOutbox = true
+	}
+}
+
+// schedule prepares msgs to be published on topic once the write they
+// follow from has been saved
+func (o *Orchestrator) schedule(topic string, msgs ...Message) []OutboxMessage {
+	scheduled := make([]OutboxMessage, len(msgs))
+	for i, msg := range msgs {
+		scheduled[i] = OutboxMessage{ID: o.newID(), Topic: topic, Message: msg, CreatedAt: o.now()}
+	}
+	return scheduled
+}
+
+// saveSagaWith saves the saga, along with the scheduled messages if the
+// orchestrator uses an outbox
+func (o *Orchestrator) saveSagaWith(ctx context.Context, saga *Saga, scheduled []OutboxMessage) error {
+	if o.outbox != nil {
+		return o.outbox.SaveSagaWithMessages(ctx, saga, scheduled)
+	}
+	return o.storage.SaveSaga(ctx, saga)
+}
+
+// updateStepWith updates the step, along with the scheduled messages if the
+// orchestrator uses an outbox
+func (o *Orchestrator) updateStepWith(ctx context.Context, step *Step, scheduled []OutboxMessage) error {
+	if o.outbox != nil {
+		return o.outbox.UpdateStepWithMessages(ctx, step, scheduled)
+	}
+	return o.storage.UpdateStep(ctx, step)
+}
+
+// send publishes messages whose write has been saved. Messages from the
+// outbox are removed from it once published; the relay picks up the rest.
+func (o *Orchestrator) send(ctx context.Context, scheduled []OutboxMessage) {
+	published := make([]string, 0, len(scheduled))
+	for _, msg := range scheduled {
+		if err := o.pubsub.Publish(ctx, msg.Topic, msg.Message); err != nil {
+			o.logger.Warn("Failed to publish message",
+				"type", msg.Message.Type, "saga_id", msg.Message.SagaID, "step_id", msg.Message.StepID, "error", err)
+			continue
+		}
+		published = append(published, msg.ID)
+	}
+	if o.outbox == nil || len(published) == 0 {
+		return
+	}
+	if err := o.outbox.DeleteMessages(ctx, published); err != nil {
+		o.logger.Warn("Failed to delete published outbox messages", "error", err)
+	}
+}
+
+// OutboxRelay publishes the messages left in an Outbox. Run one alongside
+// orchestrators created with WithOutbox. A message can be published more
+// than once, e.g. by the orchestrator and the relay or by several relays,
+// which at-least-once delivery already allows for.
+type OutboxRelay struct {
+	outbox    Outbox
+	pubsub    PubSub
+	interval  time.Duration
+	batchSize int
+	logger    Logger
+
+	mu      sync.Mutex
+	running bool
+	stopCh  chan struct{}
+}
+
+// OutboxRelayOption configures an OutboxRelay
+type OutboxRelayOption func(*OutboxRelay)
+
+// WithRelayInterval sets how often the relay checks the outbox. d must be
+// positive; the default is one second.
+func WithRelayInterval(d time.Duration) OutboxRelayOption {
+	if d <= 0 {
+		panic("saga: relay interval must be positive")
+	}
+	return func(r *OutboxRelay) {
+		r.interval = d
+	}
+}
+
+// WithRelayBatchSize sets how many messages the relay publishes per read of
+// the outbox. n must be positive; the default is 100.
+func WithRelayBatchSize(n int) OutboxRelayOption {
+	if n <= 0 {
+		panic("saga: relay batch size must be positive")
+	}
+	return func(r *OutboxRelay) {
+		r.batchSize = n
+	}
+}
+
+// WithRelayLogger sets the logger used for relay errors. Nothing is logged
+// by default.
+func WithRelayLogger(logger Logger) OutboxRelayOption {
+	return func(r *OutboxRelay) {
+		r.logger = logger
+	}
+}
+
+func NewOutboxRelay(outbox Outbox, pubsub PubSub, opts ...OutboxRelayOption) *OutboxRelay {
+	r := &OutboxRelay{
+		outbox:    outbox,
+		pubsub:    pubsub,
+		interval:  time.Second,
+		batchSize: 100,
+		logger:    nopLogger{},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Start begins relaying in the background until Stop is called or ctx is
+// done. Calling Start on a running relay does nothing.
+func (r *OutboxRelay) Start(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.running {
+		return
+	}
+
+	r.running = true
+	r.stopCh = make(chan struct{})
+	go r.loop(ctx, r.stopCh)
+}
+
+// Stop stops the relay. It is safe to call more than once.
+func (r *OutboxRelay) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.running {
+		return
+	}
+
+	r.running = false
+	close(r.stopCh)
+}
+
+func (r *OutboxRelay) loop(ctx context.Context, stopCh chan struct{}) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			r.mu.Lock()
+			if r.stopCh == stopCh {
+				r.running = false
+			}
+			r.mu.Unlock()
+			return
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if _, err := r.Flush(ctx); err != nil {
+				r.logger.Error("Failed to relay outbox messages", "error", err)
+			}
+		}
+	}
+}
+
+// Flush publishes every message in the outbox and returns how many it
+// published. It stops at the first message that fails to publish, so
+// messages go out in order, and returns the error.
+func (r *OutboxRelay) Flush(ctx context.Context) (int, error) {
+	var relayed int
+	for {
+		msgs, err := r.outbox.PendingMessages(ctx, r.batchSize)
+		if err != nil {
+			return relayed, err
+		}
+
+		ids := make([]string, 0, len(msgs))
+		var publishErr error
+		for _, msg := range msgs {
+			if publishErr = r.pubsub.Publish(ctx, msg.Topic, msg.Message); publishErr != nil {
+				break
+			}
+			ids = append(ids, msg.ID)
+		}
+		if len(ids) > 0 {
+			if err := r.outbox.DeleteMessages(ctx, ids); err != nil {
+				return relayed, err
+			}
+			relayed += len(ids)
+		}
+		if publishErr != nil {
+			return relayed, publishErr
+		}
+		if len(msgs) < r.batchSize {
+			return relayed, nil
+		}
+	}
+}
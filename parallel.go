@@ -0,0 +1,77 @@
+package saga
+
+import (
+	"context"
+	"errors"
+)
+
+// FailurePolicy decides what happens to a saga's steps that are still
+// running in parallel when the saga starts rolling back, e.g. because one
+// of their siblings failed
+type FailurePolicy string
+
+const (
+	// WaitAll lets running steps finish before anything is compensated.
+	// Those that complete are then compensated like the rest. This is the
+	// default.
+	WaitAll FailurePolicy = "wait_all"
+	// FailFast cancels the context of running steps' handlers as soon as
+	// the rollback starts. A handler that returns an error is marked failed
+	// without being retried and, unless it has CompensateFailedStep, isn't
+	// compensated; one that completes anyway is compensated. Compensation still waits for every handler to
+	// return. Only handlers running on the orchestrator that starts the
+	// rollback can be canceled; steps running on other instances finish as
+	// with WaitAll.
+	FailFast FailurePolicy = "fail_fast"
+)
+
+// errFailFast is the cause of a handler context canceled under FailFast
+var errFailFast = errors.New("saga is compensating")
+
+// validFailurePolicy reports whether p is a known policy; empty means
+// WaitAll
+func validFailurePolicy(p FailurePolicy) bool {
+	return p == "" || p == WaitAll || p == FailFast
+}
+
+// trackStep returns the context for a step's handler, which FailFast
+// cancels through cancelRunningSteps, and the func to call once the handler
+// has returned. The caller must hold the saga's lock, so a rollback can't
+// start between checking the saga and tracking the step.
+func (o *Orchestrator) trackStep(ctx context.Context, stepID string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	o.runningMu.Lock()
+	o.running[stepID] = cancel
+	o.runningMu.Unlock()
+
+	return ctx, func() {
+		o.runningMu.Lock()
+		delete(o.running, stepID)
+		o.runningMu.Unlock()
+		cancel(nil)
+	}
+}
+
+// canceledByFailFast reports whether a step's handler context was canceled
+// because its saga started rolling back
+func canceledByFailFast(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errFailFast)
+}
+
+// cancelRunningSteps cancels the handlers of the saga's steps running on
+// this orchestrator if the saga fails fast
+func (o *Orchestrator) cancelRunningSteps(saga *Saga) {
+	if saga.FailurePolicy != FailFast {
+		return
+	}
+
+	o.runningMu.Lock()
+	defer o.runningMu.Unlock()
+	for _, step := range saga.Steps {
+		if cancel, exists := o.running[step.ID]; exists {
+			cancel(errFailFast)
+			o.logger.Info("Canceling running step", "saga_id", saga.ID, "step_id", step.ID, "step", step.Name)
+		}
+	}
+}
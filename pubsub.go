@@ -2,20 +2,102 @@ package saga
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"time"
 )
 
-// MemoryPubSub implements PubSub interface using in-memory channels
+// ErrClosed is returned when publishing to or subscribing on a closed pubsub
+var ErrClosed = errors.New("pubsub is closed")
+
+// defaultCloseTimeout bounds how long Close waits for deliveries to finish
+const defaultCloseTimeout = 5 * time.Second
+
+// MemoryPubSub implements PubSub interface using in-memory channels. By
+// default every delivery runs in its own goroutine; see WithSyncDelivery
+// and WithOrderedDelivery.
 type MemoryPubSub struct {
 	mu          sync.RWMutex
-	subscribers map[string][]func(Message)
+	subscribers map[string][]func(Message) error
 	closed      bool
+
+	// How often a delivery whose handler fails is retried
+	maxRedeliveries int
+
+	// Deliveries queued or still running
+	deliveries sync.WaitGroup
+
+	// Queue of a synchronous pubsub's single worker
+	syncDelivery bool
+	queueMu      sync.Mutex
+	queueCond    *sync.Cond
+	queue        []delivery
+	stopped      bool
+
+	// Queues of an ordered pubsub, by saga ID, each with a worker goroutine
+	// while it isn't empty; guarded by queueMu
+	orderedDelivery bool
+	sagaQueues      map[string][]delivery
+}
+
+// delivery is a message waiting for one subscriber
+type delivery struct {
+	handler func(Message) error
+	msg     Message
+}
+
+// MemoryPubSubOption configures a MemoryPubSub
+type MemoryPubSubOption func(*MemoryPubSub)
+
+// WithSyncDelivery delivers messages one at a time, in publish order, on a
+// single worker goroutine instead of a goroutine per message. Processing is
+// then sequential and deterministic, which makes tests reliable without
+// sleeps, but a handler that blocks holds up every message after it. The
+// worker exits on Close.
+func WithSyncDelivery() MemoryPubSubOption {
+	return func(m *MemoryPubSub) {
+		m.syncDelivery = true
+	}
+}
+
+// WithOrderedDelivery delivers the messages of each saga one at a time, in
+// publish order, on a worker goroutine of the saga's own, while the
+// messages of different sagas are still delivered concurrently. A message
+// published again, e.g. by recovery, then can't be handled at the same time
+// as the original, but the parallel steps of a saga run one after another,
+// and a handler that blocks holds up the rest of its saga. Messages without
+// a SagaID get a goroutine each as usual. It has no effect with
+// WithSyncDelivery, which orders every message.
+func WithOrderedDelivery() MemoryPubSubOption {
+	return func(m *MemoryPubSub) {
+		m.orderedDelivery = true
+	}
 }
 
-func NewMemoryPubSub() *MemoryPubSub {
-	return &MemoryPubSub{
-		subscribers: make(map[string][]func(Message)),
+// WithRedelivery delivers a message again, up to n more times, when its
+// handler returns an error. Failed messages are dropped by default.
+func WithRedelivery(n int) MemoryPubSubOption {
+	if n < 0 {
+		panic("saga: redeliveries must not be negative")
+	}
+	return func(m *MemoryPubSub) {
+		m.maxRedeliveries = n
+	}
+}
+
+func NewMemoryPubSub(opts ...MemoryPubSubOption) *MemoryPubSub {
+	m := &MemoryPubSub{
+		subscribers: make(map[string][]func(Message) error),
+		sagaQueues:  make(map[string][]delivery),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.syncDelivery {
+		m.queueCond = sync.NewCond(&m.queueMu)
+		go m.work()
 	}
+	return m
 }
 
 func (m *MemoryPubSub) Publish(ctx context.Context, topic string, msg Message) error {
@@ -23,7 +105,7 @@ func (m *MemoryPubSub) Publish(ctx context.Context, topic string, msg Message) e
 	defer m.mu.RUnlock()
 
 	if m.closed {
-		return nil
+		return ErrClosed
 	}
 
 	handlers, exists := m.subscribers[topic]
@@ -31,31 +113,151 @@ func (m *MemoryPubSub) Publish(ctx context.Context, topic string, msg Message) e
 		return nil
 	}
 
+	if m.syncDelivery {
+		// Handlers may publish themselves, so queue rather than call them
+		// here
+		m.queueMu.Lock()
+		for _, handler := range handlers {
+			m.deliveries.Add(1)
+			m.queue = append(m.queue, delivery{handler: handler, msg: msg})
+		}
+		m.queueMu.Unlock()
+		m.queueCond.Signal()
+		return nil
+	}
+
+	if m.orderedDelivery && msg.SagaID != "" {
+		m.queueMu.Lock()
+		for _, handler := range handlers {
+			m.deliveries.Add(1)
+			queue, working := m.sagaQueues[msg.SagaID]
+			m.sagaQueues[msg.SagaID] = append(queue, delivery{handler: handler, msg: msg})
+			if !working {
+				go m.workSaga(msg.SagaID)
+			}
+		}
+		m.queueMu.Unlock()
+		return nil
+	}
+
 	// Call handlers in separate goroutines to avoid blocking
 	for _, handler := range handlers {
-		go handler(msg)
+		m.deliveries.Add(1)
+		go func(handler func(Message) error) {
+			defer m.deliveries.Done()
+			m.deliver(handler, msg)
+		}(handler)
 	}
 
 	return nil
 }
 
-func (m *MemoryPubSub) Subscribe(ctx context.Context, topic string, handler func(Message)) error {
+// PublishBatch publishes msgs on topic one after another
+func (m *MemoryPubSub) PublishBatch(ctx context.Context, topic string, msgs []Message) error {
+	for _, msg := range msgs {
+		if err := m.Publish(ctx, topic, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryPubSub) Subscribe(ctx context.Context, topic string, handler func(Message) error) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	if m.closed {
-		return nil
+		return ErrClosed
 	}
 
 	m.subscribers[topic] = append(m.subscribers[topic], handler)
 	return nil
 }
 
+// Close stops delivery and waits up to five seconds for handlers that are
+// still running; use CloseContext to choose how long to wait
 func (m *MemoryPubSub) Close() error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCloseTimeout)
+	defer cancel()
+	return m.CloseContext(ctx)
+}
 
+// CloseContext stops delivery and waits for handlers that are still running
+// until ctx is done, in which case it returns ctx's error. Publishing after
+// Close returns ErrClosed.
+func (m *MemoryPubSub) CloseContext(ctx context.Context) error {
+	m.mu.Lock()
 	m.closed = true
-	m.subscribers = make(map[string][]func(Message))
-	return nil
+	m.subscribers = make(map[string][]func(Message) error)
+	m.mu.Unlock()
+
+	if m.syncDelivery {
+		m.queueMu.Lock()
+		m.stopped = true
+		m.queueMu.Unlock()
+		m.queueCond.Broadcast()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.deliveries.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// work delivers queued messages in order until the pubsub is closed and the
+// queue has drained
+func (m *MemoryPubSub) work() {
+	for {
+		m.queueMu.Lock()
+		for len(m.queue) == 0 && !m.stopped {
+			m.queueCond.Wait()
+		}
+		if len(m.queue) == 0 {
+			m.queueMu.Unlock()
+			return
+		}
+		next := m.queue[0]
+		m.queue = m.queue[1:]
+		m.queueMu.Unlock()
+
+		m.deliver(next.handler, next.msg)
+		m.deliveries.Done()
+	}
+}
+
+// workSaga delivers the messages queued for the saga in order, until its
+// queue is empty
+func (m *MemoryPubSub) workSaga(sagaID string) {
+	for {
+		m.queueMu.Lock()
+		queue := m.sagaQueues[sagaID]
+		if len(queue) == 0 {
+			delete(m.sagaQueues, sagaID)
+			m.queueMu.Unlock()
+			return
+		}
+		next := queue[0]
+		m.sagaQueues[sagaID] = queue[1:]
+		m.queueMu.Unlock()
+
+		m.deliver(next.handler, next.msg)
+		m.deliveries.Done()
+	}
+}
+
+// deliver runs handler, retrying it while it fails and redeliveries remain
+func (m *MemoryPubSub) deliver(handler func(Message) error, msg Message) {
+	for attempt := 0; ; attempt++ {
+		if err := handler(msg); err == nil || attempt >= m.maxRedeliveries {
+			return
+		}
+	}
 }
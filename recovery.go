@@ -2,42 +2,217 @@ package saga
 
 import (
 	"context"
-	"log"
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"sync"
 	"time"
+
+	"github.com/google/uuid"
 )
 
+// recoveryLockName is the Locker lock held by the instance running recovery
+const recoveryLockName = "saga-recovery"
+
 // RecoveryManager handles recovery of stuck/failed steps
 type RecoveryManager struct {
 	storage     Storage
 	pubsub      PubSub
+	topic       string
+	shards      int
 	interval    time.Duration
 	stepTimeout time.Duration
-	running     bool
-	stopCh      chan struct{}
+	logger      Logger
+	events      EventStore
+
+	// Bounds each check; zero means no limit
+	checkTimeout time.Duration
+
+	// Republish limits; zero means unlimited
+	maxPerTick  int
+	minInterval time.Duration
+
+	// Extra wait before a step is recovered again; see WithRecoveryBackoff
+	backoffBase time.Duration
+	backoffMax  time.Duration
+
+	// Set with WithLocker, so only the instance holding the lock recovers
+	locker Locker
+	owner  string
+
+	// See WithRecoveryClock
+	now func() time.Time
+
+	mu      sync.Mutex
+	running bool
+	stopCh  chan struct{}
+}
+
+// RecoveryOption configures a RecoveryManager
+type RecoveryOption func(*RecoveryManager)
+
+// WithRecoveryLogger sets the logger used for recovery events. Nothing is
+// logged by default.
+func WithRecoveryLogger(logger Logger) RecoveryOption {
+	return func(r *RecoveryManager) {
+		r.logger = logger
+	}
+}
+
+// WithRecoveryEventStore records the steps recovery resets to pending in
+// store, alongside the orchestrator's events
+func WithRecoveryEventStore(store EventStore) RecoveryOption {
+	return func(r *RecoveryManager) {
+		r.events = store
+	}
+}
+
+// WithRecoveryTopic sets the topic recovery publishes to. It must match the
+// orchestrators' WithTopic; the default is DefaultTopic.
+func WithRecoveryTopic(topic string) RecoveryOption {
+	if topic == "" {
+		panic("saga: topic must not be empty")
+	}
+	return func(r *RecoveryManager) {
+		r.topic = topic
+	}
+}
+
+// WithInterval sets how often recovery checks for stuck steps and expired
+// sagas. The default is 5 seconds. d must be positive.
+func WithInterval(d time.Duration) RecoveryOption {
+	if d <= 0 {
+		panic("saga: recovery interval must be positive")
+	}
+	return func(r *RecoveryManager) {
+		r.interval = d
+	}
+}
+
+// WithStepTimeout sets how long a step may stay pending or processing before
+// recovery republishes it. The default is 10 seconds. d must be positive.
+func WithStepTimeout(d time.Duration) RecoveryOption {
+	if d <= 0 {
+		panic("saga: recovery step timeout must be positive")
+	}
+	return func(r *RecoveryManager) {
+		r.stepTimeout = d
+	}
+}
+
+// WithContextTimeout bounds each recovery check: the storage and pubsub
+// calls of a check share a context that is canceled after d, so a hung
+// backend doesn't stall recovery past the next tick. Steps the check
+// didn't get to are picked up by the next one. d must be positive; by
+// default checks run until done.
+func WithContextTimeout(d time.Duration) RecoveryOption {
+	if d <= 0 {
+		panic("saga: recovery context timeout must be positive")
+	}
+	return func(r *RecoveryManager) {
+		r.checkTimeout = d
+	}
+}
+
+// WithRecoveryRate limits how hard recovery pushes stuck steps. At most
+// maxPerTick steps are republished per check, with the rest left for later
+// checks, and a step isn't republished again until minInterval has passed
+// since it was last recovered. The time of the last recovery is saved as the
+// step's LastRecoveredAt, so the interval holds across recovery managers
+// sharing the storage and across restarts. Zero disables either limit;
+// neither may be negative.
+func WithRecoveryRate(maxPerTick int, minInterval time.Duration) RecoveryOption {
+	if maxPerTick < 0 || minInterval < 0 {
+		panic("saga: recovery rate limits must not be negative")
+	}
+	return func(r *RecoveryManager) {
+		r.maxPerTick = maxPerTick
+		r.minInterval = minInterval
+	}
 }
 
-func NewRecoveryManager(storage Storage, pubsub PubSub) *RecoveryManager {
-	return &RecoveryManager{
+// WithRecoveryBackoff sets how much longer recovery waits before
+// republishing a step it has recovered before. The wait doubles with each
+// of the step's RecoveryAttempts, starting at base and capped at max, and is
+// varied by up to half in either direction so steps stuck together don't
+// come back together. The default is one second up to five minutes; a zero
+// base disables the backoff.
+func WithRecoveryBackoff(base, max time.Duration) RecoveryOption {
+	if base < 0 || max < base {
+		panic("saga: recovery backoff must not be negative or exceed its maximum")
+	}
+	return func(r *RecoveryManager) {
+		r.backoffBase = base
+		r.backoffMax = max
+	}
+}
+
+// WithLocker makes recovery managers sharing locker take turns: each check
+// only runs on the instance holding the recovery lock, so running a manager
+// per instance against shared storage doesn't republish every stuck step
+// once per instance. The lock lasts three intervals and is renewed on every
+// check, so another instance takes over when the holder stops or dies.
+func WithLocker(locker Locker) RecoveryOption {
+	return func(r *RecoveryManager) {
+		r.locker = locker
+	}
+}
+
+// WithRecoveryClock sets the function the manager reads the current time
+// from, for expiring sagas, rate limits and backoff, e.g. a fake clock in
+// tests. GetStuckSteps goes by the storage's clock, so give MemoryStorage
+// the same one with WithMemoryClock. The default is time.Now.
+func WithRecoveryClock(now func() time.Time) RecoveryOption {
+	return func(r *RecoveryManager) {
+		r.now = now
+	}
+}
+
+func NewRecoveryManager(storage Storage, pubsub PubSub, opts ...RecoveryOption) *RecoveryManager {
+	r := &RecoveryManager{
 		storage:     storage,
 		pubsub:      pubsub,
-		interval:    5 * time.Second,  // Check every 5 seconds for demo
-		stepTimeout: 10 * time.Second, // Consider step stuck after 10 seconds for demo
-		stopCh:      make(chan struct{}),
+		topic:       DefaultTopic,
+		shards:      1,
+		interval:    5 * time.Second,
+		stepTimeout: 10 * time.Second,
+		logger:      nopLogger{},
+		backoffBase: time.Second,
+		backoffMax:  5 * time.Minute,
+		owner:       uuid.New().String(),
+		now:         time.Now,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.pubsub == nil {
+		// Alongside RunWorker, which picks up the steps it resets
+		r.pubsub = nopPubSub{}
 	}
+	return r
 }
 
-// Start begins the recovery process
+// Start begins the recovery process. It does nothing if recovery is
+// already running. The loop stops when ctx is done or Stop is called, and
+// can be started again afterwards.
 func (r *RecoveryManager) Start(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	if r.running {
 		return
 	}
 
 	r.running = true
-	go r.recoveryLoop(ctx)
+	r.stopCh = make(chan struct{})
+	go r.recoveryLoop(ctx, r.stopCh)
 }
 
-// Stop stops the recovery process
+// Stop stops the recovery process. It is safe to call more than once.
 func (r *RecoveryManager) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	if !r.running {
 		return
 	}
@@ -46,30 +221,119 @@ func (r *RecoveryManager) Stop() {
 	close(r.stopCh)
 }
 
-func (r *RecoveryManager) recoveryLoop(ctx context.Context) {
+func (r *RecoveryManager) recoveryLoop(ctx context.Context, stopCh chan struct{}) {
 	ticker := time.NewTicker(r.interval)
 	defer ticker.Stop()
 
+	defer r.releaseLock()
+
+	// Stop cancels a check in progress, as the parent context ending does
+	checkCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-checkCtx.Done():
+		}
+	}()
+
 	for {
 		select {
 		case <-ctx.Done():
+			r.loopExited(stopCh)
 			return
-		case <-r.stopCh:
+		case <-stopCh:
 			return
 		case <-ticker.C:
-			r.recoverStuckSteps(ctx)
+			r.Check(checkCtx)
 		}
 	}
 }
 
+// Check runs one round of recovery right away, as Start does every
+// interval, stopping early once ctx is done. With a fake clock set through
+// WithRecoveryClock, tests can use it to trigger recovery deterministically
+// instead of waiting for the interval.
+func (r *RecoveryManager) Check(ctx context.Context) {
+	if r.checkTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.checkTimeout)
+		defer cancel()
+	}
+
+	if !r.holdLock(ctx) {
+		return
+	}
+	r.recoverStuckSteps(ctx)
+	r.recoverStuckCompensations(ctx)
+	r.expireSagas(ctx)
+	if err := ctx.Err(); err != nil {
+		r.logger.Warn("Recovery check stopped early", "error", err)
+	}
+}
+
+// holdLock acquires or renews the recovery lock, reporting whether this
+// manager may run the check. Without a locker it always may.
+func (r *RecoveryManager) holdLock(ctx context.Context) bool {
+	if r.locker == nil {
+		return true
+	}
+	held, err := r.locker.AcquireLock(ctx, recoveryLockName, r.owner, 3*r.interval)
+	if err != nil {
+		r.logger.Error("Failed to acquire recovery lock", "error", err)
+		return false
+	}
+	if !held {
+		r.logger.Debug("Recovery lock held by another instance")
+	}
+	return held
+}
+
+// releaseLock lets another instance take over recovery once this loop ends
+func (r *RecoveryManager) releaseLock() {
+	if r.locker == nil {
+		return
+	}
+	if err := r.locker.Release(context.Background(), recoveryLockName, r.owner); err != nil {
+		r.logger.Error("Failed to release recovery lock", "error", err)
+	}
+}
+
+// loopExited marks recovery as stopped after its context ended, unless it
+// has already been stopped or restarted in the meantime
+func (r *RecoveryManager) loopExited(stopCh chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.running && r.stopCh == stopCh {
+		r.running = false
+		close(r.stopCh)
+	}
+}
+
 func (r *RecoveryManager) recoverStuckSteps(ctx context.Context) {
 	stuckSteps, err := r.storage.GetStuckSteps(ctx, r.stepTimeout)
 	if err != nil {
-		log.Printf("Failed to get stuck steps: %v", err)
+		r.logger.Error("Failed to get stuck steps", "error", err)
 		return
 	}
 
+	now := r.now()
+	recovered := 0
 	for _, step := range stuckSteps {
+		if ctx.Err() != nil {
+			return
+		}
+		if r.maxPerTick > 0 && recovered >= r.maxPerTick {
+			r.logger.Info("Recovery limit reached, deferring remaining steps",
+				"limit", r.maxPerTick, "stuck", len(stuckSteps))
+			return
+		}
+		if r.recentlyRecovered(step, now) || r.backingOff(step, now) {
+			continue
+		}
+
 		var reason string
 
 		switch step.Status {
@@ -77,24 +341,187 @@ func (r *RecoveryManager) recoverStuckSteps(ctx context.Context) {
 			reason = "pending too long"
 		case StatusProcessing:
 			reason = "processing too long"
+		}
 
-			// Reset to pending so it can be picked up again
-			step.Status = StatusPending
-			step.StartedAt = nil
-			r.storage.UpdateStep(ctx, &step)
+		// Record the recovery on the step, resetting it to pending so it can
+		// be picked up again, unless a worker or another recovery manager
+		// got to it since the scan
+		from := step.Status
+		step.RecoveryAttempts++
+		step.LastRecoveredAt = &now
+		if !r.resetStep(ctx, step, StatusPending) {
+			continue
 		}
 
-		log.Printf("Recovering stuck step: %s (saga: %s) - %s", step.ID, step.SagaID, reason)
+		r.logger.Info("Recovering stuck step",
+			"saga_id", step.SagaID, "step_id", step.ID, "status", from, "reason", reason)
+		recovered++
 
 		// Re-publish the step execution message
 		msg := Message{
-			Type:   "step_execute",
+			Type:   "step_recover",
 			SagaID: step.SagaID,
 			StepID: step.ID,
 		}
 
-		if err := r.pubsub.Publish(ctx, "saga_events", msg); err != nil {
-			log.Printf("Failed to republish step %s: %v", step.ID, err)
+		if err := r.pubsub.Publish(ctx, shardTopic(r.topic, r.shards, msg.SagaID), msg); err != nil {
+			r.logger.Error("Failed to republish step",
+				"saga_id", step.SagaID, "step_id", step.ID, "error", err)
 		}
 	}
 }
+
+// backingOff reports whether a step recovered before is still within its
+// backoff. The backoff adds to the step timeout, counted from when the step
+// started processing or was last updated.
+func (r *RecoveryManager) backingOff(step Step, now time.Time) bool {
+	delay := r.recoveryDelay(step)
+	if delay <= 0 {
+		return false
+	}
+	since := step.UpdatedAt
+	if step.Status == StatusProcessing && step.StartedAt != nil {
+		since = *step.StartedAt
+	}
+	return now.Sub(since) < r.stepTimeout+delay
+}
+
+// recoveryDelay returns how long to back off before recovering the step
+// again. The jitter is derived from the step ID and attempt, so it stays the
+// same across checks instead of being redrawn every tick.
+func (r *RecoveryManager) recoveryDelay(step Step) time.Duration {
+	if r.backoffBase <= 0 || step.RecoveryAttempts == 0 {
+		return 0
+	}
+
+	delay := r.backoffBase
+	for i := 1; i < step.RecoveryAttempts && delay < r.backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > r.backoffMax {
+		delay = r.backoffMax
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(step.ID + "/" + strconv.Itoa(step.RecoveryAttempts)))
+	jitter := float64(h.Sum64()%1000)/1000 - 0.5 // in [-0.5, 0.5)
+	return delay + time.Duration(jitter*float64(delay))
+}
+
+// recoverStuckCompensations restarts rollbacks that made no progress within
+// the step timeout, e.g. because a step_compensate message was lost or the
+// instance running a step died mid-rollback. Steps stuck executing or
+// compensating are reset so the orchestrator can pick them up again.
+func (r *RecoveryManager) recoverStuckCompensations(ctx context.Context) {
+	stuck, err := r.storage.GetStuckCompensations(ctx, r.stepTimeout)
+	if err != nil {
+		r.logger.Error("Failed to get stuck compensations", "error", err)
+		return
+	}
+
+	for _, saga := range stuck {
+		if ctx.Err() != nil {
+			return
+		}
+		for _, step := range saga.Steps {
+			switch step.Status {
+			case StatusProcessing:
+				r.resetStep(ctx, step, StatusPending)
+			case StatusCompensating:
+				to := StatusCompleted
+				if step.CompensateFailedStep && step.Error != "" {
+					to = StatusFailed // Cleaning up after its own failure
+				}
+				r.resetStep(ctx, step, to)
+			}
+		}
+
+		r.logger.Info("Resuming stuck compensation", "saga_id", saga.ID, "status", saga.Status)
+
+		msg := Message{
+			Type:   "saga_compensate",
+			SagaID: saga.ID,
+		}
+
+		if err := r.pubsub.Publish(ctx, shardTopic(r.topic, r.shards, msg.SagaID), msg); err != nil {
+			r.logger.Error("Failed to publish compensation resume",
+				"saga_id", saga.ID, "error", err)
+		}
+	}
+}
+
+// resetStep moves a stuck step back to status to so it can be retried, and
+// reports whether it did, which it doesn't if the step changed since it was
+// read. A step reset to pending loses the timing of the run it abandoned,
+// while one whose compensation is retried keeps that of its execution.
+func (r *RecoveryManager) resetStep(ctx context.Context, step Step, to Status) bool {
+	from := step.Status
+	reset := step
+	reset.Status = to
+	if to == StatusPending {
+		reset.StartedAt = nil
+		reset.CompletedAt = nil
+	}
+	err := r.storage.UpdateStep(ctx, &reset)
+	if errors.Is(err, ErrVersionConflict) {
+		return false
+	}
+	if err != nil {
+		r.logger.Error("Failed to reset step",
+			"saga_id", step.SagaID, "step_id", step.ID, "error", err)
+		return false
+	}
+	if from != to {
+		r.recordReset(ctx, step, from, to)
+	}
+	return true
+}
+
+// recentlyRecovered reports whether the step was recovered, by any recovery
+// manager, within the WithRecoveryRate interval
+func (r *RecoveryManager) recentlyRecovered(step Step, now time.Time) bool {
+	return r.minInterval > 0 && step.LastRecoveredAt != nil && now.Sub(*step.LastRecoveredAt) < r.minInterval
+}
+
+// expireSagas asks the orchestrators to fail sagas that ran past their deadline
+func (r *RecoveryManager) expireSagas(ctx context.Context) {
+	expired, err := r.storage.GetExpiredSagas(ctx, r.now())
+	if err != nil {
+		r.logger.Error("Failed to get expired sagas", "error", err)
+		return
+	}
+
+	for _, saga := range expired {
+		if ctx.Err() != nil {
+			return
+		}
+		r.logger.Warn("Saga exceeded its deadline", "saga_id", saga.ID)
+
+		msg := Message{
+			Type:   "saga_timeout",
+			SagaID: saga.ID,
+		}
+
+		if err := r.pubsub.Publish(ctx, shardTopic(r.topic, r.shards, msg.SagaID), msg); err != nil {
+			r.logger.Error("Failed to publish saga timeout", "saga_id", saga.ID, "error", err)
+		}
+	}
+}
+
+func (r *RecoveryManager) recordReset(ctx context.Context, step Step, from, to Status) {
+	if r.events == nil {
+		return
+	}
+
+	event := SagaEvent{
+		SagaID:     step.SagaID,
+		StepID:     step.ID,
+		FromStatus: from,
+		ToStatus:   to,
+		Timestamp:  r.now(),
+	}
+	if err := r.events.Append(ctx, event); err != nil {
+		r.logger.Error("Failed to record saga event",
+			"saga_id", step.SagaID, "step_id", step.ID, "error", err)
+	}
+}
@@ -0,0 +1,61 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ReenqueuePending publishes a step_execute message for every pending step
+// that is ready to run, oldest first, so that on startup, when nothing can
+// be processing them, the steps left behind by a crash run right away
+// instead of waiting out recovery's step timeout. Steps of sagas that
+// finished, are rolling back or are paused are skipped, as are steps whose
+// dependencies haven't completed. Steps whose original message is still
+// on its way run once, since the first worker to claim a step runs it. It
+// returns the first error reading storage or publishing, after publishing
+// the messages before it.
+func (o *Orchestrator) ReenqueuePending(ctx context.Context) error {
+	steps, err := o.storage.GetPendingSteps(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get pending steps: %w", err)
+	}
+	sort.SliceStable(steps, func(i, j int) bool {
+		return steps[i].CreatedAt.Before(steps[j].CreatedAt)
+	})
+
+	sagas := make(map[string]*Saga)
+	published := 0
+	for i := range steps {
+		step := &steps[i]
+		saga, exists := sagas[step.SagaID]
+		if !exists {
+			saga, err = o.storage.GetSaga(ctx, step.SagaID)
+			if errors.Is(err, ErrSagaNotFound) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to get saga: %w", err)
+			}
+			sagas[step.SagaID] = saga
+		}
+		if !StepReady(saga, step) {
+			continue
+		}
+
+		msg := Message{
+			Type:     "step_execute",
+			SagaID:   saga.ID,
+			StepID:   step.ID,
+			Metadata: saga.Metadata,
+		}
+		if err := o.pubsub.Publish(ctx, o.stepTopic(saga.ID), msg); err != nil {
+			return fmt.Errorf("failed to publish step %s: %w", step.ID, err)
+		}
+		published++
+	}
+
+	o.logger.Info("Re-enqueued pending steps", "count", published)
+	return nil
+}
@@ -0,0 +1,58 @@
+package saga
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ReservedKeyPrefix starts the saga data keys kept for the library's own
+// use. Handlers may read such keys but not add or change them.
+const ReservedKeyPrefix = "_saga."
+
+// ErrReservedKey is the error a step fails with when its handler adds or
+// changes a reserved data key
+var ErrReservedKey = errors.New("reserved data key")
+
+// WithReservedKeyPrefix reserves the data keys starting with prefix as well
+// as those starting with ReservedKeyPrefix, e.g. for keys a StepMiddleware
+// stores in saga data. A step whose handler adds or changes a reserved key
+// fails permanently with ErrReservedKey instead of having its data merged,
+// which compensates its saga. prefix must not be empty.
+func WithReservedKeyPrefix(prefix string) Option {
+	if prefix == "" {
+		panic("saga: reserved key prefix must not be empty")
+	}
+	return func(o *Orchestrator) {
+		o.reservedPrefixes = append(o.reservedPrefixes, prefix)
+	}
+}
+
+// checkReservedKeys returns an error wrapping ErrReservedKey if a handler
+// given input left output with a reserved key added or changed
+func (o *Orchestrator) checkReservedKeys(input, output map[string]interface{}) error {
+	for k, v := range output {
+		if !o.reservedKey(k) {
+			continue
+		}
+		if before, exists := input[k]; exists && reflect.DeepEqual(before, v) {
+			continue
+		}
+		return fmt.Errorf("%w: %s", ErrReservedKey, k)
+	}
+	return nil
+}
+
+// reservedKey reports whether key starts with a reserved prefix
+func (o *Orchestrator) reservedKey(key string) bool {
+	if strings.HasPrefix(key, ReservedKeyPrefix) {
+		return true
+	}
+	for _, prefix := range o.reservedPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// permanentError marks a handler error that retrying won't fix
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// retryableError marks a handler error that may succeed on another attempt
+type retryableError struct{ err error }
+
+func (e retryableError) Error() string { return e.err.Error() }
+func (e retryableError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying, e.g. a validation failure. A
+// step whose handler returns it fails immediately, whatever
+// WithMaxAttempts allows.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err: err}
+}
+
+// Retryable marks err as transient, e.g. a network blip, so its step is
+// retried while WithMaxAttempts allows
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return retryableError{err: err}
+}
+
+// IsPermanent reports whether err was marked with Permanent
+func IsPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// IsRetryable reports whether err was marked with Retryable
+func IsRetryable(err error) bool {
+	var r retryableError
+	return errors.As(err, &r)
+}
+
+// WithMaxAttempts lets a failing step execute up to n times before the saga
+// is compensated. Errors marked with Permanent are never retried; whether
+// unmarked errors are is set with WithDefaultRetryable. n must be positive;
+// the default is 1, meaning no retries.
+func WithMaxAttempts(n int) Option {
+	if n <= 0 {
+		panic("saga: max attempts must be positive")
+	}
+	return func(o *Orchestrator) {
+		o.maxAttempts = n
+	}
+}
+
+// WithDefaultRetryable sets whether errors marked with neither Permanent
+// nor Retryable are retried. They are by default.
+func WithDefaultRetryable(retryable bool) Option {
+	return func(o *Orchestrator) {
+		o.plainErrorsPermanent = !retryable
+	}
+}
+
+// shouldRetry reports whether a step that failed with err gets another attempt
+func (o *Orchestrator) shouldRetry(step *Step, err error) bool {
+	if step.Attempts >= o.maxAttempts || IsPermanent(err) {
+		return false
+	}
+	return IsRetryable(err) || !o.plainErrorsPermanent
+}
+
+// retryStep puts a processing step back to pending and schedules it again.
+// If the saga started compensating meanwhile, the rollback resumes instead.
+// The caller must hold the saga's lock.
+func (o *Orchestrator) retryStep(ctx context.Context, step *Step, stepErr error) error {
+	saga, err := o.storage.GetSaga(ctx, step.SagaID)
+	if err != nil {
+		return fmt.Errorf("failed to get saga: %w", err)
+	}
+	var scheduled []OutboxMessage
+	if saga.Status != StatusCompensating {
+		scheduled = o.scheduleSteps(Message{
+			Type:     "step_execute",
+			SagaID:   saga.ID,
+			StepID:   step.ID,
+			Metadata: saga.Metadata,
+		})
+	}
+
+	step.Status = StatusPending
+	step.Error = stepErr.Error()
+	step.Failure = o.stepFailure(step, stepErr)
+	if err := o.updateStepWith(ctx, step, scheduled); err != nil {
+		return fmt.Errorf("failed to reset step for retry: %w", err)
+	}
+	o.recordEvent(ctx, SagaEvent{SagaID: step.SagaID, StepID: step.ID, FromStatus: StatusProcessing, ToStatus: StatusPending, Error: step.Error})
+	o.logger.Warn("Step failed, retrying",
+		"saga_id", step.SagaID, "step_id", step.ID, "step", step.Name, "attempt", step.Attempts, "error", step.Error)
+
+	if saga.Status == StatusCompensating {
+		setStep(saga, step)
+		o.compensateNext(ctx, saga)
+		return nil
+	}
+	o.send(ctx, scheduled)
+	return nil
+}
+
+// RetrySaga runs a failed saga again once the cause of its failure has been
+// fixed, instead of starting a new one. Only failed sagas can be retried;
+// rolled back and canceled sagas, and sagas still compensating, are refused,
+// as are sagas past their deadline.
+//
+// The failed step and every step that was compensated are reset to pending
+// and run again in dependency order. Completed steps that were never rolled
+// back, such as NoCompensation steps or every step before the failed one if
+// compensation left them alone, keep their results and don't run again. The
+// saga's data is kept as it was, including keys the compensated steps
+// wrote. Steps keep counting their attempts, and those count against
+// WithMaxAttempts.
+func (o *Orchestrator) RetrySaga(ctx context.Context, sagaID string) error {
+	unlock := o.lockSaga(sagaID)
+	defer unlock()
+
+	saga, err := o.storage.GetSaga(ctx, sagaID)
+	if err != nil {
+		return fmt.Errorf("failed to get saga: %w", err)
+	}
+	if saga.Status != StatusFailed {
+		return fmt.Errorf("cannot retry %s saga %s", saga.Status, sagaID)
+	}
+	if o.deadlineExceeded(saga) {
+		return fmt.Errorf("cannot retry saga %s past its deadline", sagaID)
+	}
+
+	for i := range saga.Steps {
+		step := &saga.Steps[i]
+		if step.Status != StatusFailed && step.Status != StatusCompensated {
+			continue
+		}
+		from := step.Status
+		step.Status = StatusPending
+		step.Error = ""
+		step.Failure = nil
+		step.Data = make(map[string]interface{})
+		step.InputData = nil
+		step.OutputData = nil
+		step.StartedAt = nil
+		step.CompletedAt = nil
+		if err := o.storage.UpdateStep(ctx, step); err != nil {
+			return fmt.Errorf("failed to reset step %s: %w", step.Name, err)
+		}
+		o.recordEvent(ctx, SagaEvent{SagaID: sagaID, StepID: step.ID, FromStatus: from, ToStatus: StatusPending})
+	}
+
+	saga, err = o.storage.GetSaga(ctx, sagaID)
+	if err != nil {
+		return fmt.Errorf("failed to get saga: %w", err)
+	}
+	saga.Status = StatusPending
+	saga.Error = ""
+	saga.FailedStepID = ""
+	saga.FinishedAt = nil
+	scheduled := o.scheduleSteps(runnableStepMessages(saga)...)
+	if err := o.saveSagaWith(ctx, saga, scheduled); err != nil {
+		return fmt.Errorf("failed to save saga: %w", err)
+	}
+	o.recordEvent(ctx, SagaEvent{SagaID: sagaID, FromStatus: StatusFailed, ToStatus: StatusPending})
+	o.notifyWaiters(sagaID, StatusPending)
+	o.logger.Info("Saga retried", "saga_id", sagaID)
+	o.send(ctx, scheduled)
+	return nil
+}
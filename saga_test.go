@@ -1,10 +1,23 @@
 package saga
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"go.uber.org/goleak"
 )
 
 func TestSagaSuccess(t *testing.T) {
@@ -42,8 +55,7 @@ func TestSagaSuccess(t *testing.T) {
 		t.Fatalf("Failed to start saga: %v", err)
 	}
 
-	// Wait for completion
-	time.Sleep(500 * time.Millisecond)
+	waitForSaga(t, orchestrator, sagaInstance.ID)
 
 	finalSaga, err := storage.GetSaga(context.Background(), sagaInstance.ID)
 	if err != nil {
@@ -58,6 +70,15 @@ func TestSagaSuccess(t *testing.T) {
 		t.Errorf("Expected 2 steps, got %d", len(finalSaga.Steps))
 	}
 
+	// Each step records what it received and what it produced
+	step2 := finalSaga.Steps[1]
+	if _, saw := step2.InputData["step2_result"]; saw || step2.InputData["step1_result"] != "done" {
+		t.Errorf("Unexpected step2 input: %v", step2.InputData)
+	}
+	if step2.OutputData["step2_result"] != "done" {
+		t.Errorf("Unexpected step2 output: %v", step2.OutputData)
+	}
+
 	for _, step := range finalSaga.Steps {
 		if step.Status != StatusCompleted {
 			t.Errorf("Expected step %s to be completed, got %s", step.Name, step.Status)
@@ -100,8 +121,7 @@ func TestSagaFailureAndCompensation(t *testing.T) {
 		t.Fatalf("Failed to start saga: %v", err)
 	}
 
-	// Wait for completion and compensation
-	time.Sleep(500 * time.Millisecond)
+	waitForSaga(t, orchestrator, sagaInstance.ID)
 
 	finalSaga, err := storage.GetSaga(context.Background(), sagaInstance.ID)
 	if err != nil {
@@ -125,4 +145,5194 @@ func TestSagaFailureAndCompensation(t *testing.T) {
 	if finalSaga.Steps[1].Status != StatusFailed {
 		t.Errorf("Expected second step to be failed, got %s", finalSaga.Steps[1].Status)
 	}
+
+	// The failed step kept the data it was given
+	failed, err := storage.GetStep(context.Background(), finalSaga.Steps[1].ID)
+	if err != nil {
+		t.Fatalf("Failed to get step: %v", err)
+	}
+	if failed.InputData["step1_done"] != true || failed.InputData["input"] != "test" {
+		t.Errorf("Expected failed step input to include earlier results, got %v", failed.InputData)
+	}
+	if failed.OutputData != nil {
+		t.Errorf("Expected no output for a failed step, got %v", failed.OutputData)
+	}
+
+	// The saga records which step failed and why
+	if finalSaga.Error != "step failing_step failed: intentional failure" {
+		t.Errorf("Unexpected saga error: %q", finalSaga.Error)
+	}
+	if finalSaga.FailedStepID != finalSaga.Steps[1].ID {
+		t.Errorf("Expected failed step ID %s, got %s", finalSaga.Steps[1].ID, finalSaga.FailedStepID)
+	}
+}
+
+func TestConcurrentStepDataMerge(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+
+	// Both handlers wait for each other so their data merges overlap
+	var started sync.WaitGroup
+	started.Add(2)
+	writer := func(key string) func(ctx context.Context, data map[string]interface{}) error {
+		return func(ctx context.Context, data map[string]interface{}) error {
+			started.Done()
+			started.Wait()
+			data[key] = "done"
+			return nil
+		}
+	}
+
+	// Both steps are roots so they are runnable at the same time
+	sagaInstance, err := NewBuilder("parallel_saga", orchestrator).
+		Step("left", writer("left_result"), nil).DependsOn().
+		Step("right", writer("right_result"), nil).DependsOn().
+		WithData("input", "test").
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	var done sync.WaitGroup
+	for _, step := range sagaInstance.Steps {
+		done.Add(1)
+		go func(stepID string) {
+			defer done.Done()
+			if err := orchestrator.ExecuteStep(context.Background(), stepID); err != nil {
+				t.Errorf("Failed to execute step: %v", err)
+			}
+		}(step.ID)
+	}
+	done.Wait()
+
+	finalSaga, err := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to get saga: %v", err)
+	}
+
+	for _, key := range []string{"input", "left_result", "right_result"} {
+		if _, ok := finalSaga.Data[key]; !ok {
+			t.Errorf("Expected saga data to contain %q, got %v", key, finalSaga.Data)
+		}
+	}
+}
+
+func TestDuplicateDeliveryExecutesOnce(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+
+	var calls int32
+	orchestrator.RegisterHandler("charge", NewStepHandler(
+		func(ctx context.Context, data map[string]interface{}) error {
+			atomic.AddInt32(&calls, 1)
+			return nil
+		},
+		nil,
+	))
+
+	sagaInstance, err := orchestrator.StartSaga(context.Background(), "dedup_saga", []string{"charge"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	// Simulate the same step_execute message being delivered many times
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := orchestrator.ExecuteStep(context.Background(), sagaInstance.Steps[0].ID); err != nil {
+				t.Errorf("Failed to execute step: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("Expected handler to run once, ran %d times", got)
+	}
+}
+
+func TestSagaDependencies(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) func(ctx context.Context, data map[string]interface{}) error {
+		return func(ctx context.Context, data map[string]interface{}) error {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return nil
+		}
+	}
+
+	sagaInstance, err := NewBuilder("dag_saga", orchestrator).
+		Step("a", record("a"), nil).
+		Step("b", record("b"), nil).DependsOn().
+		Step("c", record("c"), nil).DependsOn("a", "b").
+		Step("d", record("d"), nil).DependsOn("a").
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	waitForSaga(t, orchestrator, sagaInstance.ID)
+
+	finalSaga, err := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to get saga: %v", err)
+	}
+
+	if finalSaga.Status != StatusCompleted {
+		t.Errorf("Expected saga status to be completed, got %s", finalSaga.Status)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	position := make(map[string]int)
+	for i, name := range order {
+		position[name] = i
+	}
+	if len(position) != 4 {
+		t.Fatalf("Expected all 4 steps to run once, got %v", order)
+	}
+	if position["c"] < position["a"] || position["c"] < position["b"] {
+		t.Errorf("Expected c to run after a and b, got %v", order)
+	}
+	if position["d"] < position["a"] {
+		t.Errorf("Expected d to run after a, got %v", order)
+	}
+}
+
+func TestRunToCompletion(t *testing.T) {
+	orchestrator := NewTestOrchestrator()
+	defer orchestrator.PubSub.Close()
+
+	var order []string
+	record := func(name string, fail bool) func(ctx context.Context, data map[string]interface{}) error {
+		return func(ctx context.Context, data map[string]interface{}) error {
+			order = append(order, name)
+			if fail {
+				return errors.New("boom")
+			}
+			return nil
+		}
+	}
+
+	// Independent steps run one at a time in declaration order, and the
+	// rollback in reverse, so the order is the same on every run
+	sagaInstance, err := NewBuilder("sync_saga", orchestrator.Orchestrator).
+		Step("a", record("a", false), record("undo_a", false)).
+		Step("b", record("b", false), record("undo_b", false)).DependsOn().
+		Step("c", record("c", true), nil).DependsOn("a", "b").
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if len(order) != 0 {
+		t.Fatalf("Expected nothing to run before RunToCompletion, got %v", order)
+	}
+
+	finalSaga, err := orchestrator.RunToCompletion(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to run saga: %v", err)
+	}
+	if finalSaga.Status != StatusFailed {
+		t.Errorf("Expected saga status to be failed, got %s", finalSaga.Status)
+	}
+	if want := []string{"a", "b", "c", "undo_b", "undo_a"}; !slices.Equal(order, want) {
+		t.Errorf("Expected %v, got %v", want, order)
+	}
+
+	paused, err := orchestrator.StartSaga(context.Background(), "sync_saga", []string{"a"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if err := orchestrator.PauseSaga(context.Background(), paused.ID); err != nil {
+		t.Fatalf("Failed to pause saga: %v", err)
+	}
+	if sg, err := orchestrator.RunToCompletion(context.Background(), paused.ID); !errors.Is(err, ErrSagaStuck) || sg.Status != StatusPaused {
+		t.Errorf("Expected a paused saga to be stuck, got %v", err)
+	}
+}
+
+func TestFollowUpCompensations(t *testing.T) {
+	orchestrator := NewTestOrchestrator()
+	defer orchestrator.PubSub.Close()
+
+	var order []string
+	noop := func(ctx context.Context, data map[string]interface{}) error { return nil }
+	release := func(name string) StepHandler {
+		return NewStepHandler(noop, func(ctx context.Context, data map[string]interface{}) error {
+			order = append(order, fmt.Sprintf("%s:%v", name, data["refund_id"]))
+			return nil
+		})
+	}
+
+	sagaInstance, err := NewBuilder("followups", orchestrator.Orchestrator).
+		Step("reserve", noop, func(ctx context.Context, data map[string]interface{}) error {
+			order = append(order, fmt.Sprintf("reserve:%v", data["refund_id"]))
+			return nil
+		}).
+		Step("charge", noop, func(ctx context.Context, data map[string]interface{}) error {
+			order = append(order, "charge")
+			data["refund_id"] = "r1"
+			return AddCompensations(ctx,
+				StepSpec{Name: "release_east", Handler: release("release_east")},
+				StepSpec{Name: "release_west", Handler: release("release_west")},
+			)
+		}).
+		Step("ship", func(ctx context.Context, data map[string]interface{}) error {
+			return errors.New("no courier")
+		}, nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	finalSaga, err := orchestrator.RunToCompletion(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to run saga: %v", err)
+	}
+	if finalSaga.Status != StatusFailed {
+		t.Errorf("Expected saga status to be failed, got %s", finalSaga.Status)
+	}
+	// The follow-ups run next, in the order added, and every compensation
+	// after charge sees what it wrote
+	want := []string{"charge", "release_east:r1", "release_west:r1", "reserve:r1"}
+	if !slices.Equal(order, want) {
+		t.Errorf("Expected %v, got %v", want, order)
+	}
+	if finalSaga.Data["refund_id"] != "r1" {
+		t.Errorf("Expected the compensation's data to be kept, got %v", finalSaga.Data)
+	}
+	if compensated := finalSaga.CompensatedStepCount(); compensated != 4 {
+		t.Errorf("Expected 4 compensated steps, got %d", compensated)
+	}
+
+	if err := AddCompensations(context.Background(), StepSpec{Name: "x"}); err == nil {
+		t.Error("Expected AddCompensations to fail outside a compensation")
+	}
+}
+
+func TestOutOfOrderCompletions(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	// The first step only finishes once steps declared after it have
+	// completed, so completions leave a gap at the front
+	release := make(chan struct{})
+	var joined int32
+	sagaInstance, err := NewBuilder("gap_saga", orchestrator).
+		Step("slow", func(ctx context.Context, data map[string]interface{}) error {
+			select {
+			case <-release:
+				return nil
+			case <-time.After(5 * time.Second):
+				return errors.New("steps after the gap never ran")
+			}
+		}, nil).
+		Step("fast", func(ctx context.Context, data map[string]interface{}) error { return nil }, nil).DependsOn().
+		Step("after_fast", func(ctx context.Context, data map[string]interface{}) error {
+			close(release)
+			return nil
+		}, nil).DependsOn("fast").
+		Step("join", func(ctx context.Context, data map[string]interface{}) error {
+			atomic.AddInt32(&joined, 1)
+			return nil
+		}, nil).DependsOn("slow", "after_fast").
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusCompleted {
+		t.Errorf("Expected saga status to be completed, got %s", status)
+	}
+	if n := atomic.LoadInt32(&joined); n != 1 {
+		t.Errorf("Expected the join step to run once, got %d", n)
+	}
+}
+
+type failingSaveStorage struct {
+	*MemoryStorage
+}
+
+func (s failingSaveStorage) SaveSaga(ctx context.Context, saga *Saga) error {
+	return errors.New("disk full")
+}
+
+func TestExecuteErrors(t *testing.T) {
+	orchestrator := NewOrchestrator(failingSaveStorage{NewMemoryStorage()}, nil)
+	noop := func(ctx context.Context, data map[string]interface{}) error { return nil }
+
+	_, err := NewBuilder("cyclic", orchestrator).
+		Step("a", noop, nil).DependsOn("b").
+		Step("b", noop, nil).
+		Execute(context.Background())
+	if !errors.Is(err, ErrInvalidSaga) || errors.Is(err, ErrStorageFailure) {
+		t.Errorf("Expected an invalid saga error, got %v", err)
+	}
+
+	_, err = NewBuilder("unsaved", orchestrator).
+		Step("a", noop, nil).
+		Execute(context.Background())
+	if !errors.Is(err, ErrStorageFailure) || errors.Is(err, ErrInvalidSaga) {
+		t.Errorf("Expected a storage failure, got %v", err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "failed to save saga: disk full") {
+		t.Errorf("Expected the storage error to be kept, got %v", err)
+	}
+
+	// A saga that wasn't started leaves no handlers behind
+	for _, name := range []string{"cyclic", "unsaved"} {
+		if handlers := orchestrator.RegisteredHandlers(name); len(handlers) != 0 {
+			t.Errorf("Expected no handlers for %s, got %v", name, handlers)
+		}
+	}
+}
+
+func TestDependencyCompensationOrder(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	var mu sync.Mutex
+	var compensated []string
+	compensate := func(name string) func(ctx context.Context, data map[string]interface{}) error {
+		return func(ctx context.Context, data map[string]interface{}) error {
+			mu.Lock()
+			compensated = append(compensated, name)
+			mu.Unlock()
+			return nil
+		}
+	}
+	noop := func(ctx context.Context, data map[string]interface{}) error { return nil }
+
+	sagaInstance, err := NewBuilder("dag_failure", orchestrator).
+		Step("a", noop, compensate("a")).
+		Step("b", noop, compensate("b")).DependsOn("a").
+		Step("c", noop, compensate("c")).DependsOn("a").
+		Step("d", func(ctx context.Context, data map[string]interface{}) error {
+			return errors.New("intentional failure")
+		}, compensate("d")).DependsOn("b", "c").
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	waitForSaga(t, orchestrator, sagaInstance.ID)
+
+	finalSaga, err := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to get saga: %v", err)
+	}
+
+	if finalSaga.Status != StatusFailed {
+		t.Errorf("Expected saga status to be failed, got %s", finalSaga.Status)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(compensated) != 3 || compensated[2] != "a" {
+		t.Errorf("Expected b and c to be compensated before a, got %v", compensated)
+	}
+}
+
+func TestBuilderRejectsDependencyCycles(t *testing.T) {
+	orchestrator := NewOrchestrator(NewMemoryStorage(), NewMemoryPubSub())
+	noop := func(ctx context.Context, data map[string]interface{}) error { return nil }
+
+	_, err := NewBuilder("cyclic", orchestrator).
+		Step("a", noop, nil).DependsOn("b").
+		Step("b", noop, nil).DependsOn("a").
+		Execute(context.Background())
+	if err == nil {
+		t.Fatal("Expected an error for a dependency cycle")
+	}
+
+	_, err = NewBuilder("unknown", orchestrator).
+		Step("a", noop, nil).DependsOn("missing").
+		Execute(context.Background())
+	if err == nil {
+		t.Fatal("Expected an error for an unknown dependency")
+	}
+
+	_, err = NewBuilder("duplicate", orchestrator).
+		Step("a", noop, nil).
+		Step("a", noop, nil).
+		Execute(context.Background())
+	if err == nil {
+		t.Fatal("Expected an error for duplicate step names")
+	}
+}
+
+// countingHandler is a StepHandler with its state injected, shared by the
+// sagas that use it
+type countingHandler struct {
+	executed int32
+}
+
+func (h *countingHandler) Execute(ctx context.Context, data map[string]interface{}) error {
+	atomic.AddInt32(&h.executed, 1)
+	return nil
+}
+
+func (h *countingHandler) Compensate(ctx context.Context, data map[string]interface{}) error {
+	return nil
+}
+
+func TestBuilderAddStep(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	handler := &countingHandler{}
+	noop := func(ctx context.Context, data map[string]interface{}) error { return nil }
+	for _, name := range []string{"first", "second"} {
+		sagaInstance, err := NewBuilder(name, orchestrator).
+			Step("prepare", noop, nil).
+			AddStep("count", handler).DependsOn("prepare").
+			Execute(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to start saga: %v", err)
+		}
+		if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusCompleted {
+			t.Errorf("Expected saga %s to complete, got %s", name, status)
+		}
+	}
+	if executed := atomic.LoadInt32(&handler.executed); executed != 2 {
+		t.Errorf("Expected the shared handler to run twice, got %d", executed)
+	}
+
+	_, err := NewBuilder("nil_handler", orchestrator).
+		AddStep("missing", nil).
+		Execute(context.Background())
+	if err == nil {
+		t.Fatal("Expected an error for a nil handler")
+	}
+}
+
+func TestSaveSagaKeepsClaimedStep(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+
+	var calls int32
+	count := func(ctx context.Context, data map[string]interface{}) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	}
+
+	sagaInstance, err := NewBuilder("claim_saga", orchestrator).
+		Step("left", count, nil).DependsOn().
+		Step("right", count, nil).DependsOn().
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	right := sagaInstance.Steps[1].ID
+
+	// A sibling reads the saga, then "right" is claimed by a worker
+	snapshot, err := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to get saga: %v", err)
+	}
+	claimed, err := storage.UpdateStepStatus(context.Background(), right, StatusPending, StatusProcessing)
+	if err != nil || !claimed {
+		t.Fatalf("Failed to claim step: %v", err)
+	}
+
+	// The sibling saves its stale snapshot when it finishes
+	if err := storage.SaveSaga(context.Background(), snapshot); err != nil {
+		t.Fatalf("Failed to save saga: %v", err)
+	}
+
+	step, err := storage.GetStep(context.Background(), right)
+	if err != nil {
+		t.Fatalf("Failed to get step: %v", err)
+	}
+	if step.Status != StatusProcessing {
+		t.Errorf("Expected claimed step to stay processing, got %s", step.Status)
+	}
+
+	// A duplicate delivery must not run the claimed step again
+	if err := orchestrator.ExecuteStep(context.Background(), right); err != nil {
+		t.Errorf("Failed to execute step: %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 0 {
+		t.Errorf("Expected claimed step not to run again, ran %d times", got)
+	}
+}
+
+func TestConditionalStepSkipped(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	var chargeCompensated int32
+	sagaInstance, err := NewBuilder("conditional_saga", orchestrator).
+		Step("apply_coupon",
+			func(ctx context.Context, data map[string]interface{}) error {
+				data["amount"] = 0
+				return nil
+			},
+			func(ctx context.Context, data map[string]interface{}) error {
+				return nil
+			},
+		).
+		StepIf("charge_card",
+			func(data map[string]interface{}) bool {
+				amount, _ := data["amount"].(int)
+				return amount > 0
+			},
+			func(ctx context.Context, data map[string]interface{}) error {
+				return nil
+			},
+			func(ctx context.Context, data map[string]interface{}) error {
+				atomic.AddInt32(&chargeCompensated, 1)
+				return nil
+			},
+		).
+		Step("ship_order",
+			func(ctx context.Context, data map[string]interface{}) error {
+				return errors.New("intentional failure")
+			},
+			nil,
+		).
+		WithData("amount", 10).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	waitForSaga(t, orchestrator, sagaInstance.ID)
+
+	finalSaga, err := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to get saga: %v", err)
+	}
+
+	if finalSaga.Status != StatusFailed {
+		t.Errorf("Expected saga status to be failed, got %s", finalSaga.Status)
+	}
+
+	// The condition sees the amount written by apply_coupon, not the initial one
+	if finalSaga.Steps[1].Status != StatusSkipped {
+		t.Errorf("Expected charge_card to be skipped, got %s", finalSaga.Steps[1].Status)
+	}
+
+	if finalSaga.Steps[0].Status != StatusCompensated {
+		t.Errorf("Expected apply_coupon to be compensated, got %s", finalSaga.Steps[0].Status)
+	}
+
+	if atomic.LoadInt32(&chargeCompensated) != 0 {
+		t.Error("Expected skipped step not to be compensated")
+	}
+}
+
+func TestBranch(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	var mu sync.Mutex
+	var calls []string
+	record := func(call string, err error) func(context.Context, map[string]interface{}) error {
+		return func(ctx context.Context, data map[string]interface{}) error {
+			mu.Lock()
+			calls = append(calls, call)
+			mu.Unlock()
+			return err
+		}
+	}
+	step := func(name string) StepSpec {
+		return StepSpec{Name: name, Handler: NewStepHandler(record(name, nil), record("undo_"+name, nil))}
+	}
+
+	for _, tc := range []struct {
+		risk     interface{}
+		finalize error
+		status   Status
+		calls    []string
+		statuses []Status
+	}{
+		{
+			risk:     "low",
+			status:   StatusCompleted,
+			calls:    []string{"auto_approve", "notify", "finalize"},
+			statuses: []Status{StatusCompleted, StatusSkipped, StatusCompleted, StatusCompleted, StatusCompleted},
+		},
+		{
+			risk:     "high",
+			finalize: errors.New("intentional failure"),
+			status:   StatusFailed,
+			calls:    []string{"manual_review", "finalize", "undo_manual_review", "undo_evaluate"},
+			statuses: []Status{StatusCompensated, StatusCompensated, StatusSkipped, StatusSkipped, StatusFailed},
+		},
+	} {
+		calls = nil
+		risk := tc.risk
+		sagaInstance, err := NewBuilder("branch_saga", orchestrator).
+			Step("evaluate",
+				func(ctx context.Context, data map[string]interface{}) error {
+					data["risk"] = risk
+					return nil
+				},
+				record("undo_evaluate", nil),
+			).
+			Branch("risk", map[string][]StepSpec{
+				"low":  {step("auto_approve"), step("notify")},
+				"high": {step("manual_review")},
+			}).
+			Step("finalize", record("finalize", tc.finalize), nil).
+			Execute(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to start saga: %v", err)
+		}
+		if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != tc.status {
+			t.Fatalf("risk %v: expected saga to be %s, got %s", risk, tc.status, status)
+		}
+
+		finalSaga, _ := storage.GetSaga(context.Background(), sagaInstance.ID)
+		for i, want := range tc.statuses {
+			if finalSaga.Steps[i].Status != want {
+				t.Errorf("risk %v: expected %s to be %s, got %s", risk, finalSaga.Steps[i].Name, want, finalSaga.Steps[i].Status)
+			}
+		}
+		mu.Lock()
+		if !slices.Equal(calls, tc.calls) {
+			t.Errorf("risk %v: expected calls %v, got %v", risk, tc.calls, calls)
+		}
+		mu.Unlock()
+	}
+
+	if _, err := NewBuilder("bad_branch", orchestrator).Branch("", nil).Execute(context.Background()); err == nil {
+		t.Error("Expected an empty branch key to be rejected")
+	}
+}
+
+type testOrder struct {
+	UserID  string  `json:"user_id"`
+	Amount  float64 `json:"amount"`
+	OrderID string  `json:"order_id,omitempty"`
+	Charged bool    `json:"charged,omitempty"`
+}
+
+func TestTypedSaga(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	sagaInstance, err := NewTypedBuilder[testOrder]("typed_saga", orchestrator).
+		Step("create_order",
+			func(ctx context.Context, order *testOrder) error {
+				order.OrderID = "order_" + order.UserID
+				return nil
+			},
+			nil,
+		).
+		Step("charge_payment",
+			func(ctx context.Context, order *testOrder) error {
+				if order.OrderID == "" {
+					return errors.New("order id from previous step is missing")
+				}
+				order.Charged = true
+				return nil
+			},
+			nil,
+		).
+		Execute(context.Background(), testOrder{UserID: "user_123", Amount: 99.99})
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	waitForSaga(t, orchestrator, sagaInstance.ID)
+
+	finalSaga, err := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to get saga: %v", err)
+	}
+
+	if finalSaga.Status != StatusCompleted {
+		t.Fatalf("Expected saga status to be completed, got %s", finalSaga.Status)
+	}
+
+	order, err := DecodeData[testOrder](finalSaga.Data)
+	if err != nil {
+		t.Fatalf("Failed to decode saga data: %v", err)
+	}
+
+	want := testOrder{UserID: "user_123", Amount: 99.99, OrderID: "order_user_123", Charged: true}
+	if order != want {
+		t.Errorf("Expected %+v, got %+v", want, order)
+	}
+}
+
+func TestShutdownWaitsForInFlightSteps(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	started := make(chan struct{})
+	sagaInstance, err := NewBuilder("shutdown_saga", orchestrator).
+		Step("slow_step",
+			func(ctx context.Context, data map[string]interface{}) error {
+				close(started)
+				time.Sleep(200 * time.Millisecond)
+				return nil
+			},
+			nil,
+		).
+		Step("next_step",
+			func(ctx context.Context, data map[string]interface{}) error {
+				return nil
+			},
+			nil,
+		).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	<-started
+	if err := orchestrator.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	// Give the next step's message a chance to be (not) processed
+	time.Sleep(100 * time.Millisecond)
+
+	finalSaga, err := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to get saga: %v", err)
+	}
+
+	if finalSaga.Steps[0].Status != StatusCompleted {
+		t.Errorf("Expected in-flight step to finish, got %s", finalSaga.Steps[0].Status)
+	}
+
+	if finalSaga.Steps[1].Status != StatusPending {
+		t.Errorf("Expected next step not to start after shutdown, got %s", finalSaga.Steps[1].Status)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(NewMemoryStorage(), pubsub)
+	orchestrator.StartListener(context.Background())
+
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	_, err := NewBuilder("stuck_saga", orchestrator).
+		Step("blocked",
+			func(ctx context.Context, data map[string]interface{}) error {
+				close(started)
+				<-release
+				return nil
+			},
+			nil,
+		).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := orchestrator.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestRunWorker(t *testing.T) {
+	storage := NewMemoryStorage()
+	orchestrator := NewOrchestrator(storage, nil)
+	if err := orchestrator.StartListener(context.Background()); err == nil {
+		t.Error("Expected the listener to need a pubsub")
+	}
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- orchestrator.RunWorker(context.Background(), 5*time.Millisecond) }()
+
+	var released int32
+	build := func(fail bool) *Saga {
+		sagaInstance, err := NewBuilder("polled_saga", orchestrator).
+			Step("reserve",
+				func(ctx context.Context, data map[string]interface{}) error { return nil },
+				func(ctx context.Context, data map[string]interface{}) error {
+					atomic.AddInt32(&released, 1)
+					return nil
+				},
+			).
+			Step("charge",
+				func(ctx context.Context, data map[string]interface{}) error {
+					if data["fail"] == true {
+						return errors.New("card declined")
+					}
+					return nil
+				},
+				nil,
+			).
+			WithData("fail", fail).
+			Execute(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to start saga: %v", err)
+		}
+		return sagaInstance
+	}
+
+	succeeding, failing := build(false), build(true)
+	if status := waitForSaga(t, orchestrator, succeeding.ID); status != StatusCompleted {
+		t.Errorf("Expected the saga to complete through the worker, got %s", status)
+	}
+	if status := waitForSaga(t, orchestrator, failing.ID); status != StatusFailed {
+		t.Errorf("Expected the failed saga to be rolled back, got %s", status)
+	}
+	if n := atomic.LoadInt32(&released); n != 1 {
+		t.Errorf("Expected the failed saga's first step to be compensated once, got %d", n)
+	}
+
+	if err := orchestrator.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Expected the worker to stop cleanly on shutdown, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the worker to stop on shutdown")
+	}
+}
+
+func TestReenqueuePending(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub(WithSyncDelivery())
+	ctx := context.Background()
+
+	// Left behind by a crash: a ready step, one waiting on it, and a
+	// pending step of a saga that already failed
+	storage.SaveSaga(ctx, &Saga{ID: "running", Status: StatusPending, Steps: []Step{
+		{ID: "ready", SagaID: "running", Name: "first", Status: StatusPending},
+		{ID: "waiting", SagaID: "running", Name: "second", Status: StatusPending, DependsOn: []string{"first"}},
+	}})
+	storage.SaveSaga(ctx, &Saga{ID: "finished", Status: StatusFailed, Steps: []Step{
+		{ID: "leftover", SagaID: "finished", Name: "first", Status: StatusPending},
+	}})
+
+	var published []string
+	pubsub.Subscribe(ctx, DefaultTopic, func(msg Message) error {
+		published = append(published, msg.Type+":"+msg.StepID)
+		return nil
+	})
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	if err := orchestrator.ReenqueuePending(ctx); err != nil {
+		t.Fatalf("Failed to re-enqueue pending steps: %v", err)
+	}
+	pubsub.Close()
+
+	if want := []string{"step_execute:ready"}; !slices.Equal(published, want) {
+		t.Errorf("Expected %v, got %v", want, published)
+	}
+}
+
+func TestSagaDeadlineStopsScheduling(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	var secondRan int32
+	sagaInstance, err := NewBuilder("deadline_saga", orchestrator).
+		Step("slow_step",
+			func(ctx context.Context, data map[string]interface{}) error {
+				time.Sleep(150 * time.Millisecond)
+				return nil
+			},
+			func(ctx context.Context, data map[string]interface{}) error {
+				return nil
+			},
+		).
+		Step("late_step",
+			func(ctx context.Context, data map[string]interface{}) error {
+				atomic.AddInt32(&secondRan, 1)
+				return nil
+			},
+			nil,
+		).
+		WithTimeout(50 * time.Millisecond).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	waitForSaga(t, orchestrator, sagaInstance.ID)
+
+	finalSaga, err := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to get saga: %v", err)
+	}
+
+	if finalSaga.Status != StatusFailed || finalSaga.Error != "saga deadline exceeded" {
+		t.Errorf("Expected saga to fail with deadline exceeded, got %s (%q)", finalSaga.Status, finalSaga.Error)
+	}
+
+	if finalSaga.Steps[0].Status != StatusCompensated {
+		t.Errorf("Expected slow_step to be compensated, got %s", finalSaga.Steps[0].Status)
+	}
+
+	if atomic.LoadInt32(&secondRan) != 0 {
+		t.Error("Expected late_step not to start after the deadline")
+	}
+}
+
+func TestContextDeadlines(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub, WithContextDeadlines())
+	orchestrator.StartListener(context.Background())
+
+	var secondRan atomic.Bool
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	sagaInstance, err := NewBuilder("request_saga", orchestrator).
+		Step("slow_step",
+			func(ctx context.Context, data map[string]interface{}) error {
+				time.Sleep(150 * time.Millisecond)
+				return nil
+			},
+			func(ctx context.Context, data map[string]interface{}) error { return nil },
+		).
+		Step("late_step",
+			func(ctx context.Context, data map[string]interface{}) error {
+				secondRan.Store(true)
+				return nil
+			},
+			nil,
+		).
+		WithTimeout(time.Hour).
+		Execute(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if deadline, _ := ctx.Deadline(); sagaInstance.Deadline == nil || !sagaInstance.Deadline.Equal(deadline) {
+		t.Errorf("Expected the context's deadline, got %v", sagaInstance.Deadline)
+	}
+
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusFailed {
+		t.Errorf("Expected the saga to fail at the context's deadline, got %s", status)
+	}
+	if secondRan.Load() {
+		t.Error("Expected late_step not to start after the deadline")
+	}
+
+	// An earlier deadline of the saga's own is kept
+	early := time.Now().Add(time.Minute)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	sagaInstance, err = NewBuilder("request_saga", orchestrator).
+		Step("late_step", func(ctx context.Context, data map[string]interface{}) error { return nil }, nil).
+		WithDeadline(early).
+		Execute(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if sagaInstance.Deadline == nil || !sagaInstance.Deadline.Equal(early) {
+		t.Errorf("Expected the earlier deadline to be kept, got %v", sagaInstance.Deadline)
+	}
+}
+
+func TestRecoveryExpiresSagaOnce(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	release := make(chan struct{})
+	var compensations int32
+	sagaInstance, err := NewBuilder("reaped_saga", orchestrator).
+		Step("blocked_step",
+			func(ctx context.Context, data map[string]interface{}) error {
+				<-release
+				return nil
+			},
+			func(ctx context.Context, data map[string]interface{}) error {
+				atomic.AddInt32(&compensations, 1)
+				return nil
+			},
+		).
+		WithTimeout(20 * time.Millisecond).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	// The reaper runs twice while the step is still executing
+	recovery := NewRecoveryManager(storage, pubsub)
+	recovery.expireSagas(context.Background())
+	time.Sleep(50 * time.Millisecond)
+	recovery.expireSagas(context.Background())
+	time.Sleep(50 * time.Millisecond)
+
+	midSaga, err := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to get saga: %v", err)
+	}
+	if midSaga.Status != StatusCompensating {
+		t.Errorf("Expected expired saga to be compensating, got %s", midSaga.Status)
+	}
+
+	// Once the in-flight step finishes it is rolled back exactly once
+	close(release)
+	waitForSaga(t, orchestrator, sagaInstance.ID)
+
+	finalSaga, err := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to get saga: %v", err)
+	}
+	if finalSaga.Steps[0].Status != StatusCompensated {
+		t.Errorf("Expected step to be compensated, got %s", finalSaga.Steps[0].Status)
+	}
+	if got := atomic.LoadInt32(&compensations); got != 1 {
+		t.Errorf("Expected one compensation, got %d", got)
+	}
+}
+
+func TestTimeoutFailOnly(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	release := make(chan struct{})
+	done := make(chan struct{})
+	var compensations, lateRan int32
+	compensate := func(ctx context.Context, data map[string]interface{}) error {
+		atomic.AddInt32(&compensations, 1)
+		return nil
+	}
+	sagaInstance, err := NewBuilder("fail_only_saga", orchestrator).
+		Step("reserve", func(ctx context.Context, data map[string]interface{}) error { return nil }, compensate).
+		Step("blocked_step", func(ctx context.Context, data map[string]interface{}) error {
+			defer close(done)
+			<-release
+			return nil
+		}, compensate).
+		Step("late_step", func(ctx context.Context, data map[string]interface{}) error {
+			atomic.AddInt32(&lateRan, 1)
+			return nil
+		}, nil).
+		WithTimeout(20 * time.Millisecond).
+		WithTimeoutPolicy(TimeoutFailOnly).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	// The reaper fails the saga while a step is still executing
+	time.Sleep(50 * time.Millisecond)
+	NewRecoveryManager(storage, pubsub).expireSagas(context.Background())
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusFailed {
+		t.Fatalf("Expected saga to fail, got %s", status)
+	}
+
+	close(release)
+	<-done
+	time.Sleep(50 * time.Millisecond)
+
+	finalSaga, err := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to get saga: %v", err)
+	}
+	if finalSaga.Status != StatusFailed || finalSaga.Error != "saga deadline exceeded" {
+		t.Errorf("Expected saga to stay failed with deadline exceeded, got %s (%q)", finalSaga.Status, finalSaga.Error)
+	}
+	for _, step := range finalSaga.Steps[:2] {
+		if step.Status != StatusCompleted {
+			t.Errorf("Expected %s to be left completed, got %s", step.Name, step.Status)
+		}
+	}
+	if got := atomic.LoadInt32(&compensations); got != 0 {
+		t.Errorf("Expected no compensations, got %d", got)
+	}
+	if atomic.LoadInt32(&lateRan) != 0 {
+		t.Error("Expected late_step not to start after the deadline")
+	}
+}
+
+// waitForSaga blocks until the saga finishes, failing the test if it takes
+// longer than a few seconds
+func waitForSaga(t *testing.T, orchestrator *Orchestrator, sagaID string) Status {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	status, err := orchestrator.WaitForCompletion(ctx, sagaID)
+	if err != nil {
+		t.Fatalf("Saga did not finish: %v", err)
+	}
+	return status
+}
+
+func TestWaitForCompletionHonorsContext(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+
+	// No listener is running, so the saga never leaves pending
+	sagaInstance, err := orchestrator.StartSaga(context.Background(), "stalled_saga", []string{"step1"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := orchestrator.WaitForCompletion(ctx, sagaInstance.ID); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestRecoveryStructuredLogging(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	startedAt := time.Now().Add(-time.Minute)
+	storage.SaveSaga(context.Background(), &Saga{
+		ID:     "saga-1",
+		Status: StatusPending,
+		Steps: []Step{{
+			ID: "step-1", SagaID: "saga-1", Name: "step1",
+			Status: StatusProcessing, StartedAt: &startedAt,
+		}},
+	})
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	recovery := NewRecoveryManager(storage, pubsub, WithRecoveryLogger(logger))
+	recovery.recoverStuckSteps(context.Background())
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected one JSON log record, got %q: %v", buf.String(), err)
+	}
+	if record["saga_id"] != "saga-1" || record["step_id"] != "step-1" || record["status"] != "processing" {
+		t.Errorf("Unexpected log record: %v", record)
+	}
+}
+
+// spyLogger records the messages logged at each level
+type spyLogger struct {
+	mu       sync.Mutex
+	messages map[string][]string
+}
+
+func (l *spyLogger) log(level, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.messages == nil {
+		l.messages = make(map[string][]string)
+	}
+	l.messages[level] = append(l.messages[level], msg)
+}
+
+func (l *spyLogger) Debug(msg string, args ...any) { l.log("debug", msg) }
+func (l *spyLogger) Info(msg string, args ...any)  { l.log("info", msg) }
+func (l *spyLogger) Warn(msg string, args ...any)  { l.log("warn", msg) }
+func (l *spyLogger) Error(msg string, args ...any) { l.log("error", msg) }
+
+func TestOrchestratorLogger(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	logger := &spyLogger{}
+	orchestrator := NewOrchestrator(storage, pubsub, WithLogger(logger))
+	orchestrator.StartListener(context.Background())
+
+	sagaInstance, err := NewBuilder("logged_saga", orchestrator).
+		Step("failing_step",
+			func(ctx context.Context, data map[string]interface{}) error {
+				return errors.New("boom")
+			},
+			nil,
+		).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	waitForSaga(t, orchestrator, sagaInstance.ID)
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if len(logger.messages["warn"]) != 1 {
+		t.Errorf("Expected one step failure warning, got %v", logger.messages)
+	}
+}
+
+func TestRecoveryStartStopConcurrently(t *testing.T) {
+	recovery := NewRecoveryManager(NewMemoryStorage(), NewMemoryPubSub())
+
+	// Stopping before starting and stopping twice are no-ops
+	recovery.Stop()
+	recovery.Start(context.Background())
+	recovery.Stop()
+	recovery.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			recovery.Start(context.Background())
+		}()
+		go func() {
+			defer wg.Done()
+			recovery.Stop()
+		}()
+	}
+	wg.Wait()
+	recovery.Stop()
+
+	// A recovery loop whose context ends can be started again
+	ctx, cancel := context.WithCancel(context.Background())
+	recovery.Start(ctx)
+	recovery.mu.Lock()
+	firstLoop := recovery.stopCh
+	recovery.mu.Unlock()
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+
+	recovery.Start(context.Background())
+	recovery.mu.Lock()
+	restarted := recovery.running && recovery.stopCh != firstLoop
+	recovery.mu.Unlock()
+	if !restarted {
+		t.Error("Expected recovery to restart after its context ended")
+	}
+	recovery.Stop()
+}
+
+func TestAddStepsAtRuntime(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	record := func(name string) func(ctx context.Context, data map[string]interface{}) error {
+		return func(ctx context.Context, data map[string]interface{}) error {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, name)
+			return nil
+		}
+	}
+
+	sagaID := make(chan string, 1)
+	addErr := make(chan error, 1)
+	sagaInstance, err := NewBuilder("dynamic_saga", orchestrator).
+		Step("create_order",
+			func(ctx context.Context, data map[string]interface{}) error {
+				// The order turns out to have two line items
+				addErr <- orchestrator.AddSteps(ctx, <-sagaID, []StepSpec{
+					{Name: "reserve_item_1", Handler: NewStepHandler(record("reserve_item_1"), record("release_item_1"))},
+					{Name: "reserve_item_2", Handler: NewStepHandler(
+						func(ctx context.Context, data map[string]interface{}) error {
+							return errors.New("out of stock")
+						}, nil)},
+				})
+				return nil
+			},
+			record("cancel_order"),
+		).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	sagaID <- sagaInstance.ID
+
+	if err := <-addErr; err != nil {
+		t.Fatalf("Failed to add steps: %v", err)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusFailed {
+		t.Fatalf("Expected saga to fail, got %s", status)
+	}
+
+	// Added steps are compensated before the step they were added after
+	mu.Lock()
+	got := append([]string(nil), order...)
+	mu.Unlock()
+	want := []string{"reserve_item_1", "release_item_1", "cancel_order"}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Expected %v, got %v", want, got)
+		}
+	}
+
+	// A finished saga can't grow
+	err = orchestrator.AddSteps(context.Background(), sagaInstance.ID, []StepSpec{{Name: "late_step"}})
+	if err == nil {
+		t.Error("Expected adding steps to a failed saga to fail")
+	}
+}
+
+func TestEventStoreRecordsTransitions(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	events := NewMemoryEventStore()
+	orchestrator := NewOrchestrator(storage, pubsub, WithEventStore(events))
+	orchestrator.StartListener(context.Background())
+
+	sagaInstance, err := NewBuilder("audited_saga", orchestrator).
+		Step("step1",
+			func(ctx context.Context, data map[string]interface{}) error { return nil },
+			func(ctx context.Context, data map[string]interface{}) error { return nil },
+		).
+		Step("step2",
+			func(ctx context.Context, data map[string]interface{}) error { return errors.New("boom") },
+			nil,
+		).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	waitForSaga(t, orchestrator, sagaInstance.ID)
+
+	history, err := events.List(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to list events: %v", err)
+	}
+
+	step1, step2 := sagaInstance.Steps[0].ID, sagaInstance.Steps[1].ID
+	want := []SagaEvent{
+		{StepID: "", FromStatus: "", ToStatus: StatusPending},
+		{StepID: step1, FromStatus: "", ToStatus: StatusPending},
+		{StepID: step2, FromStatus: "", ToStatus: StatusPending},
+		{StepID: step1, FromStatus: StatusPending, ToStatus: StatusProcessing},
+		{StepID: step1, FromStatus: StatusProcessing, ToStatus: StatusCompleted},
+		{StepID: step2, FromStatus: StatusPending, ToStatus: StatusProcessing},
+		{StepID: step2, FromStatus: StatusProcessing, ToStatus: StatusFailed, Error: "boom"},
+		{StepID: "", FromStatus: StatusPending, ToStatus: StatusCompensating},
+		{StepID: step1, FromStatus: StatusCompleted, ToStatus: StatusCompensating},
+		{StepID: step1, FromStatus: StatusCompensating, ToStatus: StatusCompensated},
+		{StepID: "", FromStatus: StatusCompensating, ToStatus: StatusFailed},
+	}
+	if len(history) != len(want) {
+		t.Fatalf("Expected %d events, got %d: %+v", len(want), len(history), history)
+	}
+	for i, event := range history {
+		if event.StepID != want[i].StepID || event.FromStatus != want[i].FromStatus ||
+			event.ToStatus != want[i].ToStatus || (want[i].Error != "" && event.Error != want[i].Error) {
+			t.Errorf("Event %d: expected %+v, got %+v", i, want[i], event)
+		}
+		if event.SagaID != sagaInstance.ID || event.Timestamp.IsZero() {
+			t.Errorf("Event %d is missing its saga or timestamp: %+v", i, event)
+		}
+	}
+}
+
+func TestCompensateCompletedSaga(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	var (
+		mu          sync.Mutex
+		compensated []string
+	)
+	compensate := func(name string) func(ctx context.Context, data map[string]interface{}) error {
+		return func(ctx context.Context, data map[string]interface{}) error {
+			mu.Lock()
+			defer mu.Unlock()
+			compensated = append(compensated, name)
+			return nil
+		}
+	}
+	noop := func(ctx context.Context, data map[string]interface{}) error { return nil }
+
+	sagaInstance, err := NewBuilder("fraud_saga", orchestrator).
+		Step("charge_card", noop, compensate("charge_card")).
+		Step("ship_order", noop, compensate("ship_order")).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	// Only completed sagas can be rolled back
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusCompleted {
+		t.Fatalf("Expected saga to complete, got %s", status)
+	}
+
+	if err := orchestrator.Compensate(context.Background(), sagaInstance.ID); err != nil {
+		t.Fatalf("Failed to compensate saga: %v", err)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusRolledBack {
+		t.Fatalf("Expected saga to be rolled back, got %s", status)
+	}
+
+	mu.Lock()
+	got := strings.Join(compensated, ",")
+	mu.Unlock()
+	if got != "ship_order,charge_card" {
+		t.Errorf("Expected compensation in reverse order, got %s", got)
+	}
+
+	if err := orchestrator.Compensate(context.Background(), sagaInstance.ID); err == nil {
+		t.Error("Expected compensating a rolled back saga to fail")
+	}
+}
+
+func TestCompensationOrder(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	var (
+		mu          sync.Mutex
+		compensated []string
+	)
+	compensate := func(name string) func(ctx context.Context, data map[string]interface{}) error {
+		return func(ctx context.Context, data map[string]interface{}) error {
+			mu.Lock()
+			defer mu.Unlock()
+			compensated = append(compensated, name)
+			return nil
+		}
+	}
+	noop := func(ctx context.Context, data map[string]interface{}) error { return nil }
+
+	// Reverse order would be ship, notify, charge, reserve; the shipment
+	// must be cancelled first and the card refunded second
+	sagaInstance, err := NewBuilder("ordered_rollback", orchestrator).
+		Step("reserve_stock", noop, compensate("reserve_stock")).
+		Step("charge_card", noop, compensate("charge_card")).CompensationOrder(2).
+		Step("notify", noop, compensate("notify")).
+		Step("ship_order", noop, compensate("ship_order")).CompensationOrder(1).
+		Step("fail", func(ctx context.Context, data map[string]interface{}) error {
+			return errors.New("boom")
+		}, nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	waitForSaga(t, orchestrator, sagaInstance.ID)
+
+	mu.Lock()
+	got := strings.Join(compensated, ",")
+	mu.Unlock()
+	if got != "ship_order,charge_card,notify,reserve_stock" {
+		t.Errorf("Unexpected compensation order: %s", got)
+	}
+
+	_, err = NewBuilder("bad_order", orchestrator).
+		Step("step1", noop, nil).CompensationOrder(0).
+		Execute(context.Background())
+	if err == nil {
+		t.Error("Expected a non-positive compensation order to be rejected")
+	}
+}
+
+func TestGetStepsBySaga(t *testing.T) {
+	storage := NewMemoryStorage()
+	orchestrator := NewOrchestrator(storage, NewMemoryPubSub())
+
+	sagaInstance, err := orchestrator.StartSaga(context.Background(), "bulk_saga", []string{"a", "b", "c"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if _, err := orchestrator.StartSaga(context.Background(), "other_saga", []string{"x"}, nil); err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	steps, err := storage.GetStepsBySaga(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to get steps: %v", err)
+	}
+	if len(steps) != 3 {
+		t.Fatalf("Expected 3 steps, got %d", len(steps))
+	}
+	for i, name := range []string{"a", "b", "c"} {
+		if steps[i].Name != name {
+			t.Errorf("Expected step %d to be %s, got %s", i, name, steps[i].Name)
+		}
+	}
+}
+
+func TestMemoryStorageReturnsCopies(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+
+	want := time.Now().Add(time.Hour)
+	deadline, finished, completed := want, want, want
+	sagaInstance := &Saga{
+		ID:         "copied_saga",
+		Status:     StatusPending,
+		Data:       map[string]interface{}{"order": map[string]interface{}{"items": []interface{}{"a"}}},
+		Deadline:   &deadline,
+		FinishedAt: &finished,
+		Steps:      []Step{{ID: "copied_step", SagaID: "copied_saga", Status: StatusPending, Data: map[string]interface{}{"nested": map[string]interface{}{"n": 1}}, CompletedAt: &completed}},
+	}
+	if err := storage.SaveSaga(ctx, sagaInstance); err != nil {
+		t.Fatalf("Failed to save saga: %v", err)
+	}
+
+	// Changes through the saga that was saved or one that was read
+	// mustn't reach the stored state
+	sagaInstance.Data["order"].(map[string]interface{})["items"] = nil
+	read, _ := storage.GetSaga(ctx, "copied_saga")
+	read.Data["order"].(map[string]interface{})["status"] = "tampered"
+	*read.Deadline = time.Time{}
+	*read.FinishedAt = time.Time{}
+	read.Steps[0].Data["nested"].(map[string]interface{})["n"] = 2
+	step, _ := storage.GetStep(ctx, "copied_step")
+	step.Data["nested"].(map[string]interface{})["n"] = 3
+	*step.CompletedAt = time.Time{}
+
+	stored, _ := storage.GetSaga(ctx, "copied_saga")
+	order := stored.Data["order"].(map[string]interface{})
+	if len(order) != 1 || order["items"] == nil {
+		t.Errorf("Expected the saga's data to be unchanged, got %v", order)
+	}
+	if !stored.Deadline.Equal(want) || !stored.FinishedAt.Equal(want) {
+		t.Errorf("Expected the deadline and finish time to be unchanged, got %v and %v", stored.Deadline, stored.FinishedAt)
+	}
+	storedStep, _ := storage.GetStep(ctx, "copied_step")
+	if !storedStep.CompletedAt.Equal(want) {
+		t.Errorf("Expected the step's completion time to be unchanged, got %v", storedStep.CompletedAt)
+	}
+	if n := storedStep.Data["nested"].(map[string]interface{})["n"]; n != 1 || stored.Steps[0].Data["nested"].(map[string]interface{})["n"] != 1 {
+		t.Errorf("Expected the step's data to be unchanged, got %v", n)
+	}
+}
+
+func TestOrchestratorStats(t *testing.T) {
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(NewMemoryStorage(), pubsub)
+	if stats := orchestrator.Stats(); stats.Running {
+		t.Error("Expected orchestrator not to be running before the listener starts")
+	}
+	orchestrator.StartListener(context.Background())
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	sagaInstance, err := NewBuilder("stats_saga", orchestrator).
+		Step("slow_step",
+			func(ctx context.Context, data map[string]interface{}) error {
+				close(started)
+				<-release
+				return nil
+			},
+			nil,
+		).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	<-started
+	stats := orchestrator.Stats()
+	if stats.InFlightSteps != 1 || stats.HandlersRegistered != 1 || !stats.Running {
+		t.Errorf("Unexpected stats while a step runs: %+v", stats)
+	}
+
+	close(release)
+	waitForSaga(t, orchestrator, sagaInstance.ID)
+	if err := orchestrator.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if stats := orchestrator.Stats(); stats.InFlightSteps != 0 || stats.Running {
+		t.Errorf("Unexpected stats after shutdown: %+v", stats)
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub, WithMaxConcurrency(2))
+	orchestrator.StartListener(context.Background())
+
+	var running, peak int32
+	work := func(ctx context.Context, data map[string]interface{}) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}
+
+	builder := NewBuilder("limited_saga", orchestrator)
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		builder.Step(name, work, nil).DependsOn()
+	}
+	sagaInstance, err := builder.Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusCompleted {
+		t.Fatalf("Expected saga to complete, got %s", status)
+	}
+	if p := atomic.LoadInt32(&peak); p > 2 {
+		t.Errorf("Expected at most 2 steps at once, got %d", p)
+	}
+}
+
+func TestRecoveryRateLimit(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	// Three sagas whose first step nobody picks up
+	orchestrator := NewOrchestrator(storage, pubsub)
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := orchestrator.StartSaga(context.Background(), "stuck_saga", []string{name}, nil); err != nil {
+			t.Fatalf("Failed to start saga: %v", err)
+		}
+	}
+
+	republished := make(chan string, 10)
+	pubsub.Subscribe(context.Background(), "saga_events", func(msg Message) error {
+		republished <- msg.StepID
+		return nil
+	})
+
+	recovery := NewRecoveryManager(storage, pubsub, WithRecoveryRate(2, time.Hour))
+	recovery.stepTimeout = -time.Second // Every pending step counts as stuck
+
+	count := func() int {
+		n := 0
+		for {
+			select {
+			case <-republished:
+				n++
+			case <-time.After(50 * time.Millisecond):
+				return n
+			}
+		}
+	}
+
+	recovery.recoverStuckSteps(context.Background())
+	if n := count(); n != 2 {
+		t.Errorf("Expected 2 steps on the first check, got %d", n)
+	}
+	recovery.recoverStuckSteps(context.Background())
+	if n := count(); n != 1 {
+		t.Errorf("Expected only the deferred step on the second check, got %d", n)
+	}
+	recovery.recoverStuckSteps(context.Background())
+	if n := count(); n != 0 {
+		t.Errorf("Expected recently recovered steps to be left alone, got %d", n)
+	}
+}
+
+func TestRecoveryRateAcrossManagers(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	saga, err := orchestrator.StartSaga(context.Background(), "stuck_saga", []string{"a"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	var republished int32
+	pubsub.Subscribe(context.Background(), "saga_events", func(msg Message) error {
+		if msg.Type == "step_recover" {
+			atomic.AddInt32(&republished, 1)
+		}
+		return nil
+	})
+
+	// Two instances sharing the storage, as after a restart or with several
+	// replicas, each with its own manager
+	for i := 0; i < 2; i++ {
+		recovery := NewRecoveryManager(storage, pubsub, WithRecoveryRate(0, time.Hour))
+		recovery.stepTimeout = -time.Second
+		recovery.recoverStuckSteps(context.Background())
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&republished); n != 1 {
+		t.Errorf("Expected the step to be republished once, got %d", n)
+	}
+	steps, _ := storage.GetStepsBySaga(context.Background(), saga.ID)
+	if len(steps) != 1 || steps[0].LastRecoveredAt == nil {
+		t.Errorf("Expected LastRecoveredAt to be recorded on the step, got %+v", steps)
+	}
+}
+
+func TestRecoveryOptionsRejectNonPositive(t *testing.T) {
+	for name, opt := range map[string]func(){
+		"interval":        func() { WithInterval(0) },
+		"step timeout":    func() { WithStepTimeout(-time.Second) },
+		"context timeout": func() { WithContextTimeout(0) },
+		"recovery rate":   func() { WithRecoveryRate(-1, 0) },
+		"rate interval":   func() { WithRecoveryRate(0, -time.Second) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected a non-positive %s to panic", name)
+				}
+			}()
+			opt()
+		}()
+	}
+
+	recovery := NewRecoveryManager(NewMemoryStorage(), NewMemoryPubSub(),
+		WithInterval(30*time.Second), WithStepTimeout(5*time.Minute))
+	if recovery.interval != 30*time.Second || recovery.stepTimeout != 5*time.Minute {
+		t.Errorf("Options not applied: interval %s, step timeout %s", recovery.interval, recovery.stepTimeout)
+	}
+}
+
+// lossyPubSub drops the first message of the given type
+type lossyPubSub struct {
+	PubSub
+	drop    string
+	dropped int32
+}
+
+func (p *lossyPubSub) Publish(ctx context.Context, topic string, msg Message) error {
+	if msg.Type == p.drop && atomic.CompareAndSwapInt32(&p.dropped, 0, 1) {
+		return nil
+	}
+	return p.PubSub.Publish(ctx, topic, msg)
+}
+
+func TestRecoveryResumesLostCompensation(t *testing.T) {
+	storage := NewMemoryStorage()
+	memory := NewMemoryPubSub()
+	defer memory.Close()
+	pubsub := &lossyPubSub{PubSub: memory, drop: "step_compensate"}
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	var compensations int32
+	sagaInstance, err := NewBuilder("lossy_saga", orchestrator).
+		Step("step1",
+			func(ctx context.Context, data map[string]interface{}) error { return nil },
+			func(ctx context.Context, data map[string]interface{}) error {
+				atomic.AddInt32(&compensations, 1)
+				return nil
+			},
+		).
+		Step("step2",
+			func(ctx context.Context, data map[string]interface{}) error { return errors.New("boom") },
+			nil,
+		).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	// The rollback stalls once its only step_compensate message is lost
+	time.Sleep(100 * time.Millisecond)
+	stalled, err := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to get saga: %v", err)
+	}
+	if stalled.Status != StatusCompensating || stalled.Steps[0].Status != StatusCompleted {
+		t.Fatalf("Expected a stalled rollback, got saga %s with step %s", stalled.Status, stalled.Steps[0].Status)
+	}
+
+	recovery := NewRecoveryManager(storage, pubsub, WithStepTimeout(50*time.Millisecond))
+	recovery.recoverStuckCompensations(context.Background())
+
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusFailed {
+		t.Fatalf("Expected saga to fail, got %s", status)
+	}
+	if n := atomic.LoadInt32(&compensations); n != 1 {
+		t.Errorf("Expected step1 to be compensated once, got %d", n)
+	}
+}
+
+func TestListenerErrors(t *testing.T) {
+	closed := NewMemoryPubSub()
+	closed.Close()
+	if err := NewOrchestrator(NewMemoryStorage(), closed).StartListener(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected StartListener to return the subscribe error, got %v", err)
+	}
+
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	failures := make(chan Message, 10)
+	orchestrator := NewOrchestrator(NewMemoryStorage(), pubsub, WithMessageErrorHandler(func(ctx context.Context, msg Message, err error) {
+		if !errors.Is(err, ErrStepNotFound) {
+			t.Errorf("Expected a step not found error, got %v", err)
+		}
+		failures <- msg
+	}))
+	if err := orchestrator.StartListener(context.Background()); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+
+	if err := pubsub.Publish(context.Background(), DefaultTopic, Message{Type: "step_execute", StepID: "missing"}); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	select {
+	case msg := <-failures:
+		if msg.StepID != "missing" {
+			t.Errorf("Unexpected failed message: %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the failed message to be reported")
+	}
+}
+
+func TestRequiredData(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	noop := func(ctx context.Context, data map[string]interface{}) error { return nil }
+	build := func() *Builder {
+		return NewBuilder("checkout", orchestrator).
+			Require("user_id").
+			RequireType("amount", TypeNumber).
+			RequireType("placed_at", TypeString).
+			Step("charge", noop, nil)
+	}
+
+	_, err := build().WithData("amount", "12.50").WithData("placed_at", time.Now()).Execute(context.Background())
+	if !errors.Is(err, ErrInvalidData) {
+		t.Fatalf("Expected invalid data to be rejected, got %v", err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "amount must be a number, got string, missing user_id") {
+		t.Errorf("Expected the error to list every problem, got %q", msg)
+	}
+	if sagas, _ := storage.ListSagas(context.Background(), SagaFilter{}); len(sagas) != 0 {
+		t.Errorf("Expected no saga to be started, got %d", len(sagas))
+	}
+
+	sagaInstance, err := build().
+		WithData("user_id", nil).
+		WithData("amount", 12.5).
+		WithData("placed_at", time.Now()).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Expected valid data to start the saga, got %v", err)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusCompleted {
+		t.Errorf("Expected saga status to be completed, got %s", status)
+	}
+
+	// Definitions check every instance
+	if err := NewBuilder("refund", orchestrator).Require("order_id").Step("refund", noop, nil).Register(); err != nil {
+		t.Fatalf("Failed to register definition: %v", err)
+	}
+	if _, err := orchestrator.StartInstance(context.Background(), "refund", nil); !errors.Is(err, ErrInvalidData) {
+		t.Errorf("Expected an instance without order_id to be rejected, got %v", err)
+	}
+	if _, err := NewBuilder("bad", orchestrator).RequireType("x", "integer").Step("a", noop, nil).Execute(context.Background()); err == nil {
+		t.Error("Expected an unknown data type to be rejected")
+	}
+}
+
+func TestMaxDataSize(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub, WithMaxDataSize(100))
+	orchestrator.StartListener(context.Background())
+
+	noop := func(ctx context.Context, data map[string]interface{}) error { return nil }
+	large := strings.Repeat("x", 200)
+
+	_, err := NewBuilder("large_input", orchestrator).
+		Step("a", noop, nil).
+		WithData("blob", large).
+		Execute(context.Background())
+	if !errors.Is(err, ErrDataTooLarge) {
+		t.Errorf("Expected ErrDataTooLarge for oversized initial data, got %v", err)
+	}
+
+	var compensated int32
+	sagaInstance, err := NewBuilder("large_output", orchestrator).
+		Step("a", noop, func(ctx context.Context, data map[string]interface{}) error {
+			atomic.AddInt32(&compensated, 1)
+			return nil
+		}).
+		Step("b", func(ctx context.Context, data map[string]interface{}) error {
+			data["blob"] = large
+			return nil
+		}, nil).
+		WithData("user_id", "user_123").
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusFailed {
+		t.Fatalf("Expected saga to fail, got %s", status)
+	}
+
+	step, err := storage.GetStep(context.Background(), sagaInstance.Steps[1].ID)
+	if err != nil {
+		t.Fatalf("Failed to get step: %v", err)
+	}
+	if step.Status != StatusFailed || !strings.Contains(step.Error, ErrDataTooLarge.Error()) {
+		t.Errorf("Expected step to fail with data too large, got %s: %s", step.Status, step.Error)
+	}
+	if _, stored := step.Data["blob"]; stored {
+		t.Error("Expected oversized data not to be stored")
+	}
+	if atomic.LoadInt32(&compensated) != 1 {
+		t.Errorf("Expected the first step to be compensated")
+	}
+}
+
+func TestMemoryMaxDataSize(t *testing.T) {
+	storage := NewMemoryStorage(WithMemoryMaxDataSize(100))
+	ctx := context.Background()
+	large := strings.Repeat("x", 200)
+
+	err := storage.SaveSaga(ctx, &Saga{ID: "large", Status: StatusPending, Data: map[string]interface{}{"blob": large}})
+	if !errors.Is(err, ErrDataTooLarge) {
+		t.Errorf("Expected ErrDataTooLarge for oversized saga data, got %v", err)
+	}
+	if _, err := storage.GetSaga(ctx, "large"); !errors.Is(err, ErrSagaNotFound) {
+		t.Errorf("Expected the oversized saga not to be stored, got %v", err)
+	}
+
+	sg := &Saga{ID: "small", Status: StatusPending, Steps: []Step{{ID: "step", SagaID: "small", Name: "a", Status: StatusPending}}}
+	if err := storage.SaveSaga(ctx, sg); err != nil {
+		t.Fatalf("Failed to save saga: %v", err)
+	}
+	step, _ := storage.GetStep(ctx, "step")
+	step.Data = map[string]interface{}{"blob": large}
+	if err := storage.UpdateStep(ctx, step); !errors.Is(err, ErrDataTooLarge) {
+		t.Errorf("Expected ErrDataTooLarge for oversized step data, got %v", err)
+	}
+	sg.Data = map[string]interface{}{"blob": large}
+	if err := storage.CompleteStep(ctx, step, sg); !errors.Is(err, ErrDataTooLarge) {
+		t.Errorf("Expected ErrDataTooLarge when completing a step, got %v", err)
+	}
+	if stored, _ := storage.GetStep(ctx, "step"); len(stored.Data) != 0 {
+		t.Errorf("Expected oversized step data not to be stored, got %v", stored.Data)
+	}
+}
+
+func TestStepMessagesOmitData(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	var mu sync.Mutex
+	var carried []string
+	pubsub.Subscribe(context.Background(), DefaultTopic, func(msg Message) error {
+		if msg.Data != nil && msg.StepID != "" {
+			mu.Lock()
+			carried = append(carried, msg.Type)
+			mu.Unlock()
+		}
+		return nil
+	})
+
+	var seen interface{}
+	sagaInstance, err := NewBuilder("lean_messages", orchestrator).
+		Step("a", func(ctx context.Context, data map[string]interface{}) error {
+			data["order_id"] = "12345"
+			return nil
+		}, nil).
+		Step("b", func(ctx context.Context, data map[string]interface{}) error {
+			seen = data["order_id"]
+			return errors.New("intentional failure")
+		}, nil).
+		WithData("user_id", "user_123").
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	waitForSaga(t, orchestrator, sagaInstance.ID)
+
+	if seen != "12345" {
+		t.Errorf("Expected step b to read step a's output from storage, got %v", seen)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(carried) > 0 {
+		t.Errorf("Expected step messages without data, got data on %v", carried)
+	}
+}
+
+func TestRetrySaga(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	var notified, charged, refunded int32
+	var shippingDown atomic.Bool
+	shippingDown.Store(true)
+
+	sagaInstance, err := NewBuilder("retry_saga", orchestrator).
+		Step("notify", func(ctx context.Context, data map[string]interface{}) error {
+			atomic.AddInt32(&notified, 1)
+			return nil
+		}, nil).NoCompensation().
+		Step("charge", func(ctx context.Context, data map[string]interface{}) error {
+			atomic.AddInt32(&charged, 1)
+			return nil
+		}, func(ctx context.Context, data map[string]interface{}) error {
+			atomic.AddInt32(&refunded, 1)
+			return nil
+		}).
+		Step("ship", func(ctx context.Context, data map[string]interface{}) error {
+			if shippingDown.Load() {
+				return errors.New("shipping unavailable")
+			}
+			return nil
+		}, nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusFailed {
+		t.Fatalf("Expected saga to fail, got %s", status)
+	}
+
+	shippingDown.Store(false)
+	if err := orchestrator.RetrySaga(context.Background(), sagaInstance.ID); err != nil {
+		t.Fatalf("Failed to retry saga: %v", err)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusCompleted {
+		t.Fatalf("Expected retried saga to complete, got %s", status)
+	}
+
+	finalSaga, err := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to get saga: %v", err)
+	}
+	if finalSaga.Error != "" || finalSaga.FailedStepID != "" {
+		t.Errorf("Expected the failure to be cleared, got %q on %q", finalSaga.Error, finalSaga.FailedStepID)
+	}
+	if n, c, r := atomic.LoadInt32(&notified), atomic.LoadInt32(&charged), atomic.LoadInt32(&refunded); n != 1 || c != 2 || r != 1 {
+		t.Errorf("Expected notify once and charge again after its refund, got %d notifications, %d charges, %d refunds", n, c, r)
+	}
+
+	if err := orchestrator.RetrySaga(context.Background(), sagaInstance.ID); err == nil {
+		t.Error("Expected retrying a completed saga to fail")
+	}
+}
+
+func TestDeadLetterHandler(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	letters := make(chan DeadLetter, 10)
+	orchestrator := NewOrchestrator(storage, pubsub, WithDeadLetterHandler(func(ctx context.Context, letter DeadLetter) {
+		letters <- letter
+	}))
+	orchestrator.StartListener(context.Background())
+
+	// A step nobody can run
+	sagaInstance, err := orchestrator.StartSaga(context.Background(), "orphan_saga", []string{"unhandled_step"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	select {
+	case letter := <-letters:
+		if letter.Reason != DeadLetterNoHandler || letter.SagaID != sagaInstance.ID || letter.StepName != "unhandled_step" {
+			t.Errorf("Unexpected dead letter: %+v", letter)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the unhandled step to be dead-lettered")
+	}
+
+	// A compensation that fails
+	failing, err := NewBuilder("bad_rollback", orchestrator).
+		Step("step1",
+			func(ctx context.Context, data map[string]interface{}) error { return nil },
+			func(ctx context.Context, data map[string]interface{}) error { return errors.New("refund failed") },
+		).
+		Step("step2",
+			func(ctx context.Context, data map[string]interface{}) error { return errors.New("boom") },
+			nil,
+		).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	waitForSaga(t, orchestrator, failing.ID)
+
+	select {
+	case letter := <-letters:
+		if letter.Reason != DeadLetterCompensationFailed || letter.Error != "refund failed" {
+			t.Errorf("Unexpected dead letter: %+v", letter)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the failed compensation to be dead-lettered")
+	}
+}
+
+func TestMissingHandlerLimit(t *testing.T) {
+	storage := NewMemoryStorage()
+	orchestrator := NewOrchestrator(storage, NewMemoryPubSub(), WithMissingHandlerLimit(2))
+
+	sagaInstance, err := orchestrator.StartSaga(context.Background(), "zombie_saga", []string{"unhandled_step"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	stepID := sagaInstance.Steps[0].ID
+
+	// The first delivery leaves the step for an instance that has the handler
+	if err := orchestrator.ExecuteStep(context.Background(), stepID); err == nil {
+		t.Error("Expected an error for the missing handler")
+	}
+	saga, err := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to get saga: %v", err)
+	}
+	if saga.Status != StatusPending || saga.Steps[0].Status != StatusPending {
+		t.Fatalf("Expected saga and step to stay pending, got %s and %s", saga.Status, saga.Steps[0].Status)
+	}
+
+	// Reaching the limit fails the step and the saga
+	orchestrator.ExecuteStep(context.Background(), stepID)
+	saga, err = storage.GetSaga(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to get saga: %v", err)
+	}
+	if saga.Status != StatusFailed || saga.Steps[0].Status != StatusFailed {
+		t.Errorf("Expected saga and step to fail, got %s and %s", saga.Status, saga.Steps[0].Status)
+	}
+	if saga.Error != "step unhandled_step failed: no handler for step: unhandled_step" {
+		t.Errorf("Unexpected saga error: %q", saga.Error)
+	}
+}
+
+func TestHandlersScopedBySaga(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	notify := func(who string) func(ctx context.Context, data map[string]interface{}) error {
+		return func(ctx context.Context, data map[string]interface{}) error {
+			data["notified"] = who
+			return nil
+		}
+	}
+
+	// Two saga types with a step of the same name
+	order, err := NewBuilder("order", orchestrator).
+		Step("notify", notify("order"), nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	refund, err := NewBuilder("refund", orchestrator).
+		Step("notify", notify("refund"), nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	for id, want := range map[string]string{order.ID: "order", refund.ID: "refund"} {
+		waitForSaga(t, orchestrator, id)
+		saga, err := storage.GetSaga(context.Background(), id)
+		if err != nil {
+			t.Fatalf("Failed to get saga: %v", err)
+		}
+		if saga.Data["notified"] != want {
+			t.Errorf("Expected %s saga to use its own handler, got %v", want, saga.Data["notified"])
+		}
+	}
+}
+
+func TestHandlerValidation(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub, WithHandlerValidation())
+	noop := NewStepHandler(func(ctx context.Context, data map[string]interface{}) error { return nil }, nil)
+	orchestrator.RegisterHandler("reserve", noop)
+	orchestrator.RegisterSagaHandler("order", "charge", noop)
+	orchestrator.RegisterSagaHandler("order", "reserve", noop)
+
+	if !orchestrator.HasHandler("order", "reserve") || !orchestrator.HasHandler("refund", "reserve") {
+		t.Error("Expected reserve to have a handler in every saga")
+	}
+	if orchestrator.HasHandler("refund", "charge") {
+		t.Error("Expected charge to only have a handler in order sagas")
+	}
+	if names := orchestrator.RegisteredHandlers("order"); !slices.Equal(names, []string{"charge", "reserve"}) {
+		t.Errorf("Expected charge and reserve, got %v", names)
+	}
+	if names := orchestrator.RegisteredHandlers(""); !slices.Equal(names, []string{"reserve"}) {
+		t.Errorf("Expected only reserve to be registered for every saga, got %v", names)
+	}
+
+	if _, err := orchestrator.StartSaga(context.Background(), "refund", []string{"reserve", "charge"}, nil); !errors.Is(err, ErrNoHandler) {
+		t.Fatalf("Expected ErrNoHandler, got %v", err)
+	}
+	sagas, err := storage.ListSagas(context.Background(), SagaFilter{})
+	if err != nil || len(sagas) != 0 {
+		t.Errorf("Expected no saga to be saved, got %d, %v", len(sagas), err)
+	}
+
+	sagaInstance, err := orchestrator.StartSaga(context.Background(), "order", []string{"reserve", "charge"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if err := orchestrator.AddSteps(context.Background(), sagaInstance.ID, []StepSpec{{Name: "ship"}}); !errors.Is(err, ErrNoHandler) {
+		t.Errorf("Expected adding a step without a handler to fail, got %v", err)
+	}
+}
+
+func TestMaxSteps(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	// Without a listener the sagas stay running, so steps can be added
+	orchestrator := NewOrchestrator(storage, pubsub, WithMaxSteps(3))
+
+	if _, err := orchestrator.StartSaga(context.Background(), "order", []string{"a", "b", "c", "d"}, nil); !errors.Is(err, ErrTooManySteps) {
+		t.Fatalf("Expected ErrTooManySteps, got %v", err)
+	}
+	if sagas, _ := storage.ListSagas(context.Background(), SagaFilter{}); len(sagas) != 0 {
+		t.Errorf("Expected no saga to be saved, got %d", len(sagas))
+	}
+	err := orchestrator.RegisterDefinition(SagaDefinition{Name: "big", Steps: linearSpecs([]string{"a", "b", "c", "d"})})
+	if !errors.Is(err, ErrTooManySteps) {
+		t.Errorf("Expected the definition to be rejected, got %v", err)
+	}
+
+	sagaInstance, err := orchestrator.StartSaga(context.Background(), "order", []string{"a", "b"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if err := orchestrator.AddSteps(context.Background(), sagaInstance.ID, []StepSpec{{Name: "c"}, {Name: "d"}}); !errors.Is(err, ErrTooManySteps) {
+		t.Errorf("Expected adding past the limit to fail, got %v", err)
+	}
+	if err := orchestrator.AddSteps(context.Background(), sagaInstance.ID, []StepSpec{{Name: "c"}}); err != nil {
+		t.Errorf("Expected adding up to the limit to succeed, got %v", err)
+	}
+}
+
+func TestSagaDefinitionInstances(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	var runs atomic.Int32
+	err := orchestrator.RegisterDefinition(SagaDefinition{
+		Name: "order",
+		Steps: []StepSpec{
+			{Name: "reserve", Handler: NewStepHandler(func(ctx context.Context, data map[string]interface{}) error {
+				runs.Add(1)
+				data["reserved"] = data["item"]
+				return nil
+			}, nil)},
+			{Name: "charge", Handler: NewStepHandler(func(ctx context.Context, data map[string]interface{}) error {
+				return nil
+			}, nil)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to register definition: %v", err)
+	}
+
+	for _, item := range []string{"book", "lamp"} {
+		sagaInstance, err := orchestrator.StartInstance(context.Background(), "order", map[string]interface{}{"item": item})
+		if err != nil {
+			t.Fatalf("Failed to start instance: %v", err)
+		}
+		if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusCompleted {
+			t.Fatalf("Expected instance to complete, got %s", status)
+		}
+		finalSaga, _ := storage.GetSaga(context.Background(), sagaInstance.ID)
+		if finalSaga.Data["reserved"] != item {
+			t.Errorf("Expected %s to be reserved, got %v", item, finalSaga.Data["reserved"])
+		}
+		if deps := finalSaga.Steps[1].DependsOn; len(deps) != 1 || deps[0] != "reserve" {
+			t.Errorf("Expected charge to depend on reserve, got %v", deps)
+		}
+	}
+	if runs.Load() != 2 {
+		t.Errorf("Expected one run per instance, got %d", runs.Load())
+	}
+
+	if err := orchestrator.RegisterDefinition(SagaDefinition{Name: "order", Steps: []StepSpec{{Name: "a"}}}); err == nil {
+		t.Error("Expected re-registering a definition to fail")
+	}
+	if err := orchestrator.RegisterDefinition(SagaDefinition{Name: "dup", Steps: []StepSpec{{Name: "a"}, {Name: "a"}}}); err == nil {
+		t.Error("Expected duplicate step names to be rejected")
+	}
+	if _, err := orchestrator.StartInstance(context.Background(), "missing", nil); err == nil {
+		t.Error("Expected starting an unknown definition to fail")
+	}
+}
+
+func TestStartSagas(t *testing.T) {
+	for _, useOutbox := range []bool{false, true} {
+		storage := NewMemoryStorage()
+		pubsub := NewMemoryPubSub()
+
+		opts := []Option{}
+		if useOutbox {
+			opts = append(opts, WithOutbox())
+		}
+		orchestrator := NewOrchestrator(storage, pubsub, opts...)
+		orchestrator.StartListener(context.Background())
+
+		err := orchestrator.RegisterDefinition(SagaDefinition{
+			Name: "order",
+			Steps: []StepSpec{
+				{Name: "reserve", Handler: NewStepHandler(func(ctx context.Context, data map[string]interface{}) error {
+					data["reserved"] = data["item"]
+					return nil
+				}, nil)},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Failed to register definition: %v", err)
+		}
+
+		items := []string{"book", "lamp", "desk"}
+		data := make([]map[string]interface{}, len(items))
+		for i, item := range items {
+			data[i] = map[string]interface{}{"item": item}
+		}
+		sagas, err := orchestrator.StartSagas(context.Background(), "order", data)
+		if err != nil {
+			t.Fatalf("Failed to start sagas: %v", err)
+		}
+		if len(sagas) != len(items) {
+			t.Fatalf("Expected %d sagas, got %d", len(items), len(sagas))
+		}
+		for i, sagaInstance := range sagas {
+			if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusCompleted {
+				t.Fatalf("Expected saga %d to complete, got %s", i, status)
+			}
+			finalSaga, _ := storage.GetSaga(context.Background(), sagaInstance.ID)
+			if finalSaga.Data["reserved"] != items[i] {
+				t.Errorf("Expected %s to be reserved, got %v", items[i], finalSaga.Data["reserved"])
+			}
+		}
+		if _, reserved := data[0]["reserved"]; reserved {
+			t.Error("Expected the caller's data to be left alone")
+		}
+		if _, err := orchestrator.StartSagas(context.Background(), "missing", data); !errors.Is(err, ErrUnknownDefinition) {
+			t.Errorf("Expected ErrUnknownDefinition, got %v", err)
+		}
+		pubsub.Close()
+	}
+}
+
+func TestMemoryStorageSaveSagas(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+
+	if err := storage.SaveSaga(ctx, &Saga{ID: "keyed", IdempotencyKey: "order-1"}); err != nil {
+		t.Fatalf("Failed to save saga: %v", err)
+	}
+	batch := []*Saga{
+		{ID: "a", Steps: []Step{{ID: "a-1", SagaID: "a"}}},
+		{ID: "b", IdempotencyKey: "order-1"},
+	}
+	if err := storage.SaveSagas(ctx, batch); !errors.Is(err, ErrDuplicateIdempotencyKey) {
+		t.Fatalf("Expected ErrDuplicateIdempotencyKey, got %v", err)
+	}
+	if _, err := storage.GetSaga(ctx, "a"); !errors.Is(err, ErrSagaNotFound) {
+		t.Errorf("Expected no saga of a failed batch to be saved, got %v", err)
+	}
+
+	batch[1].IdempotencyKey = "order-2"
+	if err := storage.SaveSagas(ctx, batch); err != nil {
+		t.Fatalf("Failed to save sagas: %v", err)
+	}
+	saved, err := storage.GetSaga(ctx, "a")
+	if err != nil || saved.Version != 1 || len(saved.Steps) != 1 {
+		t.Errorf("Expected saga a with its step at version 1, got %+v, %v", saved, err)
+	}
+	if err := storage.SaveSagas(ctx, batch[:1]); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected saving a saga twice to conflict, got %v", err)
+	}
+}
+
+func TestClaimNextPendingStep(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+
+	sagas := []*Saga{
+		{ID: "running", Status: StatusPending, Steps: []Step{
+			{ID: "first", SagaID: "running", Name: "first", Status: StatusPending},
+			{ID: "second", SagaID: "running", Name: "second", Status: StatusPending, DependsOn: []string{"first"}},
+		}},
+		{ID: "paused", Status: StatusPaused, Steps: []Step{
+			{ID: "held", SagaID: "paused", Name: "held", Status: StatusPending},
+		}},
+	}
+	for _, saga := range sagas {
+		if err := storage.SaveSaga(ctx, saga); err != nil {
+			t.Fatalf("Failed to save saga: %v", err)
+		}
+	}
+
+	step, err := storage.ClaimNextPendingStep(ctx, "worker", time.Time{})
+	if err != nil || step.ID != "first" || step.Status != StatusProcessing || step.ClaimedBy != "worker" {
+		t.Fatalf("Expected the first step to be claimed, got %+v, %v", step, err)
+	}
+	// The second step waits for the first, and paused sagas' steps for ResumeSaga
+	if step, err := storage.ClaimNextPendingStep(ctx, "worker", time.Time{}); !errors.Is(err, ErrStepNotFound) {
+		t.Fatalf("Expected no step to be ready, got %+v, %v", step, err)
+	}
+
+	if _, err := storage.UpdateStepStatus(ctx, "first", StatusProcessing, StatusCompleted); err != nil {
+		t.Fatalf("Failed to complete step: %v", err)
+	}
+	expiry := time.Now().Add(time.Minute)
+	step, err = storage.ClaimNextPendingStep(ctx, "other", expiry)
+	if err != nil || step.ID != "second" || step.ClaimExpiry == nil || !step.ClaimExpiry.Equal(expiry) {
+		t.Fatalf("Expected the second step to be claimed once the first completed, got %+v, %v", step, err)
+	}
+	if saga, _ := storage.GetSaga(ctx, "running"); saga.Steps[1].Status != StatusProcessing {
+		t.Errorf("Expected the claim to show in the saga's steps, got %s", saga.Steps[1].Status)
+	}
+}
+
+func TestMetadataReachesHandlers(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	var mu sync.Mutex
+	seen := make(map[string]string)
+	record := func(name string) func(ctx context.Context, data map[string]interface{}) error {
+		return func(ctx context.Context, data map[string]interface{}) error {
+			value, _ := MetadataValue(ctx, "request_id")
+			mu.Lock()
+			seen[name] = value
+			mu.Unlock()
+			return nil
+		}
+	}
+
+	ctx := ContextWithMetadata(context.Background(), "request_id", "req-42")
+	sagaInstance, err := NewBuilder("metadata_saga", orchestrator).
+		Step("step1", record("execute"), record("compensate")).
+		Step("step2", func(ctx context.Context, data map[string]interface{}) error {
+			return errors.New("fail")
+		}, nil).
+		Execute(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	waitForSaga(t, orchestrator, sagaInstance.ID)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if seen["execute"] != "req-42" || seen["compensate"] != "req-42" {
+		t.Errorf("Expected handlers to see the request ID, got %v", seen)
+	}
+
+	finalSaga, _ := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if finalSaga.Metadata["request_id"] != "req-42" {
+		t.Errorf("Expected metadata to be stored with the saga, got %v", finalSaga.Metadata)
+	}
+}
+
+func TestStepContext(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	var mu sync.Mutex
+	var seen []StepContext
+	shared := func(ctx context.Context, data map[string]interface{}) error {
+		sc, ok := StepFromContext(ctx)
+		if !ok {
+			return errors.New("no step context")
+		}
+		mu.Lock()
+		seen = append(seen, sc)
+		mu.Unlock()
+		if sc.StepName == "second" && !sc.IsCompensating {
+			return errors.New("fail")
+		}
+		return nil
+	}
+
+	sagaInstance, err := NewBuilder("step_context_saga", orchestrator).
+		Step("first", shared, shared).
+		Step("second", shared, shared).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	waitForSaga(t, orchestrator, sagaInstance.ID)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 3 {
+		t.Fatalf("Expected two executions and one compensation, got %+v", seen)
+	}
+	want := []struct {
+		step         string
+		compensating bool
+	}{{"first", false}, {"second", false}, {"first", true}}
+	for i, w := range want {
+		sc := seen[i]
+		if sc.StepName != w.step || sc.IsCompensating != w.compensating || sc.SagaID != sagaInstance.ID || sc.Attempt != 1 {
+			t.Errorf("Call %d: unexpected step context %+v", i, sc)
+		}
+	}
+	if _, ok := StepFromContext(context.Background()); ok {
+		t.Error("Expected no step context outside handlers")
+	}
+}
+
+func TestStepIdempotencyToken(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub, WithMaxAttempts(3))
+	orchestrator.StartListener(context.Background())
+
+	var mu sync.Mutex
+	var charges []string
+	var refund string
+	sagaInstance, err := NewBuilder("token_saga", orchestrator).
+		Step("charge", func(ctx context.Context, data map[string]interface{}) error {
+			sc, _ := StepFromContext(ctx)
+			mu.Lock()
+			defer mu.Unlock()
+			charges = append(charges, sc.IdempotencyToken)
+			if len(charges) < 3 {
+				return errors.New("provider timeout")
+			}
+			return nil
+		}, func(ctx context.Context, data map[string]interface{}) error {
+			sc, _ := StepFromContext(ctx)
+			mu.Lock()
+			defer mu.Unlock()
+			refund = sc.IdempotencyToken
+			return nil
+		}).
+		Step("ship", func(ctx context.Context, data map[string]interface{}) error {
+			return Permanent(errors.New("address invalid"))
+		}, nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	waitForSaga(t, orchestrator, sagaInstance.ID)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(charges) != 3 || charges[0] == "" || charges[1] != charges[0] || charges[2] != charges[0] {
+		t.Errorf("Expected one token across attempts, got %v", charges)
+	}
+	if refund == "" || refund == charges[0] {
+		t.Errorf("Expected the compensation to get its own token, got %q", refund)
+	}
+}
+
+func TestStepRetries(t *testing.T) {
+	run := func(t *testing.T, failWith error, opts ...Option) (Status, int32) {
+		storage := NewMemoryStorage()
+		pubsub := NewMemoryPubSub()
+		defer pubsub.Close()
+
+		orchestrator := NewOrchestrator(storage, pubsub, append([]Option{WithMaxAttempts(3)}, opts...)...)
+		orchestrator.StartListener(context.Background())
+
+		var attempts atomic.Int32
+		sagaInstance, err := NewBuilder("retry_saga", orchestrator).
+			Step("flaky", func(ctx context.Context, data map[string]interface{}) error {
+				if attempts.Add(1) < 3 {
+					return failWith
+				}
+				return nil
+			}, nil).
+			Execute(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to start saga: %v", err)
+		}
+		return waitForSaga(t, orchestrator, sagaInstance.ID), attempts.Load()
+	}
+
+	tests := []struct {
+		name     string
+		err      error
+		opts     []Option
+		status   Status
+		attempts int32
+	}{
+		{"plain error is retried", errors.New("blip"), nil, StatusCompleted, 3},
+		{"permanent error fails at once", Permanent(errors.New("invalid")), nil, StatusFailed, 1},
+		{"plain error fails when not retryable by default", errors.New("blip"), []Option{WithDefaultRetryable(false)}, StatusFailed, 1},
+		{"retryable error is retried", Retryable(errors.New("blip")), []Option{WithDefaultRetryable(false)}, StatusCompleted, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, attempts := run(t, tt.err, tt.opts...)
+			if status != tt.status || attempts != tt.attempts {
+				t.Errorf("Expected %s after %d attempts, got %s after %d", tt.status, tt.attempts, status, attempts)
+			}
+		})
+	}
+}
+
+func TestSagaJSONRoundTrip(t *testing.T) {
+	started := time.Now()
+	deadline := started.Add(time.Minute)
+	original := &Saga{
+		ID:           "saga-1",
+		Name:         "order",
+		Status:       StatusCompensating,
+		Data:         map[string]interface{}{"amount": 12.5, "count": 3, "tags": []string{"a"}},
+		Error:        "step charge failed: declined",
+		FailedStepID: "step-2",
+		Metadata:     map[string]string{"tenant": "t1"},
+		Deadline:     &deadline,
+		CreatedAt:    started,
+		UpdatedAt:    started,
+		Steps: []Step{
+			{ID: "step-1", SagaID: "saga-1", Name: "reserve", Status: StatusCompleted, StartedAt: &started, Attempts: 1,
+				Data: map[string]interface{}{}, OutputData: map[string]interface{}{"reserved": true}, CreatedAt: started, UpdatedAt: started},
+			{ID: "step-2", SagaID: "saga-1", Name: "charge", Status: StatusFailed, DependsOn: []string{"reserve"},
+				Data: map[string]interface{}{}, Error: "declined", CreatedAt: started, UpdatedAt: started},
+		},
+	}
+
+	encoded, err := MarshalSaga(original)
+	if err != nil {
+		t.Fatalf("Failed to marshal saga: %v", err)
+	}
+	decoded, err := UnmarshalSaga(encoded)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal saga: %v", err)
+	}
+
+	if decoded.ID != original.ID || decoded.Status != original.Status || decoded.FailedStepID != original.FailedStepID ||
+		decoded.Metadata["tenant"] != "t1" || !decoded.Deadline.Equal(deadline) || !decoded.CreatedAt.Equal(started) {
+		t.Errorf("Saga fields did not round-trip: %+v", decoded)
+	}
+	// Numbers come back as float64 and slices as []interface{}
+	if decoded.Data["amount"] != 12.5 || decoded.Data["count"] != float64(3) {
+		t.Errorf("Unexpected data after round-trip: %#v", decoded.Data)
+	}
+	if tags, ok := decoded.Data["tags"].([]interface{}); !ok || len(tags) != 1 || tags[0] != "a" {
+		t.Errorf("Unexpected tags after round-trip: %#v", decoded.Data["tags"])
+	}
+
+	if len(decoded.Steps) != 2 {
+		t.Fatalf("Expected 2 steps, got %d", len(decoded.Steps))
+	}
+	first, second := decoded.Steps[0], decoded.Steps[1]
+	if first.StartedAt == nil || !first.StartedAt.Equal(started) || first.Attempts != 1 || first.OutputData["reserved"] != true {
+		t.Errorf("Unexpected first step: %+v", first)
+	}
+	if second.StartedAt != nil || second.Data == nil || len(second.DependsOn) != 1 || second.Error != "declined" {
+		t.Errorf("Unexpected second step: %+v", second)
+	}
+
+	// Encoding again gives the same document
+	again, err := MarshalSaga(decoded)
+	if err != nil {
+		t.Fatalf("Failed to marshal saga: %v", err)
+	}
+	if !bytes.Equal(encoded, again) {
+		t.Errorf("Expected a stable encoding:\n%s\n%s", encoded, again)
+	}
+}
+
+func TestIDGeneratorAndKeyedStart(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	var next atomic.Int32
+	orchestrator := NewOrchestrator(storage, pubsub, WithIDGenerator(func() string {
+		return fmt.Sprintf("id-%d", next.Add(1))
+	}))
+	orchestrator.StartListener(context.Background())
+
+	var runs atomic.Int32
+	orchestrator.RegisterHandler("charge", NewStepHandler(func(ctx context.Context, data map[string]interface{}) error {
+		runs.Add(1)
+		return nil
+	}, nil))
+
+	sagaInstance, err := orchestrator.StartSaga(context.Background(), "generated", []string{"charge"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if sagaInstance.ID != "id-1" || sagaInstance.Steps[0].ID != "id-2" {
+		t.Errorf("Expected generated IDs, got saga %s and step %s", sagaInstance.ID, sagaInstance.Steps[0].ID)
+	}
+	waitForSaga(t, orchestrator, sagaInstance.ID)
+
+	first, err := orchestrator.StartSagaWithKey(context.Background(), "order-7", "keyed", []string{"charge"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to start keyed saga: %v", err)
+	}
+	waitForSaga(t, orchestrator, first.ID)
+	second, err := orchestrator.StartSagaWithKey(context.Background(), "order-7", "keyed", []string{"charge"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to start keyed saga: %v", err)
+	}
+	if second.ID != first.ID || second.Status != StatusCompleted {
+		t.Errorf("Expected the existing saga %s back, got %s (%s)", first.ID, second.ID, second.Status)
+	}
+	if runs.Load() != 2 {
+		t.Errorf("Expected the keyed saga to run once, got %d runs in total", runs.Load())
+	}
+
+	if _, err := storage.GetSaga(context.Background(), "missing"); !errors.Is(err, ErrSagaNotFound) {
+		t.Errorf("Expected ErrSagaNotFound, got %v", err)
+	}
+}
+
+func TestConcurrentStartsWithSameKey(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	var charges atomic.Int32
+	start := func() (*Saga, error) {
+		return NewBuilder("checkout", orchestrator).
+			Step("charge", func(ctx context.Context, data map[string]interface{}) error {
+				charges.Add(1)
+				return nil
+			}, nil).
+			WithIdempotencyKey("request-1").
+			Execute(context.Background())
+	}
+
+	var wg sync.WaitGroup
+	ids := make([]string, 10)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sagaInstance, err := start()
+			if err != nil {
+				t.Errorf("Failed to start saga: %v", err)
+				return
+			}
+			ids[i] = sagaInstance.ID
+		}(i)
+	}
+	wg.Wait()
+
+	for _, id := range ids {
+		if id != ids[0] {
+			t.Fatalf("Expected every start to return one saga, got %v", ids)
+		}
+	}
+	waitForSaga(t, orchestrator, ids[0])
+	if charges.Load() != 1 {
+		t.Errorf("Expected one charge, got %d", charges.Load())
+	}
+
+	stored, err := storage.GetSagaByKey(context.Background(), "request-1")
+	if err != nil || stored.ID != ids[0] || stored.IdempotencyKey != "request-1" {
+		t.Errorf("Expected to find the saga by key, got %+v, %v", stored, err)
+	}
+}
+
+func TestPurgeCompletedSagas(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	finished, err := NewBuilder("purge_saga", orchestrator).
+		Step("step1", func(ctx context.Context, data map[string]interface{}) error { return nil }, nil).
+		WithIdempotencyKey("purge-1").
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	waitForSaga(t, orchestrator, finished.ID)
+
+	running := &Saga{ID: "running", Status: StatusPending, Steps: []Step{{ID: "running-step", SagaID: "running", Status: StatusPending}}}
+	if err := storage.SaveSaga(context.Background(), running); err != nil {
+		t.Fatalf("Failed to save saga: %v", err)
+	}
+
+	if purged, _ := storage.PurgeCompletedBefore(context.Background(), time.Now().Add(-time.Hour)); purged != 0 {
+		t.Errorf("Expected nothing older than the cutoff, purged %d", purged)
+	}
+	purged, err := storage.PurgeCompletedBefore(context.Background(), time.Now().Add(time.Second))
+	if err != nil || purged != 1 {
+		t.Fatalf("Expected to purge the finished saga, got %d, %v", purged, err)
+	}
+
+	if _, err := storage.GetSaga(context.Background(), finished.ID); !errors.Is(err, ErrSagaNotFound) {
+		t.Errorf("Expected the purged saga to be gone, got %v", err)
+	}
+	if _, err := storage.GetStep(context.Background(), finished.Steps[0].ID); !errors.Is(err, ErrStepNotFound) {
+		t.Errorf("Expected the purged saga's steps to be gone, got %v", err)
+	}
+	if _, err := storage.GetSagaByKey(context.Background(), "purge-1"); !errors.Is(err, ErrSagaNotFound) {
+		t.Errorf("Expected the purged saga's key to be released, got %v", err)
+	}
+
+	if err := storage.DeleteSaga(context.Background(), "running"); err != nil {
+		t.Fatalf("Failed to delete saga: %v", err)
+	}
+	if _, err := storage.GetStep(context.Background(), "running-step"); !errors.Is(err, ErrStepNotFound) {
+		t.Errorf("Expected the deleted saga's steps to be gone, got %v", err)
+	}
+	if err := storage.DeleteSaga(context.Background(), "running"); err != nil {
+		t.Errorf("Expected deleting a missing saga to succeed, got %v", err)
+	}
+}
+
+func TestPauseAndResumeSaga(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var secondRan atomic.Bool
+	sagaInstance, err := NewBuilder("pause_saga", orchestrator).
+		Step("first", func(ctx context.Context, data map[string]interface{}) error {
+			close(started)
+			<-release
+			return nil
+		}, nil).
+		Step("second", func(ctx context.Context, data map[string]interface{}) error {
+			secondRan.Store(true)
+			return nil
+		}, nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	<-started
+	if err := orchestrator.PauseSaga(context.Background(), sagaInstance.ID); err != nil {
+		t.Fatalf("Failed to pause saga: %v", err)
+	}
+	close(release)
+
+	// The running step finishes, but the next one doesn't start
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		step, _ := storage.GetStep(context.Background(), sagaInstance.Steps[0].ID)
+		if step.Status == StatusCompleted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the running step to finish, got %s", step.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if secondRan.Load() {
+		t.Fatal("Expected the next step to wait while the saga is paused")
+	}
+
+	// Recovery doesn't treat the waiting step as stuck
+	if stuck, _ := storage.GetStuckSteps(context.Background(), -time.Second); len(stuck) != 0 {
+		t.Errorf("Expected no stuck steps while paused, got %+v", stuck)
+	}
+
+	if err := orchestrator.PauseSaga(context.Background(), sagaInstance.ID); err == nil {
+		t.Error("Expected pausing a paused saga to fail")
+	}
+	if err := orchestrator.ResumeSaga(context.Background(), sagaInstance.ID); err != nil {
+		t.Fatalf("Failed to resume saga: %v", err)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusCompleted || !secondRan.Load() {
+		t.Errorf("Expected the resumed saga to complete, got %s", status)
+	}
+	if err := orchestrator.ResumeSaga(context.Background(), sagaInstance.ID); err == nil {
+		t.Error("Expected resuming a completed saga to fail")
+	}
+}
+
+func TestMemoryPubSubCloseWaitsForDeliveries(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	pubsub := NewMemoryPubSub()
+	var delivered atomic.Int32
+	pubsub.Subscribe(context.Background(), "topic", func(msg Message) error {
+		time.Sleep(20 * time.Millisecond)
+		delivered.Add(1)
+		return nil
+	})
+
+	for i := 0; i < 5; i++ {
+		if err := pubsub.Publish(context.Background(), "topic", Message{Type: "test"}); err != nil {
+			t.Fatalf("Failed to publish: %v", err)
+		}
+	}
+	if err := pubsub.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if delivered.Load() != 5 {
+		t.Errorf("Expected Close to wait for all deliveries, got %d", delivered.Load())
+	}
+
+	if err := pubsub.Publish(context.Background(), "topic", Message{Type: "test"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed after Close, got %v", err)
+	}
+
+	// CloseContext gives up on handlers that don't return in time
+	stuck := NewMemoryPubSub()
+	release := make(chan struct{})
+	stuck.Subscribe(context.Background(), "topic", func(msg Message) error {
+		<-release
+		return nil
+	})
+	stuck.Publish(context.Background(), "topic", Message{Type: "test"})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := stuck.CloseContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected CloseContext to time out, got %v", err)
+	}
+	close(release)
+	stuck.CloseContext(context.Background())
+}
+
+func TestSyncDeliveryIsOrdered(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub(WithSyncDelivery())
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	// Only the single worker appends, so no lock is needed
+	var order []string
+	record := func(name string) func(ctx context.Context, data map[string]interface{}) error {
+		return func(ctx context.Context, data map[string]interface{}) error {
+			order = append(order, name)
+			return nil
+		}
+	}
+
+	sagaInstance, err := NewBuilder("ordered_saga", orchestrator).
+		Step("a", record("a"), nil).DependsOn().
+		Step("b", record("b"), nil).DependsOn().
+		Step("c", record("c"), nil).DependsOn().
+		Step("d", record("d"), nil).DependsOn("a", "b", "c").
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	waitForSaga(t, orchestrator, sagaInstance.ID)
+
+	if strings.Join(order, ",") != "a,b,c,d" {
+		t.Errorf("Expected steps in publish order, got %v", order)
+	}
+}
+
+func TestOrderedDelivery(t *testing.T) {
+	pubsub := NewMemoryPubSub(WithOrderedDelivery())
+
+	var mu sync.Mutex
+	received := make(map[string][]int)
+	active := make(map[string]int)
+	// The first message of each saga waits for the other's, which only
+	// works if different sagas are delivered concurrently
+	var started sync.WaitGroup
+	started.Add(2)
+	pubsub.Subscribe(context.Background(), "topic", func(msg Message) error {
+		n := msg.Data["n"].(int)
+		if n == 0 {
+			started.Done()
+			started.Wait()
+		}
+
+		mu.Lock()
+		active[msg.SagaID]++
+		if active[msg.SagaID] > 1 {
+			t.Errorf("Saga %s had messages delivered concurrently", msg.SagaID)
+		}
+		received[msg.SagaID] = append(received[msg.SagaID], n)
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		active[msg.SagaID]--
+		mu.Unlock()
+		return nil
+	})
+
+	for n := 0; n < 20; n++ {
+		for _, sagaID := range []string{"a", "b"} {
+			pubsub.Publish(context.Background(), "topic", Message{Type: "test", SagaID: sagaID, Data: map[string]interface{}{"n": n}})
+		}
+	}
+	if err := pubsub.Close(); err != nil {
+		t.Fatalf("Failed to close pubsub: %v", err)
+	}
+
+	for _, sagaID := range []string{"a", "b"} {
+		got := received[sagaID]
+		if len(got) != 20 || !slices.IsSorted(got) {
+			t.Errorf("Expected saga %s's messages in publish order, got %v", sagaID, got)
+		}
+	}
+}
+
+func TestMemoryPubSubRedelivery(t *testing.T) {
+	for _, tt := range []struct {
+		redeliveries int
+		calls        int32
+	}{{0, 1}, {1, 2}, {5, 3}} {
+		pubsub := NewMemoryPubSub(WithSyncDelivery(), WithRedelivery(tt.redeliveries))
+
+		var calls atomic.Int32
+		pubsub.Subscribe(context.Background(), "topic", func(msg Message) error {
+			if calls.Add(1) < 3 {
+				return errors.New("not yet")
+			}
+			return nil
+		})
+		pubsub.Publish(context.Background(), "topic", Message{Type: "test"})
+		pubsub.Close()
+
+		if calls.Load() != tt.calls {
+			t.Errorf("With %d redeliveries expected %d calls, got %d", tt.redeliveries, tt.calls, calls.Load())
+		}
+	}
+}
+
+func TestScopedStepData(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub, WithScopedStepData())
+	orchestrator.StartListener(context.Background())
+
+	var seen map[string]interface{}
+	sagaInstance, err := NewBuilder("scoped_saga", orchestrator).
+		Step("reserve", func(ctx context.Context, data map[string]interface{}) error {
+			data["status"] = "reserved"
+			data["reservation_id"] = "r-1"
+			Promote(ctx, "reservation_id")
+			return nil
+		}, nil).DependsOn().
+		Step("charge", func(ctx context.Context, data map[string]interface{}) error {
+			data["status"] = "charged"
+			return nil
+		}, nil).DependsOn().
+		Step("ship", func(ctx context.Context, data map[string]interface{}) error {
+			seen = StepOutput(data, "reserve")
+			return nil
+		}, nil).DependsOn("reserve", "charge").
+		WithData("user_id", "user_123").
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	waitForSaga(t, orchestrator, sagaInstance.ID)
+
+	finalSaga, _ := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if _, exists := finalSaga.Data["status"]; exists {
+		t.Errorf("Expected unpromoted keys to stay out of the top level, got %v", finalSaga.Data)
+	}
+	if finalSaga.Data["reservation_id"] != "r-1" || finalSaga.Data["user_id"] != "user_123" {
+		t.Errorf("Expected promoted and initial keys at the top level, got %v", finalSaga.Data)
+	}
+	if StepOutput(finalSaga.Data, "reserve")["status"] != "reserved" || StepOutput(finalSaga.Data, "charge")["status"] != "charged" {
+		t.Errorf("Expected each step's output under its name, got %v", finalSaga.Data[StepsDataKey])
+	}
+	if _, exists := StepOutput(finalSaga.Data, "charge")["user_id"]; exists {
+		t.Error("Expected unchanged keys not to be copied into step output")
+	}
+	if seen["status"] != "reserved" {
+		t.Errorf("Expected later steps to read earlier outputs, got %v", seen)
+	}
+}
+
+func TestNoCompensationStepsAreSkipped(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	var compensated []string
+	var mu sync.Mutex
+	compensate := func(name string) func(ctx context.Context, data map[string]interface{}) error {
+		return func(ctx context.Context, data map[string]interface{}) error {
+			mu.Lock()
+			compensated = append(compensated, name)
+			mu.Unlock()
+			return nil
+		}
+	}
+	ok := func(ctx context.Context, data map[string]interface{}) error { return nil }
+
+	sagaInstance, err := NewBuilder("no_compensation_saga", orchestrator).
+		Step("reserve", ok, compensate("reserve")).
+		Step("notify", ok, compensate("notify")).NoCompensation().
+		Step("charge", func(ctx context.Context, data map[string]interface{}) error {
+			return errors.New("declined")
+		}, nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusFailed {
+		t.Fatalf("Expected saga to fail, got %s", status)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(compensated, ",") != "reserve" {
+		t.Errorf("Expected only reserve to be compensated, got %v", compensated)
+	}
+
+	finalSaga, _ := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if finalSaga.Steps[0].Status != StatusCompensated || finalSaga.Steps[1].Status != StatusCompleted || !finalSaga.Steps[1].NoCompensation {
+		t.Errorf("Unexpected step statuses: %s, %s", finalSaga.Steps[0].Status, finalSaga.Steps[1].Status)
+	}
+}
+
+func TestCompensateFailedStep(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	var compensated []string
+	var reserved interface{}
+	var mu sync.Mutex
+	ok := func(ctx context.Context, data map[string]interface{}) error { return nil }
+
+	sagaInstance, err := NewBuilder("compensate_failed_saga", orchestrator).
+		Step("charge", ok, func(ctx context.Context, data map[string]interface{}) error {
+			mu.Lock()
+			compensated = append(compensated, "charge")
+			mu.Unlock()
+			return nil
+		}).
+		Step("reserve_items", func(ctx context.Context, data map[string]interface{}) error {
+			data["reserved"] = 2
+			return Permanent(errors.New("third item out of stock"))
+		}, func(ctx context.Context, data map[string]interface{}) error {
+			mu.Lock()
+			compensated = append(compensated, "reserve_items")
+			reserved = data["reserved"]
+			mu.Unlock()
+			return nil
+		}).CompensateFailedStep().
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusFailed {
+		t.Fatalf("Expected saga to fail, got %s", status)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(compensated, ",") != "reserve_items,charge" {
+		t.Errorf("Expected the failed step to be compensated first, got %v", compensated)
+	}
+	if reserved != 2 {
+		t.Errorf("Expected the compensation to see the partial work, got %v", reserved)
+	}
+
+	finalSaga, _ := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if finalSaga.Steps[1].Status != StatusCompensated || finalSaga.Steps[1].Error == "" {
+		t.Errorf("Expected the failed step to be compensated with its error kept, got %s %q", finalSaga.Steps[1].Status, finalSaga.Steps[1].Error)
+	}
+}
+
+func TestCompletionMessages(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	finished := make(chan Message, 2)
+	pubsub.Subscribe(context.Background(), "saga_done", func(msg Message) error {
+		finished <- msg
+		return nil
+	})
+
+	orchestrator := NewOrchestrator(storage, pubsub, WithCompletionTopic("saga_done"))
+	orchestrator.StartListener(context.Background())
+
+	ok := func(ctx context.Context, data map[string]interface{}) error { return nil }
+	succeeded, err := NewBuilder("ok_saga", orchestrator).Step("step1", ok, nil).Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	failed, err := NewBuilder("failing_saga", orchestrator).
+		Step("step1", func(ctx context.Context, data map[string]interface{}) error { return errors.New("boom") }, nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	want := map[string]string{succeeded.ID: MessageSagaCompleted, failed.ID: MessageSagaFailed}
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-finished:
+			if want[msg.SagaID] != msg.Type {
+				t.Errorf("Unexpected completion message %+v", msg)
+			}
+			delete(want, msg.SagaID)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for completion messages, missing %v", want)
+		}
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	server := httptest.NewServer(NewHTTPHandler(orchestrator, storage))
+	defer server.Close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var compensated atomic.Int32
+	compensate := func(ctx context.Context, data map[string]interface{}) error {
+		compensated.Add(1)
+		return nil
+	}
+	sagaInstance, err := NewBuilder("http_saga", orchestrator).
+		Step("first", func(ctx context.Context, data map[string]interface{}) error { return nil }, compensate).
+		Step("second", func(ctx context.Context, data map[string]interface{}) error {
+			close(started)
+			<-release
+			return nil
+		}, compensate).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	<-started
+
+	request := func(method, path string, want int, v interface{}) {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("%s %s: expected status %d, got %d", method, path, want, resp.StatusCode)
+		}
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatalf("%s %s: failed to decode response: %v", method, path, err)
+			}
+		}
+	}
+
+	var listed []Saga
+	request(http.MethodGet, "/sagas?name=http_saga&status=pending", http.StatusOK, &listed)
+	if len(listed) != 1 || listed[0].ID != sagaInstance.ID {
+		t.Fatalf("Expected the running saga to be listed, got %+v", listed)
+	}
+	request(http.MethodGet, "/sagas?status=completed", http.StatusOK, &listed)
+	if len(listed) != 0 {
+		t.Errorf("Expected no completed sagas, got %+v", listed)
+	}
+	request(http.MethodGet, "/sagas?limit=zero", http.StatusBadRequest, nil)
+
+	var fetched Saga
+	request(http.MethodGet, "/sagas/"+sagaInstance.ID, http.StatusOK, &fetched)
+	if fetched.ID != sagaInstance.ID || len(fetched.Steps) != 2 {
+		t.Errorf("Unexpected saga %+v", fetched)
+	}
+	request(http.MethodGet, "/sagas/missing", http.StatusNotFound, nil)
+	request(http.MethodGet, "/sagas/"+sagaInstance.ID+"/cancel", http.StatusMethodNotAllowed, nil)
+
+	request(http.MethodPost, "/sagas/"+sagaInstance.ID+"/cancel", http.StatusAccepted, &fetched)
+	if fetched.Status != StatusCompensating {
+		t.Errorf("Expected the canceled saga to be compensating, got %s", fetched.Status)
+	}
+
+	// The running step finishes and is rolled back along with the first one
+	close(release)
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusCanceled {
+		t.Fatalf("Expected the saga to be canceled, got %s", status)
+	}
+	if n := compensated.Load(); n != 2 {
+		t.Errorf("Expected both steps to be compensated, got %d", n)
+	}
+	request(http.MethodPost, "/sagas/"+sagaInstance.ID+"/cancel", http.StatusConflict, nil)
+	request(http.MethodPost, "/sagas/missing/cancel", http.StatusNotFound, nil)
+}
+
+func TestChildSagas(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	var childCompensated atomic.Int32
+	err := NewBuilder("reserve_stock", orchestrator).
+		Step("reserve", func(ctx context.Context, data map[string]interface{}) error {
+			if data["fail"] == true {
+				return errors.New("out of stock")
+			}
+			data["reserved"] = true
+			return nil
+		}, func(ctx context.Context, data map[string]interface{}) error {
+			childCompensated.Add(1)
+			return nil
+		}).
+		Register()
+	if err != nil {
+		t.Fatalf("Failed to register child definition: %v", err)
+	}
+
+	var child *Saga
+	run := func(failChild, failParent bool) *Saga {
+		parent, err := NewBuilder("order", orchestrator).
+			Step("stock", func(ctx context.Context, data map[string]interface{}) error {
+				var err error
+				child, err = orchestrator.StartChildSaga(ctx, "reserve_stock", map[string]interface{}{"fail": failChild})
+				return err
+			}, func(ctx context.Context, data map[string]interface{}) error {
+				return orchestrator.CompensateChildSagas(ctx)
+			}).
+			Step("charge", func(ctx context.Context, data map[string]interface{}) error {
+				if failParent {
+					return errors.New("declined")
+				}
+				return nil
+			}, nil).
+			Execute(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to start saga: %v", err)
+		}
+		waitForSaga(t, orchestrator, parent.ID)
+		parent, _ = storage.GetSaga(context.Background(), parent.ID)
+		return parent
+	}
+
+	parent := run(false, false)
+	if parent.Status != StatusCompleted || child.Status != StatusCompleted || child.Data["reserved"] != true {
+		t.Fatalf("Expected parent and child to complete, got %s and %+v", parent.Status, child)
+	}
+	if child.ParentSagaID != parent.ID || child.ParentStepID != parent.Steps[0].ID {
+		t.Errorf("Expected the child to link to its parent step, got %s/%s", child.ParentSagaID, child.ParentStepID)
+	}
+	if ids := parent.Steps[0].ChildSagaIDs; len(ids) != 1 || ids[0] != child.ID {
+		t.Errorf("Expected the parent step to list its child, got %v", ids)
+	}
+
+	// A failing child fails the parent step
+	parent = run(true, false)
+	if parent.Status != StatusFailed || !strings.Contains(parent.Error, "out of stock") {
+		t.Errorf("Expected the child's failure to fail the parent, got %s: %s", parent.Status, parent.Error)
+	}
+	if child.Status != StatusFailed {
+		t.Errorf("Expected the child to fail, got %s", child.Status)
+	}
+
+	// Compensating the parent step rolls back the completed child
+	parent = run(false, true)
+	if parent.Status != StatusFailed {
+		t.Fatalf("Expected the parent to fail, got %s", parent.Status)
+	}
+	if stored, _ := storage.GetSaga(context.Background(), child.ID); stored.Status != StatusRolledBack || childCompensated.Load() != 1 {
+		t.Errorf("Expected the child to be rolled back with the parent, got %s", stored.Status)
+	}
+
+	if _, err := orchestrator.StartChildSaga(context.Background(), "reserve_stock", nil); err == nil {
+		t.Error("Expected starting a child outside a step to fail")
+	}
+}
+
+func TestRecoveryBackoff(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	storage.SaveSaga(context.Background(), &Saga{
+		ID:     "saga-1",
+		Status: StatusPending,
+		Steps: []Step{
+			{ID: "fresh", SagaID: "saga-1", Name: "fresh", Status: StatusPending},
+			{ID: "recovered", SagaID: "saga-1", Name: "recovered", Status: StatusPending, RecoveryAttempts: 2},
+		},
+	})
+
+	republished := make(chan Message, 10)
+	pubsub.Subscribe(context.Background(), "saga_events", func(msg Message) error {
+		republished <- msg
+		return nil
+	})
+
+	recovery := NewRecoveryManager(storage, pubsub,
+		WithStepTimeout(time.Millisecond), WithRecoveryBackoff(time.Hour, time.Hour))
+	time.Sleep(5 * time.Millisecond)
+	recovery.recoverStuckSteps(context.Background())
+
+	select {
+	case msg := <-republished:
+		if msg.StepID != "fresh" || msg.Type != "step_recover" {
+			t.Errorf("Expected only the fresh step to be recovered, got %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the fresh step to be recovered")
+	}
+	select {
+	case msg := <-republished:
+		t.Errorf("Expected the recovered step to back off, got %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The delay doubles per attempt up to the maximum, within the jitter
+	recovery = NewRecoveryManager(storage, pubsub, WithRecoveryBackoff(time.Second, 10*time.Second))
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 10 * time.Second} {
+		delay := recovery.recoveryDelay(Step{ID: "step", RecoveryAttempts: attempts})
+		if delay < want/2 || delay >= want*3/2 {
+			t.Errorf("Expected a delay around %s after %d attempts, got %s", want, attempts, delay)
+		}
+	}
+
+	// Recovery counts the steps it republishes, whatever becomes of the
+	// message
+	fresh, _ := storage.GetStep(context.Background(), "fresh")
+	if fresh.RecoveryAttempts != 1 || fresh.LastRecoveredAt == nil {
+		t.Errorf("Expected recovery to record one attempt, got %+v", fresh)
+	}
+
+	// Running a recovered step doesn't count it again
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.RegisterHandler("step1", NewStepHandler(func(ctx context.Context, data map[string]interface{}) error { return nil }, nil))
+	sagaInstance, err := orchestrator.StartSaga(context.Background(), "counted", []string{"step1"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if err := orchestrator.handleMessage(context.Background(), Message{Type: "step_recover", SagaID: sagaInstance.ID, StepID: sagaInstance.Steps[0].ID}); err != nil {
+		t.Fatalf("Failed to execute step: %v", err)
+	}
+	step, _ := storage.GetStep(context.Background(), sagaInstance.Steps[0].ID)
+	if step.Status != StatusCompleted || step.RecoveryAttempts != 0 || step.Attempts != 1 {
+		t.Errorf("Expected a single uncounted attempt, got %+v", step)
+	}
+}
+
+func TestRecoveryLocker(t *testing.T) {
+	locker := NewMemoryLocker()
+	ctx := context.Background()
+
+	if held, _ := locker.AcquireLock(ctx, "lock", "a", time.Hour); !held {
+		t.Fatal("Expected to acquire a free lock")
+	}
+	if held, _ := locker.AcquireLock(ctx, "lock", "b", time.Hour); held {
+		t.Error("Expected the lock to be held by its first owner")
+	}
+	if held, _ := locker.AcquireLock(ctx, "lock", "a", -time.Second); !held {
+		t.Error("Expected the owner to renew its lock")
+	}
+	if held, _ := locker.AcquireLock(ctx, "lock", "b", time.Hour); !held {
+		t.Error("Expected an expired lock to be taken over")
+	}
+	locker.Release(ctx, "lock", "a") // Not the owner anymore
+	if held, _ := locker.AcquireLock(ctx, "lock", "a", time.Hour); held {
+		t.Error("Expected releasing someone else's lock to do nothing")
+	}
+
+	// Only one of the managers sharing a locker runs recovery
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	shared := NewMemoryLocker()
+	first := NewRecoveryManager(storage, pubsub, WithLocker(shared))
+	second := NewRecoveryManager(storage, pubsub, WithLocker(shared))
+	if !first.holdLock(ctx) || second.holdLock(ctx) {
+		t.Fatal("Expected only the first manager to hold the recovery lock")
+	}
+	first.releaseLock()
+	if !second.holdLock(ctx) || first.holdLock(ctx) {
+		t.Error("Expected the second manager to take over once the first released the lock")
+	}
+}
+
+func TestStepClaims(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	slow := NewOrchestrator(storage, pubsub, WithInstanceID("slow"), WithClaimTTL(time.Hour))
+	slow.RegisterHandler("step1", NewStepHandler(func(ctx context.Context, data map[string]interface{}) error {
+		close(started)
+		<-release
+		data["by"] = "slow"
+		return nil
+	}, nil))
+	fast := NewOrchestrator(storage, pubsub, WithInstanceID("fast"))
+	fast.RegisterHandler("step1", NewStepHandler(func(ctx context.Context, data map[string]interface{}) error {
+		data["by"] = "fast"
+		return nil
+	}, nil))
+
+	sagaInstance, err := slow.StartSaga(context.Background(), "claimed", []string{"step1"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	stepID := sagaInstance.Steps[0].ID
+
+	done := make(chan error)
+	go func() { done <- slow.ExecuteStep(context.Background(), stepID) }()
+	<-started
+
+	step, _ := storage.GetStep(context.Background(), stepID)
+	if step.ClaimedBy != "slow" || step.ClaimExpiry == nil || !step.ClaimExpiry.After(time.Now()) {
+		t.Fatalf("Expected a live claim by the slow worker, got %q until %v", step.ClaimedBy, step.ClaimExpiry)
+	}
+	// A live claim isn't stuck, however long ago the step started
+	if stuck, _ := storage.GetStuckSteps(context.Background(), -time.Second); len(stuck) != 0 {
+		t.Errorf("Expected a claimed step not to be stuck, got %+v", stuck)
+	}
+	if claimed, _ := storage.ClaimStep(context.Background(), stepID, "fast", time.Time{}); claimed {
+		t.Error("Expected a processing step not to be claimable")
+	}
+
+	// Recovery hands the step to another worker, whose result is kept
+	storage.UpdateStepStatus(context.Background(), stepID, StatusProcessing, StatusPending)
+	if err := fast.ExecuteStep(context.Background(), stepID); err != nil {
+		t.Fatalf("Failed to execute step: %v", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Slow execution failed: %v", err)
+	}
+
+	step, _ = storage.GetStep(context.Background(), stepID)
+	if step.Status != StatusCompleted || step.ClaimedBy != "fast" || step.OutputData["by"] != "fast" || step.Attempts != 2 {
+		t.Errorf("Expected the second claim's run to win, got %+v", step)
+	}
+}
+
+func TestOrchestratorTopic(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	var defaultTopic atomic.Int32
+	pubsub.Subscribe(context.Background(), DefaultTopic, func(msg Message) error {
+		defaultTopic.Add(1)
+		return nil
+	})
+	finished := make(chan Message, 1)
+	pubsub.Subscribe(context.Background(), "billing", func(msg Message) error {
+		if msg.Type == MessageSagaCompleted {
+			finished <- msg
+		}
+		return nil
+	})
+
+	orchestrator := NewOrchestrator(storage, pubsub, WithTopic("billing"))
+	orchestrator.StartListener(context.Background())
+	sagaInstance, err := NewBuilder("billing_saga", orchestrator).
+		Step("step1", func(ctx context.Context, data map[string]interface{}) error { return nil }, nil).
+		Step("step2", func(ctx context.Context, data map[string]interface{}) error { return nil }, nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusCompleted {
+		t.Fatalf("Expected the saga to complete on its own topic, got %s", status)
+	}
+
+	// Completion messages follow the orchestrator's topic by default
+	select {
+	case msg := <-finished:
+		if msg.SagaID != sagaInstance.ID {
+			t.Errorf("Unexpected completion message %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the completion message on the orchestrator's topic")
+	}
+
+	// Recovery republishes to its own configured topic
+	storage.SaveSaga(context.Background(), &Saga{
+		ID: "stuck", Status: StatusPending,
+		Steps: []Step{{ID: "stuck-step", SagaID: "stuck", Name: "missing", Status: StatusPending}},
+	})
+	recovered := make(chan Message, 1)
+	pubsub.Subscribe(context.Background(), "billing_recovery", func(msg Message) error {
+		recovered <- msg
+		return nil
+	})
+	recovery := NewRecoveryManager(storage, pubsub, WithRecoveryTopic("billing_recovery"))
+	recovery.stepTimeout = -time.Second
+	recovery.recoverStuckSteps(context.Background())
+	select {
+	case msg := <-recovered:
+		if msg.StepID != "stuck-step" {
+			t.Errorf("Unexpected recovery message %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected recovery to publish to its topic")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if n := defaultTopic.Load(); n != 0 {
+		t.Errorf("Expected nothing on the default topic, got %d messages", n)
+	}
+}
+
+func TestShards(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	// Which instance ran each saga's steps, by saga ID
+	var mu sync.Mutex
+	ranOn := make(map[string]map[string]bool)
+	instance := func(name string) *Orchestrator {
+		orchestrator := NewOrchestrator(storage, pubsub, WithShards(4))
+		handler := NewStepHandler(func(ctx context.Context, data map[string]interface{}) error {
+			step, _ := StepFromContext(ctx)
+			mu.Lock()
+			defer mu.Unlock()
+			if ranOn[step.SagaID] == nil {
+				ranOn[step.SagaID] = make(map[string]bool)
+			}
+			ranOn[step.SagaID][name] = true
+			return nil
+		}, nil)
+		orchestrator.RegisterHandler("first", handler)
+		orchestrator.RegisterHandler("second", handler)
+		return orchestrator
+	}
+	a, b := instance("a"), instance("b")
+	if err := a.StartShardListener(context.Background(), 0, 1); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	if err := b.StartShardListener(context.Background(), 2, 3); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	if err := a.StartShardListener(context.Background(), 4); err == nil {
+		t.Error("Expected a shard out of range to be rejected")
+	}
+
+	var ids []string
+	for i := 0; i < 20; i++ {
+		sagaInstance, err := a.StartSaga(context.Background(), "sharded", []string{"first", "second"}, nil)
+		if err != nil {
+			t.Fatalf("Failed to start saga: %v", err)
+		}
+		ids = append(ids, sagaInstance.ID)
+	}
+	for _, id := range ids {
+		if status := waitForSaga(t, a, id); status != StatusCompleted {
+			t.Fatalf("Expected saga %s to complete, got %s", id, status)
+		}
+	}
+
+	// Each saga's steps run on the instance that owns its shard
+	mu.Lock()
+	instances := make(map[string]bool)
+	for _, id := range ids {
+		if len(ranOn[id]) != 1 {
+			t.Errorf("Expected saga %s to run on one instance, got %v", id, ranOn[id])
+		}
+		for name := range ranOn[id] {
+			instances[name] = true
+		}
+	}
+	mu.Unlock()
+	if len(instances) != 2 {
+		t.Errorf("Expected the sagas to be spread over both instances, got %v", instances)
+	}
+
+	// Recovery republishes to the stuck saga's shard
+	recovered := make(chan string, 4)
+	for shard := 0; shard < 4; shard++ {
+		topic := fmt.Sprintf("%s.%d", DefaultTopic, shard)
+		pubsub.Subscribe(context.Background(), topic, func(msg Message) error {
+			if msg.Type == "step_recover" {
+				recovered <- topic
+			}
+			return nil
+		})
+	}
+	storage.SaveSaga(context.Background(), &Saga{
+		ID: "stuck", Status: StatusPending,
+		Steps: []Step{{ID: "stuck-step", SagaID: "stuck", Name: "missing", Status: StatusPending}},
+	})
+	recovery := NewRecoveryManager(storage, pubsub, WithRecoveryShards(4))
+	recovery.stepTimeout = -time.Second
+	recovery.recoverStuckSteps(context.Background())
+	select {
+	case topic := <-recovered:
+		if want := a.stepTopic("stuck"); topic != want {
+			t.Errorf("Expected recovery to publish on %s, got %s", want, topic)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected recovery to publish to the saga's shard")
+	}
+}
+
+// racingStorage saves a change of its own, as another orchestrator would,
+// right before the first write of a saga that has a completed step's data
+type racingStorage struct {
+	*MemoryStorage
+	raced atomic.Bool
+}
+
+func (s *racingStorage) race(ctx context.Context, saga *Saga) error {
+	if saga.Data["charged"] != nil && s.raced.CompareAndSwap(false, true) {
+		other, _ := s.MemoryStorage.GetSaga(ctx, saga.ID)
+		other.Data["audited"] = true
+		return s.MemoryStorage.SaveSaga(ctx, other)
+	}
+	return nil
+}
+
+func (s *racingStorage) SaveSaga(ctx context.Context, saga *Saga) error {
+	if err := s.race(ctx, saga); err != nil {
+		return err
+	}
+	return s.MemoryStorage.SaveSaga(ctx, saga)
+}
+
+func (s *racingStorage) CompleteStep(ctx context.Context, step *Step, saga *Saga) error {
+	if err := s.race(ctx, saga); err != nil {
+		return err
+	}
+	return s.MemoryStorage.CompleteStep(ctx, step, saga)
+}
+
+func TestVersionConflicts(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+
+	sagaInstance := &Saga{
+		ID:     "versioned",
+		Status: StatusPending,
+		Steps:  []Step{{ID: "versioned-step", SagaID: "versioned", Name: "step1", Status: StatusPending}},
+	}
+	if err := storage.SaveSaga(ctx, sagaInstance); err != nil || sagaInstance.Version != 1 {
+		t.Fatalf("Expected a new saga at version 1, got %d, %v", sagaInstance.Version, err)
+	}
+
+	// Two readers of the same version: the second write is rejected
+	first, _ := storage.GetSaga(ctx, "versioned")
+	second, _ := storage.GetSaga(ctx, "versioned")
+	first.Data = map[string]interface{}{"by": "first"}
+	if err := storage.SaveSaga(ctx, first); err != nil || first.Version != 2 {
+		t.Fatalf("Expected the first save to succeed at version 2, got %d, %v", first.Version, err)
+	}
+	second.Data = map[string]interface{}{"by": "second"}
+	if err := storage.SaveSaga(ctx, second); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected a stale save to conflict, got %v", err)
+	}
+	if stored, _ := storage.GetSaga(ctx, "versioned"); stored.Data["by"] != "first" {
+		t.Errorf("Expected the stale save not to overwrite data, got %v", stored.Data)
+	}
+
+	// Status changes count as writes to the step
+	step, _ := storage.GetStep(ctx, "versioned-step")
+	if claimed, _ := storage.ClaimStep(ctx, step.ID, "worker", time.Time{}); !claimed {
+		t.Fatal("Expected the claim to succeed")
+	}
+	step.Status = StatusCompleted
+	if err := storage.UpdateStep(ctx, step); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected an update of a step read before its claim to conflict, got %v", err)
+	}
+	step, _ = storage.GetStep(ctx, step.ID)
+	step.Status = StatusCompleted
+	if err := storage.UpdateStep(ctx, step); err != nil || step.Version != 3 {
+		t.Errorf("Expected the update to succeed at version 3, got %d, %v", step.Version, err)
+	}
+
+	// CompleteStep writes neither the step nor the saga if one is stale
+	step.Data = map[string]interface{}{"by": "step"}
+	second.Data = map[string]interface{}{"by": "step"}
+	if err := storage.CompleteStep(ctx, step, second); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected completing with a stale saga to conflict, got %v", err)
+	}
+	if stored, _ := storage.GetStep(ctx, step.ID); stored.Version != 3 || stored.Data["by"] != nil {
+		t.Errorf("Expected the step to be left alone, got version %d with %v", stored.Version, stored.Data)
+	}
+	current, _ := storage.GetSaga(ctx, "versioned")
+	current.Data = map[string]interface{}{"by": "step"}
+	if err := storage.CompleteStep(ctx, step, current); err != nil || step.Version != 4 || current.Version != 3 {
+		t.Errorf("Expected completing to write both, got step %d and saga %d, %v", step.Version, current.Version, err)
+	}
+	if stored, _ := storage.GetSaga(ctx, "versioned"); stored.Data["by"] != "step" || stored.Steps[0].Data["by"] != "step" {
+		t.Errorf("Expected the step and saga data to be stored, got %v", stored)
+	}
+}
+
+func TestStepDataSurvivesConcurrentSave(t *testing.T) {
+	storage := &racingStorage{MemoryStorage: NewMemoryStorage()}
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+	sagaInstance, err := NewBuilder("racing", orchestrator).
+		Step("charge", func(ctx context.Context, data map[string]interface{}) error {
+			data["charged"] = true
+			return nil
+		}, nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusCompleted {
+		t.Fatalf("Expected saga to complete, got %s", status)
+	}
+
+	final, _ := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if !storage.raced.Load() || final.Data["charged"] != true || final.Data["audited"] != true {
+		t.Errorf("Expected both the step's data and the concurrent write, got %v", final.Data)
+	}
+}
+
+func TestHandlerPanicsFailStep(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	letters := make(chan DeadLetter, 1)
+	orchestrator := NewOrchestrator(storage, pubsub, WithMaxAttempts(3),
+		WithDeadLetterHandler(func(ctx context.Context, letter DeadLetter) { letters <- letter }))
+	orchestrator.StartListener(context.Background())
+
+	var runs atomic.Int32
+	sagaInstance, err := NewBuilder("panicking", orchestrator).
+		Step("reserve",
+			func(ctx context.Context, data map[string]interface{}) error { return nil },
+			func(ctx context.Context, data map[string]interface{}) error { panic("release failed") },
+		).
+		Step("charge", func(ctx context.Context, data map[string]interface{}) error {
+			runs.Add(1)
+			var card map[string]string
+			card["number"] = "4242" // nil map
+			return nil
+		}, nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusFailed {
+		t.Fatalf("Expected the panicking step to fail the saga, got %s", status)
+	}
+
+	final, _ := storage.GetSaga(context.Background(), sagaInstance.ID)
+	charge := final.Steps[1]
+	if charge.Status != StatusFailed || !strings.HasPrefix(charge.Error, "panic: assignment to entry in nil map") {
+		t.Errorf("Expected the panic as the step's error, got %s %q", charge.Status, charge.Error)
+	}
+	if runs.Load() != 1 {
+		t.Errorf("Expected a panic not to be retried, ran %d times", runs.Load())
+	}
+	if f := charge.Failure; f == nil || f.Retryable || !strings.HasPrefix(f.Type, "runtime.") || !strings.Contains(f.Stack, "TestHandlerPanicsFailStep") {
+		t.Errorf("Expected the failure to record the panic and where it happened, got %+v", f)
+	}
+
+	// A panicking compensation is dead-lettered and the rollback goes on
+	if final.Steps[0].Status != StatusCompensated {
+		t.Errorf("Expected the reserve step to be compensated, got %s", final.Steps[0].Status)
+	}
+	select {
+	case letter := <-letters:
+		if letter.Reason != DeadLetterCompensationFailed || letter.Error != "panic: release failed" {
+			t.Errorf("Unexpected dead letter: %+v", letter)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the panicking compensation to be dead-lettered")
+	}
+}
+
+type declinedError struct{}
+
+func (declinedError) Error() string { return "card declined" }
+
+func TestStepFailureDetails(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	clock := &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	orchestrator := NewOrchestrator(storage, pubsub, WithMaxAttempts(2), WithClock(clock.Now))
+	orchestrator.StartListener(context.Background())
+
+	var attempts atomic.Int32
+	sagaInstance, err := NewBuilder("failure_details", orchestrator).
+		Step("reserve", func(ctx context.Context, data map[string]interface{}) error {
+			// Succeeds on its second attempt
+			if attempts.Add(1) == 1 {
+				return errors.New("timeout")
+			}
+			return nil
+		}, nil).
+		Step("charge", func(ctx context.Context, data map[string]interface{}) error {
+			return fmt.Errorf("charge: %w", Retryable(declinedError{}))
+		}, nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusFailed {
+		t.Fatalf("Expected saga to fail, got %s", status)
+	}
+
+	final, _ := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if final.Steps[0].Failure != nil {
+		t.Errorf("Expected a completed step to have no failure, got %+v", final.Steps[0].Failure)
+	}
+	want := StepFailure{Type: "*fmt.wrapError", Chain: []string{"saga.declinedError"}, Retryable: true, Attempt: 2, FailedAt: clock.Now()}
+	if f := final.Steps[1].Failure; f == nil || f.Type != want.Type || !slices.Equal(f.Chain, want.Chain) ||
+		f.Retryable != want.Retryable || f.Attempt != want.Attempt || f.Stack != "" || !f.FailedAt.Equal(want.FailedAt) {
+		t.Errorf("Expected failure %+v, got %+v", want, f)
+	}
+}
+
+func TestCompensationSeesStepOutput(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	refunded := make(chan map[string]interface{}, 1)
+	sagaInstance, err := NewBuilder("refund", orchestrator).
+		Step("charge",
+			func(ctx context.Context, data map[string]interface{}) error {
+				data["charge_id"] = "ch_1"
+				data["payment"] = map[string]interface{}{"charge_id": "ch_1"}
+				return nil
+			},
+			func(ctx context.Context, data map[string]interface{}) error {
+				refunded <- data
+				return nil
+			},
+		).
+		Step("recharge", func(ctx context.Context, data map[string]interface{}) error {
+			// Overwrites the key and changes the nested map in place
+			data["charge_id"] = "ch_2"
+			data["payment"].(map[string]interface{})["charge_id"] = "ch_2"
+			return nil
+		}, nil).
+		Step("ship", func(ctx context.Context, data map[string]interface{}) error {
+			return errors.New("out of stock")
+		}, nil).
+		WithData("order_id", "o-1").
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusFailed {
+		t.Fatalf("Expected saga to fail, got %s", status)
+	}
+
+	data := <-refunded
+	payment, _ := data["payment"].(map[string]interface{})
+	if data["charge_id"] != "ch_1" || payment["charge_id"] != "ch_1" || data["order_id"] != "o-1" {
+		t.Errorf("Expected the compensation to see the charge step's output, got %v", data)
+	}
+}
+
+// cancelingPubSub cancels a context after the first message it publishes
+type cancelingPubSub struct {
+	PubSub
+	cancel    context.CancelFunc
+	published atomic.Int32
+}
+
+func (p *cancelingPubSub) Publish(ctx context.Context, topic string, msg Message) error {
+	p.published.Add(1)
+	p.cancel()
+	return p.PubSub.Publish(ctx, topic, msg)
+}
+
+// blockingStorage blocks in GetStuckSteps until its context is done
+type blockingStorage struct {
+	*MemoryStorage
+}
+
+func (s blockingStorage) GetStuckSteps(ctx context.Context, timeout time.Duration) ([]Step, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestRecoveryHonorsCancellation(t *testing.T) {
+	storage := NewMemoryStorage()
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprintf("stuck-%d", i)
+		storage.SaveSaga(context.Background(), &Saga{
+			ID: id, Status: StatusPending,
+			Steps: []Step{{ID: id + "-step", SagaID: id, Name: "step1", Status: StatusPending}},
+		})
+	}
+	memory := NewMemoryPubSub()
+	defer memory.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pubsub := &cancelingPubSub{PubSub: memory, cancel: cancel}
+	recovery := NewRecoveryManager(storage, pubsub)
+	recovery.stepTimeout = -time.Second
+	recovery.recoverStuckSteps(ctx)
+	if n := pubsub.published.Load(); n != 1 {
+		t.Errorf("Expected no publishes after the context was canceled, got %d", n)
+	}
+
+	// A check against a hung backend gives up after its timeout
+	recovery = NewRecoveryManager(blockingStorage{storage}, memory, WithContextTimeout(50*time.Millisecond))
+	done := make(chan struct{})
+	go func() {
+		recovery.Check(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the check to stop at its context timeout")
+	}
+}
+
+func TestSagaProgress(t *testing.T) {
+	sg := &Saga{Steps: []Step{
+		{Name: "reserve", Status: StatusCompleted},
+		{Name: "notify", Status: StatusSkipped, DependsOn: []string{"reserve"}},
+		{Name: "ship", Status: StatusPending, DependsOn: []string{"pay"}},
+		{Name: "pay", Status: StatusPending, DependsOn: []string{"reserve"}},
+	}}
+	if completed, total := sg.Progress(); completed != 2 || total != 4 {
+		t.Errorf("Expected 2 of 4 steps done, got %d of %d", completed, total)
+	}
+	// The next step is the first runnable one, not the first declared
+	if current := sg.CurrentStep(); current == nil || current.Name != "pay" {
+		t.Errorf("Expected pay to be next, got %+v", current)
+	}
+
+	sg.Steps[3].Status = StatusProcessing
+	if current := sg.CurrentStep(); current == nil || current.Name != "pay" {
+		t.Errorf("Expected the processing step to be current, got %+v", current)
+	}
+
+	sg.Steps[2].Status = StatusCompleted
+	sg.Steps[3].Status = StatusCompleted
+	if completed, total := sg.Progress(); completed != total {
+		t.Errorf("Expected every step done, got %d of %d", completed, total)
+	}
+	if current := sg.CurrentStep(); current != nil {
+		t.Errorf("Expected no current step once done, got %+v", current)
+	}
+}
+
+func TestStopSaga(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	var compensated, shipped atomic.Bool
+	sagaInstance, err := NewBuilder("stop_early", orchestrator).
+		Step("reserve",
+			func(ctx context.Context, data map[string]interface{}) error { return nil },
+			func(ctx context.Context, data map[string]interface{}) error {
+				compensated.Store(true)
+				return nil
+			},
+		).
+		Step("check_order",
+			func(ctx context.Context, data map[string]interface{}) error {
+				data["fulfilled"] = true
+				return fmt.Errorf("order already fulfilled: %w", ErrStopSaga)
+			},
+			nil,
+		).
+		Step("ship",
+			func(ctx context.Context, data map[string]interface{}) error {
+				shipped.Store(true)
+				return nil
+			},
+			nil,
+		).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusCompleted {
+		t.Fatalf("Expected saga to complete, got %s", status)
+	}
+	finalSaga, _ := storage.GetSaga(context.Background(), sagaInstance.ID)
+	for i, want := range []Status{StatusCompleted, StatusCompleted, StatusSkipped} {
+		if finalSaga.Steps[i].Status != want {
+			t.Errorf("Expected step %s to be %s, got %s", finalSaga.Steps[i].Name, want, finalSaga.Steps[i].Status)
+		}
+	}
+	if finalSaga.Data["fulfilled"] != true {
+		t.Error("Expected the stopping step's data to be merged")
+	}
+	if finalSaga.Error != "" || finalSaga.Steps[1].Error != "" {
+		t.Errorf("Expected no error, got %q and %q", finalSaga.Error, finalSaga.Steps[1].Error)
+	}
+	if shipped.Load() || compensated.Load() {
+		t.Errorf("Expected no later step or compensation to run, shipped %v compensated %v", shipped.Load(), compensated.Load())
+	}
+}
+
+func TestCompensatedStepCount(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	ok := func(ctx context.Context, data map[string]interface{}) error { return nil }
+	fail := func(ctx context.Context, data map[string]interface{}) error { return errors.New("declined") }
+
+	for _, tc := range []struct {
+		name     string
+		first    func(context.Context, map[string]interface{}) error
+		expected int
+	}{
+		{"first_step_fails", fail, 0},
+		{"second_step_fails", ok, 1},
+	} {
+		sagaInstance, err := NewBuilder(tc.name, orchestrator).
+			Step("reserve", tc.first, ok).
+			Step("charge", fail, nil).
+			Execute(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to start saga: %v", err)
+		}
+		if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusFailed {
+			t.Fatalf("%s: expected saga to fail, got %s", tc.name, status)
+		}
+		finalSaga, _ := storage.GetSaga(context.Background(), sagaInstance.ID)
+		if n := finalSaga.CompensatedStepCount(); n != tc.expected {
+			t.Errorf("%s: expected %d compensated steps, got %d", tc.name, tc.expected, n)
+		}
+	}
+}
+
+// droppingPubSub fails to publish the first step_execute message for the
+// named step, as if the orchestrator crashed right after completing the
+// step before it
+type droppingPubSub struct {
+	PubSub
+	step    string
+	storage Storage
+	dropped atomic.Bool
+}
+
+func (p *droppingPubSub) Publish(ctx context.Context, topic string, msg Message) error {
+	if msg.Type == "step_execute" {
+		if step, err := p.storage.GetStep(ctx, msg.StepID); err == nil && step.Name == p.step && p.dropped.CompareAndSwap(false, true) {
+			return errors.New("broker unavailable")
+		}
+	}
+	return p.PubSub.Publish(ctx, topic, msg)
+}
+
+func TestOutbox(t *testing.T) {
+	storage := NewMemoryStorage()
+	memory := NewMemoryPubSub()
+	defer memory.Close()
+	pubsub := &droppingPubSub{PubSub: memory, step: "ship", storage: storage}
+
+	orchestrator := NewOrchestrator(storage, pubsub, WithOutbox())
+	orchestrator.StartListener(context.Background())
+
+	noop := func(ctx context.Context, data map[string]interface{}) error { return nil }
+	sagaInstance, err := NewBuilder("outbox_saga", orchestrator).
+		Step("reserve", noop, nil).
+		Step("ship", noop, nil).
+		Step("notify", noop, nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	// "ship" was scheduled in the outbox with reserve's completion, but
+	// its message didn't go out
+	deadline := time.Now().Add(time.Second)
+	for {
+		msgs, _ := storage.PendingMessages(context.Background(), 0)
+		if len(msgs) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the unpublished message to stay in the outbox, got %+v", msgs)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	relay := NewOutboxRelay(storage, pubsub)
+	if relayed, err := relay.Flush(context.Background()); err != nil || relayed != 1 {
+		t.Fatalf("Expected the relay to publish one message, got %d, %v", relayed, err)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusCompleted {
+		t.Fatalf("Expected saga to complete, got %s", status)
+	}
+	if msgs, _ := storage.PendingMessages(context.Background(), 0); len(msgs) != 0 {
+		t.Errorf("Expected an empty outbox, got %+v", msgs)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected WithOutbox to require an Outbox")
+		}
+	}()
+	NewOrchestrator(struct{ Storage }{storage}, memory, WithOutbox())
+}
+
+// outagePubSub fails every publish while down is set
+type outagePubSub struct {
+	PubSub
+	down atomic.Bool
+}
+
+func (p *outagePubSub) Publish(ctx context.Context, topic string, msg Message) error {
+	if p.down.Load() {
+		return errors.New("broker unavailable")
+	}
+	return p.PubSub.Publish(ctx, topic, msg)
+}
+
+func TestOutboxBrokerOutage(t *testing.T) {
+	storage := NewMemoryStorage()
+	memory := NewMemoryPubSub()
+	defer memory.Close()
+	pubsub := &outagePubSub{PubSub: memory}
+
+	orchestrator := NewOrchestrator(storage, pubsub, WithOutbox(), WithCompletionTopic("saga_done"))
+	orchestrator.StartListener(context.Background())
+	completions := make(chan Message, 1)
+	memory.Subscribe(context.Background(), "saga_done", func(msg Message) error {
+		completions <- msg
+		return nil
+	})
+
+	// Starting the saga succeeds with the broker down; its first message
+	// waits in the outbox
+	pubsub.down.Store(true)
+	noop := func(ctx context.Context, data map[string]interface{}) error { return nil }
+	sagaInstance, err := NewBuilder("outage_saga", orchestrator).
+		Step("step1", noop, nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	msgs, _ := storage.PendingMessages(context.Background(), 0)
+	if len(msgs) != 1 || msgs[0].Message.Type != "step_execute" {
+		t.Fatalf("Expected the first step's message in the outbox, got %+v", msgs)
+	}
+
+	relay := NewOutboxRelay(storage, pubsub)
+	if _, err := relay.Flush(context.Background()); err == nil {
+		t.Error("Expected the relay to fail while the broker is down")
+	}
+	if msgs, _ := storage.PendingMessages(context.Background(), 0); len(msgs) != 1 {
+		t.Fatalf("Expected the message to stay in the outbox, got %+v", msgs)
+	}
+
+	// Once the broker is back the relay starts the step, and the saga's
+	// completion is published directly
+	pubsub.down.Store(false)
+	if relayed, err := relay.Flush(context.Background()); err != nil || relayed != 1 {
+		t.Fatalf("Expected the relay to publish one message, got %d, %v", relayed, err)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusCompleted {
+		t.Fatalf("Expected saga to complete, got %s", status)
+	}
+	select {
+	case msg := <-completions:
+		if msg.Type != "saga_completed" || msg.SagaID != sagaInstance.ID {
+			t.Errorf("Unexpected completion message %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a completion message")
+	}
+	if msgs, _ := storage.PendingMessages(context.Background(), 0); len(msgs) != 0 {
+		t.Errorf("Expected an empty outbox, got %+v", msgs)
+	}
+}
+
+func TestOutboxCompensation(t *testing.T) {
+	storage := NewMemoryStorage()
+	memory := NewMemoryPubSub()
+	defer memory.Close()
+	pubsub := &outagePubSub{PubSub: memory}
+
+	orchestrator := NewOrchestrator(storage, pubsub, WithOutbox())
+	orchestrator.StartListener(context.Background())
+
+	var compensated []string
+	var mu sync.Mutex
+	compensate := func(name string) func(ctx context.Context, data map[string]interface{}) error {
+		return func(ctx context.Context, data map[string]interface{}) error {
+			mu.Lock()
+			defer mu.Unlock()
+			compensated = append(compensated, name)
+			return nil
+		}
+	}
+	noop := func(ctx context.Context, data map[string]interface{}) error { return nil }
+	sagaInstance, err := NewBuilder("outbox_rollback", orchestrator).
+		Step("reserve", noop, compensate("reserve")).
+		Step("charge", noop, compensate("charge")).
+		Step("ship", func(ctx context.Context, data map[string]interface{}) error {
+			// The broker goes down as the step fails
+			pubsub.down.Store(true)
+			return Permanent(errors.New("no courier"))
+		}, nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	// The first compensation was written with the move to compensating
+	deadline := time.Now().Add(time.Second)
+	for {
+		msgs, _ := storage.PendingMessages(context.Background(), 0)
+		if len(msgs) == 1 && msgs[0].Message.Type == "step_compensate" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the compensation in the outbox, got %+v", msgs)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Once the broker is back the relay resumes the rollback
+	pubsub.down.Store(false)
+	relay := NewOutboxRelay(storage, pubsub)
+	if relayed, err := relay.Flush(context.Background()); err != nil || relayed != 1 {
+		t.Fatalf("Expected the relay to publish one message, got %d, %v", relayed, err)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusFailed {
+		t.Fatalf("Expected saga to fail, got %s", status)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(compensated) != 2 || compensated[0] != "charge" || compensated[1] != "reserve" {
+		t.Errorf("Expected charge then reserve compensated, got %v", compensated)
+	}
+	if msgs, _ := storage.PendingMessages(context.Background(), 0); len(msgs) != 0 {
+		t.Errorf("Expected an empty outbox, got %+v", msgs)
+	}
+}
+
+func TestFailurePolicy(t *testing.T) {
+	run := func(t *testing.T, policy FailurePolicy) (*Saga, bool) {
+		storage := NewMemoryStorage()
+		pubsub := NewMemoryPubSub()
+		defer pubsub.Close()
+
+		orchestrator := NewOrchestrator(storage, pubsub)
+		orchestrator.StartListener(context.Background())
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+		var canceled, compensated atomic.Bool
+		slow := func(ctx context.Context, data map[string]interface{}) error {
+			close(started)
+			select {
+			case <-ctx.Done():
+				canceled.Store(true)
+				return ctx.Err()
+			case <-release:
+				return nil
+			}
+		}
+		fail := func(ctx context.Context, data map[string]interface{}) error {
+			<-started
+			return Permanent(errors.New("out of stock"))
+		}
+		sagaInstance, err := NewBuilder("parallel_saga", orchestrator).
+			WithFailurePolicy(policy).
+			Step("slow", slow, func(ctx context.Context, data map[string]interface{}) error {
+				compensated.Store(true)
+				return nil
+			}).DependsOn().
+			Step("fail", fail, nil).DependsOn().
+			Execute(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to start saga: %v", err)
+		}
+
+		// Under WaitAll the saga waits for the slow step
+		if policy != FailFast {
+			deadline := time.Now().Add(time.Second)
+			for {
+				sg, _ := storage.GetSaga(context.Background(), sagaInstance.ID)
+				if sg.Status == StatusCompensating {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected saga to start compensating, got %s", sg.Status)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			close(release)
+		}
+
+		if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusFailed {
+			t.Fatalf("Expected saga to fail, got %s", status)
+		}
+		if canceled.Load() != (policy == FailFast) {
+			t.Errorf("Expected the slow step to be canceled only with FailFast, canceled: %v", canceled.Load())
+		}
+		sg, _ := storage.GetSaga(context.Background(), sagaInstance.ID)
+		return sg, compensated.Load()
+	}
+
+	t.Run("FailFast", func(t *testing.T) {
+		sg, compensated := run(t, FailFast)
+		if sg.Steps[0].Status != StatusFailed || sg.Steps[0].Attempts != 1 || compensated {
+			t.Errorf("Expected the canceled step to fail without a retry or compensation, got %+v (compensated: %v)", sg.Steps[0], compensated)
+		}
+		if !strings.Contains(sg.Error, "fail") || sg.FailedStepID != sg.Steps[1].ID {
+			t.Errorf("Expected the sibling's failure to be kept, got %q", sg.Error)
+		}
+	})
+
+	t.Run("WaitAll", func(t *testing.T) {
+		sg, compensated := run(t, WaitAll)
+		if sg.Steps[0].Status != StatusCompensated || !compensated {
+			t.Errorf("Expected the slow step to finish and be compensated, got %+v", sg.Steps[0])
+		}
+	})
+
+	if _, err := NewBuilder("bad_policy", NewOrchestrator(NewMemoryStorage(), NewMemoryPubSub())).
+		WithFailurePolicy("sometimes").
+		Step("a", nil, nil).
+		Execute(context.Background()); err == nil {
+		t.Error("Expected an unknown failure policy to be rejected")
+	}
+}
+
+func TestListStuckSagas(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+
+	save := func(id string, status Status, steps ...Step) {
+		t.Helper()
+		for i := range steps {
+			steps[i].SagaID = id
+		}
+		if err := storage.SaveSaga(ctx, &Saga{ID: id, Status: status, Steps: steps}); err != nil {
+			t.Fatalf("Failed to save saga %s: %v", id, err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	expiry := time.Now().Add(time.Hour)
+	save("oldest", StatusPending, Step{ID: "oldest-1", Name: "a", Status: StatusPending})
+	save("stalled", StatusPending,
+		Step{ID: "stalled-1", Name: "a", Status: StatusPending},
+		Step{ID: "stalled-2", Name: "b", Status: StatusPending})
+	save("finished", StatusCompleted, Step{ID: "finished-1", Name: "a", Status: StatusPending})
+	save("claimed", StatusPending, Step{ID: "claimed-1", Name: "a", Status: StatusProcessing, ClaimExpiry: &expiry})
+
+	stuck, err := ListStuckSagas(ctx, storage, -time.Second)
+	if err != nil {
+		t.Fatalf("Failed to list stuck sagas: %v", err)
+	}
+	if len(stuck) != 2 || stuck[0].Saga.ID != "oldest" || stuck[1].Saga.ID != "stalled" {
+		t.Fatalf("Expected the two stalled sagas, longest stalled first, got %+v", stuck)
+	}
+	if len(stuck[1].StuckSteps) != 2 || stuck[1].StalledSince.IsZero() || len(stuck[1].Saga.Steps) != 2 {
+		t.Errorf("Expected both steps of the stalled saga, got %+v", stuck[1])
+	}
+
+	if stuck, _ := ListStuckSagas(ctx, storage, time.Hour); len(stuck) != 0 {
+		t.Errorf("Expected nothing stuck within an hour, got %+v", stuck)
+	}
+}
+
+// tracingHandler records calls around the handler it wraps
+type tracingHandler struct {
+	next  StepHandler
+	name  string
+	mu    *sync.Mutex
+	calls *[]string
+}
+
+func (h tracingHandler) record(ctx context.Context, call string) {
+	sc, _ := StepFromContext(ctx)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	*h.calls = append(*h.calls, h.name+" "+call+" "+sc.StepName)
+}
+
+func (h tracingHandler) Execute(ctx context.Context, data map[string]interface{}) error {
+	h.record(ctx, "execute")
+	return h.next.Execute(ctx, data)
+}
+
+func (h tracingHandler) Compensate(ctx context.Context, data map[string]interface{}) error {
+	h.record(ctx, "compensate")
+	return h.next.Compensate(ctx, data)
+}
+
+func TestStepMiddleware(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	trace := func(name string) StepMiddleware {
+		return func(next StepHandler) StepHandler {
+			return tracingHandler{next: next, name: name, mu: &mu, calls: &calls}
+		}
+	}
+	denied := errors.New("not allowed")
+	auth := func(next StepHandler) StepHandler {
+		return NewStepHandler(
+			func(ctx context.Context, data map[string]interface{}) error {
+				if sc, _ := StepFromContext(ctx); sc.StepName == "charge" {
+					return Permanent(denied)
+				}
+				return next.Execute(ctx, data)
+			},
+			next.Compensate,
+		)
+	}
+
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+	orchestrator := NewOrchestrator(storage, pubsub,
+		WithStepMiddleware(trace("outer"), trace("inner")), WithStepMiddleware(auth))
+	orchestrator.StartListener(context.Background())
+
+	record := func(call string) func(ctx context.Context, data map[string]interface{}) error {
+		return func(ctx context.Context, data map[string]interface{}) error {
+			mu.Lock()
+			defer mu.Unlock()
+			calls = append(calls, call)
+			return nil
+		}
+	}
+	var charged atomic.Bool
+	sagaInstance, err := NewBuilder("middleware_saga", orchestrator).
+		Step("reserve", record("reserve"), record("release")).
+		Step("charge", func(ctx context.Context, data map[string]interface{}) error {
+			charged.Store(true)
+			return nil
+		}, nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusFailed {
+		t.Fatalf("Expected the denied step to fail the saga, got %s", status)
+	}
+	if charged.Load() {
+		t.Error("Expected the middleware to keep the handler from running")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{
+		"outer execute reserve", "inner execute reserve", "reserve",
+		"outer execute charge", "inner execute charge",
+		"outer compensate reserve", "inner compensate reserve", "release",
+	}
+	if strings.Join(calls, ", ") != strings.Join(want, ", ") {
+		t.Errorf("Expected calls %v, got %v", want, calls)
+	}
+	sg, _ := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if !strings.Contains(sg.Error, denied.Error()) {
+		t.Errorf("Expected the middleware's error on the saga, got %q", sg.Error)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	run := func(t *testing.T, settings BreakerSettings) (Storage, func() (*Saga, Status), *atomic.Int32, *atomic.Bool) {
+		storage := NewMemoryStorage()
+		pubsub := NewMemoryPubSub()
+		t.Cleanup(func() { pubsub.Close() })
+		orchestrator := NewOrchestrator(storage, pubsub, WithCircuitBreaker("payments", settings))
+		orchestrator.StartListener(context.Background())
+
+		var calls atomic.Int32
+		var down atomic.Bool
+		down.Store(true)
+		charge := func(ctx context.Context, data map[string]interface{}) error {
+			calls.Add(1)
+			if down.Load() {
+				return Permanent(errors.New("payment service unavailable"))
+			}
+			return nil
+		}
+		start := func() (*Saga, Status) {
+			t.Helper()
+			sg, err := NewBuilder("breaker_saga", orchestrator).
+				Step("charge", charge, nil).Resource("payments").
+				Execute(context.Background())
+			if err != nil {
+				t.Fatalf("Failed to start saga: %v", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			status, _ := orchestrator.WaitForCompletion(ctx, sg.ID)
+			return sg, status
+		}
+		return storage, start, &calls, &down
+	}
+
+	t.Run("FailWhenOpen", func(t *testing.T) {
+		storage, start, calls, down := run(t, BreakerSettings{FailureThreshold: 2, OpenTimeout: 300 * time.Millisecond, FailWhenOpen: true})
+		start()
+		start()
+
+		// The breaker is open, so the handler isn't called
+		sg, status := start()
+		if status != StatusFailed || calls.Load() != 2 {
+			t.Fatalf("Expected the step to fail without calling its handler, got %s after %d calls", status, calls.Load())
+		}
+		failed, _ := storage.GetSaga(context.Background(), sg.ID)
+		if !strings.Contains(failed.Error, ErrCircuitOpen.Error()) {
+			t.Errorf("Expected a circuit breaker error, got %q", failed.Error)
+		}
+
+		// Once the timeout passes a probe closes the breaker again
+		down.Store(false)
+		time.Sleep(300 * time.Millisecond)
+		start()
+		if _, status := start(); status != StatusCompleted || calls.Load() != 4 {
+			t.Errorf("Expected the breaker to close after a successful probe, got %s after %d calls", status, calls.Load())
+		}
+	})
+
+	t.Run("Defer", func(t *testing.T) {
+		storage, start, calls, _ := run(t, BreakerSettings{FailureThreshold: 1, OpenTimeout: time.Minute})
+		start()
+
+		sg, _ := start()
+		deferred, _ := storage.GetSaga(context.Background(), sg.ID)
+		if deferred.Status != StatusPending || deferred.Steps[0].Status != StatusPending || calls.Load() != 1 {
+			t.Errorf("Expected the step to be left pending, got %s/%s after %d calls",
+				deferred.Status, deferred.Steps[0].Status, calls.Load())
+		}
+	})
+}
+
+// fakeClock is a clock tests move forward by hand
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestDeterministicIDsAndClock(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	storage := NewMemoryStorage(WithMemoryClock(clock.Now))
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	var seq atomic.Int32
+	orchestrator := NewOrchestrator(storage, pubsub,
+		WithClock(clock.Now),
+		WithIDGenerator(func() string { return fmt.Sprintf("id-%d", seq.Add(1)) }))
+	orchestrator.StartListener(context.Background())
+
+	var lateRan atomic.Bool
+	sagaInstance, err := NewBuilder("clock_saga", orchestrator).
+		Step("slow", func(ctx context.Context, data map[string]interface{}) error {
+			clock.Advance(time.Hour) // Runs past the saga's deadline
+			return nil
+		}, nil).
+		Step("late", func(ctx context.Context, data map[string]interface{}) error {
+			lateRan.Store(true)
+			return nil
+		}, nil).
+		WithTimeout(time.Minute).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if sagaInstance.ID != "id-1" || sagaInstance.Steps[0].ID != "id-2" || sagaInstance.Steps[1].ID != "id-3" {
+		t.Errorf("Expected sequential IDs, got saga %s with steps %s and %s",
+			sagaInstance.ID, sagaInstance.Steps[0].ID, sagaInstance.Steps[1].ID)
+	}
+	if want := start.Add(time.Minute); !sagaInstance.Deadline.Equal(want) {
+		t.Errorf("Expected the deadline to follow the clock, got %s", sagaInstance.Deadline)
+	}
+
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusFailed {
+		t.Fatalf("Expected the saga to time out, got %s", status)
+	}
+	if lateRan.Load() {
+		t.Error("Expected no step to start after the deadline")
+	}
+	sg, _ := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if !sg.CreatedAt.Equal(start) || !sg.UpdatedAt.Equal(start.Add(time.Hour)) {
+		t.Errorf("Expected timestamps from the clock, got created %s, updated %s", sg.CreatedAt, sg.UpdatedAt)
+	}
+}
+
+func TestStepAndSagaDuration(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	storage := NewMemoryStorage(WithMemoryClock(clock.Now))
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub, WithClock(clock.Now))
+	orchestrator.StartListener(context.Background())
+
+	sagaInstance, err := NewBuilder("timed_saga", orchestrator).
+		Step("reserve", func(ctx context.Context, data map[string]interface{}) error {
+			clock.Advance(2 * time.Second)
+			return nil
+		}, nil).
+		Step("charge", func(ctx context.Context, data map[string]interface{}) error {
+			clock.Advance(3 * time.Second)
+			return nil
+		}, nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if d := sagaInstance.Duration(); d != 0 {
+		t.Errorf("Expected no duration before the saga finished, got %s", d)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusCompleted {
+		t.Fatalf("Expected saga to complete, got %s", status)
+	}
+
+	sg, _ := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if d := sg.Steps[0].Duration(); d != 2*time.Second {
+		t.Errorf("Expected reserve to take 2s, got %s", d)
+	}
+	if d := sg.Steps[1].Duration(); d != 3*time.Second {
+		t.Errorf("Expected charge to take 3s, got %s", d)
+	}
+	if d := sg.Duration(); d != 5*time.Second || !sg.FinishedAt.Equal(start.Add(5*time.Second)) {
+		t.Errorf("Expected the saga to take 5s, got %s", d)
+	}
+
+	// A step reset by recovery no longer reads as started
+	started := clock.Now()
+	stuck := &Saga{ID: "stuck_timed_saga", Name: "unhandled", Status: StatusPending, Steps: []Step{
+		{ID: "stuck_timed_step", SagaID: "stuck_timed_saga", Name: "lost", Status: StatusProcessing, StartedAt: &started},
+	}}
+	if err := storage.SaveSaga(context.Background(), stuck); err != nil {
+		t.Fatalf("Failed to save saga: %v", err)
+	}
+	clock.Advance(time.Minute)
+	recovery := NewRecoveryManager(storage, NewMemoryPubSub(), WithStepTimeout(10*time.Second), WithRecoveryClock(clock.Now))
+	recovery.Check(context.Background())
+
+	step, _ := storage.GetStep(context.Background(), "stuck_timed_step")
+	if step.Status != StatusPending || step.StartedAt != nil || step.CompletedAt != nil {
+		t.Errorf("Expected the reset step to be pending without timing, got %s started %v", step.Status, step.StartedAt)
+	}
+}
+
+func TestRecoveryClock(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	storage := NewMemoryStorage(WithMemoryClock(clock.Now))
+	memory := NewMemoryPubSub()
+	defer memory.Close()
+	pubsub := &lossyPubSub{PubSub: memory, drop: "step_execute"}
+
+	orchestrator := NewOrchestrator(storage, pubsub, WithClock(clock.Now))
+	orchestrator.StartListener(context.Background())
+	recovery := NewRecoveryManager(storage, pubsub, WithStepTimeout(10*time.Second), WithRecoveryClock(clock.Now))
+
+	var ran atomic.Int32
+	sagaInstance, err := NewBuilder("clocked_recovery_saga", orchestrator).
+		Step("lost", func(ctx context.Context, data map[string]interface{}) error {
+			ran.Add(1)
+			return nil
+		}, nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	// The step's message was lost, but it isn't stuck yet
+	recovery.Check(context.Background())
+	if stuck, _ := storage.GetStuckSteps(context.Background(), 10*time.Second); len(stuck) != 0 || ran.Load() != 0 {
+		t.Fatalf("Expected nothing to recover before the timeout, got %+v", stuck)
+	}
+
+	clock.Advance(11 * time.Second)
+	recovery.Check(context.Background())
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusCompleted {
+		t.Fatalf("Expected the recovered saga to complete, got %s", status)
+	}
+	if ran.Load() != 1 {
+		t.Errorf("Expected the step to run once, ran %d times", ran.Load())
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	secret := []byte("webhook-secret")
+	var (
+		mu         sync.Mutex
+		deliveries []string
+		events     []WebhookEvent
+	)
+	received := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !VerifyWebhookSignature(secret, body, r.Header.Get(WebhookSignatureHeader)) {
+			t.Errorf("Expected a valid signature, got %q", r.Header.Get(WebhookSignatureHeader))
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		deliveries = append(deliveries, r.Header.Get(WebhookDeliveryHeader))
+		if len(deliveries) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable) // Fails the first attempt
+			return
+		}
+		var event WebhookEvent
+		json.Unmarshal(body, &event)
+		events = append(events, event)
+		received <- struct{}{}
+	}))
+	defer server.Close()
+
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub, WithCompletionTopic("saga_done"))
+	orchestrator.StartListener(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notifier := NewWebhookNotifier(storage, pubsub, server.URL,
+		WithWebhookTopic("saga_done"),
+		WithWebhookSecret(secret),
+		WithWebhookBackoff(10*time.Millisecond, 10*time.Millisecond),
+		WithWebhookInterval(5*time.Millisecond))
+	if err := notifier.Start(ctx); err != nil {
+		t.Fatalf("Failed to start notifier: %v", err)
+	}
+	defer notifier.Stop()
+
+	sagaInstance, err := NewBuilder("webhook_saga", orchestrator).
+		WithData("order_id", "order-1").
+		Step("reserve", func(ctx context.Context, data map[string]interface{}) error { return nil }, nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the webhook")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(deliveries) != 2 || deliveries[0] != deliveries[1] {
+		t.Errorf("Expected one delivery retried once, got %v", deliveries)
+	}
+	if len(events) != 1 || events[0].Type != MessageSagaCompleted || events[0].SagaID != sagaInstance.ID || events[0].Data["order_id"] != "order-1" {
+		t.Errorf("Unexpected webhook events: %+v", events)
+	}
+	if VerifyWebhookSignature(secret, []byte("{}"), signWebhook([]byte("other"), []byte("{}"))) {
+		t.Error("Expected a signature made with another secret not to verify")
+	}
+}
+
+func TestCompoundStep(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	var (
+		mu          sync.Mutex
+		ran         []string
+		compensated int
+	)
+	write := func(row string, err error) func(ctx context.Context, data map[string]interface{}) error {
+		return func(ctx context.Context, data map[string]interface{}) error {
+			mu.Lock()
+			defer mu.Unlock()
+			ran = append(ran, row)
+			return err
+		}
+	}
+	undo := func(ctx context.Context, data map[string]interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		compensated++
+		return nil
+	}
+	check := func(wantRan string, wantCompensated int) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.Join(ran, ",") != wantRan || compensated != wantCompensated {
+			t.Errorf("Expected operations %s compensated %d times, got %v compensated %d times", wantRan, wantCompensated, ran, compensated)
+		}
+		ran, compensated = nil, 0
+	}
+
+	// A later step failing compensates the group once
+	sagaInstance, err := NewBuilder("compound_saga", orchestrator).
+		AddStep("write_rows", CompoundStep(undo, write("a", nil), write("b", nil), write("c", nil))).
+		Step("charge", func(ctx context.Context, data map[string]interface{}) error {
+			return Permanent(errors.New("declined"))
+		}, nil).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusFailed {
+		t.Fatalf("Expected saga to fail, got %s", status)
+	}
+	check("a,b,c", 1)
+
+	// An operation failing stops the group and undoes the earlier ones
+	sagaInstance, err = NewBuilder("failing_compound_saga", orchestrator).
+		AddStep("write_rows", CompoundStep(undo, write("a", nil), write("b", Permanent(errors.New("constraint violation"))), write("c", nil))).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+	if status := waitForSaga(t, orchestrator, sagaInstance.ID); status != StatusFailed {
+		t.Fatalf("Expected saga to fail, got %s", status)
+	}
+	check("a,b", 1)
+}
+
+func TestFindSagasByTag(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	storage := NewMemoryStorage(WithMemoryClock(clock.Now))
+	orchestrator := NewOrchestrator(storage, NewMemoryPubSub(), WithClock(clock.Now))
+
+	var started []string
+	for _, name := range []string{"checkout", "refund"} {
+		clock.Advance(time.Second)
+		sagaInstance, err := NewBuilder(name, orchestrator).
+			WithTag("order_id", "789").
+			WithTag("customer_id", "c-1").
+			Step("work", func(ctx context.Context, data map[string]interface{}) error { return nil }, nil).
+			Execute(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to start saga: %v", err)
+		}
+		started = append(started, sagaInstance.ID)
+	}
+	if _, err := NewBuilder("checkout", orchestrator).
+		WithTag("order_id", "790").
+		Step("work", func(ctx context.Context, data map[string]interface{}) error { return nil }, nil).
+		Execute(context.Background()); err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	found, err := storage.FindSagasByTag(context.Background(), "order_id", "789")
+	if err != nil {
+		t.Fatalf("Failed to find sagas: %v", err)
+	}
+	if len(found) != 2 || found[0].ID != started[1] || found[1].ID != started[0] {
+		t.Fatalf("Expected both sagas for the order, newest first, got %+v", found)
+	}
+	if found[0].Tags["customer_id"] != "c-1" {
+		t.Errorf("Expected the saga's tags to be stored, got %v", found[0].Tags)
+	}
+	if found, _ := storage.FindSagasByTag(context.Background(), "order_id", "791"); len(found) != 0 {
+		t.Errorf("Expected no sagas for an unknown order, got %d", len(found))
+	}
+
+	if _, err := NewBuilder("checkout", orchestrator).WithTag("", "x").Execute(context.Background()); err == nil {
+		t.Error("Expected an empty tag key to be rejected")
+	}
+}
+
+func TestReservedDataKeys(t *testing.T) {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := NewOrchestrator(storage, pubsub, WithReservedKeyPrefix("_app."))
+	orchestrator.StartListener(context.Background())
+
+	run := func(name string, write func(data map[string]interface{})) *Saga {
+		t.Helper()
+		sagaInstance, err := NewBuilder(name, orchestrator).
+			WithData(ReservedKeyPrefix+"origin", "api").
+			Step("work", func(ctx context.Context, data map[string]interface{}) error {
+				write(data)
+				return nil
+			}, nil).
+			Execute(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to start saga: %v", err)
+		}
+		waitForSaga(t, orchestrator, sagaInstance.ID)
+		sg, _ := storage.GetSaga(context.Background(), sagaInstance.ID)
+		return sg
+	}
+
+	// Reading reserved keys and writing others is fine
+	sg := run("reads_reserved", func(data map[string]interface{}) {
+		data["copied"] = data[ReservedKeyPrefix+"origin"]
+	})
+	if sg.Status != StatusCompleted || sg.Data["copied"] != "api" {
+		t.Errorf("Expected the saga to complete, got %s with %v", sg.Status, sg.Data)
+	}
+
+	for name, key := range map[string]string{"overwrites_reserved": ReservedKeyPrefix + "origin", "adds_custom_reserved": "_app.owner"} {
+		sg := run(name, func(data map[string]interface{}) { data[key] = "handler" })
+		if sg.Status != StatusFailed || !strings.Contains(sg.Steps[0].Error, ErrReservedKey.Error()) {
+			t.Errorf("%s: expected the step to fail with a reserved key error, got %s: %q", name, sg.Status, sg.Steps[0].Error)
+		}
+		if v, exists := sg.Data[key]; exists && v == "handler" {
+			t.Errorf("%s: expected the reserved key not to be merged", name)
+		}
+	}
 }
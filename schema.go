@@ -0,0 +1,146 @@
+package saga
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrInvalidData is returned when starting a saga whose data doesn't match
+// the keys declared with Builder.Require or Builder.RequireType
+var ErrInvalidData = errors.New("invalid saga data")
+
+// DataType is the kind of value a required data key must hold, named as in
+// JSON Schema
+type DataType string
+
+const (
+	// TypeAny accepts any value, including nil, as long as the key is set
+	TypeAny     DataType = ""
+	TypeString  DataType = "string"
+	TypeNumber  DataType = "number"
+	TypeBoolean DataType = "boolean"
+	// TypeObject accepts maps, such as a map[string]interface{}
+	TypeObject DataType = "object"
+	// TypeArray accepts slices and arrays
+	TypeArray DataType = "array"
+)
+
+// DataSchema maps the keys a saga's initial data must have to the type of
+// value each must hold
+type DataSchema map[string]DataType
+
+// Require makes starting the saga fail with ErrInvalidData unless its
+// initial data has each of keys, e.g. "user_id", set to any value. The data
+// is checked before the saga is saved, so a missing input is reported to
+// the caller instead of failing a step halfway through the saga.
+func (b *Builder) Require(keys ...string) *Builder {
+	for _, key := range keys {
+		b.RequireType(key, TypeAny)
+	}
+	return b
+}
+
+// RequireType is like Require, and also checks that the key holds a value
+// of type typ, e.g. TypeNumber for an amount
+func (b *Builder) RequireType(key string, typ DataType) *Builder {
+	if key == "" {
+		b.err = fmt.Errorf("required data key must not be empty")
+		return b
+	}
+	if !validDataType(typ) {
+		b.err = fmt.Errorf("unknown data type %q for key %s", typ, key)
+		return b
+	}
+	if b.schema == nil {
+		b.schema = make(DataSchema)
+	}
+	b.schema[key] = typ
+	return b
+}
+
+// Validate returns an error wrapping ErrInvalidData that lists every key of
+// the schema data is missing or holds a value of the wrong type for
+func (s DataSchema) Validate(data map[string]interface{}) error {
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []string
+	for _, key := range keys {
+		value, exists := data[key]
+		switch typ := s[key]; {
+		case !exists:
+			problems = append(problems, "missing "+key)
+		case !hasDataType(value, typ):
+			problems = append(problems, fmt.Sprintf("%s must be %s, got %s", key, article(string(typ)), dataTypeOf(value)))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidData, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+func validDataType(typ DataType) bool {
+	switch typ {
+	case TypeAny, TypeString, TypeNumber, TypeBoolean, TypeObject, TypeArray:
+		return true
+	}
+	return false
+}
+
+// hasDataType reports whether value is of type typ
+func hasDataType(value interface{}, typ DataType) bool {
+	return typ == TypeAny || dataTypeOf(value) == string(typ)
+}
+
+// dataTypeOf names the JSON type value is encoded as, so e.g. a time.Time
+// is a string
+func dataTypeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return string(TypeString)
+	case bool:
+		return string(TypeBoolean)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, json.Number:
+		return string(TypeNumber)
+	case map[string]interface{}:
+		return string(TypeObject)
+	case []interface{}:
+		return string(TypeArray)
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil || len(encoded) == 0 {
+		return fmt.Sprintf("%T", value)
+	}
+	switch encoded[0] {
+	case 'n':
+		return "null"
+	case '"':
+		return string(TypeString)
+	case 't', 'f':
+		return string(TypeBoolean)
+	case '{':
+		return string(TypeObject)
+	case '[':
+		return string(TypeArray)
+	default:
+		return string(TypeNumber)
+	}
+}
+
+// article prefixes name with "a" or "an"
+func article(name string) string {
+	if strings.ContainsAny(name[:1], "aeiou") {
+		return "an " + name
+	}
+	return "a " + name
+}
@@ -0,0 +1,99 @@
+package saga
+
+import (
+	"context"
+	"reflect"
+	"sync"
+)
+
+// StepsDataKey is the saga data key holding each step's output when
+// WithScopedStepData is set
+const StepsDataKey = "steps"
+
+// WithScopedStepData keeps steps from overwriting each other's results.
+// Handlers still see all saga data, but the keys a step adds or changes are
+// stored under data["steps"][stepName] instead of at the top level, unless
+// the handler promotes them with Promote. Without it, every key in the
+// handler's data is merged into the saga's data.
+func WithScopedStepData() Option {
+	return func(o *Orchestrator) {
+		o.scopedData = true
+	}
+}
+
+type promotionsKey struct{}
+
+// promotions collects the keys a handler promoted to the saga's top level
+type promotions struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+// Promote makes the keys a step writes visible at the top level of the saga
+// data as well as under its own output, for values shared by several steps
+// or read by code written for flat data. It only has an effect within a
+// step handler on an orchestrator with WithScopedStepData.
+func Promote(ctx context.Context, keys ...string) {
+	p, ok := ctx.Value(promotionsKey{}).(*promotions)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, key := range keys {
+		p.keys[key] = true
+	}
+}
+
+func (p *promotions) promoted(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.keys[key]
+}
+
+// StepOutput returns the data a step wrote, as stored by
+// WithScopedStepData, from a saga's data map
+func StepOutput(data map[string]interface{}, stepName string) map[string]interface{} {
+	steps, _ := data[StepsDataKey].(map[string]interface{})
+	output, _ := steps[stepName].(map[string]interface{})
+	return output
+}
+
+// mergeStepData writes a completed step's results into the saga's data.
+// Flat data takes every key the handler saw; scoped data only takes the
+// keys it added or changed, under the step's name, plus promoted keys.
+func (o *Orchestrator) mergeStepData(saga *Saga, step *Step, input, output map[string]interface{}, promoted *promotions) {
+	if saga.Data == nil {
+		saga.Data = make(map[string]interface{})
+	}
+	if !o.scopedData {
+		for k, v := range output {
+			saga.Data[k] = v
+		}
+		return
+	}
+
+	writes := make(map[string]interface{})
+	for k, v := range output {
+		if k == StepsDataKey {
+			continue
+		}
+		if before, exists := input[k]; exists && reflect.DeepEqual(before, v) {
+			continue
+		}
+		writes[k] = v
+		if promoted.promoted(k) {
+			saga.Data[k] = v
+		}
+	}
+
+	// Copy the outputs map rather than changing it, since stored sagas may
+	// share it
+	steps := make(map[string]interface{})
+	existing, _ := saga.Data[StepsDataKey].(map[string]interface{})
+	for k, v := range existing {
+		steps[k] = v
+	}
+	steps[step.Name] = writes
+	saga.Data[StepsDataKey] = steps
+}
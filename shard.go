@@ -0,0 +1,99 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+)
+
+// WithShards spreads the orchestrator's step messages over n topics, named
+// after its topic with the shard's number, e.g. saga_events.0 to
+// saga_events.3, by a hash of the saga ID. All of a saga's messages go to
+// the same shard, so they keep their order, while sagas on different shards
+// are handled in parallel: StartListener subscribes to every shard, and
+// StartShardListener to some of them, so instances can split the shards
+// between them. Completion messages stay on the completion topic. Every
+// orchestrator and recovery manager of one system must use the same n; see
+// WithRecoveryShards. n must be positive; the default, 1, publishes on the
+// topic itself.
+func WithShards(n int) Option {
+	if n <= 0 {
+		panic("saga: shards must be positive")
+	}
+	return func(o *Orchestrator) {
+		o.shards = n
+	}
+}
+
+// WithRecoveryShards makes recovery publish to the shard topics of the
+// sagas it recovers. It must match the orchestrators' WithShards; the
+// default is 1. n must be positive.
+func WithRecoveryShards(n int) RecoveryOption {
+	if n <= 0 {
+		panic("saga: shards must be positive")
+	}
+	return func(r *RecoveryManager) {
+		r.shards = n
+	}
+}
+
+// StartShardListener is like StartListener, but only listens on the given
+// shards, numbered from 0, so each instance can own a subset of them. It
+// returns an error if a shard is out of range, or if the pubsub can't
+// subscribe to one, in which case the shards before it stay subscribed.
+func (o *Orchestrator) StartShardListener(ctx context.Context, shards ...int) error {
+	if len(shards) == 0 {
+		return fmt.Errorf("no shards to listen on")
+	}
+	for _, shard := range shards {
+		if shard < 0 || shard >= o.shards {
+			return fmt.Errorf("shard %d out of range, the orchestrator has %d", shard, o.shards)
+		}
+	}
+
+	for _, shard := range shards {
+		if err := o.listen(ctx, shardName(o.topic, o.shards, shard)); err != nil {
+			return err
+		}
+	}
+
+	o.listenerMu.Lock()
+	o.listening = true
+	o.listenerMu.Unlock()
+	return nil
+}
+
+// stepTopic returns the topic the step messages of the saga are published
+// on
+func (o *Orchestrator) stepTopic(sagaID string) string {
+	return shardTopic(o.topic, o.shards, sagaID)
+}
+
+// scheduleSteps prepares step messages to be published on their sagas'
+// topics once the write they follow from has been saved
+func (o *Orchestrator) scheduleSteps(msgs ...Message) []OutboxMessage {
+	scheduled := make([]OutboxMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		scheduled = append(scheduled, o.schedule(o.stepTopic(msg.SagaID), msg)...)
+	}
+	return scheduled
+}
+
+// shardTopic returns the topic of the shard of topic the saga belongs to
+func shardTopic(topic string, shards int, sagaID string) string {
+	if shards <= 1 {
+		return topic
+	}
+	h := fnv.New32a()
+	h.Write([]byte(sagaID))
+	return shardName(topic, shards, int(h.Sum32()%uint32(shards)))
+}
+
+// shardName returns the topic of shard of topic; with a single shard, the
+// topic itself
+func shardName(topic string, shards, shard int) string {
+	if shards <= 1 {
+		return topic
+	}
+	return fmt.Sprintf("%s.%d", topic, shard)
+}
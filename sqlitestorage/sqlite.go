@@ -0,0 +1,1061 @@
+// Package sqlitestorage provides a saga.Storage backed by a SQLite file.
+package sqlitestorage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	saga "github.com/andrewnguyen41/saga-go"
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+var (
+	_ saga.Storage      = (*SQLiteStorage)(nil)
+	_ saga.Outbox       = (*SQLiteStorage)(nil)
+	_ saga.WebhookStore = (*SQLiteStorage)(nil)
+	_ saga.BatchStorage = (*SQLiteStorage)(nil)
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS sagas (
+	id              TEXT PRIMARY KEY,
+	name            TEXT NOT NULL,
+	status          TEXT NOT NULL,
+	deadline        INTEGER,
+	created_at      INTEGER NOT NULL,
+	updated_at      INTEGER NOT NULL,
+	idempotency_key TEXT,
+	version         INTEGER NOT NULL,
+	doc             TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sagas_status_deadline ON sagas (status, deadline);
+CREATE INDEX IF NOT EXISTS sagas_created ON sagas (created_at);
+CREATE UNIQUE INDEX IF NOT EXISTS sagas_idempotency_key ON sagas (idempotency_key) WHERE idempotency_key IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS steps (
+	id           TEXT PRIMARY KEY,
+	saga_id      TEXT NOT NULL,
+	position     INTEGER NOT NULL,
+	status       TEXT NOT NULL,
+	started_at   INTEGER,
+	updated_at   INTEGER NOT NULL,
+	claimed_by   TEXT,
+	claim_expiry INTEGER,
+	version      INTEGER NOT NULL,
+	doc          TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS steps_saga ON steps (saga_id, position);
+CREATE INDEX IF NOT EXISTS steps_status_updated ON steps (status, updated_at);
+
+CREATE TABLE IF NOT EXISTS saga_tags (
+	saga_id TEXT NOT NULL,
+	key     TEXT NOT NULL,
+	value   TEXT NOT NULL,
+	PRIMARY KEY (saga_id, key)
+);
+CREATE INDEX IF NOT EXISTS saga_tags_key_value ON saga_tags (key, value);
+
+CREATE TABLE IF NOT EXISTS outbox (
+	seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+	id         TEXT NOT NULL UNIQUE,
+	topic      TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	doc        TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+	id           TEXT PRIMARY KEY,
+	next_attempt INTEGER NOT NULL,
+	doc          TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS webhooks_next_attempt ON webhooks (next_attempt);
+`
+
+// SQLiteStorage implements saga.Storage on a single SQLite database. Each
+// saga and step is a row holding its JSON encoding, with the fields used in
+// queries (name, status, deadline, timestamps, idempotency key and claims)
+// and its version copied into columns, and its tags indexed in a table of
+// their own.
+// The columns are authoritative: status changes made through
+// UpdateStepStatus and ClaimStep only touch the columns.
+type SQLiteStorage struct {
+	db *sql.DB
+	// See WithMaxDataSize; zero means unlimited
+	maxDataSize int
+}
+
+// Option configures a SQLiteStorage
+type Option func(*SQLiteStorage)
+
+// WithMaxDataSize makes SaveSaga, UpdateStep and every other write return
+// an error wrapping saga.ErrDataTooLarge, and store nothing, if the data of
+// the saga or of one of its steps is over n bytes, measured by encoding it
+// as JSON. n must be positive; there is no limit by default.
+func WithMaxDataSize(n int) Option {
+	if n <= 0 {
+		panic("sqlitestorage: max data size must be positive")
+	}
+	return func(s *SQLiteStorage) {
+		s.maxDataSize = n
+	}
+}
+
+// NewSQLiteStorage opens (or creates) the database at path and creates the
+// schema if needed
+func NewSQLiteStorage(path string, opts ...Option) (*SQLiteStorage, error) {
+	dsn := "file:" + path + "?" + url.Values{
+		"_pragma": {"busy_timeout(5000)", "journal_mode(WAL)", "synchronous(NORMAL)"},
+	}.Encode()
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
+	}
+	// SQLite allows a single writer; serializing on one connection avoids
+	// SQLITE_BUSY errors between our own transactions
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema: %w", err)
+	}
+
+	s := &SQLiteStorage{db: db}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// Close closes the underlying database
+func (s *SQLiteStorage) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStorage) SaveSaga(ctx context.Context, sg *saga.Saga) error {
+	return s.SaveSagaWithMessages(ctx, sg, nil)
+}
+
+// SaveSagaWithMessages saves the saga and inserts msgs into the outbox
+// table in one transaction
+func (s *SQLiteStorage) SaveSagaWithMessages(ctx context.Context, sg *saga.Saga, msgs []saga.OutboxMessage) error {
+	if err := saga.CheckDataSize(s.maxDataSize, sg); err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	version, err := saveSaga(ctx, tx, sg, now)
+	if err != nil {
+		return err
+	}
+	if err := insertMessages(ctx, tx, msgs, now); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit saga: %w", err)
+	}
+	sg.Version = version
+	return nil
+}
+
+// saveSaga writes sg within tx and returns its new version, which the
+// caller records on sg once tx commits
+func saveSaga(ctx context.Context, tx *sql.Tx, sg *saga.Saga, now time.Time) (int, error) {
+	sg.UpdatedAt = now
+	if sg.CreatedAt.IsZero() {
+		sg.CreatedAt = now
+	}
+
+	var version int
+	err := tx.QueryRowContext(ctx, `SELECT version FROM sagas WHERE id = ?`, sg.ID).Scan(&version)
+	if err == nil && version != sg.Version {
+		return 0, saga.ErrVersionConflict
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("failed to check saga version: %w", err)
+	}
+
+	if sg.IdempotencyKey != "" {
+		var owner string
+		err := tx.QueryRowContext(ctx, `SELECT id FROM sagas WHERE idempotency_key = ?`, sg.IdempotencyKey).Scan(&owner)
+		if err == nil && owner != sg.ID {
+			return 0, saga.ErrDuplicateIdempotencyKey
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("failed to check idempotency key: %w", err)
+		}
+	}
+
+	saved := *sg
+	saved.Version++
+	doc, err := encodeSaga(&saved)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO sagas (id, name, status, deadline, created_at, updated_at, idempotency_key, version, doc)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			status = excluded.status, deadline = excluded.deadline, updated_at = excluded.updated_at,
+			idempotency_key = excluded.idempotency_key, version = excluded.version, doc = excluded.doc`,
+		sg.ID, sg.Name, string(sg.Status), nullableTime(sg.Deadline), sg.CreatedAt.UnixNano(), now.UnixNano(),
+		nullableString(sg.IdempotencyKey), saved.Version, doc)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save saga: %w", err)
+	}
+	if err := saveTags(ctx, tx, sg); err != nil {
+		return 0, err
+	}
+
+	// Existing steps only change through UpdateStep/UpdateStepStatus, so a
+	// stale snapshot can't undo a status change made concurrently
+	for i := range sg.Steps {
+		step := sg.Steps[i]
+		if step.CreatedAt.IsZero() {
+			step.CreatedAt = now
+		}
+		step.UpdatedAt = now
+		step.Version = 1
+
+		doc, err := json.Marshal(step)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode step: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO steps (id, saga_id, position, status, started_at, updated_at, claimed_by, claim_expiry, version, doc)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO NOTHING`,
+			step.ID, step.SagaID, i, string(step.Status), nullableTime(step.StartedAt), now.UnixNano(),
+			nullableString(step.ClaimedBy), nullableTime(step.ClaimExpiry), step.Version, string(doc))
+		if err != nil {
+			return 0, fmt.Errorf("failed to save step: %w", err)
+		}
+	}
+
+	return saved.Version, nil
+}
+
+// batchRows is how many rows SaveSagas inserts per statement, which keeps
+// the statements well within SQLite's limit on bound parameters
+const batchRows = 500
+
+// SaveSagas inserts new sagas, their steps and their tags in one
+// transaction, with a multi-row insert per table
+func (s *SQLiteStorage) SaveSagas(ctx context.Context, sagas []*saga.Saga) error {
+	for _, sg := range sagas {
+		if err := saga.CheckDataSize(s.maxDataSize, sg); err != nil {
+			return err
+		}
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	keys := make(map[string]bool)
+	var sagaRows, stepRows, tagRows [][]interface{}
+	for _, sg := range sagas {
+		if sg.Version != 0 {
+			return saga.ErrVersionConflict
+		}
+		if sg.IdempotencyKey != "" {
+			var owner string
+			err := tx.QueryRowContext(ctx, `SELECT id FROM sagas WHERE idempotency_key = ?`, sg.IdempotencyKey).Scan(&owner)
+			if err == nil || keys[sg.IdempotencyKey] {
+				return saga.ErrDuplicateIdempotencyKey
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("failed to check idempotency key: %w", err)
+			}
+			keys[sg.IdempotencyKey] = true
+		}
+
+		sg.UpdatedAt = now
+		if sg.CreatedAt.IsZero() {
+			sg.CreatedAt = now
+		}
+		saved := *sg
+		saved.Version = 1
+		doc, err := encodeSaga(&saved)
+		if err != nil {
+			return err
+		}
+		sagaRows = append(sagaRows, []interface{}{
+			sg.ID, sg.Name, string(sg.Status), nullableTime(sg.Deadline), sg.CreatedAt.UnixNano(), now.UnixNano(),
+			nullableString(sg.IdempotencyKey), saved.Version, doc,
+		})
+
+		for i := range sg.Steps {
+			step := sg.Steps[i]
+			if step.CreatedAt.IsZero() {
+				step.CreatedAt = now
+			}
+			step.UpdatedAt = now
+			step.Version = 1
+
+			doc, err := json.Marshal(step)
+			if err != nil {
+				return fmt.Errorf("failed to encode step: %w", err)
+			}
+			stepRows = append(stepRows, []interface{}{
+				step.ID, step.SagaID, i, string(step.Status), nullableTime(step.StartedAt), now.UnixNano(),
+				nullableString(step.ClaimedBy), nullableTime(step.ClaimExpiry), step.Version, string(doc),
+			})
+		}
+		for key, value := range sg.Tags {
+			tagRows = append(tagRows, []interface{}{sg.ID, key, value})
+		}
+	}
+
+	if err := insertRows(ctx, tx, "sagas", "id, name, status, deadline, created_at, updated_at, idempotency_key, version, doc", sagaRows); err != nil {
+		return fmt.Errorf("failed to save sagas: %w", err)
+	}
+	if err := insertRows(ctx, tx, "steps", "id, saga_id, position, status, started_at, updated_at, claimed_by, claim_expiry, version, doc", stepRows); err != nil {
+		return fmt.Errorf("failed to save steps: %w", err)
+	}
+	if err := insertRows(ctx, tx, "saga_tags", "saga_id, key, value", tagRows); err != nil {
+		return fmt.Errorf("failed to save tags: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit sagas: %w", err)
+	}
+	for _, sg := range sagas {
+		sg.Version = 1
+	}
+	return nil
+}
+
+// insertRows inserts rows into the columns of table within tx, batchRows
+// rows per statement
+func insertRows(ctx context.Context, tx *sql.Tx, table, columns string, rows [][]interface{}) error {
+	n := strings.Count(columns, ",") + 1
+	row := "(" + strings.TrimSuffix(strings.Repeat("?, ", n), ", ") + ")"
+	for len(rows) > 0 {
+		batch := rows[:min(len(rows), batchRows)]
+		rows = rows[len(batch):]
+
+		args := make([]interface{}, 0, len(batch)*n)
+		for _, values := range batch {
+			args = append(args, values...)
+		}
+		query := "INSERT INTO " + table + " (" + columns + ") VALUES " + strings.TrimSuffix(strings.Repeat(row+", ", len(batch)), ", ")
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveTags replaces the rows indexing sg's tags within tx
+func saveTags(ctx context.Context, tx *sql.Tx, sg *saga.Saga) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM saga_tags WHERE saga_id = ?`, sg.ID); err != nil {
+		return fmt.Errorf("failed to save tags: %w", err)
+	}
+	for key, value := range sg.Tags {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO saga_tags (saga_id, key, value) VALUES (?, ?, ?)`, sg.ID, key, value); err != nil {
+			return fmt.Errorf("failed to save tags: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) GetSaga(ctx context.Context, id string) (*saga.Saga, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var (
+		status    string
+		updatedAt int64
+		version   int
+		doc       string
+	)
+	err = tx.QueryRowContext(ctx, `SELECT status, updated_at, version, doc FROM sagas WHERE id = ?`, id).
+		Scan(&status, &updatedAt, &version, &doc)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, saga.ErrSagaNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get saga: %w", err)
+	}
+
+	sg := &saga.Saga{}
+	if err := json.Unmarshal([]byte(doc), sg); err != nil {
+		return nil, fmt.Errorf("failed to decode saga: %w", err)
+	}
+	sg.Status = saga.Status(status)
+	sg.UpdatedAt = time.Unix(0, updatedAt)
+	sg.Version = version
+
+	rows, err := tx.QueryContext(ctx, stepColumns+` WHERE saga_id = ? ORDER BY position`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get steps: %w", err)
+	}
+	sg.Steps, err = scanSteps(rows)
+	if err != nil {
+		return nil, err
+	}
+	return sg, nil
+}
+
+func (s *SQLiteStorage) GetSagaByKey(ctx context.Context, key string) (*saga.Saga, error) {
+	var id string
+	err := s.db.QueryRowContext(ctx, `SELECT id FROM sagas WHERE idempotency_key = ?`, key).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, saga.ErrSagaNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get saga by key: %w", err)
+	}
+	return s.GetSaga(ctx, id)
+}
+
+func (s *SQLiteStorage) ListSagas(ctx context.Context, filter saga.SagaFilter) ([]saga.Saga, error) {
+	query := `SELECT id FROM sagas WHERE 1 = 1`
+	var args []interface{}
+	if filter.Name != "" {
+		query += ` AND name = ?`
+		args = append(args, filter.Name)
+	}
+	if filter.Status != "" {
+		query += ` AND status = ?`
+		args = append(args, string(filter.Status))
+	}
+	query += ` ORDER BY created_at DESC, id`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sagas: %w", err)
+	}
+	return s.sagasByID(ctx, rows)
+}
+
+func (s *SQLiteStorage) FindSagasByTag(ctx context.Context, key, value string) ([]saga.Saga, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT s.id FROM saga_tags t JOIN sagas s ON s.id = t.saga_id
+		WHERE t.key = ? AND t.value = ?
+		ORDER BY s.created_at DESC, s.id`, key, value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find sagas by tag: %w", err)
+	}
+	return s.sagasByID(ctx, rows)
+}
+
+func (s *SQLiteStorage) UpdateStep(ctx context.Context, step *saga.Step) error {
+	return s.UpdateStepWithMessages(ctx, step, nil)
+}
+
+// UpdateStepWithMessages updates the step and inserts msgs into the outbox
+// table in one transaction
+func (s *SQLiteStorage) UpdateStepWithMessages(ctx context.Context, step *saga.Step, msgs []saga.OutboxMessage) error {
+	if err := saga.CheckDataSize(s.maxDataSize, nil, step); err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	version, err := updateStep(ctx, tx, step, now)
+	if err != nil {
+		return err
+	}
+	if err := insertMessages(ctx, tx, msgs, now); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit step: %w", err)
+	}
+	step.Version = version
+	return nil
+}
+
+func (s *SQLiteStorage) CompleteStep(ctx context.Context, step *saga.Step, sg *saga.Saga) error {
+	return s.CompleteStepWithMessages(ctx, step, sg, nil)
+}
+
+// CompleteStepWithMessages completes the step and inserts msgs into the
+// outbox table in one transaction
+func (s *SQLiteStorage) CompleteStepWithMessages(ctx context.Context, step *saga.Step, sg *saga.Saga, msgs []saga.OutboxMessage) error {
+	if err := saga.CheckDataSize(s.maxDataSize, sg, step); err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM sagas WHERE id = ?)`, sg.ID).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check saga: %w", err)
+	}
+	if !exists {
+		return saga.ErrSagaNotFound
+	}
+	stepVersion, err := updateStep(ctx, tx, step, now)
+	if err != nil {
+		return err
+	}
+	sagaVersion, err := saveSaga(ctx, tx, sg, now)
+	if err != nil {
+		return err
+	}
+	if err := insertMessages(ctx, tx, msgs, now); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit step: %w", err)
+	}
+	step.Version = stepVersion
+	sg.Version = sagaVersion
+	return nil
+}
+
+// insertMessages adds msgs to the outbox table within tx
+func insertMessages(ctx context.Context, tx *sql.Tx, msgs []saga.OutboxMessage, now time.Time) error {
+	for _, msg := range msgs {
+		doc, err := json.Marshal(msg.Message)
+		if err != nil {
+			return fmt.Errorf("failed to encode message: %w", err)
+		}
+		createdAt := msg.CreatedAt
+		if createdAt.IsZero() {
+			createdAt = now
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO outbox (id, topic, created_at, doc) VALUES (?, ?, ?, ?)`,
+			msg.ID, msg.Topic, createdAt.UnixNano(), string(doc))
+		if err != nil {
+			return fmt.Errorf("failed to add message to outbox: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) PendingMessages(ctx context.Context, limit int) ([]saga.OutboxMessage, error) {
+	query := `SELECT id, topic, created_at, doc FROM outbox ORDER BY seq`
+	var args []interface{}
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get outbox messages: %w", err)
+	}
+	defer rows.Close()
+
+	var msgs []saga.OutboxMessage
+	for rows.Next() {
+		var (
+			msg       saga.OutboxMessage
+			createdAt int64
+			doc       string
+		)
+		if err := rows.Scan(&msg.ID, &msg.Topic, &createdAt, &doc); err != nil {
+			return nil, fmt.Errorf("failed to scan outbox message: %w", err)
+		}
+		if err := json.Unmarshal([]byte(doc), &msg.Message); err != nil {
+			return nil, fmt.Errorf("failed to decode outbox message: %w", err)
+		}
+		msg.CreatedAt = time.Unix(0, createdAt)
+		msgs = append(msgs, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get outbox messages: %w", err)
+	}
+	return msgs, nil
+}
+
+func (s *SQLiteStorage) SaveWebhook(ctx context.Context, delivery saga.WebhookDelivery) error {
+	doc, err := json.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook: %w", err)
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO webhooks (id, next_attempt, doc) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET next_attempt = excluded.next_attempt, doc = excluded.doc`,
+		delivery.ID, delivery.NextAttempt.UnixNano(), string(doc))
+	if err != nil {
+		return fmt.Errorf("failed to save webhook: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) DueWebhooks(ctx context.Context, now time.Time, limit int) ([]saga.WebhookDelivery, error) {
+	query := `SELECT doc FROM webhooks WHERE next_attempt <= ? ORDER BY next_attempt, id`
+	args := []interface{}{now.UnixNano()}
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	var due []saga.WebhookDelivery
+	for rows.Next() {
+		var doc string
+		if err := rows.Scan(&doc); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %w", err)
+		}
+		var delivery saga.WebhookDelivery
+		if err := json.Unmarshal([]byte(doc), &delivery); err != nil {
+			return nil, fmt.Errorf("failed to decode webhook: %w", err)
+		}
+		due = append(due, delivery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get webhooks: %w", err)
+	}
+	return due, nil
+}
+
+func (s *SQLiteStorage) DeleteWebhook(ctx context.Context, id string) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM webhooks WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete webhook: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) DeleteMessages(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	query := `DELETE FROM outbox WHERE id IN (?` + strings.Repeat(`, ?`, len(ids)-1) + `)`
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	if _, err := s.db.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("failed to delete outbox messages: %w", err)
+	}
+	return nil
+}
+
+// updateStep writes step within tx and returns its new version, which the
+// caller records on step once tx commits
+func updateStep(ctx context.Context, tx *sql.Tx, step *saga.Step, now time.Time) (int, error) {
+	step.UpdatedAt = now
+
+	var version int
+	err := tx.QueryRowContext(ctx, `SELECT version FROM steps WHERE id = ?`, step.ID).Scan(&version)
+	if err == nil && version != step.Version {
+		return 0, saga.ErrVersionConflict
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("failed to check step version: %w", err)
+	}
+
+	saved := *step
+	saved.Version++
+	doc, err := json.Marshal(saved)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode step: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO steps (id, saga_id, position, status, started_at, updated_at, claimed_by, claim_expiry, version, doc)
+		VALUES (?, ?, (SELECT COUNT(*) FROM steps WHERE saga_id = ?), ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			status = excluded.status, started_at = excluded.started_at, updated_at = excluded.updated_at,
+			claimed_by = excluded.claimed_by, claim_expiry = excluded.claim_expiry, version = excluded.version,
+			doc = excluded.doc`,
+		step.ID, step.SagaID, step.SagaID, string(step.Status), nullableTime(step.StartedAt), now.UnixNano(),
+		nullableString(step.ClaimedBy), nullableTime(step.ClaimExpiry), saved.Version, string(doc))
+	if err != nil {
+		return 0, fmt.Errorf("failed to update step: %w", err)
+	}
+	if err := touchSaga(ctx, tx, step.SagaID, now); err != nil {
+		return 0, err
+	}
+	return saved.Version, nil
+}
+
+func (s *SQLiteStorage) UpdateStepStatus(ctx context.Context, id string, from, to saga.Status) (bool, error) {
+	return s.updateStepIf(ctx, id, from, `status = ?`, string(to))
+}
+
+func (s *SQLiteStorage) ClaimStep(ctx context.Context, id, owner string, expiry time.Time) (bool, error) {
+	var claimExpiry interface{}
+	if !expiry.IsZero() {
+		claimExpiry = expiry.UnixNano()
+	}
+	return s.updateStepIf(ctx, id, saga.StatusPending, `status = ?, claimed_by = ?, claim_expiry = ?`,
+		string(saga.StatusProcessing), owner, claimExpiry)
+}
+
+// ClaimNextPendingStep picks and claims the step in one transaction. The
+// storage's single connection serializes it with every other write, so no
+// other claim can take the step in between.
+func (s *SQLiteStorage) ClaimNextPendingStep(ctx context.Context, owner string, expiry time.Time) (*saga.Step, error) {
+	now := time.Now()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT s.status, s.updated_at, s.claimed_by, s.claim_expiry, s.version, s.doc FROM steps s
+		JOIN sagas g ON g.id = s.saga_id
+		WHERE s.status = ? AND g.status = ?
+		ORDER BY s.updated_at, s.id`,
+		string(saga.StatusPending), string(saga.StatusPending))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending steps: %w", err)
+	}
+	candidates, err := scanSteps(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// Steps without dependencies are ready as they are; the others need
+	// their saga's steps, loaded once per saga
+	sagas := make(map[string]*saga.Saga)
+	for i := range candidates {
+		step := &candidates[i]
+		sg := &saga.Saga{ID: step.SagaID, Status: saga.StatusPending}
+		if len(step.DependsOn) > 0 {
+			if sagas[step.SagaID] == nil {
+				rows, err := tx.QueryContext(ctx, stepColumns+` WHERE saga_id = ?`, step.SagaID)
+				if err != nil {
+					return nil, fmt.Errorf("failed to get steps: %w", err)
+				}
+				if sg.Steps, err = scanSteps(rows); err != nil {
+					return nil, err
+				}
+				sagas[step.SagaID] = sg
+			}
+			sg = sagas[step.SagaID]
+		}
+		if !saga.StepReady(sg, step) {
+			continue
+		}
+
+		var claimExpiry interface{}
+		if !expiry.IsZero() {
+			claimExpiry = expiry.UnixNano()
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE steps SET status = ?, claimed_by = ?, claim_expiry = ?, updated_at = ?, version = version + 1 WHERE id = ?`,
+			string(saga.StatusProcessing), owner, claimExpiry, now.UnixNano(), step.ID); err != nil {
+			return nil, fmt.Errorf("failed to claim step: %w", err)
+		}
+		if err := touchSaga(ctx, tx, step.SagaID, now); err != nil {
+			return nil, err
+		}
+
+		rows, err := tx.QueryContext(ctx, stepColumns+` WHERE id = ?`, step.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get step: %w", err)
+		}
+		claimed, err := scanSteps(rows)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, fmt.Errorf("failed to commit step claim: %w", err)
+		}
+		return &claimed[0], nil
+	}
+	return nil, saga.ErrStepNotFound
+}
+
+// updateStepIf applies the column assignments in set, with args, to a step
+// currently in the from status, bumping its version, and reports whether it
+// was
+func (s *SQLiteStorage) updateStepIf(ctx context.Context, id string, from saga.Status, set string, args ...interface{}) (bool, error) {
+	now := time.Now()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var sagaID string
+	err = tx.QueryRowContext(ctx, `SELECT saga_id FROM steps WHERE id = ?`, id).Scan(&sagaID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, saga.ErrStepNotFound
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get step: %w", err)
+	}
+
+	args = append(args, now.UnixNano(), id, string(from))
+	res, err := tx.ExecContext(ctx, `UPDATE steps SET `+set+`, updated_at = ?, version = version + 1 WHERE id = ? AND status = ?`, args...)
+	if err != nil {
+		return false, fmt.Errorf("failed to update step status: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to update step status: %w", err)
+	}
+	if n == 0 {
+		return false, nil
+	}
+	if err := touchSaga(ctx, tx, sagaID, now); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit step status: %w", err)
+	}
+	return true, nil
+}
+
+func (s *SQLiteStorage) GetStep(ctx context.Context, id string) (*saga.Step, error) {
+	rows, err := s.db.QueryContext(ctx, stepColumns+` WHERE id = ?`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get step: %w", err)
+	}
+	steps, err := scanSteps(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		return nil, saga.ErrStepNotFound
+	}
+	return &steps[0], nil
+}
+
+func (s *SQLiteStorage) GetStepsBySaga(ctx context.Context, sagaID string) ([]saga.Step, error) {
+	rows, err := s.db.QueryContext(ctx, stepColumns+` WHERE saga_id = ? ORDER BY position`, sagaID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get steps: %w", err)
+	}
+	return scanSteps(rows)
+}
+
+func (s *SQLiteStorage) GetPendingSteps(ctx context.Context) ([]saga.Step, error) {
+	rows, err := s.db.QueryContext(ctx, stepColumns+` WHERE status = ?`, string(saga.StatusPending))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending steps: %w", err)
+	}
+	return scanSteps(rows)
+}
+
+func (s *SQLiteStorage) GetStuckSteps(ctx context.Context, timeout time.Duration) ([]saga.Step, error) {
+	cutoff := time.Now().Add(-timeout).UnixNano()
+
+	// Steps of finished or failed sagas are never going to run, and those
+	// of paused sagas wait for ResumeSaga
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT s.status, s.updated_at, s.claimed_by, s.claim_expiry, s.version, s.doc FROM steps s
+		LEFT JOIN sagas g ON g.id = s.saga_id
+		WHERE (g.id IS NULL OR g.status = ?) AND (
+			(s.status = ? AND s.updated_at < ?) OR
+			(s.status = ? AND s.claim_expiry IS NULL AND COALESCE(s.started_at, s.updated_at) < ?) OR
+			(s.status = ? AND s.claim_expiry < ?)
+		)`,
+		string(saga.StatusPending),
+		string(saga.StatusPending), cutoff,
+		string(saga.StatusProcessing), cutoff,
+		string(saga.StatusProcessing), time.Now().UnixNano())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stuck steps: %w", err)
+	}
+	return scanSteps(rows)
+}
+
+func (s *SQLiteStorage) GetExpiredSagas(ctx context.Context, now time.Time) ([]saga.Saga, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id FROM sagas WHERE status = ? AND deadline < ?`,
+		string(saga.StatusPending), now.UnixNano())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get expired sagas: %w", err)
+	}
+	return s.sagasByID(ctx, rows)
+}
+
+func (s *SQLiteStorage) GetStuckCompensations(ctx context.Context, timeout time.Duration) ([]saga.Saga, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id FROM sagas WHERE status = ? AND updated_at < ?`,
+		string(saga.StatusCompensating), time.Now().Add(-timeout).UnixNano())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stuck compensations: %w", err)
+	}
+	return s.sagasByID(ctx, rows)
+}
+
+func (s *SQLiteStorage) DeleteSaga(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := deleteSagas(ctx, tx, `id = ?`, id); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit delete: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) PurgeCompletedBefore(ctx context.Context, before time.Time) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var purged int
+	where := `status IN (?, ?, ?, ?) AND updated_at < ?`
+	args := []interface{}{string(saga.StatusCompleted), string(saga.StatusFailed), string(saga.StatusRolledBack),
+		string(saga.StatusCanceled), before.UnixNano()}
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM sagas WHERE `+where, args...).Scan(&purged); err != nil {
+		return 0, fmt.Errorf("failed to count sagas: %w", err)
+	}
+	if err := deleteSagas(ctx, tx, where, args...); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit purge: %w", err)
+	}
+	return purged, nil
+}
+
+// deleteSagas deletes the sagas matching where, along with their steps and
+// tags
+func deleteSagas(ctx context.Context, tx *sql.Tx, where string, args ...interface{}) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM steps WHERE saga_id IN (SELECT id FROM sagas WHERE `+where+`)`, args...); err != nil {
+		return fmt.Errorf("failed to delete steps: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM saga_tags WHERE saga_id IN (SELECT id FROM sagas WHERE `+where+`)`, args...); err != nil {
+		return fmt.Errorf("failed to delete tags: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sagas WHERE `+where, args...); err != nil {
+		return fmt.Errorf("failed to delete sagas: %w", err)
+	}
+	return nil
+}
+
+// sagasByID loads the sagas whose IDs rows selects, closing rows first so
+// the loads can use the single connection
+func (s *SQLiteStorage) sagasByID(ctx context.Context, rows *sql.Rows) ([]saga.Saga, error) {
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan saga: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read sagas: %w", err)
+	}
+
+	sagas := make([]saga.Saga, 0, len(ids))
+	for _, id := range ids {
+		sg, err := s.GetSaga(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		sagas = append(sagas, *sg)
+	}
+	return sagas, nil
+}
+
+const stepColumns = `SELECT status, updated_at, claimed_by, claim_expiry, version, doc FROM steps`
+
+// scanSteps decodes and closes rows selected with stepColumns
+func scanSteps(rows *sql.Rows) ([]saga.Step, error) {
+	defer rows.Close()
+
+	var steps []saga.Step
+	for rows.Next() {
+		var (
+			status      string
+			updatedAt   int64
+			claimedBy   sql.NullString
+			claimExpiry sql.NullInt64
+			version     int
+			doc         string
+		)
+		if err := rows.Scan(&status, &updatedAt, &claimedBy, &claimExpiry, &version, &doc); err != nil {
+			return nil, fmt.Errorf("failed to scan step: %w", err)
+		}
+
+		var step saga.Step
+		if err := json.Unmarshal([]byte(doc), &step); err != nil {
+			return nil, fmt.Errorf("failed to decode step: %w", err)
+		}
+		step.Status = saga.Status(status)
+		step.UpdatedAt = time.Unix(0, updatedAt)
+		step.ClaimedBy = claimedBy.String
+		step.Version = version
+		step.ClaimExpiry = nil
+		if claimExpiry.Valid {
+			expiry := time.Unix(0, claimExpiry.Int64)
+			step.ClaimExpiry = &expiry
+		}
+		steps = append(steps, step)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read steps: %w", err)
+	}
+	return steps, nil
+}
+
+// encodeSaga returns the JSON document stored for a saga. Steps live in
+// their own rows.
+func encodeSaga(sg *saga.Saga) (string, error) {
+	c := *sg
+	c.Steps = nil
+	doc, err := json.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode saga: %w", err)
+	}
+	return string(doc), nil
+}
+
+func touchSaga(ctx context.Context, tx *sql.Tx, id string, now time.Time) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE sagas SET updated_at = ? WHERE id = ?`, now.UnixNano(), id); err != nil {
+		return fmt.Errorf("failed to update saga: %w", err)
+	}
+	return nil
+}
+
+func nullableString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func nullableTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UnixNano()
+}
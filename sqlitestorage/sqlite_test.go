@@ -0,0 +1,646 @@
+package sqlitestorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	saga "github.com/andrewnguyen41/saga-go"
+	"github.com/andrewnguyen41/saga-go/storagetest"
+)
+
+func newTestStorage(t *testing.T, opts ...Option) *SQLiteStorage {
+	t.Helper()
+
+	storage, err := NewSQLiteStorage(filepath.Join(t.TempDir(), "saga.db"), opts...)
+	if err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+func TestSQLiteConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) saga.Storage { return newTestStorage(t) })
+}
+
+func TestSQLiteSagaLifecycle(t *testing.T) {
+	storage := newTestStorage(t)
+	pubsub := saga.NewMemoryPubSub()
+	defer pubsub.Close()
+
+	orchestrator := saga.NewOrchestrator(storage, pubsub)
+	orchestrator.StartListener(context.Background())
+
+	sagaInstance, err := saga.NewBuilder("sqlite_saga", orchestrator).
+		Step("reserve",
+			func(ctx context.Context, data map[string]interface{}) error {
+				data["reserved"] = true
+				return nil
+			},
+			func(ctx context.Context, data map[string]interface{}) error {
+				return nil
+			},
+		).
+		Step("charge",
+			func(ctx context.Context, data map[string]interface{}) error {
+				return errors.New("card declined")
+			},
+			nil,
+		).
+		WithData("user_id", "user_123").
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start saga: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	status, err := orchestrator.WaitForCompletion(ctx, sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Saga did not finish: %v", err)
+	}
+	if status != saga.StatusFailed {
+		t.Errorf("Expected saga to fail, got %s", status)
+	}
+
+	finalSaga, err := storage.GetSaga(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to get saga: %v", err)
+	}
+	if finalSaga.Data["reserved"] != true || finalSaga.Data["user_id"] != "user_123" {
+		t.Errorf("Unexpected saga data: %v", finalSaga.Data)
+	}
+	if len(finalSaga.Steps) != 2 || finalSaga.Steps[0].Name != "reserve" {
+		t.Fatalf("Expected steps in declaration order, got %+v", finalSaga.Steps)
+	}
+	if finalSaga.Steps[0].Status != saga.StatusCompensated {
+		t.Errorf("Expected first step to be compensated, got %s", finalSaga.Steps[0].Status)
+	}
+	if finalSaga.Steps[1].Error != "card declined" {
+		t.Errorf("Expected step error to be stored, got %q", finalSaga.Steps[1].Error)
+	}
+
+	steps, err := storage.GetStepsBySaga(context.Background(), sagaInstance.ID)
+	if err != nil {
+		t.Fatalf("Failed to get steps: %v", err)
+	}
+	if len(steps) != 2 || steps[0].ID != finalSaga.Steps[0].ID || steps[1].Status != saga.StatusFailed {
+		t.Errorf("Unexpected steps: %+v", steps)
+	}
+}
+
+func TestSQLiteStepStatusCAS(t *testing.T) {
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	sg := &saga.Saga{
+		ID:     "saga-1",
+		Status: saga.StatusPending,
+		Steps:  []saga.Step{{ID: "step-1", SagaID: "saga-1", Name: "step1", Status: saga.StatusPending}},
+	}
+	if err := storage.SaveSaga(ctx, sg); err != nil {
+		t.Fatalf("Failed to save saga: %v", err)
+	}
+
+	claimed, err := storage.UpdateStepStatus(ctx, "step-1", saga.StatusPending, saga.StatusProcessing)
+	if err != nil || !claimed {
+		t.Fatalf("Expected first claim to succeed, got %v, %v", claimed, err)
+	}
+	claimed, err = storage.UpdateStepStatus(ctx, "step-1", saga.StatusPending, saga.StatusProcessing)
+	if err != nil || claimed {
+		t.Fatalf("Expected second claim to fail, got %v, %v", claimed, err)
+	}
+
+	// Saving a stale snapshot must not undo the claim
+	if err := storage.SaveSaga(ctx, sg); err != nil {
+		t.Fatalf("Failed to save saga: %v", err)
+	}
+	step, err := storage.GetStep(ctx, "step-1")
+	if err != nil {
+		t.Fatalf("Failed to get step: %v", err)
+	}
+	if step.Status != saga.StatusProcessing {
+		t.Errorf("Expected step to stay processing, got %s", step.Status)
+	}
+
+	stuck, err := storage.GetStuckSteps(ctx, -time.Second)
+	if err != nil {
+		t.Fatalf("Failed to get stuck steps: %v", err)
+	}
+	if len(stuck) != 1 || stuck[0].ID != "step-1" {
+		t.Errorf("Expected the processing step to be stuck, got %+v", stuck)
+	}
+
+	keyed := &saga.Saga{ID: "saga-2", Status: saga.StatusPending, IdempotencyKey: "order-7"}
+	if err := storage.SaveSaga(ctx, keyed); err != nil {
+		t.Fatalf("Failed to save keyed saga: %v", err)
+	}
+	if err := storage.SaveSaga(ctx, keyed); err != nil {
+		t.Fatalf("Expected re-saving a keyed saga to succeed, got %v", err)
+	}
+	duplicate := &saga.Saga{ID: "saga-3", Status: saga.StatusPending, IdempotencyKey: "order-7"}
+	if err := storage.SaveSaga(ctx, duplicate); !errors.Is(err, saga.ErrDuplicateIdempotencyKey) {
+		t.Errorf("Expected ErrDuplicateIdempotencyKey, got %v", err)
+	}
+	found, err := storage.GetSagaByKey(ctx, "order-7")
+	if err != nil || found.ID != "saga-2" {
+		t.Errorf("Expected to find saga-2 by key, got %+v, %v", found, err)
+	}
+
+	if _, err := storage.GetSaga(ctx, "missing"); !errors.Is(err, saga.ErrSagaNotFound) {
+		t.Errorf("Expected ErrSagaNotFound, got %v", err)
+	}
+	if _, err := storage.GetStep(ctx, "missing"); !errors.Is(err, saga.ErrStepNotFound) {
+		t.Errorf("Expected ErrStepNotFound, got %v", err)
+	}
+}
+
+func TestSQLitePurge(t *testing.T) {
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	for _, sg := range []*saga.Saga{
+		{ID: "done", Status: saga.StatusCompleted, Steps: []saga.Step{{ID: "done-step", SagaID: "done", Status: saga.StatusCompleted}}},
+		{ID: "running", Status: saga.StatusPending, Steps: []saga.Step{{ID: "running-step", SagaID: "running", Status: saga.StatusPending}}},
+	} {
+		if err := storage.SaveSaga(ctx, sg); err != nil {
+			t.Fatalf("Failed to save saga: %v", err)
+		}
+	}
+
+	purged, err := storage.PurgeCompletedBefore(ctx, time.Now().Add(time.Second))
+	if err != nil || purged != 1 {
+		t.Fatalf("Expected to purge the completed saga, got %d, %v", purged, err)
+	}
+	if _, err := storage.GetStep(ctx, "done-step"); !errors.Is(err, saga.ErrStepNotFound) {
+		t.Errorf("Expected the purged saga's steps to be gone, got %v", err)
+	}
+
+	if err := storage.DeleteSaga(ctx, "running"); err != nil {
+		t.Fatalf("Failed to delete saga: %v", err)
+	}
+	if _, err := storage.GetSaga(ctx, "running"); !errors.Is(err, saga.ErrSagaNotFound) {
+		t.Errorf("Expected the deleted saga to be gone, got %v", err)
+	}
+	if _, err := storage.GetStep(ctx, "running-step"); !errors.Is(err, saga.ErrStepNotFound) {
+		t.Errorf("Expected the deleted saga's steps to be gone, got %v", err)
+	}
+}
+
+func TestSQLiteListSagas(t *testing.T) {
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i, sg := range []*saga.Saga{
+		{ID: "oldest", Name: "order", Status: saga.StatusCompleted},
+		{ID: "middle", Name: "order", Status: saga.StatusPending},
+		{ID: "newest", Name: "refund", Status: saga.StatusPending},
+	} {
+		sg.CreatedAt = start.Add(time.Duration(i) * time.Second)
+		if err := storage.SaveSaga(ctx, sg); err != nil {
+			t.Fatalf("Failed to save saga: %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		filter saga.SagaFilter
+		want   []string
+	}{
+		{saga.SagaFilter{}, []string{"newest", "middle", "oldest"}},
+		{saga.SagaFilter{Name: "order"}, []string{"middle", "oldest"}},
+		{saga.SagaFilter{Status: saga.StatusPending, Limit: 1}, []string{"newest"}},
+	} {
+		sagas, err := storage.ListSagas(ctx, tc.filter)
+		if err != nil {
+			t.Fatalf("Failed to list sagas: %v", err)
+		}
+		var ids []string
+		for _, sg := range sagas {
+			ids = append(ids, sg.ID)
+		}
+		if strings.Join(ids, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("ListSagas(%+v) = %v, want %v", tc.filter, ids, tc.want)
+		}
+	}
+}
+
+func TestSQLiteClaimStep(t *testing.T) {
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	sg := &saga.Saga{
+		ID:     "saga-1",
+		Status: saga.StatusPending,
+		Steps:  []saga.Step{{ID: "step-1", SagaID: "saga-1", Name: "step1", Status: saga.StatusPending}},
+	}
+	if err := storage.SaveSaga(ctx, sg); err != nil {
+		t.Fatalf("Failed to save saga: %v", err)
+	}
+
+	expiry := time.Now().Add(time.Hour)
+	claimed, err := storage.ClaimStep(ctx, "step-1", "worker-1", expiry)
+	if err != nil || !claimed {
+		t.Fatalf("Expected the claim to succeed, got %v, %v", claimed, err)
+	}
+	if claimed, _ := storage.ClaimStep(ctx, "step-1", "worker-2", expiry); claimed {
+		t.Error("Expected a second claim to fail")
+	}
+	step, err := storage.GetStep(ctx, "step-1")
+	if err != nil {
+		t.Fatalf("Failed to get step: %v", err)
+	}
+	if step.Status != saga.StatusProcessing || step.ClaimedBy != "worker-1" || step.ClaimExpiry == nil || !step.ClaimExpiry.Equal(expiry) {
+		t.Errorf("Expected the claim to be recorded, got %+v", step)
+	}
+	if stuck, _ := storage.GetStuckSteps(ctx, -time.Second); len(stuck) != 0 {
+		t.Errorf("Expected a live claim not to be stuck, got %+v", stuck)
+	}
+
+	// Updating the step keeps the claim, and an expired one makes it stuck
+	past := time.Now().Add(-time.Second)
+	step.ClaimExpiry = &past
+	if err := storage.UpdateStep(ctx, step); err != nil {
+		t.Fatalf("Failed to update step: %v", err)
+	}
+	stuck, err := storage.GetStuckSteps(ctx, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to get stuck steps: %v", err)
+	}
+	if len(stuck) != 1 || stuck[0].ClaimedBy != "worker-1" {
+		t.Errorf("Expected the step with an expired claim to be stuck, got %+v", stuck)
+	}
+}
+
+func TestSQLiteClaimNextPendingStep(t *testing.T) {
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	sagas := []*saga.Saga{
+		{ID: "running", Status: saga.StatusPending, Steps: []saga.Step{
+			{ID: "first", SagaID: "running", Name: "first", Status: saga.StatusPending},
+			{ID: "second", SagaID: "running", Name: "second", Status: saga.StatusPending, DependsOn: []string{"first"}},
+		}},
+		{ID: "paused", Status: saga.StatusPaused, Steps: []saga.Step{
+			{ID: "held", SagaID: "paused", Name: "held", Status: saga.StatusPending},
+		}},
+	}
+	for _, sg := range sagas {
+		if err := storage.SaveSaga(ctx, sg); err != nil {
+			t.Fatalf("Failed to save saga: %v", err)
+		}
+	}
+
+	step, err := storage.ClaimNextPendingStep(ctx, "worker", time.Time{})
+	if err != nil || step.ID != "first" || step.Status != saga.StatusProcessing || step.ClaimedBy != "worker" {
+		t.Fatalf("Expected the first step to be claimed, got %+v, %v", step, err)
+	}
+	// The second step waits for the first, and paused sagas' steps for ResumeSaga
+	if step, err := storage.ClaimNextPendingStep(ctx, "worker", time.Time{}); !errors.Is(err, saga.ErrStepNotFound) {
+		t.Fatalf("Expected no step to be ready, got %+v, %v", step, err)
+	}
+
+	if _, err := storage.UpdateStepStatus(ctx, "first", saga.StatusProcessing, saga.StatusCompleted); err != nil {
+		t.Fatalf("Failed to complete step: %v", err)
+	}
+	expiry := time.Now().Add(time.Minute)
+	step, err = storage.ClaimNextPendingStep(ctx, "other", expiry)
+	if err != nil || step.ID != "second" || step.ClaimExpiry == nil || !step.ClaimExpiry.Equal(expiry) {
+		t.Fatalf("Expected the second step to be claimed once the first completed, got %+v, %v", step, err)
+	}
+	if sg, _ := storage.GetSaga(ctx, "running"); sg.Steps[1].Status != saga.StatusProcessing {
+		t.Errorf("Expected the claim to show in the saga's steps, got %s", sg.Steps[1].Status)
+	}
+}
+
+func TestSQLiteVersionConflict(t *testing.T) {
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	sg := &saga.Saga{
+		ID:     "saga-1",
+		Status: saga.StatusPending,
+		Steps:  []saga.Step{{ID: "step-1", SagaID: "saga-1", Name: "step1", Status: saga.StatusPending}},
+	}
+	if err := storage.SaveSaga(ctx, sg); err != nil || sg.Version != 1 {
+		t.Fatalf("Expected a new saga at version 1, got %d, %v", sg.Version, err)
+	}
+
+	stale, _ := storage.GetSaga(ctx, "saga-1")
+	sg.Data = map[string]interface{}{"by": "first"}
+	if err := storage.SaveSaga(ctx, sg); err != nil {
+		t.Fatalf("Failed to save saga: %v", err)
+	}
+	stale.Data = map[string]interface{}{"by": "stale"}
+	if err := storage.SaveSaga(ctx, stale); !errors.Is(err, saga.ErrVersionConflict) {
+		t.Errorf("Expected a stale save to conflict, got %v", err)
+	}
+	if got, _ := storage.GetSaga(ctx, "saga-1"); got.Version != 2 || got.Data["by"] != "first" {
+		t.Errorf("Expected the first save to be kept at version 2, got %d, %v", got.Version, got.Data)
+	}
+
+	step, _ := storage.GetStep(ctx, "step-1")
+	if claimed, _ := storage.ClaimStep(ctx, "step-1", "worker-1", time.Time{}); !claimed {
+		t.Fatal("Expected the claim to succeed")
+	}
+	if err := storage.UpdateStep(ctx, step); !errors.Is(err, saga.ErrVersionConflict) {
+		t.Errorf("Expected an update of a step read before its claim to conflict, got %v", err)
+	}
+	step, _ = storage.GetStep(ctx, "step-1")
+	if err := storage.UpdateStep(ctx, step); err != nil || step.Version != 3 {
+		t.Errorf("Expected the update to succeed at version 3, got %d, %v", step.Version, err)
+	}
+}
+
+func TestSQLiteCompleteStep(t *testing.T) {
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	sg := &saga.Saga{
+		ID:     "saga-1",
+		Status: saga.StatusPending,
+		Steps:  []saga.Step{{ID: "step-1", SagaID: "saga-1", Name: "step1", Status: saga.StatusPending}},
+	}
+	if err := storage.SaveSaga(ctx, sg); err != nil {
+		t.Fatalf("Failed to save saga: %v", err)
+	}
+	stale, _ := storage.GetSaga(ctx, "saga-1")
+	if err := storage.SaveSaga(ctx, sg); err != nil {
+		t.Fatalf("Failed to save saga: %v", err)
+	}
+
+	step, _ := storage.GetStep(ctx, "step-1")
+	step.Status = saga.StatusCompleted
+	step.Data = map[string]interface{}{"order_id": "12345"}
+	stale.Data = map[string]interface{}{"order_id": "12345"}
+	if err := storage.CompleteStep(ctx, step, stale); !errors.Is(err, saga.ErrVersionConflict) {
+		t.Errorf("Expected completing with a stale saga to conflict, got %v", err)
+	}
+	if got, _ := storage.GetStep(ctx, "step-1"); got.Status != saga.StatusPending || got.Version != 1 {
+		t.Errorf("Expected the step to be rolled back with the saga, got %s at version %d", got.Status, got.Version)
+	}
+
+	current, _ := storage.GetSaga(ctx, "saga-1")
+	current.Data = map[string]interface{}{"order_id": "12345"}
+	if err := storage.CompleteStep(ctx, step, current); err != nil || step.Version != 2 || current.Version != 3 {
+		t.Fatalf("Expected completing to write both, got step %d and saga %d, %v", step.Version, current.Version, err)
+	}
+	got, _ := storage.GetSaga(ctx, "saga-1")
+	if got.Data["order_id"] != "12345" || got.Steps[0].Status != saga.StatusCompleted || got.Steps[0].Data["order_id"] != "12345" {
+		t.Errorf("Expected the step and saga data to be stored, got %+v", got)
+	}
+}
+
+func TestSQLiteOutbox(t *testing.T) {
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	sg := &saga.Saga{
+		ID:     "saga-1",
+		Status: saga.StatusPending,
+		Steps: []saga.Step{
+			{ID: "step-1", SagaID: "saga-1", Name: "step1", Status: saga.StatusPending},
+			{ID: "step-2", SagaID: "saga-1", Name: "step2", Status: saga.StatusPending, DependsOn: []string{"step1"}},
+		},
+	}
+	if err := storage.SaveSaga(ctx, sg); err != nil {
+		t.Fatalf("Failed to save saga: %v", err)
+	}
+
+	msgs := []saga.OutboxMessage{
+		{ID: "msg-1", Topic: "saga_events", Message: saga.Message{Type: "step_execute", SagaID: "saga-1", StepID: "step-2"}},
+		{ID: "msg-2", Topic: "saga_events", Message: saga.Message{Type: "step_execute", SagaID: "saga-1", StepID: "step-3"}},
+	}
+	step, _ := storage.GetStep(ctx, "step-1")
+	step.Status = saga.StatusCompleted
+	stale := *sg
+	stale.Version = 0
+	if err := storage.CompleteStepWithMessages(ctx, step, &stale, msgs); !errors.Is(err, saga.ErrVersionConflict) {
+		t.Fatalf("Expected a stale saga to conflict, got %v", err)
+	}
+	if pending, _ := storage.PendingMessages(ctx, 0); len(pending) != 0 {
+		t.Errorf("Expected no messages after a conflict, got %+v", pending)
+	}
+
+	if err := storage.CompleteStepWithMessages(ctx, step, sg, msgs); err != nil {
+		t.Fatalf("Failed to complete step: %v", err)
+	}
+	pending, err := storage.PendingMessages(ctx, 1)
+	if err != nil || len(pending) != 1 || pending[0].ID != "msg-1" || pending[0].Message.StepID != "step-2" {
+		t.Fatalf("Expected the oldest message, got %+v, %v", pending, err)
+	}
+
+	if err := storage.DeleteMessages(ctx, []string{"msg-1"}); err != nil {
+		t.Fatalf("Failed to delete messages: %v", err)
+	}
+	pending, _ = storage.PendingMessages(ctx, 0)
+	if len(pending) != 1 || pending[0].ID != "msg-2" {
+		t.Errorf("Expected only the undeleted message, got %+v", pending)
+	}
+
+	step, _ = storage.GetStep(ctx, "step-2")
+	step.Status = saga.StatusProcessing
+	retry := []saga.OutboxMessage{{ID: "msg-3", Topic: "saga_events", Message: saga.Message{Type: "step_execute", SagaID: "saga-1", StepID: "step-2"}}}
+	if err := storage.UpdateStepWithMessages(ctx, step, retry); err != nil {
+		t.Fatalf("Failed to update step: %v", err)
+	}
+	step.Version = 0
+	if err := storage.UpdateStepWithMessages(ctx, step, []saga.OutboxMessage{{ID: "msg-4", Topic: "saga_events"}}); !errors.Is(err, saga.ErrVersionConflict) {
+		t.Fatalf("Expected a stale step to conflict, got %v", err)
+	}
+
+	sg, _ = storage.GetSaga(ctx, "saga-1")
+	sg.Status = saga.StatusCompleted
+	done := []saga.OutboxMessage{{ID: "msg-5", Topic: "saga_done", Message: saga.Message{Type: "saga_completed", SagaID: "saga-1"}}}
+	if err := storage.SaveSagaWithMessages(ctx, sg, done); err != nil {
+		t.Fatalf("Failed to save saga: %v", err)
+	}
+	stale = *sg
+	stale.Version = 0
+	if err := storage.SaveSagaWithMessages(ctx, &stale, []saga.OutboxMessage{{ID: "msg-6", Topic: "saga_done"}}); !errors.Is(err, saga.ErrVersionConflict) {
+		t.Fatalf("Expected a stale saga to conflict, got %v", err)
+	}
+
+	pending, _ = storage.PendingMessages(ctx, 0)
+	var ids []string
+	for _, msg := range pending {
+		ids = append(ids, msg.ID)
+	}
+	if strings.Join(ids, ",") != "msg-2,msg-3,msg-5" {
+		t.Errorf("Expected only the committed messages in order, got %v", ids)
+	}
+}
+
+func TestSQLiteWebhooks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "saga.db")
+	storage, err := NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	ctx := context.Background()
+
+	now := time.Now()
+	later := saga.WebhookDelivery{ID: "hook-2", URL: "http://example.com", Payload: []byte(`{"type":"saga_failed"}`), NextAttempt: now.Add(time.Minute), CreatedAt: now}
+	due := saga.WebhookDelivery{ID: "hook-1", URL: "http://example.com", Payload: []byte(`{"type":"saga_completed"}`), NextAttempt: now, CreatedAt: now}
+	for _, delivery := range []saga.WebhookDelivery{later, due} {
+		if err := storage.SaveWebhook(ctx, delivery); err != nil {
+			t.Fatalf("Failed to save webhook: %v", err)
+		}
+	}
+
+	// Pending deliveries survive a restart
+	storage.Close()
+	storage, err = NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer storage.Close()
+
+	found, err := storage.DueWebhooks(ctx, now, 10)
+	if err != nil || len(found) != 1 || found[0].ID != "hook-1" || string(found[0].Payload) != `{"type":"saga_completed"}` {
+		t.Fatalf("Expected only the due webhook, got %+v, %v", found, err)
+	}
+
+	found[0].Attempts = 1
+	found[0].NextAttempt = now.Add(2 * time.Minute)
+	if err := storage.SaveWebhook(ctx, found[0]); err != nil {
+		t.Fatalf("Failed to reschedule webhook: %v", err)
+	}
+	if err := storage.DeleteWebhook(ctx, "hook-2"); err != nil {
+		t.Fatalf("Failed to delete webhook: %v", err)
+	}
+	found, _ = storage.DueWebhooks(ctx, now.Add(time.Hour), 0)
+	if len(found) != 1 || found[0].ID != "hook-1" || found[0].Attempts != 1 {
+		t.Errorf("Expected the rescheduled webhook, got %+v", found)
+	}
+}
+
+func TestSQLiteFindSagasByTag(t *testing.T) {
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	for i, tags := range []map[string]string{
+		{"order_id": "789"},
+		{"order_id": "789", "customer_id": "c-1"},
+		{"order_id": "790"},
+	} {
+		sg := &saga.Saga{ID: fmt.Sprintf("saga-%d", i+1), Status: saga.StatusPending, Tags: tags, CreatedAt: now.Add(time.Duration(i) * time.Second)}
+		if err := storage.SaveSaga(ctx, sg); err != nil {
+			t.Fatalf("Failed to save saga: %v", err)
+		}
+	}
+
+	found, err := storage.FindSagasByTag(ctx, "order_id", "789")
+	if err != nil {
+		t.Fatalf("Failed to find sagas: %v", err)
+	}
+	if len(found) != 2 || found[0].ID != "saga-2" || found[1].ID != "saga-1" || found[0].Tags["customer_id"] != "c-1" {
+		t.Fatalf("Expected both sagas for the order, newest first, got %+v", found)
+	}
+
+	// Retagging a saga and deleting one update the index
+	sg, _ := storage.GetSaga(ctx, "saga-1")
+	sg.Tags = map[string]string{"order_id": "790"}
+	if err := storage.SaveSaga(ctx, sg); err != nil {
+		t.Fatalf("Failed to save saga: %v", err)
+	}
+	if err := storage.DeleteSaga(ctx, "saga-2"); err != nil {
+		t.Fatalf("Failed to delete saga: %v", err)
+	}
+	if found, _ := storage.FindSagasByTag(ctx, "order_id", "789"); len(found) != 0 {
+		t.Errorf("Expected no sagas left for the order, got %+v", found)
+	}
+	if found, _ := storage.FindSagasByTag(ctx, "order_id", "790"); len(found) != 2 {
+		t.Errorf("Expected two sagas for the other order, got %+v", found)
+	}
+}
+
+func TestSQLiteSaveSagas(t *testing.T) {
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	if err := storage.SaveSaga(ctx, &saga.Saga{ID: "keyed", Status: saga.StatusPending, IdempotencyKey: "order-1"}); err != nil {
+		t.Fatalf("Failed to save saga: %v", err)
+	}
+
+	// Enough steps to take more than one insert
+	var sagas []*saga.Saga
+	for i := 0; i < 300; i++ {
+		id := fmt.Sprintf("saga-%d", i)
+		sagas = append(sagas, &saga.Saga{
+			ID:     id,
+			Name:   "bulk",
+			Status: saga.StatusPending,
+			Tags:   map[string]string{"batch": "nightly"},
+			Steps: []saga.Step{
+				{ID: id + "-1", SagaID: id, Name: "reserve", Status: saga.StatusPending},
+				{ID: id + "-2", SagaID: id, Name: "charge", Status: saga.StatusPending, DependsOn: []string{"reserve"}},
+			},
+		})
+	}
+	sagas[299].IdempotencyKey = "order-1"
+	if err := storage.SaveSagas(ctx, sagas); !errors.Is(err, saga.ErrDuplicateIdempotencyKey) {
+		t.Fatalf("Expected ErrDuplicateIdempotencyKey, got %v", err)
+	}
+	if _, err := storage.GetSaga(ctx, "saga-0"); !errors.Is(err, saga.ErrSagaNotFound) {
+		t.Errorf("Expected no saga of a failed batch to be saved, got %v", err)
+	}
+
+	sagas[299].IdempotencyKey = "order-2"
+	if err := storage.SaveSagas(ctx, sagas); err != nil {
+		t.Fatalf("Failed to save sagas: %v", err)
+	}
+	if sagas[0].Version != 1 {
+		t.Errorf("Expected saved sagas at version 1, got %d", sagas[0].Version)
+	}
+	saved, err := storage.GetSaga(ctx, "saga-250")
+	if err != nil {
+		t.Fatalf("Failed to get saga: %v", err)
+	}
+	if len(saved.Steps) != 2 || saved.Steps[1].Name != "charge" || saved.Steps[1].Version != 1 {
+		t.Errorf("Expected both steps in order, got %+v", saved.Steps)
+	}
+	tagged, err := storage.FindSagasByTag(ctx, "batch", "nightly")
+	if err != nil || len(tagged) != 300 {
+		t.Errorf("Expected 300 tagged sagas, got %d, %v", len(tagged), err)
+	}
+	if err := storage.SaveSagas(ctx, sagas[:1]); !errors.Is(err, saga.ErrVersionConflict) {
+		t.Errorf("Expected saving a saga twice to conflict, got %v", err)
+	}
+}
+
+func TestSQLiteMaxDataSize(t *testing.T) {
+	storage := newTestStorage(t, WithMaxDataSize(100))
+	ctx := context.Background()
+	large := strings.Repeat("x", 200)
+
+	err := storage.SaveSaga(ctx, &saga.Saga{ID: "large", Status: saga.StatusPending, Data: map[string]interface{}{"blob": large}})
+	if !errors.Is(err, saga.ErrDataTooLarge) {
+		t.Errorf("Expected ErrDataTooLarge for oversized saga data, got %v", err)
+	}
+	if _, err := storage.GetSaga(ctx, "large"); !errors.Is(err, saga.ErrSagaNotFound) {
+		t.Errorf("Expected the oversized saga not to be stored, got %v", err)
+	}
+
+	sg := &saga.Saga{ID: "small", Status: saga.StatusPending, Steps: []saga.Step{{ID: "step", SagaID: "small", Name: "a", Status: saga.StatusPending}}}
+	if err := storage.SaveSaga(ctx, sg); err != nil {
+		t.Fatalf("Failed to save saga: %v", err)
+	}
+	step, err := storage.GetStep(ctx, "step")
+	if err != nil {
+		t.Fatalf("Failed to get step: %v", err)
+	}
+	step.Data = map[string]interface{}{"blob": large}
+	if err := storage.UpdateStep(ctx, step); !errors.Is(err, saga.ErrDataTooLarge) {
+		t.Errorf("Expected ErrDataTooLarge for oversized step data, got %v", err)
+	}
+	if err := storage.SaveSagas(ctx, []*saga.Saga{{ID: "batch", Data: map[string]interface{}{"blob": large}}}); !errors.Is(err, saga.ErrDataTooLarge) {
+		t.Errorf("Expected ErrDataTooLarge from SaveSagas, got %v", err)
+	}
+}
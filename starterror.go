@@ -0,0 +1,37 @@
+package saga
+
+import "errors"
+
+var (
+	// ErrInvalidSaga is matched, with errors.Is, by the error for a saga
+	// that can't be started as declared, e.g. because its steps form a
+	// cycle, its data is missing a required key or a step has no handler
+	ErrInvalidSaga = errors.New("invalid saga")
+	// ErrStorageFailure is matched by the error for a saga that wasn't
+	// started because storage failed, e.g. while saving it, so starting it
+	// again may succeed
+	ErrStorageFailure = errors.New("storage failure")
+)
+
+// startError classifies the error for a saga that wasn't started as kind,
+// ErrInvalidSaga or ErrStorageFailure, keeping the error's message and
+// what it wraps
+type startError struct {
+	kind error
+	err  error
+}
+
+func (e startError) Error() string        { return e.err.Error() }
+func (e startError) Unwrap() error        { return e.err }
+func (e startError) Is(target error) bool { return target == e.kind }
+
+// invalidSaga marks err as the reason a saga can't be started as declared
+func invalidSaga(err error) error {
+	return startError{kind: ErrInvalidSaga, err: err}
+}
+
+// storageFailure marks err as the storage failure that kept a saga from
+// being started
+func storageFailure(err error) error {
+	return startError{kind: ErrStorageFailure, err: err}
+}
@@ -0,0 +1,63 @@
+package saga
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// StepContext describes the step a handler is serving. It is available in
+// the handler's context through StepFromContext, so one handler function
+// can be shared between steps and still tell them apart.
+type StepContext struct {
+	SagaID   string
+	SagaName string
+	StepID   string
+	StepName string
+	// Attempt is 1 the first time a step executes and grows each time it
+	// is run again, e.g. after recovery re-delivers it
+	Attempt int
+	// IsCompensating is true while the handler's Compensate runs
+	IsCompensating bool
+	// IdempotencyToken identifies the step's side effect to downstream
+	// APIs that dedupe requests, such as a payment provider. It is derived
+	// from the saga and step IDs, so it is the same on every attempt of the
+	// step, including after RetrySaga, and differs between Execute and
+	// Compensate.
+	IdempotencyToken string
+}
+
+type stepContextKey struct{}
+
+// StepFromContext returns the step a handler is serving. It reports false
+// outside of a step handler.
+func StepFromContext(ctx context.Context) (StepContext, bool) {
+	sc, ok := ctx.Value(stepContextKey{}).(StepContext)
+	return sc, ok
+}
+
+// handlerContext returns the context a step's handler runs with, carrying
+// the saga's metadata and the step's StepContext
+func handlerContext(ctx context.Context, saga *Saga, step *Step, compensating bool) context.Context {
+	ctx = withSagaMetadata(ctx, saga.Metadata)
+	return context.WithValue(ctx, stepContextKey{}, StepContext{
+		SagaID:           saga.ID,
+		SagaName:         saga.Name,
+		StepID:           step.ID,
+		StepName:         step.Name,
+		Attempt:          step.Attempts,
+		IsCompensating:   compensating,
+		IdempotencyToken: idempotencyToken(saga.ID, step.ID, compensating),
+	})
+}
+
+// idempotencyToken hashes the step's identity so the token doesn't expose
+// saga and step IDs and has a fixed length whatever the ID format
+func idempotencyToken(sagaID, stepID string, compensating bool) string {
+	phase := "execute"
+	if compensating {
+		phase = "compensate"
+	}
+	sum := sha256.Sum256([]byte(sagaID + "/" + stepID + "/" + phase))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,41 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrStopSaga is returned by a step handler to end its saga early with
+// success, e.g. when an order turns out to be fulfilled already. The step
+// completes with its data merged as usual, the steps that haven't started
+// are skipped, and the saga completes once any steps still running have
+// finished. Nothing is compensated. It may be wrapped.
+var ErrStopSaga = errors.New("stop saga")
+
+// skipRemaining marks every pending step of stopped's saga skipped, so no
+// step starts after stopped asked the saga to stop. Steps another worker
+// has claimed in the meantime are left to finish. The caller must hold the
+// saga's lock.
+func (o *Orchestrator) skipRemaining(ctx context.Context, stopped *Step) error {
+	saga, err := o.storage.GetSaga(ctx, stopped.SagaID)
+	if err != nil {
+		return fmt.Errorf("failed to get saga: %w", err)
+	}
+
+	for _, step := range saga.Steps {
+		if step.Status != StatusPending || step.ID == stopped.ID {
+			continue
+		}
+		skipped, err := o.storage.UpdateStepStatus(ctx, step.ID, StatusPending, StatusSkipped)
+		if err != nil {
+			return fmt.Errorf("failed to mark step as skipped: %w", err)
+		}
+		if skipped {
+			o.recordEvent(ctx, SagaEvent{SagaID: saga.ID, StepID: step.ID, FromStatus: StatusPending, ToStatus: StatusSkipped})
+		}
+	}
+	o.logger.Info("Step stopped saga, skipping remaining steps",
+		"saga_id", stopped.SagaID, "step_id", stopped.ID, "step", stopped.Name)
+	return nil
+}
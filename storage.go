@@ -2,45 +2,153 @@ package saga
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 )
 
-// MemoryStorage implements Storage interface using in-memory maps
+// Errors returned by storage implementations for missing records. Custom
+// backends should return them, possibly wrapped, so callers can tell a
+// missing saga apart from a failed lookup.
+var (
+	ErrSagaNotFound = errors.New("saga not found")
+	ErrStepNotFound = errors.New("step not found")
+	// ErrDuplicateIdempotencyKey is returned by SaveSaga when another saga
+	// already has the saga's idempotency key
+	ErrDuplicateIdempotencyKey = errors.New("duplicate idempotency key")
+	// ErrVersionConflict is returned by SaveSaga and UpdateStep when the
+	// record was written since the caller read it
+	ErrVersionConflict = errors.New("version conflict")
+)
+
+// MemoryStorage implements Storage interface using in-memory maps.
+// Sagas and steps are stored as copies, so callers never share maps with
+// the stored state and must persist changes through SaveSaga/UpdateStep.
 type MemoryStorage struct {
 	mu    sync.RWMutex
 	sagas map[string]*Saga
 	steps map[string]*Step
+	// Saga IDs by idempotency key
+	keys map[string]string
+	// Messages recorded with the *WithMessages methods, oldest first
+	outbox []OutboxMessage
+	// Deliveries saved by a WebhookNotifier, by ID
+	webhooks map[string]WebhookDelivery
+	now      func() time.Time
+	// See WithMemoryMaxDataSize; zero means unlimited
+	maxDataSize int
 }
 
-func NewMemoryStorage() *MemoryStorage {
-	return &MemoryStorage{
-		sagas: make(map[string]*Saga),
-		steps: make(map[string]*Step),
+// MemoryStorageOption configures a MemoryStorage
+type MemoryStorageOption func(*MemoryStorage)
+
+// WithMemoryClock sets the function the storage reads the current time from
+// for CreatedAt and UpdatedAt and to find stuck steps and compensations,
+// e.g. the fake clock passed to WithClock in tests. The default is
+// time.Now.
+func WithMemoryClock(now func() time.Time) MemoryStorageOption {
+	return func(m *MemoryStorage) {
+		m.now = now
 	}
 }
 
+func NewMemoryStorage(opts ...MemoryStorageOption) *MemoryStorage {
+	m := &MemoryStorage{
+		sagas:    make(map[string]*Saga),
+		steps:    make(map[string]*Step),
+		keys:     make(map[string]string),
+		webhooks: make(map[string]WebhookDelivery),
+		now:      time.Now,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
 func (m *MemoryStorage) SaveSaga(ctx context.Context, saga *Saga) error {
+	if err := CheckDataSize(m.maxDataSize, saga); err != nil {
+		return err
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	saga.UpdatedAt = time.Now()
+	if existing, exists := m.sagas[saga.ID]; exists && existing.Version != saga.Version {
+		return ErrVersionConflict
+	}
+	return m.saveSaga(saga)
+}
+
+// SaveSagas saves new sagas under a single lock, checking all of them
+// before saving any
+func (m *MemoryStorage) SaveSagas(ctx context.Context, sagas []*Saga) error {
+	for _, saga := range sagas {
+		if err := CheckDataSize(m.maxDataSize, saga); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make(map[string]bool)
+	for _, saga := range sagas {
+		if _, exists := m.sagas[saga.ID]; exists || saga.Version != 0 {
+			return ErrVersionConflict
+		}
+		if saga.IdempotencyKey == "" {
+			continue
+		}
+		if _, exists := m.keys[saga.IdempotencyKey]; exists || keys[saga.IdempotencyKey] {
+			return ErrDuplicateIdempotencyKey
+		}
+		keys[saga.IdempotencyKey] = true
+	}
+	for _, saga := range sagas {
+		if err := m.saveSaga(saga); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveSaga stores a saga whose version has been checked. The caller must
+// hold m.mu.
+func (m *MemoryStorage) saveSaga(saga *Saga) error {
+	if saga.IdempotencyKey != "" {
+		if id, exists := m.keys[saga.IdempotencyKey]; exists && id != saga.ID {
+			return ErrDuplicateIdempotencyKey
+		}
+		m.keys[saga.IdempotencyKey] = saga.ID
+	}
+
+	saga.Version++
+	saga.UpdatedAt = m.now()
 	if saga.CreatedAt.IsZero() {
-		saga.CreatedAt = time.Now()
+		saga.CreatedAt = m.now()
 	}
 
-	m.sagas[saga.ID] = saga
+	stored := copySaga(saga)
+	for i := range stored.Steps {
+		// Existing steps only change through UpdateStep/UpdateStepStatus, so a
+		// stale snapshot can't undo a status change made concurrently
+		if existing, exists := m.steps[stored.Steps[i].ID]; exists {
+			stored.Steps[i] = *copyStep(existing)
+			continue
+		}
 
-	// Also save steps
-	for i := range saga.Steps {
-		step := &saga.Steps[i]
+		// Also save new steps
+		step := &stored.Steps[i]
 		if step.CreatedAt.IsZero() {
-			step.CreatedAt = time.Now()
+			step.CreatedAt = m.now()
 		}
-		step.UpdatedAt = time.Now()
-		m.steps[step.ID] = step
+		step.Version = 1
+		step.UpdatedAt = m.now()
+		m.steps[step.ID] = copyStep(step)
 	}
+	m.sagas[saga.ID] = stored
 
 	return nil
 }
@@ -51,43 +159,366 @@ func (m *MemoryStorage) GetSaga(ctx context.Context, id string) (*Saga, error) {
 
 	saga, exists := m.sagas[id]
 	if !exists {
-		return nil, errors.New("saga not found")
+		return nil, ErrSagaNotFound
+	}
+
+	return copySaga(saga), nil
+}
+
+func (m *MemoryStorage) GetSagaByKey(ctx context.Context, key string) (*Saga, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	id, exists := m.keys[key]
+	if !exists {
+		return nil, ErrSagaNotFound
 	}
+	return copySaga(m.sagas[id]), nil
+}
+
+func (m *MemoryStorage) ListSagas(ctx context.Context, filter SagaFilter) ([]Saga, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-	return saga, nil
+	var sagas []Saga
+	for _, saga := range m.sagas {
+		if (filter.Name == "" || saga.Name == filter.Name) && (filter.Status == "" || saga.Status == filter.Status) {
+			sagas = append(sagas, *copySaga(saga))
+		}
+	}
+
+	sortNewestFirst(sagas)
+	if filter.Limit > 0 && len(sagas) > filter.Limit {
+		sagas = sagas[:filter.Limit]
+	}
+	return sagas, nil
+}
+
+func (m *MemoryStorage) FindSagasByTag(ctx context.Context, key, value string) ([]Saga, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var sagas []Saga
+	for _, saga := range m.sagas {
+		if v, exists := saga.Tags[key]; exists && v == value {
+			sagas = append(sagas, *copySaga(saga))
+		}
+	}
+
+	sortNewestFirst(sagas)
+	return sagas, nil
 }
 
 func (m *MemoryStorage) UpdateStep(ctx context.Context, step *Step) error {
+	if err := CheckDataSize(m.maxDataSize, nil, step); err != nil {
+		return err
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	step.UpdatedAt = time.Now()
-	m.steps[step.ID] = step
+	if existing, exists := m.steps[step.ID]; exists && existing.Version != step.Version {
+		return ErrVersionConflict
+	}
+	m.updateStep(step)
+	return nil
+}
+
+// updateStep stores a step whose version has been checked. The caller must
+// hold m.mu.
+func (m *MemoryStorage) updateStep(step *Step) {
+	step.Version++
+	step.UpdatedAt = m.now()
+	m.steps[step.ID] = copyStep(step)
 
 	// Update step in saga
 	if saga, exists := m.sagas[step.SagaID]; exists {
 		for i := range saga.Steps {
 			if saga.Steps[i].ID == step.ID {
-				saga.Steps[i] = *step
+				saga.Steps[i] = *copyStep(step)
 				break
 			}
 		}
-		saga.UpdatedAt = time.Now()
+		saga.UpdatedAt = m.now()
+	}
+}
+
+func (m *MemoryStorage) CompleteStep(ctx context.Context, step *Step, saga *Saga) error {
+	if err := CheckDataSize(m.maxDataSize, saga, step); err != nil {
+		return err
 	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.completeStep(step, saga)
+}
 
+// completeStep checks and writes a step with its saga. The caller must hold
+// m.mu.
+func (m *MemoryStorage) completeStep(step *Step, saga *Saga) error {
+	existingStep, exists := m.steps[step.ID]
+	if !exists {
+		return ErrStepNotFound
+	}
+	existingSaga, exists := m.sagas[saga.ID]
+	if !exists {
+		return ErrSagaNotFound
+	}
+	if existingStep.Version != step.Version || existingSaga.Version != saga.Version {
+		return ErrVersionConflict
+	}
+	if id, exists := m.keys[saga.IdempotencyKey]; saga.IdempotencyKey != "" && exists && id != saga.ID {
+		return ErrDuplicateIdempotencyKey
+	}
+
+	m.updateStep(step)
+	return m.saveSaga(saga)
+}
+
+func (m *MemoryStorage) SaveSagaWithMessages(ctx context.Context, saga *Saga, msgs []OutboxMessage) error {
+	if err := CheckDataSize(m.maxDataSize, saga); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existing, exists := m.sagas[saga.ID]; exists && existing.Version != saga.Version {
+		return ErrVersionConflict
+	}
+	if err := m.saveSaga(saga); err != nil {
+		return err
+	}
+	m.addMessages(msgs)
 	return nil
 }
 
+func (m *MemoryStorage) UpdateStepWithMessages(ctx context.Context, step *Step, msgs []OutboxMessage) error {
+	if err := CheckDataSize(m.maxDataSize, nil, step); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existing, exists := m.steps[step.ID]; exists && existing.Version != step.Version {
+		return ErrVersionConflict
+	}
+	m.updateStep(step)
+	m.addMessages(msgs)
+	return nil
+}
+
+func (m *MemoryStorage) CompleteStepWithMessages(ctx context.Context, step *Step, saga *Saga, msgs []OutboxMessage) error {
+	if err := CheckDataSize(m.maxDataSize, saga, step); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.completeStep(step, saga); err != nil {
+		return err
+	}
+	m.addMessages(msgs)
+	return nil
+}
+
+// addMessages appends msgs to the outbox. The caller must hold m.mu.
+func (m *MemoryStorage) addMessages(msgs []OutboxMessage) {
+	for _, msg := range msgs {
+		msg.Message.Data = deepCopyData(msg.Message.Data)
+		m.outbox = append(m.outbox, msg)
+	}
+}
+
+func (m *MemoryStorage) PendingMessages(ctx context.Context, limit int) ([]OutboxMessage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if limit <= 0 || limit > len(m.outbox) {
+		limit = len(m.outbox)
+	}
+	msgs := make([]OutboxMessage, limit)
+	copy(msgs, m.outbox)
+	return msgs, nil
+}
+
+func (m *MemoryStorage) DeleteMessages(ctx context.Context, ids []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	remaining := m.outbox[:0]
+	for _, msg := range m.outbox {
+		if !containsString(ids, msg.ID) {
+			remaining = append(remaining, msg)
+		}
+	}
+	m.outbox = remaining
+	return nil
+}
+
+func (m *MemoryStorage) SaveWebhook(ctx context.Context, delivery WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delivery.Payload = append(json.RawMessage(nil), delivery.Payload...)
+	m.webhooks[delivery.ID] = delivery
+	return nil
+}
+
+func (m *MemoryStorage) DueWebhooks(ctx context.Context, now time.Time, limit int) ([]WebhookDelivery, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var due []WebhookDelivery
+	for _, delivery := range m.webhooks {
+		if !delivery.NextAttempt.After(now) {
+			delivery.Payload = append(json.RawMessage(nil), delivery.Payload...)
+			due = append(due, delivery)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextAttempt.Equal(due[j].NextAttempt) {
+			return due[i].NextAttempt.Before(due[j].NextAttempt)
+		}
+		return due[i].ID < due[j].ID
+	})
+	if limit > 0 && len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+func (m *MemoryStorage) DeleteWebhook(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.webhooks, id)
+	return nil
+}
+
+func (m *MemoryStorage) UpdateStepStatus(ctx context.Context, id string, from, to Status) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	step, exists := m.steps[id]
+	if !exists {
+		return false, ErrStepNotFound
+	}
+
+	if step.Status != from {
+		return false, nil
+	}
+
+	step.Status = to
+	m.touchStep(step)
+	return true, nil
+}
+
+func (m *MemoryStorage) ClaimStep(ctx context.Context, id, owner string, expiry time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	step, exists := m.steps[id]
+	if !exists {
+		return false, ErrStepNotFound
+	}
+
+	if step.Status != StatusPending {
+		return false, nil
+	}
+
+	m.claim(step, owner, expiry)
+	return true, nil
+}
+
+func (m *MemoryStorage) ClaimNextPendingStep(ctx context.Context, owner string, expiry time.Time) (*Step, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var next *Step
+	for _, step := range m.steps {
+		saga, exists := m.sagas[step.SagaID]
+		if !exists || !StepReady(saga, step) {
+			continue
+		}
+		if next == nil || step.UpdatedAt.Before(next.UpdatedAt) ||
+			step.UpdatedAt.Equal(next.UpdatedAt) && step.ID < next.ID {
+			next = step
+		}
+	}
+	if next == nil {
+		return nil, ErrStepNotFound
+	}
+
+	m.claim(next, owner, expiry)
+	return copyStep(next), nil
+}
+
+// claim moves a pending step to processing for owner. The caller must hold
+// the write lock.
+func (m *MemoryStorage) claim(step *Step, owner string, expiry time.Time) {
+	step.Status = StatusProcessing
+	step.ClaimedBy = owner
+	step.ClaimExpiry = nil
+	if !expiry.IsZero() {
+		step.ClaimExpiry = &expiry
+	}
+	m.touchStep(step)
+}
+
+// touchStep marks a step changed in place as updated, in its saga's copy as
+// well. The caller must hold the write lock.
+func (m *MemoryStorage) touchStep(step *Step) {
+	step.Version++
+	step.UpdatedAt = m.now()
+
+	if saga, exists := m.sagas[step.SagaID]; exists {
+		for i := range saga.Steps {
+			if saga.Steps[i].ID == step.ID {
+				saga.Steps[i] = *copyStep(step)
+				break
+			}
+		}
+		saga.UpdatedAt = m.now()
+	}
+}
+
 func (m *MemoryStorage) GetStep(ctx context.Context, id string) (*Step, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	step, exists := m.steps[id]
 	if !exists {
-		return nil, errors.New("step not found")
+		return nil, ErrStepNotFound
+	}
+
+	return copyStep(step), nil
+}
+
+func (m *MemoryStorage) GetStepsBySaga(ctx context.Context, sagaID string) ([]Step, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var steps []Step
+	for _, step := range m.steps {
+		if step.SagaID == sagaID {
+			steps = append(steps, *copyStep(step))
+		}
+	}
+
+	// Steps created together fall back to their order in the saga
+	position := make(map[string]int)
+	if saga, exists := m.sagas[sagaID]; exists {
+		for i, step := range saga.Steps {
+			position[step.ID] = i
+		}
 	}
+	sort.Slice(steps, func(i, j int) bool {
+		if !steps[i].CreatedAt.Equal(steps[j].CreatedAt) {
+			return steps[i].CreatedAt.Before(steps[j].CreatedAt)
+		}
+		return position[steps[i].ID] < position[steps[j].ID]
+	})
 
-	return step, nil
+	return steps, nil
 }
 
 func (m *MemoryStorage) GetPendingSteps(ctx context.Context) ([]Step, error) {
@@ -97,7 +528,7 @@ func (m *MemoryStorage) GetPendingSteps(ctx context.Context) ([]Step, error) {
 	var pending []Step
 	for _, step := range m.steps {
 		if step.Status == StatusPending {
-			pending = append(pending, *step)
+			pending = append(pending, *copyStep(step))
 		}
 	}
 
@@ -109,22 +540,200 @@ func (m *MemoryStorage) GetStuckSteps(ctx context.Context, timeout time.Duration
 	defer m.mu.RUnlock()
 
 	var stuck []Step
-	now := time.Now()
+	now := m.now()
 
 	for _, step := range m.steps {
+		// Steps of finished or failed sagas are never going to run, and
+		// those of paused sagas wait for ResumeSaga
+		if saga, exists := m.sagas[step.SagaID]; exists && saga.Status != StatusPending {
+			continue
+		}
+
 		switch step.Status {
 		case StatusPending:
 			// Step never started processing
 			if now.Sub(step.UpdatedAt) > timeout {
-				stuck = append(stuck, *step)
+				stuck = append(stuck, *copyStep(step))
 			}
 		case StatusProcessing:
+			// A live claim means its worker is still on it
+			if step.ClaimExpiry != nil {
+				if now.After(*step.ClaimExpiry) {
+					stuck = append(stuck, *copyStep(step))
+				}
+				continue
+			}
+
 			// Step started but may have crashed
-			if step.StartedAt != nil && now.Sub(*step.StartedAt) > timeout {
-				stuck = append(stuck, *step)
+			startedAt := step.UpdatedAt
+			if step.StartedAt != nil {
+				startedAt = *step.StartedAt
+			}
+			if now.Sub(startedAt) > timeout {
+				stuck = append(stuck, *copyStep(step))
 			}
 		}
 	}
 
 	return stuck, nil
 }
+
+func (m *MemoryStorage) GetExpiredSagas(ctx context.Context, now time.Time) ([]Saga, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var expired []Saga
+	for _, saga := range m.sagas {
+		if saga.Status == StatusPending && saga.Deadline != nil && now.After(*saga.Deadline) {
+			expired = append(expired, *copySaga(saga))
+		}
+	}
+
+	return expired, nil
+}
+
+func (m *MemoryStorage) GetStuckCompensations(ctx context.Context, timeout time.Duration) ([]Saga, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var stuck []Saga
+	now := m.now()
+	for _, saga := range m.sagas {
+		if saga.Status == StatusCompensating && now.Sub(saga.UpdatedAt) > timeout {
+			stuck = append(stuck, *copySaga(saga))
+		}
+	}
+
+	return stuck, nil
+}
+
+func (m *MemoryStorage) DeleteSaga(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteSaga(id)
+	return nil
+}
+
+func (m *MemoryStorage) PurgeCompletedBefore(ctx context.Context, before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	purged := 0
+	for id, saga := range m.sagas {
+		if isTerminal(saga.Status) && saga.UpdatedAt.Before(before) {
+			m.deleteSaga(id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// deleteSaga removes a saga with its steps and idempotency key. The caller
+// must hold the write lock.
+func (m *MemoryStorage) deleteSaga(id string) {
+	saga, exists := m.sagas[id]
+	if !exists {
+		return
+	}
+	for _, step := range saga.Steps {
+		delete(m.steps, step.ID)
+	}
+	if saga.IdempotencyKey != "" {
+		delete(m.keys, saga.IdempotencyKey)
+	}
+	delete(m.sagas, id)
+}
+
+// sortNewestFirst orders sagas by creation, newest first, falling back to
+// their IDs
+func sortNewestFirst(sagas []Saga) {
+	sort.Slice(sagas, func(i, j int) bool {
+		if !sagas[i].CreatedAt.Equal(sagas[j].CreatedAt) {
+			return sagas[i].CreatedAt.After(sagas[j].CreatedAt)
+		}
+		return sagas[i].ID < sagas[j].ID
+	})
+}
+
+// copySaga returns a deep copy of saga, sharing nothing with it that a
+// change through one could reach the other with
+func copySaga(saga *Saga) *Saga {
+	c := *saga
+	c.Data = deepCopyData(saga.Data)
+	c.Metadata = copyMetadata(saga.Metadata)
+	c.Tags = copyMetadata(saga.Tags)
+	c.Deadline = copyTime(saga.Deadline)
+	c.FinishedAt = copyTime(saga.FinishedAt)
+	c.Steps = make([]Step, len(saga.Steps))
+	for i := range saga.Steps {
+		c.Steps[i] = *copyStep(&saga.Steps[i])
+	}
+	return &c
+}
+
+// copyStep returns a deep copy of step
+func copyStep(step *Step) *Step {
+	c := *step
+	c.Data = deepCopyData(step.Data)
+	c.InputData = deepCopyData(step.InputData)
+	c.OutputData = deepCopyData(step.OutputData)
+	c.DependsOn = slices.Clone(step.DependsOn)
+	c.ChildSagaIDs = slices.Clone(step.ChildSagaIDs)
+	c.ClaimExpiry = copyTime(step.ClaimExpiry)
+	c.StartedAt = copyTime(step.StartedAt)
+	c.CompletedAt = copyTime(step.CompletedAt)
+	if step.Failure != nil {
+		failure := *step.Failure
+		failure.Chain = slices.Clone(step.Failure.Chain)
+		c.Failure = &failure
+	}
+	return &c
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+func copyData(data map[string]interface{}) map[string]interface{} {
+	if data == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		c[k] = v
+	}
+	return c
+}
+
+// deepCopyData copies data along with the maps and slices nested in it, so
+// changes made through either never reach the other
+func deepCopyData(data map[string]interface{}) map[string]interface{} {
+	if data == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		c[k] = deepCopyValue(v)
+	}
+	return c
+}
+
+func deepCopyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return deepCopyData(v)
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = deepCopyValue(e)
+		}
+		return c
+	default:
+		return v
+	}
+}
@@ -0,0 +1,343 @@
+// Package storagetest checks that a saga.Storage implementation behaves as
+// the orchestrator and recovery manager expect, so every backend is held to
+// the same contract. Call Run from a backend's tests.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	saga "github.com/andrewnguyen41/saga-go"
+)
+
+// Run runs the conformance tests against storage from newStorage, which is
+// called once per test and should return an empty storage, cleaning it up
+// with t.Cleanup.
+func Run(t *testing.T, newStorage func(t *testing.T) saga.Storage) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, storage saga.Storage)
+	}{
+		{"SaveAndGet", testSaveAndGet},
+		{"VersionConflicts", testVersionConflicts},
+		{"IdempotencyKeys", testIdempotencyKeys},
+		{"CompleteStep", testCompleteStep},
+		{"StatusTransitions", testStatusTransitions},
+		{"ClaimNextPendingStep", testClaimNextPendingStep},
+		{"StuckSteps", testStuckSteps},
+		{"ListAndFind", testListAndFind},
+		{"DeleteAndPurge", testDeleteAndPurge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStorage(t))
+		})
+	}
+}
+
+// newSaga returns a running saga with a step per name, which depend on
+// each other in order
+func newSaga(id string, names ...string) *saga.Saga {
+	now := time.Now()
+	sg := &saga.Saga{
+		ID:        id,
+		Name:      "conformance",
+		Status:    saga.StatusPending,
+		Data:      map[string]interface{}{"order_id": "order-" + id},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	for i, name := range names {
+		step := saga.Step{
+			ID:        fmt.Sprintf("%s-%s", id, name),
+			SagaID:    id,
+			Name:      name,
+			Status:    saga.StatusPending,
+			CreatedAt: now.Add(time.Duration(i) * time.Millisecond),
+			UpdatedAt: now,
+		}
+		if i > 0 {
+			step.DependsOn = []string{fmt.Sprintf("%s-%s", id, names[i-1])}
+		}
+		sg.Steps = append(sg.Steps, step)
+	}
+	return sg
+}
+
+func save(t *testing.T, storage saga.Storage, sg *saga.Saga) {
+	t.Helper()
+	if err := storage.SaveSaga(context.Background(), sg); err != nil {
+		t.Fatalf("Failed to save saga %s: %v", sg.ID, err)
+	}
+}
+
+func getStep(t *testing.T, storage saga.Storage, id string) *saga.Step {
+	t.Helper()
+	step, err := storage.GetStep(context.Background(), id)
+	if err != nil {
+		t.Fatalf("Failed to get step %s: %v", id, err)
+	}
+	return step
+}
+
+func testSaveAndGet(t *testing.T, storage saga.Storage) {
+	ctx := context.Background()
+	sg := newSaga("saga-1", "reserve", "charge")
+	save(t, storage, sg)
+	if sg.Version != 1 {
+		t.Errorf("Expected SaveSaga to bump the version to 1, got %d", sg.Version)
+	}
+
+	stored, err := storage.GetSaga(ctx, "saga-1")
+	if err != nil {
+		t.Fatalf("Failed to get saga: %v", err)
+	}
+	if stored.Name != "conformance" || stored.Status != saga.StatusPending || stored.Data["order_id"] != "order-saga-1" {
+		t.Errorf("Expected the saga as saved, got %+v", stored)
+	}
+	if len(stored.Steps) != 2 || stored.Steps[0].Name != "reserve" || stored.Steps[1].Name != "charge" {
+		t.Fatalf("Expected both steps in order, got %+v", stored.Steps)
+	}
+
+	steps, err := storage.GetStepsBySaga(ctx, "saga-1")
+	if err != nil {
+		t.Fatalf("Failed to get steps: %v", err)
+	}
+	if len(steps) != 2 || steps[0].ID != "saga-1-reserve" || steps[1].ID != "saga-1-charge" {
+		t.Errorf("Expected the steps in creation order, got %+v", steps)
+	}
+	if step := getStep(t, storage, "saga-1-charge"); len(step.DependsOn) != 1 || step.DependsOn[0] != "saga-1-reserve" {
+		t.Errorf("Expected the step's dependencies to be stored, got %v", step.DependsOn)
+	}
+
+	if _, err := storage.GetSaga(ctx, "missing"); !errors.Is(err, saga.ErrSagaNotFound) {
+		t.Errorf("Expected ErrSagaNotFound, got %v", err)
+	}
+	if _, err := storage.GetStep(ctx, "missing"); !errors.Is(err, saga.ErrStepNotFound) {
+		t.Errorf("Expected ErrStepNotFound, got %v", err)
+	}
+}
+
+func testVersionConflicts(t *testing.T, storage saga.Storage) {
+	ctx := context.Background()
+	sg := newSaga("saga-1", "reserve")
+	save(t, storage, sg)
+
+	stale := *sg
+	sg.Data = map[string]interface{}{"order_id": "changed"}
+	save(t, storage, sg)
+	if err := storage.SaveSaga(ctx, &stale); !errors.Is(err, saga.ErrVersionConflict) {
+		t.Errorf("Expected a stale saga to conflict, got %v", err)
+	}
+
+	step := getStep(t, storage, "saga-1-reserve")
+	staleStep := *step
+	step.Error = "first"
+	if err := storage.UpdateStep(ctx, step); err != nil {
+		t.Fatalf("Failed to update step: %v", err)
+	}
+	if step.Version != staleStep.Version+1 {
+		t.Errorf("Expected UpdateStep to bump the version, got %d after %d", step.Version, staleStep.Version)
+	}
+	staleStep.Error = "second"
+	if err := storage.UpdateStep(ctx, &staleStep); !errors.Is(err, saga.ErrVersionConflict) {
+		t.Errorf("Expected a stale step to conflict, got %v", err)
+	}
+	if stored := getStep(t, storage, "saga-1-reserve"); stored.Error != "first" {
+		t.Errorf("Expected the conflicting write to be dropped, got %q", stored.Error)
+	}
+}
+
+func testIdempotencyKeys(t *testing.T, storage saga.Storage) {
+	ctx := context.Background()
+	first := newSaga("saga-1", "reserve")
+	first.IdempotencyKey = "order-42"
+	save(t, storage, first)
+
+	second := newSaga("saga-2", "reserve")
+	second.IdempotencyKey = "order-42"
+	if err := storage.SaveSaga(ctx, second); !errors.Is(err, saga.ErrDuplicateIdempotencyKey) {
+		t.Errorf("Expected a reused key to be rejected, got %v", err)
+	}
+
+	stored, err := storage.GetSagaByKey(ctx, "order-42")
+	if err != nil || stored.ID != "saga-1" {
+		t.Errorf("Expected the key to find saga-1, got %v, %v", stored, err)
+	}
+	if _, err := storage.GetSagaByKey(ctx, "missing"); !errors.Is(err, saga.ErrSagaNotFound) {
+		t.Errorf("Expected ErrSagaNotFound for an unknown key, got %v", err)
+	}
+}
+
+func testCompleteStep(t *testing.T, storage saga.Storage) {
+	ctx := context.Background()
+	sg := newSaga("saga-1", "reserve")
+	save(t, storage, sg)
+
+	step := getStep(t, storage, "saga-1-reserve")
+	step.Status = saga.StatusCompleted
+	stale := *sg
+	stale.Version--
+	stale.Status = saga.StatusCompleted
+	if err := storage.CompleteStep(ctx, step, &stale); !errors.Is(err, saga.ErrVersionConflict) {
+		t.Fatalf("Expected a stale saga to conflict, got %v", err)
+	}
+	if stored := getStep(t, storage, "saga-1-reserve"); stored.Status != saga.StatusPending {
+		t.Errorf("Expected a conflicting CompleteStep to write neither, got step %s", stored.Status)
+	}
+
+	step = getStep(t, storage, "saga-1-reserve")
+	step.Status = saga.StatusCompleted
+	sg.Status = saga.StatusCompleted
+	if err := storage.CompleteStep(ctx, step, sg); err != nil {
+		t.Fatalf("Failed to complete step: %v", err)
+	}
+	stored, _ := storage.GetSaga(ctx, "saga-1")
+	if stored.Status != saga.StatusCompleted || stored.Steps[0].Status != saga.StatusCompleted {
+		t.Errorf("Expected both the step and saga completed, got %s and %s", stored.Steps[0].Status, stored.Status)
+	}
+}
+
+func testStatusTransitions(t *testing.T, storage saga.Storage) {
+	ctx := context.Background()
+	save(t, storage, newSaga("saga-1", "reserve", "charge"))
+
+	if moved, err := storage.UpdateStepStatus(ctx, "saga-1-reserve", saga.StatusProcessing, saga.StatusCompleted); err != nil || moved {
+		t.Errorf("Expected a step in another status to stay put, got %v, %v", moved, err)
+	}
+	if moved, err := storage.UpdateStepStatus(ctx, "saga-1-reserve", saga.StatusPending, saga.StatusSkipped); err != nil || !moved {
+		t.Errorf("Expected the step to move, got %v, %v", moved, err)
+	}
+	if step := getStep(t, storage, "saga-1-reserve"); step.Status != saga.StatusSkipped {
+		t.Errorf("Expected the step skipped, got %s", step.Status)
+	}
+
+	expiry := time.Now().Add(time.Minute)
+	if claimed, err := storage.ClaimStep(ctx, "saga-1-charge", "worker-1", expiry); err != nil || !claimed {
+		t.Fatalf("Expected to claim the pending step, got %v, %v", claimed, err)
+	}
+	if claimed, _ := storage.ClaimStep(ctx, "saga-1-charge", "worker-2", expiry); claimed {
+		t.Error("Expected a claimed step not to be claimed again")
+	}
+	step := getStep(t, storage, "saga-1-charge")
+	if step.Status != saga.StatusProcessing || step.ClaimedBy != "worker-1" || step.ClaimExpiry == nil {
+		t.Errorf("Expected the step claimed by worker-1, got %+v", step)
+	}
+}
+
+func testClaimNextPendingStep(t *testing.T, storage saga.Storage) {
+	ctx := context.Background()
+	save(t, storage, newSaga("saga-1", "reserve", "charge"))
+
+	step, err := storage.ClaimNextPendingStep(ctx, "worker-1", time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to claim a step: %v", err)
+	}
+	if step.ID != "saga-1-reserve" || step.Status != saga.StatusProcessing || step.ClaimedBy != "worker-1" {
+		t.Errorf("Expected the first step claimed, got %+v", step)
+	}
+
+	// The second step waits for the first
+	if step, err := storage.ClaimNextPendingStep(ctx, "worker-2", time.Time{}); !errors.Is(err, saga.ErrStepNotFound) {
+		t.Errorf("Expected no step ready, got %+v, %v", step, err)
+	}
+}
+
+func testStuckSteps(t *testing.T, storage saga.Storage) {
+	ctx := context.Background()
+	save(t, storage, newSaga("running", "reserve"))
+	paused := newSaga("paused", "reserve")
+	paused.Status = saga.StatusPaused
+	save(t, storage, paused)
+	done := newSaga("done", "reserve")
+	done.Status = saga.StatusCompleted
+	save(t, storage, done)
+
+	stuck, err := storage.GetStuckSteps(ctx, -time.Second)
+	if err != nil {
+		t.Fatalf("Failed to get stuck steps: %v", err)
+	}
+	if len(stuck) != 1 || stuck[0].ID != "running-reserve" {
+		t.Errorf("Expected only the running saga's step to be stuck, got %+v", stuck)
+	}
+	if stuck, _ := storage.GetStuckSteps(ctx, time.Hour); len(stuck) != 0 {
+		t.Errorf("Expected no step stuck within the timeout, got %+v", stuck)
+	}
+
+	pending, err := storage.GetPendingSteps(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get pending steps: %v", err)
+	}
+	if len(pending) != 3 {
+		t.Errorf("Expected every pending step, got %d", len(pending))
+	}
+}
+
+func testListAndFind(t *testing.T, storage saga.Storage) {
+	ctx := context.Background()
+	for i, id := range []string{"saga-1", "saga-2", "saga-3"} {
+		sg := newSaga(id, "reserve")
+		sg.CreatedAt = sg.CreatedAt.Add(time.Duration(i) * time.Second)
+		sg.Tags = map[string]string{"customer": "customer-1"}
+		if id == "saga-3" {
+			sg.Name = "other"
+			sg.Tags["customer"] = "customer-2"
+		}
+		save(t, storage, sg)
+	}
+
+	sagas, err := storage.ListSagas(ctx, saga.SagaFilter{Name: "conformance"})
+	if err != nil {
+		t.Fatalf("Failed to list sagas: %v", err)
+	}
+	if len(sagas) != 2 || sagas[0].ID != "saga-2" || sagas[1].ID != "saga-1" {
+		t.Errorf("Expected the named sagas newest first, got %+v", sagas)
+	}
+	if sagas, _ := storage.ListSagas(ctx, saga.SagaFilter{Limit: 1}); len(sagas) != 1 || sagas[0].ID != "saga-3" {
+		t.Errorf("Expected the newest saga, got %+v", sagas)
+	}
+
+	tagged, err := storage.FindSagasByTag(ctx, "customer", "customer-1")
+	if err != nil {
+		t.Fatalf("Failed to find sagas by tag: %v", err)
+	}
+	if len(tagged) != 2 || tagged[0].ID != "saga-2" {
+		t.Errorf("Expected the tagged sagas newest first, got %+v", tagged)
+	}
+}
+
+func testDeleteAndPurge(t *testing.T, storage saga.Storage) {
+	ctx := context.Background()
+	save(t, storage, newSaga("running", "reserve"))
+	done := newSaga("done", "reserve")
+	done.Status = saga.StatusCompleted
+	save(t, storage, done)
+	save(t, storage, newSaga("deleted", "reserve"))
+
+	if err := storage.DeleteSaga(ctx, "deleted"); err != nil {
+		t.Fatalf("Failed to delete saga: %v", err)
+	}
+	if _, err := storage.GetStep(ctx, "deleted-reserve"); !errors.Is(err, saga.ErrStepNotFound) {
+		t.Errorf("Expected the deleted saga's steps to go with it, got %v", err)
+	}
+	if err := storage.DeleteSaga(ctx, "deleted"); err != nil {
+		t.Errorf("Expected deleting a missing saga to succeed, got %v", err)
+	}
+
+	purged, err := storage.PurgeCompletedBefore(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to purge: %v", err)
+	}
+	if purged != 1 {
+		t.Errorf("Expected only the finished saga purged, got %d", purged)
+	}
+	if _, err := storage.GetSaga(ctx, "done"); !errors.Is(err, saga.ErrSagaNotFound) {
+		t.Errorf("Expected the finished saga to be gone, got %v", err)
+	}
+	if _, err := storage.GetSaga(ctx, "running"); err != nil {
+		t.Errorf("Expected the running saga to be kept, got %v", err)
+	}
+}
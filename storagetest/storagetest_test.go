@@ -0,0 +1,11 @@
+package storagetest
+
+import (
+	"testing"
+
+	saga "github.com/andrewnguyen41/saga-go"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	Run(t, func(t *testing.T) saga.Storage { return saga.NewMemoryStorage() })
+}
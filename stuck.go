@@ -0,0 +1,72 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// StuckSaga is a running saga with steps that made no progress within a
+// timeout; see ListStuckSagas
+type StuckSaga struct {
+	Saga *Saga
+	// StuckSteps are the saga's steps returned by Storage.GetStuckSteps
+	StuckSteps []Step
+	// StalledSince is when the longest stuck of them last made progress
+	StalledSince time.Time
+}
+
+// ListStuckSagas returns the sagas with at least one step that made no
+// progress within timeout, as found by Storage.GetStuckSteps, longest
+// stalled first, e.g. for a dashboard showing how many sagas have been
+// stalled for over five minutes. Sagas deleted while they are listed are
+// left out.
+func ListStuckSagas(ctx context.Context, storage Storage, timeout time.Duration) ([]StuckSaga, error) {
+	steps, err := storage.GetStuckSteps(ctx, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stuck steps: %w", err)
+	}
+
+	var stuck []StuckSaga
+	index := make(map[string]int)
+	for _, step := range steps {
+		i, exists := index[step.SagaID]
+		if !exists {
+			i = len(stuck)
+			index[step.SagaID] = i
+			stuck = append(stuck, StuckSaga{StalledSince: lastProgress(&step)})
+		}
+		stuck[i].StuckSteps = append(stuck[i].StuckSteps, step)
+		if since := lastProgress(&step); since.Before(stuck[i].StalledSince) {
+			stuck[i].StalledSince = since
+		}
+	}
+
+	found := stuck[:0]
+	for _, s := range stuck {
+		saga, err := storage.GetSaga(ctx, s.StuckSteps[0].SagaID)
+		if errors.Is(err, ErrSagaNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get saga: %w", err)
+		}
+		s.Saga = saga
+		found = append(found, s)
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].StalledSince.Before(found[j].StalledSince)
+	})
+	return found, nil
+}
+
+// lastProgress returns when a pending or processing step last moved
+func lastProgress(step *Step) time.Time {
+	if step.Status == StatusProcessing && step.StartedAt != nil {
+		return *step.StartedAt
+	}
+	return step.UpdatedAt
+}
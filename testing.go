@@ -0,0 +1,103 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrSagaStuck is returned by RunToCompletion when a saga hasn't finished
+// but nothing is left that would move it on, e.g. because it is paused or
+// a step's circuit breaker is open
+var ErrSagaStuck = errors.New("saga has nothing left to run")
+
+// TestOrchestrator is an orchestrator for tests that runs sagas on the
+// caller's goroutine, one step at a time, instead of on messages delivered
+// in the background, so tests can assert on a saga's outcome without
+// sleeping. Use RunToCompletion after starting a saga; don't call
+// StartListener or RunWorker.
+type TestOrchestrator struct {
+	*Orchestrator
+	// Storage holds the sagas the orchestrator runs
+	Storage *MemoryStorage
+	// PubSub delivers completion events synchronously, in publish order,
+	// to subscribers a test adds. The orchestrator doesn't listen on it.
+	PubSub *MemoryPubSub
+}
+
+// NewTestOrchestrator creates a TestOrchestrator on in-memory storage and
+// pubsub, configured with opts. Close its PubSub when the test is done.
+func NewTestOrchestrator(opts ...Option) *TestOrchestrator {
+	storage := NewMemoryStorage()
+	pubsub := NewMemoryPubSub(WithSyncDelivery())
+	return &TestOrchestrator{
+		Orchestrator: NewOrchestrator(storage, pubsub, opts...),
+		Storage:      storage,
+		PubSub:       pubsub,
+	}
+}
+
+// RunToCompletion runs the work pending in storage, for the saga and every
+// other saga, until the saga reaches a terminal status, and returns it. The
+// steps that are ready run one at a time in the order the saga declares
+// them, and compensations the same way. It returns ErrSagaStuck along with
+// the saga if the saga is left unfinished with nothing to run, and the
+// first error handling a step returns, such as a missing handler; handler
+// failures are not errors but fail their steps as usual. StartChildSaga
+// can't be used, since its child would only run once the handler waiting
+// for it has returned.
+func (t *TestOrchestrator) RunToCompletion(ctx context.Context, sagaID string) (*Saga, error) {
+	var before string
+	for {
+		saga, err := t.storage.GetSaga(ctx, sagaID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get saga: %w", err)
+		}
+		if isTerminal(saga.Status) {
+			return saga, nil
+		}
+
+		// A round that changes nothing, e.g. deferring a step whose circuit
+		// breaker is open, would be repeated forever
+		state, err := t.snapshot(ctx)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := t.pendingWork(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) == 0 || state == before {
+			return saga, fmt.Errorf("%w: saga %s is %s", ErrSagaStuck, sagaID, saga.Status)
+		}
+		before = state
+
+		for _, msg := range msgs {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if err := t.handleMessage(ctx, msg); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// snapshot describes the status and version of every saga and step, to
+// tell whether a round of work changed anything
+func (t *TestOrchestrator) snapshot(ctx context.Context) (string, error) {
+	sagas, err := t.storage.ListSagas(ctx, SagaFilter{})
+	if err != nil {
+		return "", fmt.Errorf("failed to list sagas: %w", err)
+	}
+	var b strings.Builder
+	for _, saga := range sagas {
+		fmt.Fprintf(&b, "%s:%s:%d", saga.ID, saga.Status, saga.Version)
+		for _, step := range saga.Steps {
+			fmt.Fprintf(&b, ",%s:%d", step.Status, step.Version)
+		}
+		b.WriteByte(';')
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,167 @@
+package saga
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// TypedBuilder defines a saga whose data is a struct T instead of an untyped
+// map. T is stored in the saga's Data map as its JSON encoding, so its fields
+// should have json tags, and every handler receives a *T decoded from the
+// current saga data.
+type TypedBuilder[T any] struct {
+	builder *Builder
+}
+
+// NewTypedBuilder creates a builder for sagas over data of type T
+func NewTypedBuilder[T any](name string, orchestrator *Orchestrator) *TypedBuilder[T] {
+	return &TypedBuilder[T]{builder: NewBuilder(name, orchestrator)}
+}
+
+// Step adds a step with inline typed handler definition
+func (b *TypedBuilder[T]) Step(
+	name string,
+	execute func(ctx context.Context, data *T) error,
+	compensate func(ctx context.Context, data *T) error,
+) *TypedBuilder[T] {
+	b.builder.steps = append(b.builder.steps, builderStep{
+		name:    name,
+		handler: NewTypedStepHandler(execute, compensate),
+	})
+	return b
+}
+
+// StepIf adds a typed step that only runs when condition holds
+func (b *TypedBuilder[T]) StepIf(
+	name string,
+	condition func(data *T) bool,
+	execute func(ctx context.Context, data *T) error,
+	compensate func(ctx context.Context, data *T) error,
+) *TypedBuilder[T] {
+	b.builder.steps = append(b.builder.steps, builderStep{
+		name: name,
+		handler: conditionalHandler{
+			StepHandler: NewTypedStepHandler(execute, compensate),
+			condition: func(data map[string]interface{}) bool {
+				typed, err := DecodeData[T](data)
+				if err != nil {
+					return false
+				}
+				return condition(&typed)
+			},
+		},
+	})
+	return b
+}
+
+// DependsOn sets the steps the most recently added step waits for
+func (b *TypedBuilder[T]) DependsOn(steps ...string) *TypedBuilder[T] {
+	b.builder.DependsOn(steps...)
+	return b
+}
+
+// CompensationOrder sets when the most recently added step is compensated
+func (b *TypedBuilder[T]) CompensationOrder(order int) *TypedBuilder[T] {
+	b.builder.CompensationOrder(order)
+	return b
+}
+
+// NoCompensation marks the most recently added step as having nothing to
+// undo
+func (b *TypedBuilder[T]) NoCompensation() *TypedBuilder[T] {
+	b.builder.NoCompensation()
+	return b
+}
+
+// CompensateFailedStep makes a failure of the most recently added step run
+// its own compensation first
+func (b *TypedBuilder[T]) CompensateFailedStep() *TypedBuilder[T] {
+	b.builder.CompensateFailedStep()
+	return b
+}
+
+// Resource declares the dependency the most recently added step calls
+func (b *TypedBuilder[T]) Resource(name string) *TypedBuilder[T] {
+	b.builder.Resource(name)
+	return b
+}
+
+// Execute registers all handlers and starts the saga with data as its
+// initial state
+func (b *TypedBuilder[T]) Execute(ctx context.Context, data T) (*Saga, error) {
+	encoded, err := EncodeData(data)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range encoded {
+		b.builder.data[k] = v
+	}
+	return b.builder.Execute(ctx)
+}
+
+// NewTypedStepHandler creates a step handler over typed data. The data map is
+// decoded into a T before each call and the handler's changes are written
+// back, so fields set by earlier steps are visible to later ones. Keys in the
+// map that T doesn't declare are left untouched.
+func NewTypedStepHandler[T any](
+	execute func(ctx context.Context, data *T) error,
+	compensate func(ctx context.Context, data *T) error,
+) StepHandler {
+	return StepFunc{
+		ExecFn:       typedFunc(execute),
+		CompensateFn: typedFunc(compensate),
+	}
+}
+
+func typedFunc[T any](fn func(ctx context.Context, data *T) error) func(ctx context.Context, data map[string]interface{}) error {
+	if fn == nil {
+		return nil
+	}
+	return func(ctx context.Context, data map[string]interface{}) error {
+		typed, err := DecodeData[T](data)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(ctx, &typed); err != nil {
+			return err
+		}
+
+		encoded, err := EncodeData(typed)
+		if err != nil {
+			return err
+		}
+		for k, v := range encoded {
+			data[k] = v
+		}
+		return nil
+	}
+}
+
+// EncodeData converts a typed value into the map form stored on a saga
+func EncodeData[T any](value T) (map[string]interface{}, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode saga data: %w", err)
+	}
+
+	data := make(map[string]interface{})
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("saga data must encode to a JSON object: %w", err)
+	}
+	return data, nil
+}
+
+// DecodeData converts a saga's data map into a typed value
+func DecodeData[T any](data map[string]interface{}) (T, error) {
+	var value T
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return value, fmt.Errorf("failed to encode saga data: %w", err)
+	}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return value, fmt.Errorf("failed to decode saga data: %w", err)
+	}
+	return value, nil
+}
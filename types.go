@@ -9,37 +9,167 @@ import (
 type Status string
 
 const (
-	StatusPending     Status = "pending"
-	StatusProcessing  Status = "processing"
-	StatusCompleted   Status = "completed"
-	StatusFailed      Status = "failed"
-	StatusCompensated Status = "compensated"
+	StatusPending      Status = "pending"
+	StatusProcessing   Status = "processing"
+	StatusCompleted    Status = "completed"
+	StatusFailed       Status = "failed"
+	StatusCompensated  Status = "compensated"
+	StatusSkipped      Status = "skipped"
+	StatusCompensating Status = "compensating"
+	StatusRolledBack   Status = "rolled_back"
+	StatusPaused       Status = "paused"
+	StatusCanceled     Status = "canceled"
 )
 
 // Step represents a single step in a saga
 type Step struct {
-	ID           string                 `json:"id"`
-	SagaID       string                 `json:"saga_id"`
-	Name         string                 `json:"name"`
-	Status       Status                 `json:"status"`
-	Data         map[string]interface{} `json:"data,omitempty"`
-	Error        string                 `json:"error,omitempty"`
-	CompensateID string                 `json:"compensate_id,omitempty"`
-	StartedAt    *time.Time             `json:"started_at,omitempty"`
-	CreatedAt    time.Time              `json:"created_at"`
-	UpdatedAt    time.Time              `json:"updated_at"`
+	ID     string                 `json:"id"`
+	SagaID string                 `json:"saga_id"`
+	Name   string                 `json:"name"`
+	Status Status                 `json:"status"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+	// Error is the message of the error the step's execution or
+	// compensation last failed with
+	Error string `json:"error,omitempty"`
+	// Failure describes the step's last failed execution in detail, until
+	// an execution completes
+	Failure *StepFailure `json:"failure,omitempty"`
+	// InputData is the merged data the step's handler received on its last
+	// run and OutputData the data it returned when it completed, for
+	// auditing what each step saw and produced
+	InputData         map[string]interface{} `json:"input_data,omitempty"`
+	OutputData        map[string]interface{} `json:"output_data,omitempty"`
+	DependsOn         []string               `json:"depends_on,omitempty"`
+	CompensationOrder int                    `json:"compensation_order,omitempty"`
+	// NoCompensation steps are skipped during rollback and stay completed
+	NoCompensation bool `json:"no_compensation,omitempty"`
+	// CompensateFailedStep has the step compensated before the others if
+	// it fails
+	CompensateFailedStep bool `json:"compensate_failed_step,omitempty"`
+	// Resource names the dependency the step calls, for circuit breaking;
+	// see WithCircuitBreaker
+	Resource     string `json:"resource,omitempty"`
+	CompensateID string `json:"compensate_id,omitempty"`
+	// Attempts counts how many times the step has started executing
+	Attempts int `json:"attempts,omitempty"`
+	// RecoveryAttempts counts how many times recovery republished the step
+	RecoveryAttempts int `json:"recovery_attempts,omitempty"`
+	// LastRecoveredAt is when recovery last republished the step; see
+	// WithRecoveryRate
+	LastRecoveredAt *time.Time `json:"last_recovered_at,omitempty"`
+	// ClaimedBy is the orchestrator that last claimed the step to run it,
+	// and ClaimExpiry, if set, when that claim lapses
+	ClaimedBy    string     `json:"claimed_by,omitempty"`
+	ClaimExpiry  *time.Time `json:"claim_expiry,omitempty"`
+	ChildSagaIDs []string   `json:"child_saga_ids,omitempty"`
+	// StartedAt is when the step's last run started and CompletedAt when it
+	// completed, failed or was skipped; see Duration
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	// Version counts the writes to the step; see Storage.UpdateStep
+	Version   int       `json:"version,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
-// Saga represents a saga transaction
+// Saga represents a saga transaction. FinalStatus is the status a
+// compensating saga moves to once its rollback is done; it is empty (meaning
+// failed) unless the rollback was requested with Orchestrator.Compensate.
+// Metadata holds the context metadata the saga was started with, and
+// IdempotencyKey the key it was started with, if any. Tags are the business
+// keys it can be found by; see Builder.WithTag. FailurePolicy decides
+// whether steps still running when the saga starts rolling back are
+// canceled, and TimeoutPolicy whether the saga is compensated once its
+// Deadline passes. FinishedAt is when it reached a terminal status; see
+// Duration. Version counts the writes to the saga's own fields; see
+// Storage.SaveSaga.
 type Saga struct {
-	ID        string                 `json:"id"`
-	Name      string                 `json:"name"`
-	Status    Status                 `json:"status"`
-	Steps     []Step                 `json:"steps"`
-	Data      map[string]interface{} `json:"data,omitempty"`
-	Error     string                 `json:"error,omitempty"`
-	CreatedAt time.Time              `json:"created_at"`
-	UpdatedAt time.Time              `json:"updated_at"`
+	ID             string                 `json:"id"`
+	Name           string                 `json:"name"`
+	Status         Status                 `json:"status"`
+	Steps          []Step                 `json:"steps"`
+	Data           map[string]interface{} `json:"data,omitempty"`
+	Error          string                 `json:"error,omitempty"`
+	FailedStepID   string                 `json:"failed_step_id,omitempty"`
+	FinalStatus    Status                 `json:"final_status,omitempty"`
+	Metadata       map[string]string      `json:"metadata,omitempty"`
+	Tags           map[string]string      `json:"tags,omitempty"`
+	IdempotencyKey string                 `json:"idempotency_key,omitempty"`
+	ParentSagaID   string                 `json:"parent_saga_id,omitempty"`
+	ParentStepID   string                 `json:"parent_step_id,omitempty"`
+	Deadline       *time.Time             `json:"deadline,omitempty"`
+	FailurePolicy  FailurePolicy          `json:"failure_policy,omitempty"`
+	TimeoutPolicy  TimeoutPolicy          `json:"timeout_policy,omitempty"`
+	FinishedAt     *time.Time             `json:"finished_at,omitempty"`
+	Version        int                    `json:"version,omitempty"`
+	CreatedAt      time.Time              `json:"created_at"`
+	UpdatedAt      time.Time              `json:"updated_at"`
+}
+
+// Duration returns how long the saga took from its creation until it
+// finished, or zero while it hasn't
+func (s *Saga) Duration() time.Duration {
+	if s.FinishedAt == nil {
+		return 0
+	}
+	return s.FinishedAt.Sub(s.CreatedAt)
+}
+
+// Progress returns how many of the saga's steps are done, meaning completed
+// or skipped, out of its total, e.g. to show "step 2 of 5". Steps that have
+// been compensated no longer count as done.
+func (s *Saga) Progress() (completed, total int) {
+	for _, step := range s.Steps {
+		if stepDone(step.Status) {
+			completed++
+		}
+	}
+	return completed, len(s.Steps)
+}
+
+// CompensatedStepCount returns how many of the saga's steps have been
+// rolled back, counting those whose compensation failed and was
+// dead-lettered. A failed saga with no compensated or completed steps
+// failed before any step took effect, so it is safe to simply start again
+// from scratch.
+func (s *Saga) CompensatedStepCount() int {
+	var n int
+	for _, step := range s.Steps {
+		if step.Status == StatusCompensated {
+			n++
+		}
+	}
+	return n
+}
+
+// CurrentStep returns the first step that is processing or, if none is, the
+// next pending step: the first one whose dependencies are done, or else the
+// first pending one. It returns nil once no step is processing or pending.
+func (s *Saga) CurrentStep() *Step {
+	var firstPending *Step
+	for i := range s.Steps {
+		if s.Steps[i].Status == StatusProcessing {
+			return &s.Steps[i]
+		}
+		if s.Steps[i].Status == StatusPending && firstPending == nil {
+			firstPending = &s.Steps[i]
+		}
+	}
+	for i := range s.Steps {
+		if s.Steps[i].Status == StatusPending && dependenciesCompleted(s, &s.Steps[i]) {
+			return &s.Steps[i]
+		}
+	}
+	return firstPending
+}
+
+// Duration returns how long the step's last run took, or zero while it
+// hasn't run to an end
+func (s *Step) Duration() time.Duration {
+	if s.StartedAt == nil || s.CompletedAt == nil {
+		return 0
+	}
+	return s.CompletedAt.Sub(*s.StartedAt)
 }
 
 // StepHandler defines how to execute and compensate a step
@@ -70,25 +200,93 @@ func (f StepFunc) Compensate(ctx context.Context, data map[string]interface{}) e
 
 // Message represents pub/sub messages
 type Message struct {
-	Type   string                 `json:"type"`
-	SagaID string                 `json:"saga_id"`
-	StepID string                 `json:"step_id"`
-	Data   map[string]interface{} `json:"data,omitempty"`
+	Type   string `json:"type"`
+	SagaID string `json:"saga_id"`
+	StepID string `json:"step_id"`
+	// Data is the saga's final data on completion messages. Step messages
+	// leave it out; the step's data is read from storage when it runs.
+	Data map[string]interface{} `json:"data,omitempty"`
+	// Metadata carries the saga's context metadata; see ContextWithMetadata
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// SagaFilter selects sagas for ListSagas. Zero fields match every saga, and
+// a zero Limit returns all matches.
+type SagaFilter struct {
+	Name   string
+	Status Status
+	Limit  int
 }
 
 // Storage interface for saga persistence
 type Storage interface {
+	// SaveSaga stores the saga and creates any steps it doesn't have yet.
+	// Existing steps are only changed through UpdateStep and UpdateStepStatus.
+	// The saga's Version must match the stored one (zero for a new saga),
+	// or SaveSaga returns ErrVersionConflict; on success it increments
+	// Version.
 	SaveSaga(ctx context.Context, saga *Saga) error
 	GetSaga(ctx context.Context, id string) (*Saga, error)
+	// GetSagaByKey returns the saga started with an idempotency key. SaveSaga
+	// must enforce that keys are unique, returning ErrDuplicateIdempotencyKey.
+	GetSagaByKey(ctx context.Context, key string) (*Saga, error)
+	// ListSagas returns the sagas matching filter, newest first
+	ListSagas(ctx context.Context, filter SagaFilter) ([]Saga, error)
+	// FindSagasByTag returns the sagas tagged with key set to value, newest
+	// first
+	FindSagasByTag(ctx context.Context, key, value string) ([]Saga, error)
+	// UpdateStep stores the step. Like SaveSaga, it returns
+	// ErrVersionConflict unless the step's Version matches the stored one,
+	// and increments Version on success.
 	UpdateStep(ctx context.Context, step *Step) error
+	// CompleteStep stores a step together with its saga in one atomic
+	// write, as UpdateStep followed by SaveSaga would. If either Version
+	// doesn't match the stored one it returns ErrVersionConflict and writes
+	// neither; on success it increments both.
+	CompleteStep(ctx context.Context, step *Step, saga *Saga) error
+	// UpdateStepStatus atomically moves a step from one status to another
+	// and increments its Version. It reports false if the step was not in
+	// the from status.
+	UpdateStepStatus(ctx context.Context, id string, from, to Status) (bool, error)
+	// ClaimStep atomically moves a pending step to processing for owner,
+	// recording ClaimedBy and, unless expiry is zero, ClaimExpiry, and
+	// increments its Version. It reports false if the step was not pending.
+	ClaimStep(ctx context.Context, id, owner string, expiry time.Time) (bool, error)
+	// ClaimNextPendingStep atomically picks a step that is ready to run
+	// (see StepReady), the one that has waited longest, and claims it for
+	// owner as ClaimStep would, for workers that poll storage for work
+	// instead of receiving messages. It returns the claimed step, or
+	// ErrStepNotFound if no step is ready.
+	ClaimNextPendingStep(ctx context.Context, owner string, expiry time.Time) (*Step, error)
 	GetStep(ctx context.Context, id string) (*Step, error)
+	// GetStepsBySaga returns all steps of a saga ordered by creation
+	GetStepsBySaga(ctx context.Context, sagaID string) ([]Step, error)
 	GetPendingSteps(ctx context.Context) ([]Step, error)
+	// GetStuckSteps returns pending or processing steps of running sagas
+	// that made no progress within timeout. A processing step with a
+	// ClaimExpiry is stuck once its claim has expired instead. Steps of
+	// paused sagas are not returned.
 	GetStuckSteps(ctx context.Context, timeout time.Duration) ([]Step, error)
+	// GetExpiredSagas returns running sagas whose deadline is before now
+	GetExpiredSagas(ctx context.Context, now time.Time) ([]Saga, error)
+	// GetStuckCompensations returns compensating sagas that haven't been
+	// updated within timeout
+	GetStuckCompensations(ctx context.Context, timeout time.Duration) ([]Saga, error)
+	// DeleteSaga removes a saga and all of its steps. Deleting a saga that
+	// doesn't exist is not an error.
+	DeleteSaga(ctx context.Context, id string) error
+	// PurgeCompletedBefore deletes sagas that finished (completed, failed,
+	// rolled back or canceled) and were last updated before the cutoff,
+	// and returns how many it deleted
+	PurgeCompletedBefore(ctx context.Context, before time.Time) (int, error)
 }
 
-// PubSub interface for messaging
+// PubSub interface for messaging. Delivery is at least once: a handler
+// returns nil once it has processed a message and an error if it should be
+// delivered again, e.g. because the orchestrator is shutting down or
+// storage is unavailable.
 type PubSub interface {
 	Publish(ctx context.Context, topic string, msg Message) error
-	Subscribe(ctx context.Context, topic string, handler func(Message)) error
+	Subscribe(ctx context.Context, topic string, handler func(Message) error) error
 	Close() error
 }
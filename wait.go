@@ -0,0 +1,129 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// waitPollInterval is how often WaitForCompletion re-reads the saga, to catch
+// sagas finished by another orchestrator instance
+const waitPollInterval = 500 * time.Millisecond
+
+// isTerminal reports whether a saga in this status will not change anymore
+func isTerminal(status Status) bool {
+	return status == StatusCompleted || status == StatusFailed || status == StatusRolledBack || status == StatusCanceled
+}
+
+// WaitForCompletion blocks until the saga reaches a terminal status
+// (completed, or failed, rolled back or canceled once its compensation has
+// finished) and returns it. It returns ctx's error if ctx is done first.
+// Sagas finished by this orchestrator are reported as soon as they finish;
+// ones finished by other instances are picked up by periodically re-reading
+// storage.
+func (o *Orchestrator) WaitForCompletion(ctx context.Context, sagaID string) (Status, error) {
+	ch := o.addWaiter(sagaID)
+	defer o.removeWaiter(sagaID, ch)
+
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+
+	for {
+		saga, err := o.storage.GetSaga(ctx, sagaID)
+		if err != nil {
+			return "", fmt.Errorf("failed to get saga: %w", err)
+		}
+		if isTerminal(saga.Status) {
+			return saga.Status, nil
+		}
+
+		select {
+		case status := <-ch:
+			if isTerminal(status) {
+				return status, nil
+			}
+		case <-ticker.C:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// WatchSaga calls fn with the saga each time its status changes, starting
+// with its current state, until the saga reaches a terminal status, fn
+// returns an error or ctx is done, and returns that error. Changes made by
+// this orchestrator are reported as they happen, ones made by other
+// instances when storage is next re-read; statuses that change in quick
+// succession may be reported only once.
+func (o *Orchestrator) WatchSaga(ctx context.Context, sagaID string, fn func(*Saga) error) error {
+	ch := o.addWaiter(sagaID)
+	defer o.removeWaiter(sagaID, ch)
+
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+
+	var last Status
+	for {
+		saga, err := o.storage.GetSaga(ctx, sagaID)
+		if err != nil {
+			return fmt.Errorf("failed to get saga: %w", err)
+		}
+		if saga.Status != last {
+			last = saga.Status
+			if err := fn(saga); err != nil {
+				return err
+			}
+		}
+		if isTerminal(saga.Status) {
+			return nil
+		}
+
+		select {
+		case <-ch:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (o *Orchestrator) addWaiter(sagaID string) chan Status {
+	o.waitersMu.Lock()
+	defer o.waitersMu.Unlock()
+
+	ch := make(chan Status, 1)
+	o.waiters[sagaID] = append(o.waiters[sagaID], ch)
+	return ch
+}
+
+func (o *Orchestrator) removeWaiter(sagaID string, ch chan Status) {
+	o.waitersMu.Lock()
+	defer o.waitersMu.Unlock()
+
+	waiters := o.waiters[sagaID]
+	for i, w := range waiters {
+		if w == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(o.waiters, sagaID)
+	} else {
+		o.waiters[sagaID] = waiters
+	}
+}
+
+// notifyWaiters tells WaitForCompletion and WatchSaga callers that the
+// saga has moved to status
+func (o *Orchestrator) notifyWaiters(sagaID string, status Status) {
+	o.waitersMu.Lock()
+	defer o.waitersMu.Unlock()
+
+	for _, ch := range o.waiters[sagaID] {
+		select {
+		case ch <- status:
+		default:
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package saga
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Headers set on every webhook request
+const (
+	// WebhookDeliveryHeader carries the delivery's ID, which stays the same
+	// across retries of the delivery
+	WebhookDeliveryHeader = "X-Saga-Delivery"
+	// WebhookSignatureHeader carries "sha256=" followed by the hex-encoded
+	// HMAC-SHA256 of the body, when the notifier has a secret; see
+	// VerifyWebhookSignature
+	WebhookSignatureHeader = "X-Saga-Signature"
+)
+
+// WebhookEvent is the JSON body POSTed when a saga finishes. Type is one of
+// MessageSagaCompleted, MessageSagaFailed, MessageSagaRolledBack or
+// MessageSagaCanceled, and Data and Metadata are the saga's final data and
+// metadata. Timestamp is when the notifier recorded the event.
+type WebhookEvent struct {
+	Type      string                 `json:"type"`
+	SagaID    string                 `json:"saga_id"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	Metadata  map[string]string      `json:"metadata,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+// WebhookDelivery is a webhook waiting in a WebhookStore to be POSTed to
+// URL. Attempts counts the failed attempts so far, LastError holds the
+// latest failure and NextAttempt is when the delivery is due.
+type WebhookDelivery struct {
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts,omitempty"`
+	LastError   string          `json:"last_error,omitempty"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// WebhookStore is implemented by storage backends that can keep the
+// deliveries of a WebhookNotifier, so webhooks that couldn't be delivered
+// yet survive a restart
+type WebhookStore interface {
+	// SaveWebhook adds the delivery, or replaces the one with the same ID
+	SaveWebhook(ctx context.Context, delivery WebhookDelivery) error
+	// DueWebhooks returns up to limit deliveries whose NextAttempt isn't
+	// after now, earliest due first
+	DueWebhooks(ctx context.Context, now time.Time, limit int) ([]WebhookDelivery, error)
+	// DeleteWebhook removes a delivery. Deleting a delivery that isn't
+	// there is not an error.
+	DeleteWebhook(ctx context.Context, id string) error
+}
+
+// webhookBatchSize is how many deliveries Flush reads from the store at once
+const webhookBatchSize = 100
+
+// WebhookNotifier POSTs a WebhookEvent to a URL whenever a saga finishes.
+// It subscribes to the completion messages (see WithCompletionTopic),
+// records a delivery for each in its WebhookStore before acknowledging the
+// message, and delivers them in the background, retrying failures with
+// exponential backoff. A webhook can be delivered more than once, e.g.
+// when a completion message is, so receivers should deduplicate on the
+// saga ID and event type.
+type WebhookNotifier struct {
+	store       WebhookStore
+	pubsub      PubSub
+	url         string
+	topic       string
+	secret      []byte
+	client      *http.Client
+	interval    time.Duration
+	backoffBase time.Duration
+	backoffMax  time.Duration
+	maxAttempts int
+	logger      Logger
+
+	mu         sync.Mutex
+	subscribed bool
+	running    bool
+	stopCh     chan struct{}
+	// Signaled when a delivery is recorded, to send it without waiting for
+	// the next tick
+	wake chan struct{}
+}
+
+// WebhookOption configures a WebhookNotifier
+type WebhookOption func(*WebhookNotifier)
+
+// WithWebhookTopic sets the topic the notifier reads completion messages
+// from. It defaults to "saga_events", the orchestrator's default topic and
+// completion topic.
+func WithWebhookTopic(topic string) WebhookOption {
+	return func(n *WebhookNotifier) {
+		n.topic = topic
+	}
+}
+
+// WithWebhookSecret signs every webhook with secret; see
+// WebhookSignatureHeader. Webhooks are unsigned by default.
+func WithWebhookSecret(secret []byte) WebhookOption {
+	return func(n *WebhookNotifier) {
+		n.secret = secret
+	}
+}
+
+// WithWebhookClient sets the HTTP client webhooks are sent with. The
+// default is a client with a 10 second timeout.
+func WithWebhookClient(client *http.Client) WebhookOption {
+	return func(n *WebhookNotifier) {
+		n.client = client
+	}
+}
+
+// WithWebhookBackoff sets the delay before retrying a failed delivery:
+// base after the first failure, doubling with each further failure up to
+// max. Both must be positive; the defaults are one second and five minutes.
+func WithWebhookBackoff(base, max time.Duration) WebhookOption {
+	if base <= 0 || max <= 0 {
+		panic("saga: webhook backoff must be positive")
+	}
+	return func(n *WebhookNotifier) {
+		n.backoffBase = base
+		n.backoffMax = max
+	}
+}
+
+// WithWebhookMaxAttempts sets how many times a delivery is attempted before
+// it is dropped and logged as an error. n must be positive; the default is
+// 10.
+func WithWebhookMaxAttempts(n int) WebhookOption {
+	if n <= 0 {
+		panic("saga: webhook max attempts must be positive")
+	}
+	return func(w *WebhookNotifier) {
+		w.maxAttempts = n
+	}
+}
+
+// WithWebhookInterval sets how often the notifier checks its store for
+// deliveries that are due. d must be positive; the default is one second.
+func WithWebhookInterval(d time.Duration) WebhookOption {
+	if d <= 0 {
+		panic("saga: webhook interval must be positive")
+	}
+	return func(n *WebhookNotifier) {
+		n.interval = d
+	}
+}
+
+// WithWebhookLogger sets the logger used for failed deliveries. Nothing is
+// logged by default.
+func WithWebhookLogger(logger Logger) WebhookOption {
+	return func(n *WebhookNotifier) {
+		n.logger = logger
+	}
+}
+
+// NewWebhookNotifier creates a notifier POSTing to url
+func NewWebhookNotifier(store WebhookStore, pubsub PubSub, url string, opts ...WebhookOption) *WebhookNotifier {
+	n := &WebhookNotifier{
+		store:       store,
+		pubsub:      pubsub,
+		url:         url,
+		topic:       "saga_events",
+		client:      &http.Client{Timeout: 10 * time.Second},
+		interval:    time.Second,
+		backoffBase: time.Second,
+		backoffMax:  5 * time.Minute,
+		maxAttempts: 10,
+		logger:      nopLogger{},
+		wake:        make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	return n
+}
+
+// Start subscribes to the completion messages and begins delivering
+// webhooks in the background until Stop is called or ctx is done. It
+// returns an error if the pubsub can't subscribe. The notifier subscribes
+// only once, so after Stop it keeps recording deliveries, which a later
+// Start sends. Calling Start on a running notifier does nothing.
+func (n *WebhookNotifier) Start(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.running {
+		return nil
+	}
+	if !n.subscribed {
+		if err := n.pubsub.Subscribe(ctx, n.topic, n.record); err != nil {
+			return fmt.Errorf("failed to subscribe to %s: %w", n.topic, err)
+		}
+		n.subscribed = true
+	}
+
+	n.running = true
+	n.stopCh = make(chan struct{})
+	go n.loop(ctx, n.stopCh)
+	return nil
+}
+
+// Stop stops delivering webhooks. It is safe to call more than once.
+func (n *WebhookNotifier) Stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.running {
+		return
+	}
+
+	n.running = false
+	close(n.stopCh)
+}
+
+// record stores a delivery for a completion message. Other messages on the
+// topic are ignored.
+func (n *WebhookNotifier) record(msg Message) error {
+	switch msg.Type {
+	case MessageSagaCompleted, MessageSagaFailed, MessageSagaRolledBack, MessageSagaCanceled:
+	default:
+		return nil
+	}
+
+	now := time.Now()
+	payload, err := json.Marshal(WebhookEvent{
+		Type:      msg.Type,
+		SagaID:    msg.SagaID,
+		Data:      msg.Data,
+		Metadata:  msg.Metadata,
+		Timestamp: now,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook: %w", err)
+	}
+
+	delivery := WebhookDelivery{
+		ID:          uuid.New().String(),
+		URL:         n.url,
+		Payload:     payload,
+		NextAttempt: now,
+		CreatedAt:   now,
+	}
+	if err := n.store.SaveWebhook(context.Background(), delivery); err != nil {
+		return fmt.Errorf("failed to save webhook: %w", err)
+	}
+
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (n *WebhookNotifier) loop(ctx context.Context, stopCh chan struct{}) {
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			n.mu.Lock()
+			if n.stopCh == stopCh {
+				n.running = false
+			}
+			n.mu.Unlock()
+			return
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		case <-n.wake:
+		}
+		if _, err := n.Flush(ctx); err != nil {
+			n.logger.Error("Failed to deliver webhooks", "error", err)
+		}
+	}
+}
+
+// Flush attempts every delivery that is due and returns how many were
+// delivered. Failed deliveries are rescheduled with backoff, or dropped once
+// they reach the maximum attempts. It returns an error only if the store
+// fails.
+func (n *WebhookNotifier) Flush(ctx context.Context) (int, error) {
+	var delivered int
+	for {
+		due, err := n.store.DueWebhooks(ctx, time.Now(), webhookBatchSize)
+		if err != nil {
+			return delivered, err
+		}
+
+		for _, delivery := range due {
+			if ctx.Err() != nil {
+				return delivered, ctx.Err()
+			}
+			if err := n.deliver(ctx, delivery); err != nil {
+				if err := n.reschedule(ctx, delivery, err); err != nil {
+					return delivered, err
+				}
+				continue
+			}
+			if err := n.store.DeleteWebhook(ctx, delivery.ID); err != nil {
+				return delivered, err
+			}
+			delivered++
+		}
+		if len(due) < webhookBatchSize {
+			return delivered, nil
+		}
+	}
+}
+
+// deliver POSTs a delivery's payload, succeeding on any 2xx response
+func (n *WebhookNotifier) deliver(ctx context.Context, delivery WebhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookDeliveryHeader, delivery.ID)
+	if n.secret != nil {
+		req.Header.Set(WebhookSignatureHeader, signWebhook(n.secret, delivery.Payload))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body) // Lets the connection be reused
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// reschedule records a failed attempt and schedules the next one, or drops
+// the delivery once it has used up its attempts
+func (n *WebhookNotifier) reschedule(ctx context.Context, delivery WebhookDelivery, deliverErr error) error {
+	delivery.Attempts++
+	delivery.LastError = deliverErr.Error()
+
+	if delivery.Attempts >= n.maxAttempts {
+		n.logger.Error("Dropping webhook after too many attempts",
+			"delivery_id", delivery.ID, "url", delivery.URL, "attempts", delivery.Attempts, "error", deliverErr)
+		return n.store.DeleteWebhook(ctx, delivery.ID)
+	}
+
+	delay := n.backoffBase
+	for i := 1; i < delivery.Attempts && delay < n.backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > n.backoffMax {
+		delay = n.backoffMax
+	}
+	delivery.NextAttempt = time.Now().Add(delay)
+
+	n.logger.Warn("Webhook delivery failed, retrying",
+		"delivery_id", delivery.ID, "url", delivery.URL, "attempt", delivery.Attempts, "retry_in", delay, "error", deliverErr)
+	return n.store.SaveWebhook(ctx, delivery)
+}
+
+// signWebhook returns the WebhookSignatureHeader value for body
+func signWebhook(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature reports whether signature, the value of a
+// request's WebhookSignatureHeader, was made for body with secret. Receivers
+// should pass the raw body, before decoding it.
+func VerifyWebhookSignature(secret, body []byte, signature string) bool {
+	return hmac.Equal([]byte(signature), []byte(signWebhook(secret, body)))
+}
@@ -0,0 +1,187 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errNoPubSub is returned when subscribing on an orchestrator created
+// without a pubsub
+var errNoPubSub = errors.New("orchestrator has no pubsub; use RunWorker")
+
+// nopPubSub stands in for the pubsub of an orchestrator created without
+// one. Messages are dropped: RunWorker finds the work they announce in
+// storage.
+type nopPubSub struct{}
+
+func (nopPubSub) Publish(ctx context.Context, topic string, msg Message) error { return nil }
+
+func (nopPubSub) Subscribe(ctx context.Context, topic string, handler func(Message) error) error {
+	return errNoPubSub
+}
+
+func (nopPubSub) Close() error { return nil }
+
+// RunWorker executes sagas by polling storage every pollInterval, as an
+// alternative to StartListener that doesn't need a message broker: pass a
+// nil PubSub to NewOrchestrator and run a worker on each instance. Each poll
+// starts the pending steps whose dependencies are done, the next
+// compensation of each rolling back saga, and the timeouts of sagas past
+// their deadline. Steps run concurrently, up to WithMaxConcurrency, and are
+// claimed as with StartListener, so any number of workers can share a
+// storage. A saga moves on to its next step at the following poll, so
+// pollInterval bounds the latency between steps, and each poll reads every
+// running and rolling back saga. RunWorker blocks until ctx is done,
+// returning its error, or Shutdown is called, returning nil; Shutdown waits
+// for the steps being run to finish.
+func (o *Orchestrator) RunWorker(ctx context.Context, pollInterval time.Duration) error {
+	if pollInterval <= 0 {
+		return fmt.Errorf("poll interval must be positive")
+	}
+
+	o.listenerMu.Lock()
+	o.listening = true
+	o.listenerMu.Unlock()
+	defer func() {
+		o.listenerMu.Lock()
+		o.listening = false
+		o.listenerMu.Unlock()
+	}()
+
+	w := &worker{o: o, running: make(map[string]bool)}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		o.listenerMu.Lock()
+		stopping := o.shuttingDown
+		o.listenerMu.Unlock()
+		if stopping || !w.poll(ctx) {
+			return ctx.Err()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// worker runs the work RunWorker finds in storage
+type worker struct {
+	o *Orchestrator
+
+	// Messages being handled, by type and ID, so a step that is slow to be
+	// claimed isn't started again by the next poll
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+// poll handles the work storage holds now. It reports false if the
+// orchestrator is shutting down or ctx is done.
+func (w *worker) poll(ctx context.Context) bool {
+	msgs, err := w.o.pendingWork(ctx)
+	if err != nil {
+		w.o.logger.Warn("Failed to poll storage for work", "error", err)
+	}
+	for _, msg := range msgs {
+		if !w.dispatch(ctx, msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// pendingWork returns the messages for the work storage holds: starting
+// the steps that are ready to run, oldest saga first and in the order each
+// saga declares them, compensating the next step of each rolling back
+// saga, and timing out sagas past their deadline. On error it returns the
+// work it found before.
+func (o *Orchestrator) pendingWork(ctx context.Context) ([]Message, error) {
+	var msgs []Message
+
+	pending, err := o.storage.ListSagas(ctx, SagaFilter{Status: StatusPending})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending sagas: %w", err)
+	}
+	// ListSagas returns the newest first; the oldest have waited longest
+	for i := len(pending) - 1; i >= 0; i-- {
+		saga := &pending[i]
+		if o.deadlineExceeded(saga) {
+			msgs = append(msgs, Message{Type: "saga_timeout", SagaID: saga.ID})
+			continue
+		}
+		for j := range saga.Steps {
+			if step := &saga.Steps[j]; StepReady(saga, step) {
+				msgs = append(msgs, Message{Type: "step_execute", SagaID: saga.ID, StepID: step.ID, Metadata: saga.Metadata})
+			}
+		}
+	}
+
+	compensating, err := o.storage.ListSagas(ctx, SagaFilter{Status: StatusCompensating})
+	if err != nil {
+		return msgs, fmt.Errorf("failed to get compensating sagas: %w", err)
+	}
+	for i := range compensating {
+		saga := &compensating[i]
+		next, ready := nextCompensation(saga)
+		switch {
+		case next != nil:
+			msgs = append(msgs, Message{Type: "step_compensate", SagaID: saga.ID, StepID: next.ID, Metadata: saga.Metadata})
+		case ready:
+			// Nothing left to roll back; resuming finishes the saga
+			msgs = append(msgs, Message{Type: "saga_compensate", SagaID: saga.ID})
+		}
+	}
+	return msgs, nil
+}
+
+// dispatch handles msg in its own goroutine, once there is room under the
+// concurrency limit, unless the worker is handling it already. It reports
+// false if the orchestrator is shutting down or ctx is done.
+func (w *worker) dispatch(ctx context.Context, msg Message) bool {
+	key := msg.Type + ":" + msg.StepID
+	if msg.StepID == "" {
+		key = msg.Type + ":" + msg.SagaID
+	}
+	w.mu.Lock()
+	if w.running[key] {
+		w.mu.Unlock()
+		return true
+	}
+	w.running[key] = true
+	w.mu.Unlock()
+
+	o := w.o
+	limited := msg.Type == "step_execute" || msg.Type == "step_compensate"
+	if limited && !o.acquireSlot(ctx) {
+		w.done(key)
+		return false
+	}
+	if !o.beginMessage() {
+		if limited {
+			o.releaseSlot()
+		}
+		w.done(key)
+		return false
+	}
+
+	go func() {
+		defer w.done(key)
+		defer o.inFlight.Done()
+		if limited {
+			defer o.releaseSlot()
+		}
+		o.handleMessage(ctx, msg)
+	}()
+	return true
+}
+
+func (w *worker) done(key string) {
+	w.mu.Lock()
+	delete(w.running, key)
+	w.mu.Unlock()
+}